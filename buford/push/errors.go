@@ -8,9 +8,10 @@ import (
 
 // Error responses from Apple
 type Error struct {
-	Reason    error
-	Status    int // http StatusCode
-	Timestamp time.Time
+	Reason     error
+	Status     int // http StatusCode
+	Timestamp  time.Time
+	RetryAfter time.Duration // from the Retry-After header, if any
 }
 
 // Service error responses.
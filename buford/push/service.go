@@ -10,6 +10,8 @@ import (
 	"io"
 	"net/http"
 	"time"
+
+	"github.com/nohana/gaurun/internal/retryafter"
 )
 
 // Apple host locations for configuring Service.
@@ -80,7 +82,11 @@ func (s *Service) Push(deviceToken string, headers *Headers, payload []byte) (st
 		return resp.Header.Get("apns-id"), nil
 	}
 
-	return "", parseErrorResponse(resp.Body, resp.StatusCode)
+	err = parseErrorResponse(resp.Body, resp.StatusCode)
+	if e, ok := err.(*Error); ok {
+		e.RetryAfter = retryafter.Parse(resp.Header.Get("Retry-After"))
+	}
+	return "", err
 }
 
 func parseErrorResponse(body io.Reader, statusCode int) error {
@@ -148,3 +148,34 @@ func TestPayloadTooLarge(t *testing.T) {
 		t.Errorf("Expected status %v, got %v.", http.StatusRequestEntityTooLarge, e.Status)
 	}
 }
+
+func TestRetryAfterError(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"reason":"ServiceUnavailable"}`))
+	})
+
+	service := push.NewService(http.DefaultClient, server.URL)
+
+	_, err := service.Push(deviceToken, nil, payload)
+
+	e, ok := err.(*push.Error)
+	if !ok {
+		t.Fatalf("Expected push error, got %v.", err)
+	}
+
+	if e.Reason != push.ErrServiceUnavailable {
+		t.Errorf("Expected error reason %v, got %v.", push.ErrServiceUnavailable, err)
+	}
+
+	if e.RetryAfter != 120*time.Second {
+		t.Errorf("Expected retry after %v, got %v.", 120*time.Second, e.RetryAfter)
+	}
+}
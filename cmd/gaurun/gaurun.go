@@ -128,6 +128,12 @@ func main() {
 		}
 	}
 
+	gaurun.InitChaos()
+
+	if err := gaurun.InitTracing(); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to set up tracing: %v", err))
+	}
+
 	if gaurun.ConfGaurun.Android.Enabled {
 		if err := gaurun.InitGCMClient(); err != nil {
 			gaurun.LogSetupFatal(fmt.Errorf("failed to init gcm/fcm client: %v", err))
@@ -145,14 +151,70 @@ func main() {
 		}
 	}
 
+	if err := gaurun.InitNotificationCopy(); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to load notification key: %v", err))
+	}
+	if err := gaurun.InitRedaction(); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to init redaction: %v", err))
+	}
+	if err := gaurun.InitAccessLog(); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to init access log: %v", err))
+	}
+	if err := gaurun.InitPushIDs(); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to init push IDs: %v", err))
+	}
+	if err := gaurun.InitEvents(); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to set up event sink: %v", err))
+	}
+
+	if err := gaurun.InitMetrics(); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to set up metrics: %v", err))
+	}
+
+	if err := gaurun.InitTokenStore(); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to open token store: %v", err))
+	}
+
+	if err := gaurun.InitTemplates(); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to load templates: %v", err))
+	}
+
+	if err := gaurun.InitDeadLetterStore(); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to open dead-letter store: %v", err))
+	}
+
+	if err := gaurun.InitCampaigns(); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to load campaigns: %v", err))
+	}
+
+	gaurun.InitIdempotencyStore()
 	gaurun.InitStat()
-	gaurun.StartPushWorkers(gaurun.ConfGaurun.Core.WorkerNum, gaurun.ConfGaurun.Core.QueueNum)
+	gaurun.InitIdentifierStats()
+	if err := gaurun.InitStatStore(); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to restore stat: %v", err))
+	}
+	if err := gaurun.InitQueue(gaurun.ConfGaurun.Core.QueueNum); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to set up queue: %v", err))
+	}
+	gaurun.StartPushWorkers(gaurun.ConfGaurun.Core.WorkerNum)
+
+	if err := gaurun.RecoverNotifications(); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to recover notifications: %v", err))
+	}
+
+	if gaurun.Campaigns != nil {
+		gaurun.Campaigns.Start()
+	}
+
+	if err := gaurun.StartIngesters(); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to start ingesting: %v", err))
+	}
 
 	mux := http.NewServeMux()
 	gaurun.RegisterHandlers(mux)
 
 	server := &http.Server{
-		Handler: mux,
+		Handler: gaurun.AccessLogHandler(mux),
 	}
 	go func() {
 		gaurun.LogError.Info("start server")
@@ -164,7 +226,8 @@ func main() {
 	// Graceful shutdown (kicked by SIGTERM).
 	//
 	// First, it shutdowns server and stops accepting new requests.
-	// Then wait until all remaining queues in buffer are flushed.
+	// Then wait until all remaining queues in buffer are flushed until
+	// shutdown_timeout, and save the rest to the recovery file.
 	sigTERMChan := make(chan os.Signal, 1)
 	signal.Notify(sigTERMChan, syscall.SIGTERM)
 
@@ -177,21 +240,56 @@ func main() {
 		gaurun.LogError.Error(fmt.Sprintf("failed to shutdown server: %v", err))
 	}
 
-	// Start a goroutine to log number of job queue.
-	go func() {
-		for {
-			queue := len(gaurun.QueueNotification)
-			if queue == 0 {
-				break
-			}
+	// Messages not enqueued yet are delivered again by the brokers.
+	gaurun.StopIngesters()
+
+	// Campaigns are resumed from the saved progress on the next start.
+	if gaurun.Campaigns != nil {
+		gaurun.Campaigns.Stop()
+	}
 
-			gaurun.LogError.Info(fmt.Sprintf("wait until queue is empty. Current queue len: %d", queue))
-			time.Sleep(1 * time.Second)
+	// Block until all pusher worker job is done. Notifications in a shared
+	// queue are left to the other instances.
+	if err := gaurun.ShutdownPushWorkers(ctx); err != nil {
+		gaurun.LogError.Error(fmt.Sprintf("failed to drain queue: %v", err))
+	}
+
+	if err := gaurun.QueueNotification.Close(); err != nil {
+		gaurun.LogError.Error(fmt.Sprintf("failed to close queue: %v", err))
+	}
+
+	if gaurun.Events != nil {
+		if err := gaurun.Events.Close(); err != nil {
+			gaurun.LogError.Error(fmt.Sprintf("failed to close event sink: %v", err))
 		}
-	}()
+	}
 
-	// Block until all pusher worker job is done.
-	gaurun.PusherWg.Wait()
+	if gaurun.StatFile != nil {
+		if err := gaurun.StatFile.Close(); err != nil {
+			gaurun.LogError.Error(fmt.Sprintf("failed to save stat: %v", err))
+		}
+	}
+
+	if gaurun.Metrics != nil {
+		if err := gaurun.Metrics.Close(); err != nil {
+			gaurun.LogError.Error(fmt.Sprintf("failed to send metrics: %v", err))
+		}
+	}
+
+	if gaurun.InvalidTokens != nil {
+		if err := gaurun.InvalidTokens.Close(); err != nil {
+			gaurun.LogError.Error(fmt.Sprintf("failed to close token store: %v", err))
+		}
+	}
+	if gaurun.DeadLetters != nil {
+		if err := gaurun.DeadLetters.Close(); err != nil {
+			gaurun.LogError.Error(fmt.Sprintf("failed to close dead-letter store: %v", err))
+		}
+	}
+
+	if err := gaurun.ShutdownTracing(ctx); err != nil {
+		gaurun.LogError.Error(fmt.Sprintf("failed to export traces: %v", err))
+	}
 
 	gaurun.LogError.Info("successfully shutdown")
 }
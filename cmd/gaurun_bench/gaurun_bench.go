@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nohana/gaurun/gaurun"
+	"github.com/nohana/gaurun/mock"
+	"golang.org/x/time/rate"
+)
+
+// recorder records the requests sent to gaurun.
+type recorder struct {
+	mu              sync.Mutex
+	sent            map[string]time.Time // token -> when the request with it was sent
+	acceptLatencies []time.Duration
+	statuses        map[int]int
+	transportErrors int
+	requests        int
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		sent:     make(map[string]time.Time),
+		statuses: make(map[int]int),
+	}
+}
+
+func (r *recorder) record(tokens []string, sent time.Time, latency time.Duration, status int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	if err != nil {
+		r.transportErrors++
+		return
+	}
+	r.statuses[status]++
+	r.acceptLatencies = append(r.acceptLatencies, latency)
+	if status == http.StatusOK {
+		for _, token := range tokens {
+			r.sent[token] = sent
+		}
+	}
+}
+
+// tokenGenerator makes tokens unique across runs, valid for APNs as well.
+type tokenGenerator struct {
+	mu     sync.Mutex
+	prefix string
+	seq    uint64
+}
+
+func newTokenGenerator() *tokenGenerator {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &tokenGenerator{prefix: hex.EncodeToString(b)}
+}
+
+func (g *tokenGenerator) next() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.seq++
+	return fmt.Sprintf("%s%048x", g.prefix, g.seq)
+}
+
+type benchmark struct {
+	url         string
+	client      *http.Client
+	batch       int
+	tokens      int
+	platform    string
+	message     string
+	tokenGen    *tokenGenerator
+	recorder    *recorder
+	platformSeq uint64
+	mu          sync.Mutex
+}
+
+func (b *benchmark) nextPlatform() int {
+	switch b.platform {
+	case "ios":
+		return gaurun.PlatFormIos
+	case "android":
+		return gaurun.PlatFormAndroid
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.platformSeq++
+	if b.platformSeq%2 == 0 {
+		return gaurun.PlatFormAndroid
+	}
+	return gaurun.PlatFormIos
+}
+
+// push posts a request of b.batch notifications with b.tokens tokens each.
+func (b *benchmark) push() {
+	var (
+		req    gaurun.RequestGaurun
+		tokens []string
+	)
+	for i := 0; i < b.batch; i++ {
+		n := gaurun.RequestGaurunNotification{
+			Platform: b.nextPlatform(),
+			Message:  b.message,
+		}
+		for j := 0; j < b.tokens; j++ {
+			token := b.tokenGen.next()
+			n.Tokens = append(n.Tokens, token)
+			tokens = append(tokens, token)
+		}
+		req.Notifications = append(req.Notifications, n)
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sent := time.Now()
+	res, err := b.client.Post(b.url+"/push", "application/json", bytes.NewReader(body))
+	if err != nil {
+		b.recorder.record(tokens, sent, 0, 0, err)
+		return
+	}
+	res.Body.Close()
+	b.recorder.record(tokens, sent, time.Since(sent), res.StatusCode, nil)
+}
+
+// statSampler polls /stat/app of gaurun for the saturation of the queue
+// and the pushers.
+type statSampler struct {
+	mu          sync.Mutex
+	first, last gaurun.StatApp
+	samples     int
+	queueMax    int
+	pusherMax   int64
+	errors      int
+}
+
+func fetchStat(client *http.Client, url string) (gaurun.StatApp, error) {
+	var stat gaurun.StatApp
+	res, err := client.Get(url + "/stat/app")
+	if err != nil {
+		return stat, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return stat, fmt.Errorf("gaurun responded %d", res.StatusCode)
+	}
+	err = json.NewDecoder(res.Body).Decode(&stat)
+	return stat, err
+}
+
+func (s *statSampler) sample(client *http.Client, url string) {
+	stat, err := fetchStat(client, url)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors++
+		return
+	}
+	if s.samples == 0 {
+		s.first = stat
+	}
+	s.samples++
+	s.last = stat
+	if stat.QueueUsage > s.queueMax {
+		s.queueMax = stat.QueueUsage
+	}
+	if stat.PusherCount > s.pusherMax {
+		s.pusherMax = stat.PusherCount
+	}
+}
+
+func (s *statSampler) run(ctx context.Context, client *http.Client, url string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sample(client, url)
+		}
+	}
+}
+
+// deliveries returns the time each token was received by the mock, the
+// last one if it was retried.
+type deliveries func() (map[string]time.Time, error)
+
+func embeddedDeliveries(server *mock.Server) deliveries {
+	return func() (map[string]time.Time, error) {
+		received := make(map[string]time.Time)
+		for _, req := range server.Requests() {
+			received[req.Token] = req.Time
+		}
+		return received, nil
+	}
+}
+
+func remoteDeliveries(client *http.Client, url string) deliveries {
+	return func() (map[string]time.Time, error) {
+		res, err := client.Get(strings.TrimSuffix(url, "/") + "/mock/requests")
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		var requests []mock.RequestJSON
+		if err := json.NewDecoder(res.Body).Decode(&requests); err != nil {
+			return nil, err
+		}
+		received := make(map[string]time.Time)
+		for _, req := range requests {
+			received[req.Token] = req.Time
+		}
+		return received, nil
+	}
+}
+
+// waitDeliveries waits until the mock receives all the tokens or timeout
+// passes, and returns the latencies from sending them to gaurun and when
+// the last one was received.
+func waitDeliveries(get deliveries, sent map[string]time.Time, timeout time.Duration) ([]time.Duration, time.Time, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		received, err := get()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		var (
+			latencies []time.Duration
+			last      time.Time
+		)
+		for token, sentAt := range sent {
+			if at, ok := received[token]; ok {
+				latencies = append(latencies, at.Sub(sentAt))
+				if at.After(last) {
+					last = at
+				}
+			}
+		}
+		if len(latencies) == len(sent) || time.Now().After(deadline) {
+			return latencies, last, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Percentiles of latencies.
+type Percentiles struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+func percentiles(latencies []time.Duration) Percentiles {
+	if len(latencies) == 0 {
+		return Percentiles{}
+	}
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) time.Duration {
+		i := int(p*float64(len(sorted))+0.5) - 1
+		if i < 0 {
+			i = 0
+		}
+		if i >= len(sorted) {
+			i = len(sorted) - 1
+		}
+		return sorted[i]
+	}
+	return Percentiles{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: sorted[len(sorted)-1]}
+}
+
+func (p Percentiles) String() string {
+	return fmt.Sprintf("p50=%v p90=%v p99=%v max=%v", p.P50, p.P90, p.P99, p.Max)
+}
+
+// Report is the result of a benchmark.
+type Report struct {
+	Duration        time.Duration  `json:"duration"`
+	Requests        int            `json:"requests"`
+	RequestsPerSec  float64        `json:"requests_per_sec"`
+	Statuses        map[int]int    `json:"statuses"`
+	TransportErrors int            `json:"transport_errors"`
+	AcceptLatency   Percentiles    `json:"accept_latency"`
+	Pushes          int            `json:"pushes"`
+	Delivered       int            `json:"delivered,omitempty"`
+	PushesPerSec    float64        `json:"pushes_per_sec,omitempty"`
+	DeliveryLatency *Percentiles   `json:"delivery_latency,omitempty"`
+	QueueMax        int            `json:"queue_max"`
+	QueuePeak       int            `json:"queue_peak"`
+	PusherMax       int64          `json:"pusher_max"`
+	PusherPeak      int64          `json:"pusher_peak"`
+	PushSuccess     int64          `json:"push_success"`
+	PushError       int64          `json:"push_error"`
+	PushRetry       int64          `json:"push_retry"`
+	ErrorRate       float64        `json:"error_rate"`
+	Errors          map[string]int `json:"errors"`
+}
+
+func ratio(n, d float64) float64 {
+	if d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+func (r *Report) Print() {
+	fmt.Printf("duration:          %v\n", r.Duration)
+	fmt.Printf("requests:          %d (%.1f/s), transport errors %d\n", r.Requests, r.RequestsPerSec, r.TransportErrors)
+	statuses := make([]int, 0, len(r.Statuses))
+	for status := range r.Statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		fmt.Printf("  %-17s%d\n", fmt.Sprintf("%d:", status), r.Statuses[status])
+	}
+	fmt.Printf("accept latency:    %v\n", r.AcceptLatency)
+	fmt.Printf("pushes accepted:   %d\n", r.Pushes)
+	if r.DeliveryLatency != nil {
+		fmt.Printf("pushes delivered:  %d (%.1f/s)\n", r.Delivered, r.PushesPerSec)
+		fmt.Printf("delivery latency:  %v\n", *r.DeliveryLatency)
+	}
+	fmt.Printf("queue peak:        %d/%d (%.0f%%)\n", r.QueuePeak, r.QueueMax, 100*ratio(float64(r.QueuePeak), float64(r.QueueMax)))
+	if r.PusherMax > 0 {
+		fmt.Printf("pusher peak:       %d/%d (%.0f%%)\n", r.PusherPeak, r.PusherMax, 100*ratio(float64(r.PusherPeak), float64(r.PusherMax)))
+	} else {
+		fmt.Printf("pusher peak:       %d (no limit)\n", r.PusherPeak)
+	}
+	fmt.Printf("push success:      %d\n", r.PushSuccess)
+	fmt.Printf("push error:        %d (%.2f%%), retried %d\n", r.PushError, 100*r.ErrorRate, r.PushRetry)
+	for _, category := range errorCategories {
+		if n := r.Errors[category]; n > 0 {
+			fmt.Printf("  %-17s%d\n", category+":", n)
+		}
+	}
+}
+
+var errorCategories = []string{"retryable", "permanent", "auth", "token_invalid", "payload"}
+
+func statDelta(first, last gaurun.StatApp) (success, errs, retry int64, categories map[string]int) {
+	success = last.Ios.PushSuccess + last.Android.PushSuccess - first.Ios.PushSuccess - first.Android.PushSuccess
+	errs = last.Ios.PushError + last.Android.PushError - first.Ios.PushError - first.Android.PushError
+	retry = last.Ios.PushRetry + last.Android.PushRetry - first.Ios.PushRetry - first.Android.PushRetry
+	sum := func(f func(gaurun.StatErrors) int64) int {
+		return int(f(last.Ios.Errors) + f(last.Android.Errors) - f(first.Ios.Errors) - f(first.Android.Errors))
+	}
+	categories = map[string]int{
+		"retryable":     sum(func(e gaurun.StatErrors) int64 { return e.Retryable }),
+		"permanent":     sum(func(e gaurun.StatErrors) int64 { return e.Permanent }),
+		"auth":          sum(func(e gaurun.StatErrors) int64 { return e.Auth }),
+		"token_invalid": sum(func(e gaurun.StatErrors) int64 { return e.TokenInvalid }),
+		"payload":       sum(func(e gaurun.StatErrors) int64 { return e.Payload }),
+	}
+	return
+}
+
+func main() {
+	versionPrinted := flag.Bool("v", false, "gaurun version")
+	url := flag.String("s", "http://127.0.0.1:1056", "URL of gaurun")
+	perSecond := flag.Float64("rate", 100, "requests per second (0 for as fast as possible)")
+	duration := flag.Duration("d", 10*time.Second, "duration to send requests")
+	concurrency := flag.Int("c", 16, "number of concurrent requests")
+	batch := flag.Int("n", 1, "notifications per request")
+	tokens := flag.Int("t", 1, "tokens per notification")
+	platform := flag.String("platform", "mixed", "platform of notifications (ios, android or mixed)")
+	messageSize := flag.Int("size", 32, "size of messages in bytes")
+	statInterval := flag.Duration("stat", time.Second, "interval to poll /stat/app")
+	mockAddr := flag.String("mock", "", "address to run mock APNs and FCM on, which gaurun pushes to")
+	mockLatency := flag.Duration("mock_latency", 0, "latency of the mock")
+	mockRate := flag.Int("mock_rate", 0, "pushes per second accepted by the mock (0 for no limit)")
+	mockURL := flag.String("mock_url", "", "URL of a running gaurun_mock, which gaurun pushes to")
+	wait := flag.Duration("wait", 30*time.Second, "time to wait for pushes to be delivered to the mock")
+	jsonOutput := flag.Bool("json", false, "print the report in JSON")
+	flag.Parse()
+
+	if *versionPrinted {
+		gaurun.PrintVersion()
+		return
+	}
+	if *platform != "ios" && *platform != "android" && *platform != "mixed" {
+		gaurun.LogSetupFatal(fmt.Errorf("platform must be ios, android or mixed"))
+	}
+	if *batch <= 0 || *tokens <= 0 || *concurrency <= 0 {
+		gaurun.LogSetupFatal(fmt.Errorf("-n, -t and -c must be positive"))
+	}
+	*url = strings.TrimSuffix(*url, "/")
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: *concurrency,
+		},
+	}
+
+	var get deliveries
+	if *mockAddr != "" {
+		server := mock.NewServer()
+		server.Latency = *mockLatency
+		server.RateLimit = *mockRate
+		l, err := net.Listen("tcp", *mockAddr)
+		if err != nil {
+			gaurun.LogSetupFatal(err)
+		}
+		go http.Serve(l, server)
+		get = embeddedDeliveries(server)
+		log.Printf("mock APNs and FCM are running on %s", l.Addr())
+	} else if *mockURL != "" {
+		get = remoteDeliveries(client, *mockURL)
+	}
+
+	b := &benchmark{
+		url:      *url,
+		client:   client,
+		batch:    *batch,
+		tokens:   *tokens,
+		platform: *platform,
+		message:  strings.Repeat("x", *messageSize),
+		tokenGen: newTokenGenerator(),
+		recorder: newRecorder(),
+	}
+
+	sampler := &statSampler{}
+	sampler.sample(client, *url)
+	if sampler.samples == 0 {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to get /stat/app of %s", *url))
+	}
+	statCtx, stopStat := context.WithCancel(context.Background())
+	go sampler.run(statCtx, client, *url, *statInterval)
+
+	limit := rate.Inf
+	if *perSecond > 0 {
+		limit = rate.Limit(*perSecond)
+	}
+	limiter := rate.NewLimiter(limit, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	log.Printf("sending requests to %s for %v", *url, *duration)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for limiter.Wait(ctx) == nil {
+				b.push()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	report := &Report{
+		Duration:        elapsed,
+		Requests:        b.recorder.requests,
+		RequestsPerSec:  ratio(float64(b.recorder.requests), elapsed.Seconds()),
+		Statuses:        b.recorder.statuses,
+		TransportErrors: b.recorder.transportErrors,
+		AcceptLatency:   percentiles(b.recorder.acceptLatencies),
+		Pushes:          len(b.recorder.sent),
+	}
+
+	if get != nil {
+		log.Printf("waiting for %d pushes to be delivered", len(b.recorder.sent))
+		latencies, last, err := waitDeliveries(get, b.recorder.sent, *wait)
+		if err != nil {
+			gaurun.LogSetupFatal(err)
+		}
+		p := percentiles(latencies)
+		report.Delivered = len(latencies)
+		report.DeliveryLatency = &p
+		if report.Delivered > 0 {
+			report.PushesPerSec = ratio(float64(report.Delivered), last.Sub(start).Seconds())
+		}
+	} else {
+		// let the queue drain before the last sample.
+		time.Sleep(*statInterval)
+	}
+
+	stopStat()
+	sampler.sample(client, *url)
+	report.QueueMax = sampler.last.QueueMax
+	report.QueuePeak = sampler.queueMax
+	report.PusherMax = sampler.last.PusherMax
+	report.PusherPeak = sampler.pusherMax
+	report.PushSuccess, report.PushError, report.PushRetry, report.Errors = statDelta(sampler.first, sampler.last)
+	report.ErrorRate = ratio(float64(report.PushError), float64(report.PushSuccess+report.PushError))
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			gaurun.LogSetupFatal(err)
+		}
+		return
+	}
+	report.Print()
+}
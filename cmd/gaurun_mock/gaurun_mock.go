@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nohana/gaurun/buford/token"
+	"github.com/nohana/gaurun/gaurun"
+	"github.com/nohana/gaurun/mock"
+)
+
+// listFlag is a flag which may be given more than once.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// loadScript reads a JSON object mapping tokens to arrays of responses.
+func loadScript(server *mock.Server, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var script map[string][]mock.ResponseJSON
+	if err := json.Unmarshal(b, &script); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	for token, scripted := range script {
+		responses := make([]mock.Response, 0, len(scripted))
+		for _, resp := range scripted {
+			responses = append(responses, resp.Response())
+		}
+		server.SetResponses(token, responses...)
+	}
+	return nil
+}
+
+func main() {
+	var topics listFlag
+	versionPrinted := flag.Bool("v", false, "gaurun version")
+	addr := flag.String("p", ":1056", "address to listen on")
+	latency := flag.Duration("latency", 0, "latency of every response")
+	perSecond := flag.Int("rate", 0, "maximum pushes accepted per second (0 for no limit)")
+	apiKey := flag.String("apikey", "", "API key required by legacy FCM (any if empty)")
+	flag.Var(&topics, "topic", "APNs topic accepted (repeatable, any if not given)")
+	authKeyPath := flag.String("auth_key", "", "APNs auth key file (.p8) verifying provider tokens")
+	authKeyID := flag.String("auth_key_id", "", "key id of the APNs auth key")
+	certPath := flag.String("cert", "", "certificate file to serve over TLS with HTTP/2")
+	keyPath := flag.String("key", "", "key file of the certificate")
+	scriptPath := flag.String("s", "", "JSON file of responses scripted per token")
+	flag.Parse()
+
+	if *versionPrinted {
+		gaurun.PrintVersion()
+		return
+	}
+
+	server := mock.NewServer()
+	server.Latency = *latency
+	server.RateLimit = *perSecond
+	server.FCMAPIKey = *apiKey
+	server.APNsTopics = topics
+	if *authKeyPath != "" {
+		authKey, err := token.AuthKeyFromFile(*authKeyPath)
+		if err != nil {
+			gaurun.LogSetupFatal(err)
+		}
+		server.APNsKeys = map[string]*ecdsa.PublicKey{*authKeyID: &authKey.PublicKey}
+	}
+	if *scriptPath != "" {
+		if err := loadScript(server, *scriptPath); err != nil {
+			gaurun.LogSetupFatal(err)
+		}
+	}
+
+	httpServer := &http.Server{
+		Addr:              *addr,
+		Handler:           server,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	var err error
+	if *certPath != "" {
+		log.Printf("serving mock APNs and FCM over TLS on %s", *addr)
+		err = httpServer.ListenAndServeTLS(*certPath, *keyPath)
+	} else {
+		log.Printf("serving mock APNs and FCM on %s", *addr)
+		err = httpServer.ListenAndServe()
+	}
+	gaurun.LogSetupFatal(err)
+}
@@ -1,213 +1,295 @@
 package main
 
 import (
-	"bufio"
-	"crypto/ecdsa"
+	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/nohana/gaurun/buford/token"
 	"github.com/nohana/gaurun/gaurun"
-	"github.com/nohana/gaurun/gcm"
+	"golang.org/x/time/rate"
 )
 
-var (
-	APNSClient gaurun.APNsClient
-	GCMClient  *gcm.Client
-)
+// pathsFlag is a flag which may be given more than once.
+type pathsFlag []string
 
-func pushNotification(wg *sync.WaitGroup, req gaurun.RequestGaurunNotification, logPush gaurun.LogPushEntry) {
-	var result bool
-	switch logPush.Platform {
-	case "ios":
-		result = pushNotificationIos(req)
-	case "android":
-		result = pushNotificationAndroid(req)
-	}
-	if !result {
-		msg := fmt.Sprintf("failed to push notification: %s %s %s", logPush.Token, logPush.Platform, logPush.Message)
-		log.Println(msg)
-	} else {
-		msg := fmt.Sprintf("succeeded push notification: %s %s %s", logPush.Token, logPush.Platform, logPush.Message)
-		log.Println(msg)
-	}
-
-	wg.Done()
+func (p *pathsFlag) String() string {
+	return strings.Join(*p, ",")
 }
 
-func pushNotificationAndroid(req gaurun.RequestGaurunNotification) bool {
-	data := map[string]interface{}{"message": req.Message}
-	msg := gcm.NewMessage(data, req.Tokens...)
-	msg.CollapseKey = req.CollapseKey
-	msg.DelayWhileIdle = req.DelayWhileIdle
-	msg.TimeToLive = req.TimeToLive
-	msg.Priority = req.Priority
+func (p *pathsFlag) Set(v string) error {
+	*p = append(*p, v)
+	return nil
+}
 
-	_, err := GCMClient.Send(msg)
+func parseTime(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, s)
 	if err != nil {
-		return false
+		gaurun.LogSetupFatal(fmt.Errorf("time must be in RFC3339: %v", err))
 	}
-
-	return true
+	return t
 }
 
-func pushNotificationIos(req gaurun.RequestGaurunNotification) bool {
+// collectLostPushes reads the logs and the recovery files and returns the
+// notifications to replay.
+func collectLostPushes(logPaths, recoveryPaths []string, filter gaurun.ReplayFilter) ([]gaurun.RequestGaurunNotification, error) {
+	var key []byte
+	if path := gaurun.ConfGaurun.Log.NotificationKeyFile; path != "" {
+		var err error
+		if key, err = gaurun.LoadNotificationKey(path); err != nil {
+			return nil, err
+		}
+	}
+	lost := gaurun.NewLostPushes(key)
+	if gaurun.LogRedactor != nil {
+		lost.RequireCopy()
+	}
+	for _, path := range logPaths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		malformed, err := lost.ScanLog(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		if malformed > 0 {
+			log.Printf("skipped %d malformed lines in %s", malformed, path)
+		}
+	}
+	for _, path := range recoveryPaths {
+		notifications, err := gaurun.LoadRecoveryFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		lost.AddRecovered(notifications)
+	}
+	if n := lost.Uncopied(); n > 0 {
+		log.Printf("skipped %d notifications logged without copies, whose fields may be redacted", n)
+	}
+	return lost.Notifications(filter), nil
+}
 
-	service := gaurun.NewApnsServiceHttp2(APNSClient)
+// initPushers sets up the clients for APNs and FCM as gaurun does.
+func initPushers() {
+	accessLogger, _, err := gaurun.InitLog("stdout", "info")
+	if err != nil {
+		gaurun.LogSetupFatal(err)
+	}
+	errorLogger, _, err := gaurun.InitLog("stderr", gaurun.ConfGaurun.Log.Level)
+	if err != nil {
+		gaurun.LogSetupFatal(err)
+	}
+	gaurun.LogAccess = accessLogger
+	gaurun.LogError = errorLogger
 
-	for _, token := range req.Tokens {
+	if gaurun.ConfGaurun.Android.Enabled {
+		if err := gaurun.InitGCMClient(); err != nil {
+			gaurun.LogSetupFatal(fmt.Errorf("failed to init gcm/fcm client: %v", err))
+		}
+		if gaurun.ConfGaurun.Android.UseV1 {
+			if err := gaurun.InitFirebaseAppForFcmV1(); err != nil {
+				gaurun.LogSetupFatal(fmt.Errorf("failed to init fcm v1 firebase messaging client: %v", err))
+			}
+		}
+	}
+	if gaurun.ConfGaurun.Ios.Enabled {
+		if err := gaurun.InitAPNSClient(); err != nil {
+			gaurun.LogSetupFatal(fmt.Errorf("failed to init http client for APNs: %v", err))
+		}
+	}
+}
 
-		headers := gaurun.NewApnsHeadersHttp2(&req)
-		payload := gaurun.NewApnsPayloadHttp2(&req)
+// pushDirectly pushes a batch of one notification with the pushers of gaurun.
+func pushDirectly(notifications []gaurun.RequestGaurunNotification) error {
+	n := notifications[0]
+	switch {
+	case n.Platform == gaurun.PlatFormIos && !gaurun.ConfGaurun.Ios.Enabled,
+		n.Platform == gaurun.PlatFormAndroid && !gaurun.ConfGaurun.Android.Enabled:
+		return fmt.Errorf("platform %d is disabled", n.Platform)
+	}
+	return gaurun.PushNotification(n)
+}
 
-		err := gaurun.ApnsPushHttp2(token, service, headers, payload)
+// resubmitter posts batches of notifications to POST /push of a running gaurun.
+func resubmitter(url string, timeout time.Duration) func([]gaurun.RequestGaurunNotification) error {
+	client := &http.Client{Timeout: timeout}
+	return func(notifications []gaurun.RequestGaurunNotification) error {
+		for i := range notifications {
+			// numbered and accepted again by gaurun.
+			notifications[i] = notifications[i].WithRemainingLifetime()
+			notifications[i].ID = ""
+		}
+		body, err := json.Marshal(gaurun.RequestGaurun{Notifications: notifications})
+		if err != nil {
+			return err
+		}
+		res, err := client.Post(strings.TrimSuffix(url, "/")+"/push", "application/json", bytes.NewReader(body))
 		if err != nil {
-			return false
+			return err
 		}
+		defer res.Body.Close()
+		var respGaurun gaurun.ResponseGaurun
+		json.NewDecoder(res.Body).Decode(&respGaurun)
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("gaurun responded %d: %s", res.StatusCode, respGaurun.Message)
+		}
+		return nil
+	}
+}
+
+// replay pushes notifications in batches of batchSize by workers at most
+// perSecond notifications per second. It returns the numbers of succeeded
+// and failed notifications.
+func replay(notifications []gaurun.RequestGaurunNotification, push func([]gaurun.RequestGaurunNotification) error, batchSize, workers, perSecond int) (int64, int64) {
+	limit := rate.Inf
+	if perSecond > 0 {
+		limit = rate.Limit(perSecond)
 	}
+	limiter := rate.NewLimiter(limit, batchSize)
 
-	return true
+	batches := make(chan []gaurun.RequestGaurunNotification)
+	go func() {
+		defer close(batches)
+		for len(notifications) > 0 {
+			n := batchSize
+			if n > len(notifications) {
+				n = len(notifications)
+			}
+			batches <- notifications[:n]
+			notifications = notifications[n:]
+		}
+	}()
+
+	var (
+		succeeded, failed int64
+		wg                sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				limiter.WaitN(context.Background(), len(batch))
+				if err := push(batch); err != nil {
+					for _, n := range batch {
+						log.Printf("failed to replay notification: token=%s request_id=%s: %v", gaurun.LogRedactor.Redact(gaurun.RedactFieldToken, n.Tokens[0]), n.RequestID, err)
+					}
+					atomic.AddInt64(&failed, int64(len(batch)))
+					continue
+				}
+				atomic.AddInt64(&succeeded, int64(len(batch)))
+			}
+		}()
+	}
+	wg.Wait()
+	return succeeded, failed
 }
 
 func main() {
+	var logPaths, recoveryPaths pathsFlag
 	versionPrinted := flag.Bool("v", false, "gaurun version")
 	confPath := flag.String("c", "", "configuration file path for gaurun")
-	logPath := flag.String("l", "", "log file path for gaurun")
+	flag.Var(&logPaths, "l", "access log path of gaurun, gzipped or not (repeatable)")
+	flag.Var(&recoveryPaths, "r", "recovery file path of gaurun (repeatable)")
+	since := flag.String("since", "", "replay notifications accepted at or after this time (RFC3339)")
+	until := flag.String("until", "", "replay notifications accepted before this time (RFC3339)")
+	platform := flag.String("platform", "", "replay notifications only for this platform (ios or android)")
+	identifier := flag.String("identifier", "", "replay notifications only with this identifier")
+	dryRun := flag.Bool("n", false, "print notifications to replay without pushing")
+	perSecond := flag.Int("rate", 100, "maximum notifications replayed per second (0 for no limit)")
+	workers := flag.Int("w", 8, "number of batches replayed concurrently")
+	url := flag.String("u", "", "URL of a running gaurun to resubmit notifications to, instead of pushing directly")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [log ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	logPaths = append(logPaths, flag.Args()...)
 
 	if *versionPrinted {
 		gaurun.PrintVersion()
-		os.Exit(0)
+		return
 	}
 
-	// set default parameters
-	gaurun.ConfGaurun = gaurun.BuildDefaultConf()
-
-	// load configuration
-	conf, err := gaurun.LoadConf(gaurun.ConfGaurun, *confPath)
-	if err != nil {
-		gaurun.LogSetupFatal(err)
+	if len(logPaths) == 0 && len(recoveryPaths) == 0 {
+		gaurun.LogSetupFatal(fmt.Errorf("no log or recovery file is given"))
 	}
-	gaurun.ConfGaurun = conf
-
-	f, err := os.Open(*logPath)
-	if err != nil {
-		panic(err)
+	if *platform != "" && *platform != "ios" && *platform != "android" {
+		gaurun.LogSetupFatal(fmt.Errorf("platform must be ios or android"))
 	}
-	defer f.Close()
-
-	scanner := bufio.NewScanner(f)
-	accepts := make(map[uint64]gaurun.LogPushEntry)
-	successes := make(map[uint64]gaurun.LogPushEntry)
-
-	for scanner.Scan() {
-		var logPush gaurun.LogPushEntry
-		line := scanner.Text()
-		err := json.Unmarshal([]byte(line), &logPush)
-		if err != nil {
-			log.Printf("JSON parse error(%s)", line)
-			continue
-		}
-		if logPush.Type == "accepted-request" {
-			continue
-		}
-
-		switch logPush.Type {
-		case "accepted-push":
-			accepts[logPush.ID] = logPush
-		case "succeeded-push":
-			successes[logPush.ID] = logPush
-		}
+	if *workers <= 0 {
+		*workers = 1
 	}
 
-	losts := make(map[uint64]gaurun.LogPushEntry)
-	for id, logPush := range accepts {
-		if _, ok := successes[id]; !ok {
-			losts[id] = logPush
-		}
-	}
+	// set default parameters
+	gaurun.ConfGaurun = gaurun.BuildDefaultConf()
 
-	if gaurun.ConfGaurun.Ios.IsCertificateBasedProvider() {
-		APNSClient, err = gaurun.NewApnsClientHttp2(
-			gaurun.ConfGaurun.Ios.PemCertPath,
-			gaurun.ConfGaurun.Ios.PemKeyPath,
-			gaurun.ConfGaurun.Ios.PemKeyPassphrase,
-		)
-	} else if gaurun.ConfGaurun.Ios.IsTokenBasedProvider() {
-		var authKey *ecdsa.PrivateKey
-		authKey, err = token.AuthKeyFromFile(gaurun.ConfGaurun.Ios.TokenAuthKeyPath)
+	// load configuration, which is required to push directly
+	if *confPath != "" {
+		conf, err := gaurun.LoadConf(gaurun.ConfGaurun, *confPath)
 		if err != nil {
 			gaurun.LogSetupFatal(err)
 		}
-		APNSClient, err = gaurun.NewApnsClientHttp2ForToken(
-			authKey,
-			gaurun.ConfGaurun.Ios.TokenAuthKeyID,
-			gaurun.ConfGaurun.Ios.TokenAuthTeamID,
-		)
-	} else {
-		gaurun.LogSetupFatal(fmt.Errorf("should be specify Token-based provider or Certificate-based provider"))
+		gaurun.ConfGaurun = conf
+	} else if !*dryRun && *url == "" {
+		gaurun.LogSetupFatal(fmt.Errorf("configuration file is required to push directly"))
 	}
-	if err != nil {
-		gaurun.LogSetupFatal(err)
+	if err := gaurun.InitRedaction(); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to init redaction: %v", err))
 	}
-	APNSClient.HTTPClient.Timeout = time.Duration(gaurun.ConfGaurun.Ios.Timeout) * time.Second
 
-	GCMClient, err := gcm.NewClient(gcm.FCMSendEndpoint, gaurun.ConfGaurun.Android.ApiKey)
+	filter := gaurun.ReplayFilter{
+		Since:      parseTime(*since),
+		Until:      parseTime(*until),
+		Platform:   *platform,
+		Identifier: *identifier,
+	}
+	notifications, err := collectLostPushes(logPaths, recoveryPaths, filter)
 	if err != nil {
 		gaurun.LogSetupFatal(err)
 	}
+	log.Printf("%d notifications to replay", len(notifications))
 
-	TransportGCM := &http.Transport{
-		MaxIdleConnsPerHost: gaurun.ConfGaurun.Android.KeepAliveConns,
-		Dial: (&net.Dialer{
-			Timeout:   time.Duration(gaurun.ConfGaurun.Android.Timeout) * time.Second,
-			KeepAlive: time.Duration(gaurun.ConfGaurun.Android.KeepAliveTimeout) * time.Second,
-		}).Dial,
-	}
-
-	GCMClient.Http = &http.Client{
-		Transport: TransportGCM,
-		Timeout:   time.Duration(gaurun.ConfGaurun.Android.Timeout) * time.Second,
-	}
-
-	wg := new(sync.WaitGroup)
-	for _, logPush := range losts {
-		tokens := make([]string, 1)
-		var platform int
-		tokens[0] = logPush.Token
-		switch logPush.Platform {
-		case "ios":
-			platform = 1
-		case "android":
-			platform = 2
-
+	if *dryRun {
+		enc := json.NewEncoder(os.Stdout)
+		for _, n := range notifications {
+			if err := enc.Encode(n); err != nil {
+				gaurun.LogSetupFatal(err)
+			}
 		}
+		return
+	}
 
-		req := gaurun.RequestGaurunNotification{
-			Tokens:           tokens,
-			Platform:         platform,
-			Message:          logPush.Message,
-			CollapseKey:      logPush.CollapseKey,
-			DelayWhileIdle:   logPush.DelayWhileIdle,
-			TimeToLive:       logPush.TimeToLive,
-			Title:            logPush.Title,
-			Subtitle:         logPush.Subtitle,
-			Badge:            logPush.Badge,
-			Category:         logPush.Category,
-			Sound:            logPush.Sound,
-			ContentAvailable: logPush.ContentAvailable,
-			Expiry:           logPush.Expiry,
+	var (
+		push      func([]gaurun.RequestGaurunNotification) error
+		batchSize = 1
+	)
+	if *url != "" {
+		push = resubmitter(*url, 30*time.Second)
+		if gaurun.ConfGaurun.Core.NotificationMax > 0 {
+			batchSize = int(gaurun.ConfGaurun.Core.NotificationMax)
 		}
-		wg.Add(1)
-		go pushNotification(wg, req, logPush)
+	} else {
+		initPushers()
+		push = pushDirectly
 	}
 
-	wg.Wait()
+	succeeded, failed := replay(notifications, push, batchSize, *workers, *perSecond)
+	log.Printf("replayed %d notifications: %d succeeded, %d failed", succeeded+failed, succeeded, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
 }
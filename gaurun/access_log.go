@@ -0,0 +1,226 @@
+package gaurun
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// apiKeyIdentityLen is the length of the hash of an API key written in
+// access logs.
+const apiKeyIdentityLen = 12
+
+// trustedProxies is the networks of the proxies whose X-Forwarded-For is
+// trusted.
+var trustedProxies []*net.IPNet
+
+type accessLogKey struct{}
+
+// accessLogEntry holds what a handler tells the access log.
+type accessLogEntry struct {
+	notifications int
+}
+
+// accessLogWriter records the status and the size of a response.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// InitAccessLog parses the trusted proxies given by the configuration.
+func InitAccessLog() error {
+	proxies, err := parseTrustedProxies(ConfGaurun.Log.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	trustedProxies = proxies
+	return nil
+}
+
+// parseTrustedProxies parses IP addresses and CIDRs.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", proxy)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of r. X-Forwarded-For is
+// followed from the right only while the hops are trusted proxies, so
+// that clients cannot forge their addresses.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			break
+		}
+		host = hop
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return host
+}
+
+// apiKeyIdentity returns a hash identifying the API key given by r, so
+// that callers are told apart without logging their keys.
+func apiKeyIdentity(r *http.Request) string {
+	header := ConfGaurun.Log.APIKeyHeader
+	if header == "" {
+		return ""
+	}
+	key := r.Header.Get(header)
+	if i := strings.IndexByte(key, ' '); i >= 0 && strings.EqualFold(key[:i], "Bearer") {
+		key = strings.TrimSpace(key[i+1:])
+	}
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:apiKeyIdentityLen]
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// setAccessNotifications tells the access log the number of notifications
+// accepted by the request of ctx.
+func setAccessNotifications(ctx context.Context, n int) {
+	if entry, ok := ctx.Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.notifications = n
+	}
+}
+
+// AccessLogHandler logs every request to the access log on its completion.
+// A request without X-Request-ID is given a new one, which is returned in
+// the response and logged with the notifications of the request.
+func AccessLogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" {
+			requestID = newRequestID()
+			r.Header.Set(RequestIDHeader, requestID)
+		}
+		if validRequestID(requestID) {
+			w.Header().Set(RequestIDHeader, requestID)
+		} else {
+			// rejected by the handler, and not logged as is.
+			requestID = ""
+		}
+
+		entry := &accessLogEntry{notifications: -1}
+		aw := &accessLogWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry)))
+		if aw.status == 0 {
+			aw.status = http.StatusOK
+		}
+
+		LogAccessRequest(r, aw.status, aw.size, time.Since(start), requestID, entry.notifications)
+	})
+}
+
+// LogAccessRequest writes a request completed to the access log. The
+// number of notifications is not written if it is negative.
+func LogAccessRequest(r *http.Request, status int, size int64, duration time.Duration, requestID string, notifications int) {
+	requestIDField := zap.Skip()
+	if requestID != "" {
+		requestIDField = zap.String("request_id", requestID)
+	}
+	apiKey := zap.Skip()
+	if id := apiKeyIdentity(r); id != "" {
+		apiKey = zap.String("api_key", id)
+	}
+	notificationsField := zap.Skip()
+	if notifications >= 0 {
+		notificationsField = zap.Int("notifications", notifications)
+	}
+
+	LogAccess.Info("",
+		zap.String("type", "request"),
+		zap.String("uri", r.URL.RequestURI()),
+		zap.String("method", r.Method),
+		zap.String("proto", r.Proto),
+		zap.Int64("content_length", r.ContentLength),
+		zap.Int("status", status),
+		zap.Int64("size", size),
+		zap.Float64("duration", math.Floor(duration.Seconds()*1000)/1000),
+		zap.String("remote_addr", clientIP(r)),
+		zap.String("user_agent", r.UserAgent()),
+		apiKey,
+		requestIDField,
+		notificationsField,
+	)
+}
@@ -0,0 +1,140 @@
+package gaurun
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func() {
+		trustedProxies = nil
+	}()
+	var err error
+	trustedProxies, err = parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	require.Nil(t, err)
+
+	cases := []struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		// X-Forwarded-For of untrusted clients is ignored.
+		{"198.51.100.1:1234", "203.0.113.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "203.0.113.1", "203.0.113.1"},
+		// the client can forge the left of the trusted proxies.
+		{"10.0.0.1:1234", "198.51.100.9, 203.0.113.1, 192.0.2.1", "203.0.113.1"},
+		{"10.0.0.1:1234", "unknown, 10.0.0.2", "10.0.0.2"},
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		assert.Equal(t, c.expected, clientIP(r), c.forwarded)
+	}
+
+	_, err = parseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.NotNil(t, err)
+	_, err = parseTrustedProxies([]string{"proxy"})
+	assert.NotNil(t, err)
+}
+
+func TestAccessLogHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	logAccessBefore := LogAccess
+	withConf(t)
+	defer func() {
+		LogAccess = logAccessBefore
+		trustedProxies = nil
+	}()
+	path := filepath.Join(dir, "access.log")
+	LogAccess, _, err = InitLog(path, "info")
+	require.Nil(t, err)
+	ConfGaurun.Core.NotificationMax = 100
+	ConfGaurun.Ios.Enabled = true
+	ConfGaurun.Log.TrustedProxies = []string{"192.0.2.0/24"}
+	ConfGaurun.Log.APIKeyHeader = "Authorization"
+	require.Nil(t, InitAccessLog())
+	withQueue(t, NewNotificationQueue(10, nil, 0))
+
+	mux := http.NewServeMux()
+	RegisterHandlers(mux)
+	handler := AccessLogHandler(mux)
+
+	req := httptest.NewRequest("POST", "/push", strings.NewReader(`{"notifications":[{"token":["a","b"],"platform":1,"message":"hello"}]}`))
+	req.RemoteAddr = "192.0.2.10:5000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("User-Agent", "client/1.0")
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	requestID := w.Header().Get(RequestIDHeader)
+	assert.Len(t, requestID, 32)
+
+	// the ID given to the request is logged with its notifications.
+	for i := 0; i < 2; i++ {
+		msg, err := QueueNotification.Receive()
+		require.Nil(t, err)
+		assert.Equal(t, requestID, msg.Notification.RequestID)
+	}
+
+	req = httptest.NewRequest("GET", "/stat/unknown", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, "req-1", w.Header().Get(RequestIDHeader))
+	LogAccess.Sync()
+
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	var requests []LogReq
+	pushes := 0
+	for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+		var entry LogReq
+		require.Nil(t, json.Unmarshal(line, &entry))
+		switch entry.Type {
+		case "request":
+			requests = append(requests, entry)
+		case StatusAcceptedPush:
+			pushes++
+			assert.Equal(t, requestID, entry.RequestID)
+		}
+	}
+	assert.Equal(t, 2, pushes)
+	require.Len(t, requests, 2)
+
+	push := requests[0]
+	assert.Equal(t, "/push", push.URI)
+	assert.Equal(t, "POST", push.Method)
+	assert.Equal(t, http.StatusOK, push.Status)
+	assert.True(t, push.Size > 0)
+	assert.Equal(t, "203.0.113.7", push.RemoteAddr)
+	assert.Equal(t, "client/1.0", push.UserAgent)
+	assert.Len(t, push.APIKey, apiKeyIdentityLen)
+	assert.NotContains(t, push.APIKey, "secret")
+	assert.Equal(t, requestID, push.RequestID)
+	assert.Equal(t, 2, push.Notifications)
+
+	notFound := requests[1]
+	assert.Equal(t, http.StatusNotFound, notFound.Status)
+	assert.Equal(t, "req-1", notFound.RequestID)
+	assert.Equal(t, 0, notFound.Notifications)
+	assert.Equal(t, "", notFound.APIKey)
+}
@@ -10,18 +10,22 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/nohana/gaurun/buford/payload"
 	"github.com/nohana/gaurun/buford/payload/badge"
 	"github.com/nohana/gaurun/buford/push"
 	"github.com/nohana/gaurun/buford/token"
+	"github.com/nohana/gaurun/internal/upstream"
 )
 
 type APNsClient struct {
 	HTTPClient *http.Client
 	// Token is set only for token-based provider connection trust
 	Token *token.Token
+	// CertNotAfter is set only for certificate-based provider connection trust
+	CertNotAfter time.Time
 }
 
 func NewTransportHttp2(cert tls.Certificate) (*http.Transport, error) {
@@ -50,6 +54,11 @@ func NewApnsClientHttp2(certPath, keyPath, keyPassphrase string) (APNsClient, er
 		return APNsClient{}, err
 	}
 
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return APNsClient{}, err
+	}
+
 	transport, err := NewTransportHttp2(cert)
 	if err != nil {
 		return APNsClient{}, err
@@ -57,9 +66,10 @@ func NewApnsClientHttp2(certPath, keyPath, keyPassphrase string) (APNsClient, er
 
 	return APNsClient{
 		HTTPClient: &http.Client{
-			Transport: transport,
+			Transport: wrapChaos(transport, upstream.APIAPNs, PlatFormIos, ConfGaurun.Ios.Timeout),
 			Timeout:   time.Duration(ConfGaurun.Ios.Timeout) * time.Second,
 		},
+		CertNotAfter: leaf.NotAfter,
 	}, nil
 }
 
@@ -82,7 +92,7 @@ func NewApnsClientHttp2ForToken(authKey *ecdsa.PrivateKey, keyID, teamID string)
 
 	return APNsClient{
 		HTTPClient: &http.Client{
-			Transport: transport,
+			Transport: wrapChaos(transport, upstream.APIAPNs, PlatFormIos, ConfGaurun.Ios.Timeout),
 			Timeout:   time.Duration(ConfGaurun.Ios.Timeout) * time.Second,
 		},
 		Token: authToken,
@@ -124,6 +134,9 @@ func NewApnsServiceHttp2(apnsClient APNsClient) *push.Service {
 	} else {
 		host = push.Production
 	}
+	if ConfGaurun.Ios.Endpoint != "" {
+		host = strings.TrimSuffix(ConfGaurun.Ios.Endpoint, "/")
+	}
 	return &push.Service{
 		Client: apnsClient.HTTPClient,
 		Host:   host,
@@ -167,8 +180,8 @@ func NewApnsHeadersHttp2(req *RequestGaurunNotification) *push.Headers {
 		PushType: pushType,
 	}
 
-	if req.Expiry > 0 {
-		headers.Expiration = time.Now().Add(time.Duration(int64(req.Expiry)) * time.Second).UTC()
+	if deadline, ok := req.Deadline(); ok {
+		headers.Expiration = deadline.UTC()
 	}
 
 	return headers
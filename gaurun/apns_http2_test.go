@@ -2,6 +2,7 @@ package gaurun
 
 import (
 	"testing"
+	"time"
 
 	"github.com/nohana/gaurun/buford/push"
 	"github.com/stretchr/testify/assert"
@@ -20,3 +21,18 @@ func TestNewApnsClientHttp2(t *testing.T) {
 	headers = NewApnsHeadersHttp2(req)
 	assert.Equal(t, push.PushTypeBackground, headers.PushType)
 }
+
+func TestNewApnsHeadersHttp2Expiration(t *testing.T) {
+	req := &RequestGaurunNotification{Platform: PlatFormIos}
+	headers := NewApnsHeadersHttp2(req)
+	assert.True(t, headers.Expiration.IsZero())
+
+	acceptedAt := time.Now().Add(-time.Minute)
+	req = &RequestGaurunNotification{
+		Platform:   PlatFormIos,
+		Expiry:     3600,
+		AcceptedAt: acceptedAt.UnixNano() / int64(time.Millisecond),
+	}
+	headers = NewApnsHeadersHttp2(req)
+	assert.Equal(t, acceptedAt.Add(time.Hour).Unix(), headers.Expiration.Unix())
+}
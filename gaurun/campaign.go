@@ -0,0 +1,762 @@
+package gaurun
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CampaignStatusRunning   = "running"
+	CampaignStatusPaused    = "paused"
+	CampaignStatusCompleted = "completed"
+	CampaignStatusCanceled  = "canceled"
+	CampaignStatusFailed    = "failed"
+)
+
+const (
+	campaignStateFile  = "campaign.json"
+	campaignTokensFile = "tokens.ndjson"
+	// campaignMaxLine is the longest line allowed in a token list.
+	campaignMaxLine = 1024 * 1024
+	// campaignRetryInterval is how long a campaign waits before enqueueing
+	// a notification again when the queue is full.
+	campaignRetryInterval = time.Second
+)
+
+// Campaign fans out a notification to an uploaded list of tokens.
+type Campaign struct {
+	ID           string                    `json:"id"`
+	Status       string                    `json:"status"`
+	Rate         int                       `json:"rate"`
+	Total        int64                     `json:"total"`
+	Sent         int64                     `json:"sent"`
+	Skipped      int64                     `json:"skipped"`
+	Failed       int64                     `json:"failed"`
+	Error        string                    `json:"error,omitempty"`
+	CreatedAt    time.Time                 `json:"created_at"`
+	UpdatedAt    time.Time                 `json:"updated_at"`
+	Notification RequestGaurunNotification `json:"notification"`
+
+	mu      sync.Mutex
+	dir     string
+	running bool
+	wake    chan struct{}
+}
+
+// CampaignToken is a line of a token list. Vars overwrite the vars of the
+// notification of the campaign.
+type CampaignToken struct {
+	Token string            `json:"token"`
+	Vars  map[string]string `json:"vars,omitempty"`
+}
+
+// CampaignManager stores campaigns under a directory and runs them.
+type CampaignManager struct {
+	dir string
+
+	mu        sync.Mutex
+	campaigns map[string]*Campaign
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewCampaignManager returns a manager loaded with the campaigns in dir.
+// Campaigns which were running are resumed by Start.
+func NewCampaignManager(dir string) (*CampaignManager, error) {
+	m := &CampaignManager{
+		dir:       dir,
+		campaigns: make(map[string]*Campaign),
+		stop:      make(chan struct{}),
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*", campaignStateFile))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		c := &Campaign{}
+		if err := json.Unmarshal(b, c); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		c.dir = filepath.Dir(path)
+		c.wake = make(chan struct{}, 1)
+		m.campaigns[c.ID] = c
+	}
+	return m, nil
+}
+
+// Start runs the campaigns which were running when the manager stopped.
+func (m *CampaignManager) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.campaigns {
+		if c.Status == CampaignStatusRunning {
+			m.startLocked(c)
+		}
+	}
+}
+
+// Stop stops feeding notifications and saves the progress of the campaigns,
+// which are resumed by Start of the next manager.
+func (m *CampaignManager) Stop() {
+	m.mu.Lock()
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+func (m *CampaignManager) startLocked(c *Campaign) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running {
+		return
+	}
+	select {
+	case <-m.stop:
+		return
+	default:
+	}
+	c.running = true
+	m.wg.Add(1)
+	go m.run(c)
+}
+
+// Get returns the campaign with id.
+func (m *CampaignManager) Get(id string) (*Campaign, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.campaigns[id]
+	return c, ok
+}
+
+// List returns the campaigns from the oldest.
+func (m *CampaignManager) List() []*Campaign {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	campaigns := make([]*Campaign, 0, len(m.campaigns))
+	for _, c := range m.campaigns {
+		campaigns = append(campaigns, c)
+	}
+	sort.Slice(campaigns, func(i, j int) bool {
+		return campaigns[i].CreatedAt.Before(campaigns[j].CreatedAt)
+	})
+	return campaigns
+}
+
+// Create stores a new campaign pushing notification to the tokens read
+// from tokens in format ("csv" or "ndjson") at rate notifications per
+// second, and starts it.
+func (m *CampaignManager) Create(notification RequestGaurunNotification, rate int, tokens io.Reader, format string) (*Campaign, error) {
+	notification.Tokens = nil
+	notification.clearInternalFields()
+	if err := validateNotification(&notification); err != nil {
+		return nil, err
+	}
+	if rate <= 0 {
+		return nil, errors.New("rate must be positive")
+	}
+
+	id, err := newCampaignID()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(m.dir, id)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	total, err := writeCampaignTokens(filepath.Join(dir, campaignTokensFile), tokens, format)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	c := &Campaign{
+		ID:           id,
+		Status:       CampaignStatusRunning,
+		Rate:         rate,
+		Total:        total,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		Notification: notification,
+		dir:          dir,
+		wake:         make(chan struct{}, 1),
+	}
+	c.mu.Lock()
+	err = c.saveLocked()
+	c.mu.Unlock()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.campaigns[id] = c
+	m.startLocked(c)
+	m.mu.Unlock()
+
+	return c, nil
+}
+
+// Pause stops feeding notifications of the campaign until Resume.
+func (m *CampaignManager) Pause(id string) error {
+	c, ok := m.Get(id)
+	if !ok {
+		return errCampaignNotFound
+	}
+	return c.transition(CampaignStatusPaused, CampaignStatusRunning)
+}
+
+// Resume restarts feeding notifications of a paused campaign.
+func (m *CampaignManager) Resume(id string) error {
+	c, ok := m.Get(id)
+	if !ok {
+		return errCampaignNotFound
+	}
+	if err := c.transition(CampaignStatusRunning, CampaignStatusPaused); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.startLocked(c)
+	m.mu.Unlock()
+	return nil
+}
+
+// Cancel stops the campaign for good.
+func (m *CampaignManager) Cancel(id string) error {
+	c, ok := m.Get(id)
+	if !ok {
+		return errCampaignNotFound
+	}
+	if err := c.transition(CampaignStatusCanceled, CampaignStatusRunning, CampaignStatusPaused); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	running := c.running
+	c.mu.Unlock()
+	if !running {
+		os.Remove(filepath.Join(c.dir, campaignTokensFile))
+	}
+	return nil
+}
+
+var errCampaignNotFound = errors.New("campaign not found")
+
+// transition changes the status of c to status if it is one of from.
+func (c *Campaign) transition(status string, from ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	allowed := false
+	for _, f := range from {
+		if c.Status == f {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("campaign is %s", c.Status)
+	}
+	c.Status = status
+	if err := c.saveLocked(); err != nil {
+		return err
+	}
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Snapshot returns a copy of c safe to read.
+func (c *Campaign) Snapshot() *Campaign {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &Campaign{
+		ID:           c.ID,
+		Status:       c.Status,
+		Rate:         c.Rate,
+		Total:        c.Total,
+		Sent:         c.Sent,
+		Skipped:      c.Skipped,
+		Failed:       c.Failed,
+		Error:        c.Error,
+		CreatedAt:    c.CreatedAt,
+		UpdatedAt:    c.UpdatedAt,
+		Notification: c.Notification,
+	}
+}
+
+func (c *Campaign) saveLocked() error {
+	c.UpdatedAt = time.Now().UTC()
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(c.dir, campaignStateFile)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// finishLocked ends c with status and removes its token list.
+func (c *Campaign) finishLocked(status string, err error) {
+	c.Status = status
+	if err != nil {
+		c.Error = err.Error()
+	}
+	if err := c.saveLocked(); err != nil {
+		LogError.Error(fmt.Sprintf("failed to save campaign %s: %v", c.ID, err))
+	}
+	os.Remove(filepath.Join(c.dir, campaignTokensFile))
+}
+
+func (m *CampaignManager) run(c *Campaign) {
+	defer m.wg.Done()
+	defer func() {
+		c.mu.Lock()
+		c.running = false
+		c.mu.Unlock()
+	}()
+
+	f, err := os.Open(filepath.Join(c.dir, campaignTokensFile))
+	if err != nil {
+		c.mu.Lock()
+		c.finishLocked(CampaignStatusFailed, err)
+		c.mu.Unlock()
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), campaignMaxLine)
+
+	c.mu.Lock()
+	done := c.Sent + c.Skipped + c.Failed
+	interval := time.Second / time.Duration(c.Rate)
+	c.mu.Unlock()
+	if interval <= 0 {
+		interval = 1
+	}
+	// a restart pushes again at most the tokens since the last checkpoint.
+	checkpoint := ConfGaurun.Campaign.CheckpointInterval
+	if checkpoint <= 0 {
+		checkpoint = 1
+	}
+
+	// skip the tokens processed before restart
+	for i := int64(0); i < done && scanner.Scan(); i++ {
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var processed int64
+	for {
+		c.mu.Lock()
+		status := c.Status
+		if status != CampaignStatusRunning || processed >= checkpoint {
+			processed = 0
+			if err := c.saveLocked(); err != nil {
+				LogError.Error(fmt.Sprintf("failed to save campaign %s: %v", c.ID, err))
+			}
+		}
+		if status == CampaignStatusCanceled {
+			c.finishLocked(CampaignStatusCanceled, nil)
+		}
+		c.mu.Unlock()
+
+		switch status {
+		case CampaignStatusCanceled:
+			return
+		case CampaignStatusPaused:
+			select {
+			case <-c.wake:
+			case <-m.stop:
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-ticker.C:
+		case <-c.wake:
+			continue
+		case <-m.stop:
+			c.mu.Lock()
+			if err := c.saveLocked(); err != nil {
+				LogError.Error(fmt.Sprintf("failed to save campaign %s: %v", c.ID, err))
+			}
+			c.mu.Unlock()
+			return
+		}
+
+		if !scanner.Scan() {
+			c.mu.Lock()
+			if err := scanner.Err(); err != nil {
+				c.finishLocked(CampaignStatusFailed, err)
+			} else {
+				c.finishLocked(CampaignStatusCompleted, nil)
+			}
+			c.mu.Unlock()
+			return
+		}
+
+		sent, err := c.push(scanner.Bytes(), m.stop)
+		if err == ErrQueueClosed {
+			// the token is pushed again after restart.
+			c.mu.Lock()
+			if err := c.saveLocked(); err != nil {
+				LogError.Error(fmt.Sprintf("failed to save campaign %s: %v", c.ID, err))
+			}
+			c.mu.Unlock()
+			return
+		}
+		processed++
+
+		c.mu.Lock()
+		switch {
+		case err != nil:
+			c.Failed++
+		case sent:
+			c.Sent++
+		default:
+			c.Skipped++
+		}
+		c.mu.Unlock()
+	}
+}
+
+// push enqueues the notification of c for a line of the token list. It
+// returns false without an error if the line is skipped as its token or
+// notification is invalid, and the error if the queue rejects it. While the
+// queue is full, it retries until stop is closed, when it returns
+// ErrQueueClosed as it does when the queue is stopped.
+func (c *Campaign) push(line []byte, stop <-chan struct{}) (bool, error) {
+	var t CampaignToken
+	if err := json.Unmarshal(line, &t); err != nil {
+		LogError.Error(fmt.Sprintf("campaign %s: malformed token: %v", c.ID, err))
+		return false, nil
+	}
+
+	notification := c.Notification
+	notification.Tokens = []string{t.Token}
+	if notification.Identifier == "" {
+		notification.Identifier = c.ID
+	}
+	if len(t.Vars) > 0 {
+		vars := make(map[string]string, len(c.Notification.Vars)+len(t.Vars))
+		for k, v := range c.Notification.Vars {
+			vars[k] = v
+		}
+		for k, v := range t.Vars {
+			vars[k] = v
+		}
+		notification.Vars = vars
+	}
+
+	numbered, _ := numberNotifications([]RequestGaurunNotification{notification}, false)
+	if len(numbered) == 0 {
+		return false, nil
+	}
+	for {
+		_, err := enqueueNotifications(numbered)
+		if err != ErrQueueFull {
+			return err == nil, err
+		}
+		select {
+		case <-time.After(campaignRetryInterval):
+		case <-stop:
+			return false, ErrQueueClosed
+		}
+	}
+}
+
+func newCampaignID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// writeCampaignTokens normalizes a token list into NDJSON of CampaignToken
+// at path and returns the number of tokens.
+//
+// An NDJSON list has a CampaignToken per line. A CSV list has a header
+// line which must have the column "token", and the other columns are
+// used as vars.
+func writeCampaignTokens(path string, r io.Reader, format string) (int64, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	var total int64
+
+	switch format {
+	case "csv":
+		reader := csv.NewReader(r)
+		header, err := reader.Read()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read csv header: %v", err)
+		}
+		tokenColumn := -1
+		for i, name := range header {
+			if strings.TrimSpace(name) == "token" {
+				tokenColumn = i
+			}
+		}
+		if tokenColumn < 0 {
+			return 0, errors.New("csv header must have the column token")
+		}
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+			t := CampaignToken{Token: record[tokenColumn]}
+			if t.Token == "" {
+				continue
+			}
+			for i, value := range record {
+				if i == tokenColumn {
+					continue
+				}
+				if t.Vars == nil {
+					t.Vars = make(map[string]string, len(record)-1)
+				}
+				t.Vars[header[i]] = value
+			}
+			if err := encoder.Encode(t); err != nil {
+				return 0, err
+			}
+			total++
+		}
+	case "ndjson":
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), campaignMaxLine)
+		for line := 1; scanner.Scan(); line++ {
+			if len(strings.TrimSpace(scanner.Text())) == 0 {
+				continue
+			}
+			var t CampaignToken
+			if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
+				return 0, fmt.Errorf("line %d: %v", line, err)
+			}
+			if t.Token == "" {
+				return 0, fmt.Errorf("line %d: empty token", line)
+			}
+			if err := encoder.Encode(t); err != nil {
+				return 0, err
+			}
+			total++
+		}
+		if err := scanner.Err(); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("unknown format: %s", format)
+	}
+
+	if total == 0 {
+		return 0, errors.New("no token")
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	return total, f.Sync()
+}
+
+// tokenListFormat returns the format of a token list from its part.
+func tokenListFormat(part *multipart.Part) string {
+	if strings.HasPrefix(part.Header.Get("Content-Type"), "text/csv") || strings.HasSuffix(part.FileName(), ".csv") {
+		return "csv"
+	}
+	return "ndjson"
+}
+
+// InitCampaigns loads Campaigns from the configured directory.
+func InitCampaigns() error {
+	if ConfGaurun.Campaign.Dir == "" {
+		return nil
+	}
+	var err error
+	Campaigns, err = NewCampaignManager(ConfGaurun.Campaign.Dir)
+	return err
+}
+
+// CampaignsHandler creates a campaign (POST) or lists campaigns (GET).
+//
+// A campaign is created with a multipart/form-data request-body which
+// has the field notification (the notification to push without tokens),
+// the optional field rate, and the file tokens placed at last.
+func CampaignsHandler(w http.ResponseWriter, r *http.Request) {
+	if Campaigns == nil {
+		sendResponse(w, "campaign is disabled", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		campaigns := Campaigns.List()
+		snapshots := make([]*Campaign, 0, len(campaigns))
+		for _, c := range campaigns {
+			snapshots = append(snapshots, c.Snapshot())
+		}
+		sendJSON(w, snapshots)
+	case "POST":
+		createCampaign(w, r)
+	default:
+		sendResponse(w, "method must be GET or POST", http.StatusBadRequest)
+	}
+}
+
+func createCampaign(w http.ResponseWriter, r *http.Request) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		sendResponse(w, "request-body must be multipart/form-data", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		notification    RequestGaurunNotification
+		hasNotification bool
+		rate            = ConfGaurun.Campaign.Rate
+	)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			sendResponse(w, "tokens is not given", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			LogError.Error(err.Error())
+			sendResponse(w, "Request-body is malformed", http.StatusBadRequest)
+			return
+		}
+
+		switch part.FormName() {
+		case "notification":
+			if err := json.NewDecoder(part).Decode(&notification); err != nil {
+				LogError.Error(err.Error())
+				sendResponse(w, "notification is malformed", http.StatusBadRequest)
+				return
+			}
+			hasNotification = true
+		case "rate":
+			b, err := ioutil.ReadAll(io.LimitReader(part, 32))
+			if err == nil {
+				rate, err = strconv.Atoi(strings.TrimSpace(string(b)))
+			}
+			if err != nil {
+				sendResponse(w, "rate is malformed", http.StatusBadRequest)
+				return
+			}
+		case "tokens":
+			if !hasNotification {
+				sendResponse(w, "notification must be given before tokens", http.StatusBadRequest)
+				return
+			}
+			c, err := Campaigns.Create(notification, rate, part, tokenListFormat(part))
+			if err != nil {
+				LogError.Error(err.Error())
+				sendResponse(w, fmt.Sprintf("failed to create campaign: %v", err), http.StatusBadRequest)
+				return
+			}
+			LogError.Info(fmt.Sprintf("campaign %s is created with %d tokens", c.ID, c.Total))
+			sendJSON(w, c.Snapshot())
+			return
+		}
+	}
+}
+
+// CampaignHandler shows a campaign (GET /campaigns/{id}) or controls it
+// (POST /campaigns/{id}/pause, /resume and /cancel).
+func CampaignHandler(w http.ResponseWriter, r *http.Request) {
+	if Campaigns == nil {
+		sendResponse(w, "campaign is disabled", http.StatusNotFound)
+		return
+	}
+
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/campaigns/"), "/")
+	id := path[0]
+
+	if len(path) == 1 {
+		if r.Method != "GET" {
+			sendResponse(w, "method must be GET", http.StatusBadRequest)
+			return
+		}
+		c, ok := Campaigns.Get(id)
+		if !ok {
+			sendResponse(w, errCampaignNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		sendJSON(w, c.Snapshot())
+		return
+	}
+
+	if len(path) != 2 {
+		sendResponse(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		sendResponse(w, "method must be POST", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch path[1] {
+	case "pause":
+		err = Campaigns.Pause(id)
+	case "resume":
+		err = Campaigns.Resume(id)
+	case "cancel":
+		err = Campaigns.Cancel(id)
+	default:
+		sendResponse(w, "not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case err == errCampaignNotFound:
+		sendResponse(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		sendResponse(w, err.Error(), http.StatusConflict)
+	default:
+		sendResponse(w, "ok", http.StatusOK)
+	}
+}
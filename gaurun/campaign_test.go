@@ -0,0 +1,176 @@
+package gaurun
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postCampaign(t *testing.T, url, notification, rate, filename, tokens string) *Campaign {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	require.Nil(t, mw.WriteField("notification", notification))
+	require.Nil(t, mw.WriteField("rate", rate))
+	fw, err := mw.CreateFormFile("tokens", filename)
+	require.Nil(t, err)
+	fw.Write([]byte(tokens))
+	require.Nil(t, mw.Close())
+
+	res, err := http.Post(url+"/campaigns", mw.FormDataContentType(), &body)
+	require.Nil(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	var c Campaign
+	require.Nil(t, json.NewDecoder(res.Body).Decode(&c))
+	return &c
+}
+
+func waitCampaign(t *testing.T, id string, status string) *Campaign {
+	for i := 0; i < 200; i++ {
+		c, ok := Campaigns.Get(id)
+		require.True(t, ok)
+		if snapshot := c.Snapshot(); snapshot.Status == status {
+			return snapshot
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("campaign %s did not become %s", id, status)
+	return nil
+}
+
+func TestCampaignCSV(t *testing.T) {
+	withCampaigns(t)
+
+	mux := http.NewServeMux()
+	RegisterHandlers(mux)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	c := postCampaign(t, s.URL,
+		`{"platform": 1, "message": "hello", "vars": {"name": "nobody"}}`,
+		"1000",
+		"tokens.csv",
+		"token,name\naaa,alice\nbbb,bob\n,nobody\n",
+	)
+	assert.Equal(t, int64(2), c.Total)
+
+	c = waitCampaign(t, c.ID, CampaignStatusCompleted)
+	assert.Equal(t, int64(2), c.Sent)
+	assert.Equal(t, int64(0), c.Skipped)
+
+	require.Equal(t, 2, QueueNotification.Len())
+	n := QueueNotification.(*NotificationQueue).Pop()
+	assert.Equal(t, []string{"aaa"}, n.Tokens)
+	assert.Equal(t, "alice", n.Vars["name"])
+	assert.Equal(t, c.ID, n.Identifier)
+	n = QueueNotification.(*NotificationQueue).Pop()
+	assert.Equal(t, []string{"bbb"}, n.Tokens)
+	assert.Equal(t, "bob", n.Vars["name"])
+}
+
+func TestCampaignControl(t *testing.T) {
+	withCampaigns(t)
+
+	tokens := strings.Repeat(`{"token": "aaa"}`+"\n", 50)
+	c, err := Campaigns.Create(RequestGaurunNotification{Platform: PlatFormAndroid, Message: "hello"}, 10, strings.NewReader(tokens), "ndjson")
+	require.Nil(t, err)
+	assert.Equal(t, int64(50), c.Total)
+
+	require.Nil(t, Campaigns.Pause(c.ID))
+	waitCampaign(t, c.ID, CampaignStatusPaused)
+	assert.NotNil(t, Campaigns.Pause(c.ID))
+
+	// the progress is kept over restart
+	dir := Campaigns.dir
+	Campaigns.Stop()
+	Campaigns, err = NewCampaignManager(dir)
+	require.Nil(t, err)
+	Campaigns.Start()
+	restored, ok := Campaigns.Get(c.ID)
+	require.True(t, ok)
+	assert.Equal(t, CampaignStatusPaused, restored.Snapshot().Status)
+
+	require.Nil(t, Campaigns.Resume(c.ID))
+	waitCampaign(t, c.ID, CampaignStatusRunning)
+
+	require.Nil(t, Campaigns.Cancel(c.ID))
+	canceled := waitCampaign(t, c.ID, CampaignStatusCanceled)
+	assert.True(t, canceled.Sent < 50)
+	assert.NotNil(t, Campaigns.Resume(c.ID))
+
+	assert.Equal(t, errCampaignNotFound, Campaigns.Cancel("unknown"))
+}
+
+func TestCampaignInvalid(t *testing.T) {
+	withCampaigns(t)
+
+	_, err := Campaigns.Create(RequestGaurunNotification{Platform: 100, Message: "hello"}, 10, strings.NewReader(`{"token": "aaa"}`), "ndjson")
+	assert.NotNil(t, err)
+	_, err = Campaigns.Create(RequestGaurunNotification{Platform: PlatFormIos, Message: "hello"}, 10, strings.NewReader("name\nalice\n"), "csv")
+	assert.NotNil(t, err)
+	_, err = Campaigns.Create(RequestGaurunNotification{Platform: PlatFormIos, Message: "hello"}, 10, strings.NewReader("not json\n"), "ndjson")
+	assert.NotNil(t, err)
+	_, err = Campaigns.Create(RequestGaurunNotification{Platform: PlatFormIos, Message: "hello"}, 0, strings.NewReader(`{"token": "aaa"}`), "ndjson")
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(Campaigns.List()))
+}
+
+func TestCampaignProgress(t *testing.T) {
+	withCampaigns(t)
+	ConfGaurun.Campaign.CheckpointInterval = 1
+
+	tokens := strings.Repeat(`{"token": "aaa"}`+"\n", 100)
+	c, err := Campaigns.Create(RequestGaurunNotification{Platform: PlatFormAndroid, Message: "hello"}, 10, strings.NewReader(tokens), "ndjson")
+	require.Nil(t, err)
+
+	// the progress is saved at every token.
+	var saved Campaign
+	for i := 0; i < 100 && saved.Sent == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		b, err := ioutil.ReadFile(filepath.Join(Campaigns.dir, c.ID, campaignStateFile))
+		require.Nil(t, err)
+		require.Nil(t, json.Unmarshal(b, &saved))
+	}
+	assert.True(t, saved.Sent > 0)
+
+	require.Nil(t, Campaigns.Cancel(c.ID))
+	waitCampaign(t, c.ID, CampaignStatusCanceled)
+}
+
+func TestCampaignQueueFull(t *testing.T) {
+	withCampaigns(t)
+	queue := newRejectingQueue()
+	queue.rejects["bbb"] = 2
+	withQueue(t, queue)
+
+	tokens := `{"token": "aaa"}` + "\n" + `{"token": "bbb"}` + "\n" + `{"token": "ccc"}` + "\n"
+	c, err := Campaigns.Create(RequestGaurunNotification{Platform: PlatFormAndroid, Message: "hello"}, 100, strings.NewReader(tokens), "ndjson")
+	require.Nil(t, err)
+
+	// a token the full queue rejects is retried, not failed.
+	for i := 0; i < 500; i++ {
+		if s := c.Snapshot(); s.Status == CampaignStatusCompleted {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	completed := waitCampaign(t, c.ID, CampaignStatusCompleted)
+	assert.Equal(t, int64(3), completed.Sent)
+	assert.Equal(t, int64(0), completed.Failed)
+	var pushed []string
+	for queue.Len() > 0 {
+		pushed = append(pushed, queue.Pop().Tokens[0])
+	}
+	assert.Equal(t, []string{"aaa", "bbb", "ccc"}, pushed)
+}
@@ -0,0 +1,288 @@
+package gaurun
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nohana/gaurun/gcm"
+	"github.com/nohana/gaurun/internal/upstream"
+)
+
+// chaosFCMErrors is the errors of legacy FCM which can be injected.
+var chaosFCMErrors = map[string]bool{
+	gcm.ErrorMissingRegistration:       true,
+	gcm.ErrorInvalidRegistration:       true,
+	gcm.ErrorNotRegistered:             true,
+	gcm.ErrorInvalidPackageName:        true,
+	gcm.ErrorMismatchSenderID:          true,
+	gcm.ErrorInvalidParameters:         true,
+	gcm.ErrorMessageTooBig:             true,
+	gcm.ErrorInvalidDataKey:            true,
+	gcm.ErrorInvalidTTL:                true,
+	gcm.ErrorUnavailable:               true,
+	gcm.ErrorInternalServerError:       true,
+	gcm.ErrorDeviceMessageRateExceeded: true,
+	gcm.ErrorTopicsMessageRateExceeded: true,
+	gcm.ErrorInvalidApnsCredential:     true,
+}
+
+// ChaosRule injects a fault into pushes to the matching tokens at Percent.
+// A fault delays the push by Latency, and then makes it time out or fail
+// with Reason and Status as APNs or FCM does.
+type ChaosRule struct {
+	// Platform is ios or android. Empty matches both.
+	Platform    string  `json:"platform,omitempty"`
+	TokenPrefix string  `json:"token_prefix,omitempty"`
+	Percent     float64 `json:"percent"`
+	// Latency is in millisecond.
+	Latency int64 `json:"latency,omitempty"`
+	Timeout bool  `json:"timeout,omitempty"`
+	// Reason is an APNs reason, a legacy FCM error or an FCM v1 error code.
+	Reason string `json:"reason,omitempty"`
+	// Status is the HTTP status, the one for Reason if zero.
+	Status int `json:"status,omitempty"`
+}
+
+func (rule *ChaosRule) validate() error {
+	switch rule.Platform {
+	case "", "ios", "android":
+	default:
+		return fmt.Errorf("platform must be ios or android")
+	}
+	if rule.Percent < 0 || rule.Percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100")
+	}
+	if rule.Latency < 0 {
+		return fmt.Errorf("latency must not be negative")
+	}
+	if rule.Status != 0 && (rule.Status < 100 || rule.Status > 599) {
+		return fmt.Errorf("invalid status: %d", rule.Status)
+	}
+	if rule.Reason != "" {
+		_, apns := upstream.APNsReasons[rule.Reason]
+		_, fcmV1 := upstream.FCMV1Errors[rule.Reason]
+		if !apns && !fcmV1 && !chaosFCMErrors[rule.Reason] {
+			return fmt.Errorf("unknown reason: %s", rule.Reason)
+		}
+	}
+	return nil
+}
+
+func (rule *ChaosRule) match(platform int, token string) bool {
+	if rule.Platform != "" && rule.Platform != platformName(platform) {
+		return false
+	}
+	return strings.HasPrefix(token, rule.TokenPrefix)
+}
+
+// ChaosInjector holds the rules injecting faults into the clients for
+// APNs and FCM.
+type ChaosInjector struct {
+	mu    sync.RWMutex
+	rules []ChaosRule
+}
+
+func NewChaosInjector() *ChaosInjector {
+	return &ChaosInjector{}
+}
+
+// InitChaos enables fault injection if configured. It must be called
+// before the clients for APNs and FCM are initialized.
+func InitChaos() {
+	if ConfGaurun.Chaos.Enabled {
+		Chaos = NewChaosInjector()
+		LogError.Warn("fault injection is enabled")
+	}
+}
+
+func (c *ChaosInjector) Rules() []ChaosRule {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]ChaosRule{}, c.rules...)
+}
+
+// SetRules replaces the rules. The first rule firing for a push applies.
+func (c *ChaosInjector) SetRules(rules []ChaosRule) error {
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules = append([]ChaosRule(nil), rules...)
+	return nil
+}
+
+// fire returns the rule firing for a push.
+func (c *ChaosInjector) fire(platform int, token string) (ChaosRule, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, rule := range c.rules {
+		if rule.match(platform, token) && rand.Float64()*100 < rule.Percent {
+			return rule, true
+		}
+	}
+	return ChaosRule{}, false
+}
+
+func (c *ChaosInjector) empty() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.rules) == 0
+}
+
+// chaosTimeoutError is returned for a push made to time out.
+type chaosTimeoutError struct{}
+
+func (chaosTimeoutError) Error() string   { return "injected timeout" }
+func (chaosTimeoutError) Timeout() bool   { return true }
+func (chaosTimeoutError) Temporary() bool { return true }
+
+// chaosTransport injects faults into the requests for api of mock, which
+// are made with the client of platform.
+type chaosTransport struct {
+	base     http.RoundTripper
+	chaos    *ChaosInjector
+	api      string
+	platform int
+	timeout  time.Duration
+}
+
+// wrapChaos returns base injected faults by Chaos, or base itself if
+// fault injection is disabled.
+func wrapChaos(base http.RoundTripper, api string, platform int, timeout int) http.RoundTripper {
+	if Chaos == nil {
+		return base
+	}
+	return &chaosTransport{
+		base:     base,
+		chaos:    Chaos,
+		api:      api,
+		platform: platform,
+		timeout:  time.Duration(timeout) * time.Second,
+	}
+}
+
+// requestToken returns the device token a request is made for, and the
+// request to send instead if its body is read.
+func (t *chaosTransport) requestToken(req *http.Request) (*http.Request, string, error) {
+	if t.api == upstream.APIAPNs {
+		return req, strings.TrimPrefix(req.URL.Path, "/3/device/"), nil
+	}
+	if req.Body == nil {
+		return req, "", nil
+	}
+	b, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	req = req.Clone(req.Context())
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	var body struct {
+		RegistrationIDs []string `json:"registration_ids"`
+		Message         struct {
+			Token string `json:"token"`
+		} `json:"message"`
+	}
+	json.Unmarshal(b, &body)
+	if len(body.RegistrationIDs) > 0 {
+		return req, body.RegistrationIDs[0], nil
+	}
+	return req, body.Message.Token, nil
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.chaos.empty() {
+		return t.base.RoundTrip(req)
+	}
+	req, token, err := t.requestToken(req)
+	if err != nil {
+		return nil, err
+	}
+	rule, ok := t.chaos.fire(t.platform, token)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	LogError.Info(fmt.Sprintf("inject fault: platform=%s token=%s latency=%d timeout=%t reason=%s status=%d",
+		platformName(t.platform), LogRedactor.Redact(RedactFieldToken, token), rule.Latency, rule.Timeout, rule.Reason, rule.Status))
+
+	if !sleepContext(req, time.Duration(rule.Latency)*time.Millisecond) {
+		return nil, req.Context().Err()
+	}
+	if rule.Timeout {
+		if !sleepContext(req, t.timeout) {
+			return nil, req.Context().Err()
+		}
+		return nil, chaosTimeoutError{}
+	}
+	if rule.Reason == "" && rule.Status == 0 {
+		return t.base.RoundTrip(req)
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	res := upstream.NewResponse(t.api, upstream.Error{Reason: rule.Reason, Status: rule.Status})
+	res.Request = req
+	return res, nil
+}
+
+// sleepContext sleeps for d unless the request is canceled before.
+func sleepContext(req *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+// ChaosHandler shows (GET), replaces (PUT) and clears (DELETE) the rules of
+// fault injection.
+func ChaosHandler(w http.ResponseWriter, r *http.Request) {
+	if Chaos == nil {
+		sendResponse(w, "fault injection is disabled", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		sendJSON(w, struct {
+			Rules []ChaosRule `json:"rules"`
+		}{Chaos.Rules()})
+	case "PUT":
+		var body struct {
+			Rules []ChaosRule `json:"rules"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			sendResponse(w, "Request-body is malformed", http.StatusBadRequest)
+			return
+		}
+		if err := Chaos.SetRules(body.Rules); err != nil {
+			sendResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		LogError.Warn(fmt.Sprintf("set %d rules of fault injection", len(body.Rules)))
+		sendResponse(w, "ok", http.StatusOK)
+	case "DELETE":
+		Chaos.SetRules(nil)
+		LogError.Warn("cleared rules of fault injection")
+		sendResponse(w, "ok", http.StatusOK)
+	default:
+		sendResponse(w, "method must be GET, PUT or DELETE", http.StatusBadRequest)
+	}
+}
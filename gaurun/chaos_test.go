@@ -0,0 +1,131 @@
+package gaurun
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nohana/gaurun/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChaosRules(t *testing.T) {
+	c := NewChaosInjector()
+	assert.Nil(t, c.SetRules([]ChaosRule{
+		{Platform: "ios", Percent: 100, Reason: "Unregistered"},
+		{Platform: "android", TokenPrefix: "a", Percent: 50, Reason: "NotRegistered"},
+		{Percent: 10, Reason: "UNAVAILABLE", Latency: 100},
+		{Percent: 10, Timeout: true},
+	}))
+	assert.Len(t, c.Rules(), 4)
+
+	assert.NotNil(t, c.SetRules([]ChaosRule{{Platform: "windows", Percent: 10}}))
+	assert.NotNil(t, c.SetRules([]ChaosRule{{Percent: 101}}))
+	assert.NotNil(t, c.SetRules([]ChaosRule{{Percent: 10, Reason: "Unknown"}}))
+	assert.NotNil(t, c.SetRules([]ChaosRule{{Percent: 10, Status: 1000}}))
+	// invalid rules leave the rules as they are.
+	assert.Len(t, c.Rules(), 4)
+
+	_, fired := c.fire(PlatFormIos, "x")
+	assert.True(t, fired)
+	assert.Nil(t, c.SetRules([]ChaosRule{{Platform: "android", TokenPrefix: "a", Percent: 100}}))
+	_, fired = c.fire(PlatFormIos, "a")
+	assert.False(t, fired)
+	_, fired = c.fire(PlatFormAndroid, "b")
+	assert.False(t, fired)
+	rule, fired := c.fire(PlatFormAndroid, "ab")
+	assert.True(t, fired)
+	assert.Equal(t, "a", rule.TokenPrefix)
+}
+
+func TestChaosInjection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	withConf(t)
+	defer func() {
+		Chaos = nil
+	}()
+	ConfGaurun.Chaos.Enabled = true
+	ConfGaurun.Ios.RetryMax = 0
+	ConfGaurun.Ios.Timeout = 1
+	ConfGaurun.Android.RetryMax = 0
+	InitChaos()
+	require.NotNil(t, Chaos)
+
+	server := mock.NewServer()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	initMockClients(t, dir, ts.URL, server)
+
+	require.Nil(t, Chaos.SetRules([]ChaosRule{
+		{Platform: "ios", TokenPrefix: "aa", Percent: 100, Reason: "Unregistered"},
+		{Platform: "ios", TokenPrefix: "bb", Percent: 100, Timeout: true},
+		{Platform: "android", TokenPrefix: "legacy", Percent: 100, Reason: "NotRegistered"},
+		{Platform: "android", TokenPrefix: "v1", Percent: 100, Reason: "UNREGISTERED"},
+	}))
+
+	push := func(platform int, token string) error {
+		return PushNotification(RequestGaurunNotification{
+			ID: "01", Tokens: []string{token}, Platform: platform, Message: "hello", Body: "hello",
+		})
+	}
+	category := func(err error) ErrorCategory {
+		require.IsType(t, &DeliveryError{}, err)
+		return err.(*DeliveryError).Category
+	}
+
+	assert.Equal(t, ErrorCategoryTokenInvalid, category(push(PlatFormIos, strings.Repeat("aa", 32))))
+	assert.Equal(t, ErrorCategoryRetryable, category(push(PlatFormIos, strings.Repeat("bb", 32))))
+	assert.Nil(t, push(PlatFormIos, strings.Repeat("cc", 32)))
+
+	assert.Equal(t, ErrorCategoryTokenInvalid, category(push(PlatFormAndroid, "legacy")))
+	assert.Nil(t, push(PlatFormAndroid, "other"))
+
+	ConfGaurun.Android.UseV1 = true
+	assert.Equal(t, ErrorCategoryTokenInvalid, category(push(PlatFormAndroid, "v1")))
+	assert.Nil(t, push(PlatFormAndroid, "other"))
+
+	// faults are injected without reaching APNs and FCM.
+	var tokens []string
+	for _, req := range server.Requests() {
+		tokens = append(tokens, req.Token)
+	}
+	assert.Equal(t, []string{strings.Repeat("cc", 32), "other", "other"}, tokens)
+}
+
+func TestChaosHandler(t *testing.T) {
+	defer func() {
+		Chaos = nil
+	}()
+
+	Chaos = nil
+	w := httptest.NewRecorder()
+	ChaosHandler(w, httptest.NewRequest("GET", "/chaos", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	Chaos = NewChaosInjector()
+	w = httptest.NewRecorder()
+	ChaosHandler(w, httptest.NewRequest("PUT", "/chaos", strings.NewReader(`{"rules":[{"platform":"ios","percent":20,"reason":"TooManyRequests"}]}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []ChaosRule{{Platform: "ios", Percent: 20, Reason: "TooManyRequests"}}, Chaos.Rules())
+
+	w = httptest.NewRecorder()
+	ChaosHandler(w, httptest.NewRequest("PUT", "/chaos", strings.NewReader(`{"rules":[{"percent":200}]}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	ChaosHandler(w, httptest.NewRequest("GET", "/chaos", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"TooManyRequests"`)
+
+	w = httptest.NewRecorder()
+	ChaosHandler(w, httptest.NewRequest("DELETE", "/chaos", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, Chaos.Rules(), 0)
+}
@@ -7,16 +7,21 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"google.golang.org/api/option"
+	gtransport "google.golang.org/api/transport"
+	htransport "google.golang.org/api/transport/http"
 
 	firebase "firebase.google.com/go"
 	"firebase.google.com/go/messaging"
 
 	"github.com/nohana/gaurun/buford/token"
 	"github.com/nohana/gaurun/gcm"
+	"github.com/nohana/gaurun/internal/upstream"
 )
 
 type SafeMessagingClient struct {
@@ -49,7 +54,11 @@ func keepAliveInterval(keepAliveTimeout int) int {
 // InitGCMClient initializes GCMClient which is globally declared.
 func InitGCMClient() error {
 	var err error
-	GCMClient, err = gcm.NewClient(gcm.FCMSendEndpoint, ConfGaurun.Android.ApiKey)
+	endpoint := gcm.FCMSendEndpoint
+	if ConfGaurun.Android.Endpoint != "" {
+		endpoint = ConfGaurun.Android.Endpoint
+	}
+	GCMClient, err = gcm.NewClient(endpoint, ConfGaurun.Android.ApiKey)
 	if err != nil {
 		return err
 	}
@@ -64,7 +73,7 @@ func InitGCMClient() error {
 	}
 
 	GCMClient.Http = &http.Client{
-		Transport: transport,
+		Transport: wrapChaos(transport, upstream.APIFCM, PlatFormAndroid, ConfGaurun.Android.Timeout),
 		Timeout:   time.Duration(ConfGaurun.Android.Timeout) * time.Second,
 	}
 
@@ -94,11 +103,24 @@ func InitFirebaseAppForFcmV1() error {
 	var err error
 
 	ctx := context.Background()
+	if ConfGaurun.Android.V1Endpoint != "" || Chaos != nil {
+		client, err := newFcmV1Client(ctx, ConfGaurun.Android.V1Endpoint, opts[0])
+		if err != nil {
+			return err
+		}
+		opts = append(opts, option.WithHTTPClient(client))
+	}
 	FirebaseApp, err = firebase.NewApp(ctx, nil, opts...)
 	if err != nil {
 		return err
 	}
 
+	creds, err := gtransport.Creds(ctx, opts[0], option.WithScopes(fcmV1Scope))
+	if err != nil {
+		return err
+	}
+	fcmV1TokenSource = creds.TokenSource
+
 	msgClient, err := FirebaseApp.Messaging(ctx)
 	if err != nil {
 		return err
@@ -116,6 +138,51 @@ func InitFirebaseAppForFcmV1() error {
 	return nil
 }
 
+// endpointTransport sends requests to endpoint instead of the host they
+// are made for.
+type endpointTransport struct {
+	base     http.RoundTripper
+	endpoint *url.URL
+}
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	r.URL.Scheme = t.endpoint.Scheme
+	r.URL.Host = t.endpoint.Host
+	r.URL.Path = strings.TrimSuffix(t.endpoint.Path, "/") + r.URL.Path
+	r.Host = ""
+	return t.base.RoundTrip(r)
+}
+
+// newFcmV1Client returns a client authorized with saOpt which sends the
+// requests of FCM v1 to endpoint if given, injecting faults by Chaos. The
+// firebase SDK has no option for the endpoint.
+func newFcmV1Client(ctx context.Context, endpoint string, saOpt option.ClientOption) (*http.Client, error) {
+	var base http.RoundTripper = http.DefaultTransport
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint for FCM v1: %s", endpoint)
+		}
+		base = &endpointTransport{base: base, endpoint: u}
+	}
+	transport, err := htransport.NewTransport(ctx,
+		wrapChaos(base, upstream.APIFCMV1, PlatFormAndroid, ConfGaurun.Android.Timeout),
+		saOpt,
+		option.WithScopes(fcmV1Scope),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(ConfGaurun.Android.Timeout) * time.Second,
+	}, nil
+}
+
 func InitSaOption() option.ClientOption {
 	var saOpt option.ClientOption
 	if len(ConfGaurun.Android.CredentialsJSONBase64) > 0 {
@@ -1,9 +1,23 @@
 package gaurun
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/nohana/gaurun/mock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestKeepAliveInterval(t *testing.T) {
@@ -14,3 +28,93 @@ func TestKeepAliveInterval(t *testing.T) {
 	assert.Equal(t, 90, keepAliveInterval(300))
 	assert.Equal(t, 90, keepAliveInterval(600))
 }
+
+// initMockClients points the clients for APNs, legacy FCM and FCM v1 to
+// server running at url.
+func initMockClients(t *testing.T, dir, url string, server *mock.Server) {
+	// APNs with a token-based provider
+	authKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(authKey)
+	require.Nil(t, err)
+	ConfGaurun.Ios.TokenAuthKeyPath = filepath.Join(dir, "key.p8")
+	require.Nil(t, ioutil.WriteFile(ConfGaurun.Ios.TokenAuthKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	ConfGaurun.Ios.TokenAuthKeyID = "KEY"
+	ConfGaurun.Ios.TokenAuthTeamID = "TEAM"
+	ConfGaurun.Ios.Topic = "com.example.app"
+	ConfGaurun.Ios.Endpoint = url
+	server.APNsKeys = map[string]*ecdsa.PublicKey{"KEY": &authKey.PublicKey}
+	require.Nil(t, InitAPNSClient())
+
+	// legacy FCM
+	ConfGaurun.Android.ApiKey = "key"
+	ConfGaurun.Android.Endpoint = url + "/fcm/send"
+	require.Nil(t, InitGCMClient())
+
+	// FCM v1 with a service account issued tokens by the mock
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	der, err = x509.MarshalPKCS8PrivateKey(rsaKey)
+	require.Nil(t, err)
+	credentials, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "project",
+		"private_key_id": "id",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "gaurun@project.iam.gserviceaccount.com",
+		"token_uri":      url + "/token",
+	})
+	require.Nil(t, err)
+	ConfGaurun.Android.CredentialsFile = filepath.Join(dir, "credentials.json")
+	require.Nil(t, ioutil.WriteFile(ConfGaurun.Android.CredentialsFile, credentials, 0600))
+	ConfGaurun.Android.V1Endpoint = url
+	require.Nil(t, InitFirebaseAppForFcmV1())
+}
+
+func TestPushThroughMock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	withConf(t)
+
+	server := mock.NewServer()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	initMockClients(t, dir, ts.URL, server)
+	ConfGaurun.Android.UseV1 = true
+
+	iosToken := strings.Repeat("ab", 32)
+	require.Nil(t, PushNotification(RequestGaurunNotification{
+		ID: "01", Tokens: []string{iosToken}, Platform: PlatFormIos, Message: "hello",
+	}))
+	require.Nil(t, PushNotification(RequestGaurunNotification{
+		ID: "02", Tokens: []string{"android"}, Platform: PlatFormAndroid, Title: "title", Body: "hello",
+	}))
+
+	requests := server.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, mock.APIAPNs, requests[0].API)
+	assert.Equal(t, iosToken, requests[0].Token)
+	assert.Equal(t, "com.example.app", requests[0].Header.Get("apns-topic"))
+	assert.Contains(t, string(requests[0].Body), `"hello"`)
+	assert.Equal(t, mock.APIFCMV1, requests[1].API)
+	assert.Equal(t, "android", requests[1].Token)
+	assert.Equal(t, "Bearer "+mock.AccessToken, requests[1].Header.Get("Authorization"))
+	assert.Contains(t, string(requests[1].Body), `"hello"`)
+
+	// errors of the mock are classified as those of Apple and Google.
+	server.SetResponses(iosToken, mock.Response{Reason: "Unregistered"})
+	err = PushNotification(RequestGaurunNotification{
+		ID: "03", Tokens: []string{iosToken}, Platform: PlatFormIos, Message: "hello",
+	})
+	require.IsType(t, &DeliveryError{}, err)
+	assert.Equal(t, ErrorCategoryTokenInvalid, err.(*DeliveryError).Category)
+
+	server.SetResponses("android", mock.Response{Reason: "UNREGISTERED"})
+	err = PushNotification(RequestGaurunNotification{
+		ID: "04", Tokens: []string{"android"}, Platform: PlatFormAndroid, Body: "hello",
+	})
+	require.IsType(t, &DeliveryError{}, err)
+	assert.Equal(t, ErrorCategoryTokenInvalid, err.(*DeliveryError).Category)
+}
@@ -12,10 +12,25 @@ import (
 )
 
 type ConfToml struct {
-	Core    SectionCore    `toml:"core"`
-	Android SectionAndroid `toml:"android"`
-	Ios     SectionIos     `toml:"ios"`
-	Log     SectionLog     `toml:"log"`
+	Core        SectionCore        `toml:"core"`
+	Android     SectionAndroid     `toml:"android"`
+	Ios         SectionIos         `toml:"ios"`
+	Log         SectionLog         `toml:"log"`
+	TokenStore  SectionTokenStore  `toml:"token_store"`
+	Idempotency SectionIdempotency `toml:"idempotency"`
+	Template    SectionTemplate    `toml:"template"`
+	Campaign    SectionCampaign    `toml:"campaign"`
+	Priority    SectionPriority    `toml:"priority"`
+	DeadLetter  SectionDeadLetter  `toml:"dead_letter"`
+	Queue       SectionQueue       `toml:"queue"`
+	Ingest      SectionIngest      `toml:"ingest"`
+	Event       SectionEvent       `toml:"event"`
+	Chaos       SectionChaos       `toml:"chaos"`
+	Tracing     SectionTracing     `toml:"tracing"`
+	Metrics     SectionMetrics     `toml:"metrics"`
+	Stat        SectionStat        `toml:"stat"`
+	Health      SectionHealth      `toml:"health"`
+	Redaction   SectionRedaction   `toml:"redaction"`
 }
 
 type SectionCore struct {
@@ -27,6 +42,8 @@ type SectionCore struct {
 	ShutdownTimeout    int64  `toml:"shutdown_timeout"`
 	Pid                string `toml:"pid"`
 	AllowsEmptyMessage bool   `toml:"allows_empty_message"`
+	RecoveryFile       string `toml:"recovery_file"`
+	InstanceID         string `toml:"instance_id"`
 }
 
 type SectionAndroid struct {
@@ -40,6 +57,9 @@ type SectionAndroid struct {
 	Project               string `toml:"project"`
 	CredentialsFile       string `toml:"credentials_file"`
 	CredentialsJSONBase64 string `toml:"credentials_json"`
+	// endpoints replacing the ones of Google, e.g. for gaurun_mock
+	Endpoint   string `toml:"endpoint"`
+	V1Endpoint string `toml:"v1_endpoint"`
 }
 
 type SectionIos struct {
@@ -56,12 +76,126 @@ type SectionIos struct {
 	KeepAliveTimeout int    `toml:"keepalive_timeout"`
 	KeepAliveConns   int    `toml:"keepalive_conns"`
 	Topic            string `toml:"topic"`
+	// endpoint replacing the one of Apple, e.g. for gaurun_mock
+	Endpoint string `toml:"endpoint"`
 }
 
 type SectionLog struct {
 	AccessLog string `toml:"access_log"`
 	ErrorLog  string `toml:"error_log"`
 	Level     string `toml:"level"`
+	// copy of notifications in accepted-push logs
+	NotificationCopy    bool     `toml:"notification_copy"`
+	NotificationKeyFile string   `toml:"notification_key_file"`
+	NotificationRedact  []string `toml:"notification_redact"`
+	// identification of callers in access logs
+	TrustedProxies []string `toml:"trusted_proxies"`
+	APIKeyHeader   string   `toml:"api_key_header"`
+}
+
+type SectionTokenStore struct {
+	Path string `toml:"path"`
+	TTL  int64  `toml:"ttl"`
+}
+
+type SectionIdempotency struct {
+	TTL           int64 `toml:"ttl"`
+	MaxKeys       int   `toml:"max_keys"`
+	UseIdentifier bool  `toml:"use_identifier"`
+}
+
+type SectionTemplate struct {
+	Dir string `toml:"dir"`
+}
+
+type SectionCampaign struct {
+	Dir                string `toml:"dir"`
+	Rate               int    `toml:"rate"`
+	CheckpointInterval int64  `toml:"checkpoint_interval"`
+}
+
+type SectionPriority struct {
+	HighWeight   int   `toml:"high_weight"`
+	NormalWeight int   `toml:"normal_weight"`
+	LowWeight    int   `toml:"low_weight"`
+	Aging        int64 `toml:"aging"`
+}
+
+type SectionDeadLetter struct {
+	Path       string `toml:"path"`
+	MaxEntries int    `toml:"max_entries"`
+	MaxAge     int64  `toml:"max_age"`
+}
+
+type SectionQueue struct {
+	Backend  string `toml:"backend"`
+	URL      string `toml:"url"`
+	Stream   string `toml:"stream"`
+	Group    string `toml:"group"`
+	Consumer string `toml:"consumer"`
+	AckWait  int64  `toml:"ack_wait"`
+}
+
+type SectionIngest struct {
+	KafkaBrokers []string `toml:"kafka_brokers"`
+	KafkaTopic   string   `toml:"kafka_topic"`
+	KafkaGroup   string   `toml:"kafka_group"`
+	AmqpURL      string   `toml:"amqp_url"`
+	AmqpQueue    string   `toml:"amqp_queue"`
+	NatsURL      string   `toml:"nats_url"`
+	NatsSubject  string   `toml:"nats_subject"`
+	NatsQueue    string   `toml:"nats_queue"`
+}
+
+type SectionChaos struct {
+	Enabled bool `toml:"enabled"`
+}
+
+type SectionTracing struct {
+	Endpoint    string  `toml:"endpoint"`
+	ServiceName string  `toml:"service_name"`
+	SampleRatio float64 `toml:"sample_ratio"`
+}
+
+type SectionMetrics struct {
+	Sink          string   `toml:"sink"`
+	Address       string   `toml:"address"`
+	Prefix        string   `toml:"prefix"`
+	FlushInterval int64    `toml:"flush_interval"`
+	App           string   `toml:"app"`
+	Tags          []string `toml:"tags"`
+}
+
+type SectionStat struct {
+	Path          string `toml:"path"`
+	SaveInterval  int64  `toml:"save_interval"`
+	IdentifierMax int    `toml:"identifier_max"`
+}
+
+type SectionHealth struct {
+	QueueThreshold  int   `toml:"queue_threshold"`
+	CircuitFailures int   `toml:"circuit_failures"`
+	CircuitCooldown int64 `toml:"circuit_cooldown"`
+}
+
+type SectionRedaction struct {
+	Fields         map[string]string `toml:"fields"`
+	KeyFile        string            `toml:"key_file"`
+	TruncateLength int               `toml:"truncate_length"`
+}
+
+type SectionEvent struct {
+	Sink          string   `toml:"sink"`
+	Path          string   `toml:"path"`
+	MaxSize       int64    `toml:"max_size"`
+	Brokers       []string `toml:"brokers"`
+	Topic         string   `toml:"topic"`
+	URL           string   `toml:"url"`
+	Timeout       int      `toml:"timeout"`
+	BufferSize    int      `toml:"buffer_size"`
+	BatchSize     int      `toml:"batch_size"`
+	FlushInterval int64    `toml:"flush_interval"`
+	Overflow      string   `toml:"overflow"`
 }
 
 func BuildDefaultConf() ConfToml {
@@ -77,6 +211,8 @@ func BuildDefaultConf() ConfToml {
 	conf.Core.ShutdownTimeout = 10
 	conf.Core.Pid = ""
 	conf.Core.AllowsEmptyMessage = false
+	conf.Core.RecoveryFile = ""
+	conf.Core.InstanceID = ""
 	// Android
 	conf.Android.ApiKey = ""
 	conf.Android.Enabled = true
@@ -87,6 +223,8 @@ func BuildDefaultConf() ConfToml {
 	conf.Android.UseV1 = false
 	conf.Android.Project = ""
 	conf.Android.CredentialsFile = ""
+	conf.Android.Endpoint = ""
+	conf.Android.V1Endpoint = ""
 	// iOS
 	conf.Ios.Enabled = true
 	conf.Ios.PemCertPath = ""
@@ -100,10 +238,91 @@ func BuildDefaultConf() ConfToml {
 	conf.Ios.KeepAliveTimeout = 90
 	conf.Ios.KeepAliveConns = numCPU
 	conf.Ios.Topic = ""
+	conf.Ios.Endpoint = ""
 	// log
 	conf.Log.AccessLog = "stdout"
 	conf.Log.ErrorLog = "stderr"
 	conf.Log.Level = "error"
+	conf.Log.NotificationCopy = false
+	conf.Log.NotificationKeyFile = ""
+	conf.Log.NotificationRedact = []string{}
+	conf.Log.TrustedProxies = []string{}
+	conf.Log.APIKeyHeader = "X-API-Key"
+	// token store
+	conf.TokenStore.Path = ""
+	conf.TokenStore.TTL = 2592000
+	// idempotency
+	conf.Idempotency.TTL = 0
+	conf.Idempotency.MaxKeys = 100000
+	conf.Idempotency.UseIdentifier = false
+	// template
+	conf.Template.Dir = ""
+	// campaign
+	conf.Campaign.Dir = ""
+	conf.Campaign.Rate = 100
+	conf.Campaign.CheckpointInterval = 10
+	// priority
+	conf.Priority.HighWeight = 6
+	conf.Priority.NormalWeight = 3
+	conf.Priority.LowWeight = 1
+	conf.Priority.Aging = 30
+	// dead letter
+	conf.DeadLetter.Path = ""
+	conf.DeadLetter.MaxEntries = 100000
+	conf.DeadLetter.MaxAge = 604800
+	// queue
+	conf.Queue.Backend = QueueBackendMemory
+	conf.Queue.URL = ""
+	conf.Queue.Stream = "gaurun"
+	conf.Queue.Group = "gaurun"
+	conf.Queue.Consumer = ""
+	conf.Queue.AckWait = 60
+	// ingest
+	conf.Ingest.KafkaBrokers = []string{}
+	conf.Ingest.KafkaTopic = ""
+	conf.Ingest.KafkaGroup = "gaurun"
+	conf.Ingest.AmqpURL = ""
+	conf.Ingest.AmqpQueue = ""
+	conf.Ingest.NatsURL = ""
+	conf.Ingest.NatsSubject = ""
+	conf.Ingest.NatsQueue = "gaurun"
+	// event
+	conf.Event.Sink = ""
+	conf.Event.Path = ""
+	conf.Event.MaxSize = 100
+	conf.Event.Brokers = []string{}
+	conf.Event.Topic = ""
+	conf.Event.URL = ""
+	conf.Event.Timeout = 10
+	conf.Event.BufferSize = 10000
+	conf.Event.BatchSize = 100
+	conf.Event.FlushInterval = 1
+	conf.Event.Overflow = EventOverflowDrop
+	// chaos
+	conf.Chaos.Enabled = false
+	// tracing
+	conf.Tracing.Endpoint = ""
+	conf.Tracing.ServiceName = "gaurun"
+	conf.Tracing.SampleRatio = 1.0
+	// metrics
+	conf.Metrics.Sink = ""
+	conf.Metrics.Address = "127.0.0.1:8125"
+	conf.Metrics.Prefix = "gaurun"
+	conf.Metrics.FlushInterval = 10
+	conf.Metrics.App = ""
+	conf.Metrics.Tags = []string{}
+	// stat
+	conf.Stat.Path = ""
+	conf.Stat.SaveInterval = 60
+	conf.Stat.IdentifierMax = 10000
+	// health
+	conf.Health.QueueThreshold = 90
+	conf.Health.CircuitFailures = 5
+	conf.Health.CircuitCooldown = 30
+	// redaction
+	conf.Redaction.Fields = map[string]string{}
+	conf.Redaction.KeyFile = ""
+	conf.Redaction.TruncateLength = 8
 	return conf
 }
 
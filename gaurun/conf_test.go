@@ -1,10 +1,13 @@
 package gaurun
 
 import (
+	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -12,6 +15,99 @@ const (
 	ConfGaurunPath = "../conf/gaurun.toml"
 )
 
+// withConf sets ConfGaurun to the default configuration for the test, and
+// restores it when the test ends.
+func withConf(t *testing.T) {
+	t.Helper()
+	confBefore := ConfGaurun
+	t.Cleanup(func() { ConfGaurun = confBefore })
+	ConfGaurun = BuildDefaultConf()
+}
+
+// withPushConf is withConf with pushes to both platforms enabled.
+func withPushConf(t *testing.T) {
+	t.Helper()
+	withConf(t)
+	ConfGaurun.Ios.Enabled = true
+	ConfGaurun.Android.Enabled = true
+}
+
+// withQueue sets QueueNotification to queue for the test.
+func withQueue(t *testing.T, queue Queue) {
+	t.Helper()
+	queueBefore := QueueNotification
+	t.Cleanup(func() { QueueNotification = queueBefore })
+	QueueNotification = queue
+}
+
+// withTokenStore opens InvalidTokens in a temporary directory for the test.
+func withTokenStore(t *testing.T) {
+	t.Helper()
+	store, err := OpenTokenStore(filepath.Join(t.TempDir(), "tokens.db"), time.Hour)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		store.Close()
+		InvalidTokens = nil
+	})
+	InvalidTokens = store
+}
+
+// withDeadLetterStore opens DeadLetters in a temporary directory for the
+// test.
+func withDeadLetterStore(t *testing.T) {
+	t.Helper()
+	store, err := OpenDeadLetterStore(filepath.Join(t.TempDir(), "deadletters.db"), 0, 0)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		store.Close()
+		DeadLetters = nil
+	})
+	DeadLetters = store
+}
+
+// withCampaigns sets up Campaigns in a temporary directory, enqueueing to a
+// memory queue, for the test.
+func withCampaigns(t *testing.T) {
+	t.Helper()
+	withPushConf(t)
+	withQueue(t, NewNotificationQueue(100, nil, 0))
+	manager, err := NewCampaignManager(t.TempDir())
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		manager.Stop()
+		Campaigns = nil
+	})
+	Campaigns = manager
+}
+
+// withRecoveryFile sets recovery_file to a temporary file for the test and
+// returns its path.
+func withRecoveryFile(t *testing.T) string {
+	t.Helper()
+	withPushConf(t)
+	path := filepath.Join(t.TempDir(), "recovery.ndjson")
+	ConfGaurun.Core.RecoveryFile = path
+	return path
+}
+
+// withHealth resets the health of the upstreams with a memory queue for
+// the test.
+func withHealth(t *testing.T) {
+	t.Helper()
+	withPushConf(t)
+	withQueue(t, NewNotificationQueue(10, nil, 0))
+	apnsBefore := APNSClient
+	t.Cleanup(func() {
+		APNSClient = apnsBefore
+		fcmV1TokenSource = nil
+		apnsHealth.reset()
+		fcmHealth.reset()
+	})
+	APNSClient = APNsClient{}
+	apnsHealth.reset()
+	fcmHealth.reset()
+}
+
 type ConfigTestSuite struct {
 	suite.Suite
 	ConfGaurunDefault ConfToml
@@ -37,6 +133,8 @@ func (suite *ConfigTestSuite) TestValidateConfDefault() {
 	assert.Equal(suite.T(), suite.ConfGaurunDefault.Core.PusherMax, int64(0))
 	assert.Equal(suite.T(), suite.ConfGaurunDefault.Core.Pid, "")
 	assert.Equal(suite.T(), suite.ConfGaurunDefault.Core.AllowsEmptyMessage, false)
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Core.RecoveryFile, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Core.InstanceID, "")
 	// Android
 	assert.Equal(suite.T(), suite.ConfGaurunDefault.Android.Enabled, true)
 	assert.Equal(suite.T(), suite.ConfGaurunDefault.Android.ApiKey, "")
@@ -48,6 +146,8 @@ func (suite *ConfigTestSuite) TestValidateConfDefault() {
 	assert.Equal(suite.T(), suite.ConfGaurunDefault.Android.UseV1, false)
 	assert.Equal(suite.T(), suite.ConfGaurunDefault.Android.Project, "")
 	assert.Equal(suite.T(), suite.ConfGaurunDefault.Android.CredentialsFile, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Android.Endpoint, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Android.V1Endpoint, "")
 	// Ios
 	assert.Equal(suite.T(), suite.ConfGaurunDefault.Ios.Enabled, true)
 	assert.Equal(suite.T(), suite.ConfGaurunDefault.Ios.PemCertPath, "")
@@ -58,10 +158,85 @@ func (suite *ConfigTestSuite) TestValidateConfDefault() {
 	assert.Equal(suite.T(), suite.ConfGaurunDefault.Ios.KeepAliveTimeout, 90)
 	assert.Equal(suite.T(), int64(suite.ConfGaurunDefault.Ios.KeepAliveConns), suite.ConfGaurunDefault.Core.WorkerNum)
 	assert.Equal(suite.T(), suite.ConfGaurunDefault.Ios.Topic, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Ios.Endpoint, "")
 	// Log
 	assert.Equal(suite.T(), suite.ConfGaurunDefault.Log.AccessLog, "stdout")
 	assert.Equal(suite.T(), suite.ConfGaurunDefault.Log.ErrorLog, "stderr")
 	assert.Equal(suite.T(), suite.ConfGaurunDefault.Log.Level, "error")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Log.NotificationCopy, false)
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Log.NotificationKeyFile, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Log.NotificationRedact, []string{})
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Log.TrustedProxies, []string{})
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Log.APIKeyHeader, "X-API-Key")
+	// TokenStore
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.TokenStore.Path, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.TokenStore.TTL, int64(2592000))
+	// Idempotency
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Idempotency.TTL, int64(0))
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Idempotency.MaxKeys, 100000)
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Idempotency.UseIdentifier, false)
+	// Template
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Template.Dir, "")
+	// Campaign
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Campaign.Dir, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Campaign.Rate, 100)
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Campaign.CheckpointInterval, int64(10))
+	// Priority
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Priority.HighWeight, 6)
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Priority.NormalWeight, 3)
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Priority.LowWeight, 1)
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Priority.Aging, int64(30))
+	// DeadLetter
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.DeadLetter.Path, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.DeadLetter.MaxEntries, 100000)
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.DeadLetter.MaxAge, int64(604800))
+	// Queue
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Queue.Backend, "memory")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Queue.URL, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Queue.Stream, "gaurun")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Queue.Group, "gaurun")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Queue.Consumer, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Queue.AckWait, int64(60))
+	// Ingest
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Ingest.KafkaBrokers, []string{})
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Ingest.KafkaTopic, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Ingest.KafkaGroup, "gaurun")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Ingest.AmqpURL, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Ingest.AmqpQueue, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Ingest.NatsURL, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Ingest.NatsSubject, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Ingest.NatsQueue, "gaurun")
+	// Event
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Event.Sink, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Event.Path, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Event.MaxSize, int64(100))
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Event.Brokers, []string{})
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Event.Topic, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Event.URL, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Event.Timeout, 10)
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Event.BufferSize, 10000)
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Event.BatchSize, 100)
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Event.FlushInterval, int64(1))
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Event.Overflow, "drop")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Chaos.Enabled, false)
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Tracing.Endpoint, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Tracing.ServiceName, "gaurun")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Tracing.SampleRatio, 1.0)
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Metrics.Sink, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Metrics.Address, "127.0.0.1:8125")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Metrics.Prefix, "gaurun")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Metrics.FlushInterval, int64(10))
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Metrics.App, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Metrics.Tags, []string{})
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Stat.Path, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Stat.SaveInterval, int64(60))
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Stat.IdentifierMax, 10000)
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Health.QueueThreshold, 90)
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Health.CircuitFailures, 5)
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Health.CircuitCooldown, int64(30))
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Redaction.Fields, map[string]string{})
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Redaction.KeyFile, "")
+	assert.Equal(suite.T(), suite.ConfGaurunDefault.Redaction.TruncateLength, 8)
 }
 
 func (suite *ConfigTestSuite) TestValidateConf() {
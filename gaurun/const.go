@@ -14,9 +14,28 @@ const (
 	StatusSucceededPush = "succeeded-push"
 	StatusFailedPush    = "failed-push"
 	StatusDisabledPush  = "disabled-push"
+	// StatusSuppressedPush is logged instead of accepted-push for a token
+	// recorded as invalid in the token store.
+	StatusSuppressedPush = "suppressed-push"
+	// StatusExpiredPush is logged for a notification discarded as its
+	// lifetime passed while waiting in the queue.
+	StatusExpiredPush = "expired-push"
+	// StatusRetriedPush is logged when a failed push is retried.
+	StatusRetriedPush = "retried-push"
+)
+
+const (
+	// RequestIDHeader is the header with which a caller gives its own ID
+	// of a request, echoed in the response and in the logs.
+	RequestIDHeader = "X-Request-ID"
+	// RequestIDMax is the maximum length of a request ID.
+	RequestIDMax = 128
 )
 
 const (
 	ApnsPushTypeAlert      = "alert"
 	ApnsPushTypeBackground = "background"
 )
+
+// fcmV1Scope is the OAuth2 scope to send messages with FCM v1.
+const fcmV1Scope = "https://www.googleapis.com/auth/firebase.messaging"
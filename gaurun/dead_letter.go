@@ -0,0 +1,387 @@
+package gaurun
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var deadLetterBucket = []byte("dead_letters")
+
+// DeadLetter is a notification which could not be pushed even after
+// retries, or for gaurun's credentials or configuration. It may succeed
+// when replayed after the upstream recovers or the configuration is fixed.
+type DeadLetter struct {
+	ID           uint64                    `json:"id"`
+	Platform     string                    `json:"platform"`
+	Token        string                    `json:"token"`
+	Category     ErrorCategory             `json:"category,omitempty"`
+	Reason       string                    `json:"reason,omitempty"`
+	StatusCode   int                       `json:"status_code,omitempty"`
+	Error        string                    `json:"error"`
+	Retry        int                       `json:"retry"`
+	FailedAt     time.Time                 `json:"failed_at"`
+	Notification RequestGaurunNotification `json:"notification"`
+}
+
+// DeadLetterFilter selects dead letters. Empty fields match any.
+type DeadLetterFilter struct {
+	IDs        map[uint64]bool
+	Platform   string
+	Category   string
+	Reason     string
+	Identifier string
+	// After selects dead letters with ID greater than it.
+	After uint64
+}
+
+func (f *DeadLetterFilter) match(dl *DeadLetter) bool {
+	if len(f.IDs) > 0 && !f.IDs[dl.ID] {
+		return false
+	}
+	if f.Platform != "" && dl.Platform != f.Platform {
+		return false
+	}
+	if f.Category != "" && string(dl.Category) != f.Category {
+		return false
+	}
+	if f.Reason != "" && dl.Reason != f.Reason {
+		return false
+	}
+	if f.Identifier != "" && dl.Notification.Identifier != f.Identifier {
+		return false
+	}
+	return dl.ID > f.After
+}
+
+// DeadLetterStore is an on-disk store of dead letters. The oldest dead
+// letters are removed over maxEntries or after maxAge.
+type DeadLetterStore struct {
+	db         *bolt.DB
+	maxEntries int
+	maxAge     time.Duration
+
+	// count is the number of stored dead letters, guarded by the write
+	// transactions of db.
+	count int
+}
+
+// OpenDeadLetterStore opens the dead-letter store at path, creating it if
+// necessary. maxEntries and maxAge less than or equal to zero mean no
+// limit.
+func OpenDeadLetterStore(path string, maxEntries int, maxAge time.Duration) (*DeadLetterStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &DeadLetterStore{db: db, maxEntries: maxEntries, maxAge: maxAge}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(deadLetterBucket)
+		if err != nil {
+			return err
+		}
+		s.count = b.Stats().KeyN
+		return s.prune(b, time.Now())
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *DeadLetterStore) Close() error {
+	return s.db.Close()
+}
+
+func deadLetterKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+// Add stores dl numbered with a new ID, which is set to dl.
+func (s *DeadLetterStore) Add(dl *DeadLetter) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deadLetterBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		dl.ID = id
+		v, err := json.Marshal(dl)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(deadLetterKey(id), v); err != nil {
+			return err
+		}
+		s.count++
+		return s.prune(b, time.Now())
+	})
+}
+
+// prune removes the oldest dead letters over maxEntries or older than
+// maxAge. Dead letters are in order of failure by their IDs.
+func (s *DeadLetterStore) prune(b *bolt.Bucket, now time.Time) error {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.First() {
+		if s.maxEntries <= 0 || s.count <= s.maxEntries {
+			if s.maxAge <= 0 {
+				return nil
+			}
+			var dl DeadLetter
+			if err := json.Unmarshal(v, &dl); err != nil {
+				return err
+			}
+			if now.Sub(dl.FailedAt) < s.maxAge {
+				return nil
+			}
+		}
+		if err := c.Delete(); err != nil {
+			return err
+		}
+		s.count--
+	}
+	return nil
+}
+
+// Find returns at most limit dead letters matching filter in order of ID.
+// limit less than or equal to zero means no limit.
+func (s *DeadLetterStore) Find(filter DeadLetterFilter, limit int) ([]DeadLetter, error) {
+	found := []DeadLetter{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(deadLetterBucket).Cursor()
+		for k, v := c.Seek(deadLetterKey(filter.After + 1)); k != nil; k, v = c.Next() {
+			var dl DeadLetter
+			if err := json.Unmarshal(v, &dl); err != nil {
+				return err
+			}
+			if !filter.match(&dl) {
+				continue
+			}
+			found = append(found, dl)
+			if limit > 0 && len(found) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Delete removes the dead letters with ids.
+func (s *DeadLetterStore) Delete(ids []uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deadLetterBucket)
+		for _, id := range ids {
+			if b.Get(deadLetterKey(id)) == nil {
+				continue
+			}
+			if err := b.Delete(deadLetterKey(id)); err != nil {
+				return err
+			}
+			s.count--
+		}
+		return nil
+	})
+}
+
+// InitDeadLetterStore opens DeadLetters if a path is configured.
+func InitDeadLetterStore() error {
+	if ConfGaurun.DeadLetter.Path == "" {
+		return nil
+	}
+	var err error
+	DeadLetters, err = OpenDeadLetterStore(
+		ConfGaurun.DeadLetter.Path,
+		ConfGaurun.DeadLetter.MaxEntries,
+		time.Duration(ConfGaurun.DeadLetter.MaxAge)*time.Second,
+	)
+	return err
+}
+
+// storeDeadLetter stores req which failed with err for the last time, if
+// it may succeed when replayed: a retryable error whose retries ran out or
+// an error of gaurun's credentials or configuration. Notifications to
+// invalid tokens and rejected payloads are not stored. It returns the
+// error of the store, if any.
+func storeDeadLetter(req RequestGaurunNotification, err error) error {
+	if DeadLetters == nil {
+		return nil
+	}
+	de := asDeliveryError(err)
+	if de == nil || (de.Category != ErrorCategoryRetryable && de.Category != ErrorCategoryAuth) {
+		return nil
+	}
+	dl := &DeadLetter{
+		Platform:     platformName(req.Platform),
+		Token:        req.Tokens[0],
+		Error:        err.Error(),
+		Retry:        req.Retry,
+		FailedAt:     time.Now().UTC(),
+		Notification: req,
+	}
+	dl.Category = de.Category
+	dl.Reason = de.Reason
+	dl.StatusCode = de.StatusCode
+	if err := DeadLetters.Add(dl); err != nil {
+		LogError.Error("failed to store dead letter: " + err.Error())
+		return err
+	}
+	return nil
+}
+
+// parseDeadLetterFilter reads a filter from the parameters id (repeatable),
+// platform, category, reason, identifier and after.
+func parseDeadLetterFilter(values url.Values) (DeadLetterFilter, error) {
+	filter := DeadLetterFilter{
+		Platform:   values.Get("platform"),
+		Category:   values.Get("category"),
+		Reason:     values.Get("reason"),
+		Identifier: values.Get("identifier"),
+	}
+	for _, v := range values["id"] {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return filter, err
+		}
+		if filter.IDs == nil {
+			filter.IDs = make(map[uint64]bool)
+		}
+		filter.IDs[id] = true
+	}
+	if v := values.Get("after"); v != "" {
+		after, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return filter, err
+		}
+		filter.After = after
+	}
+	return filter, nil
+}
+
+// DeadLettersHandler lists (GET) or purges (DELETE) the dead letters
+// matching the filter given by the parameters.
+func DeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if DeadLetters == nil {
+		sendResponse(w, "dead-letter store is disabled", http.StatusNotFound)
+		return
+	}
+
+	values := r.URL.Query()
+	filter, err := parseDeadLetterFilter(values)
+	if err != nil {
+		sendResponse(w, "malformed value", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		limit := 100
+		if v := values.Get("limit"); v != "" {
+			limit, err = strconv.Atoi(v)
+			if err != nil {
+				sendResponse(w, "malformed value", http.StatusBadRequest)
+				return
+			}
+		}
+		found, err := DeadLetters.Find(filter, limit)
+		if err != nil {
+			LogError.Error(err.Error())
+			sendResponse(w, "failed to find dead letters", http.StatusInternalServerError)
+			return
+		}
+		sendJSON(w, struct {
+			DeadLetters []DeadLetter `json:"dead_letters"`
+		}{found})
+	case "DELETE":
+		found, err := DeadLetters.Find(filter, 0)
+		if err == nil {
+			err = DeadLetters.Delete(deadLetterIDs(found))
+		}
+		if err != nil {
+			LogError.Error(err.Error())
+			sendResponse(w, "failed to purge dead letters", http.StatusInternalServerError)
+			return
+		}
+		sendJSON(w, struct {
+			Purged int `json:"purged"`
+		}{len(found)})
+	default:
+		sendResponse(w, "method must be GET or DELETE", http.StatusBadRequest)
+	}
+}
+
+// DeadLettersReplayHandler enqueues the dead letters matching the filter
+// given by the parameters again, and removes the enqueued ones from the
+// store. Dead letters the queue rejects are kept to be replayed later.
+func DeadLettersReplayHandler(w http.ResponseWriter, r *http.Request) {
+	if DeadLetters == nil {
+		sendResponse(w, "dead-letter store is disabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		sendResponse(w, "method must be POST", http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseDeadLetterFilter(r.URL.Query())
+	if err != nil {
+		sendResponse(w, "malformed value", http.StatusBadRequest)
+		return
+	}
+
+	found, err := DeadLetters.Find(filter, 0)
+	if err != nil {
+		LogError.Error(err.Error())
+		sendResponse(w, "failed to find dead letters", http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		numbered []RequestGaurunNotification
+		ids      []string
+		// replayedIDs are the IDs of the dead letters of numbered.
+		replayedIDs []uint64
+	)
+	for _, dl := range found {
+		notification := dl.Notification
+		// replayed as a new notification with its full lifetime and retries.
+		notification.Retry = 0
+		notification.AcceptedAt = 0
+		notification.Template = ""
+		n, _ := numberNotifications([]RequestGaurunNotification{notification}, false)
+		for _, notification := range n {
+			numbered = append(numbered, notification)
+			ids = append(ids, notification.ID)
+			replayedIDs = append(replayedIDs, dl.ID)
+		}
+	}
+
+	enqueued, enqueueErr := enqueueNotifications(numbered)
+	if err := DeadLetters.Delete(replayedIDs[:enqueued]); err != nil {
+		LogError.Error(err.Error())
+		sendResponse(w, "failed to remove replayed dead letters", http.StatusInternalServerError)
+		return
+	}
+	if enqueueErr != nil {
+		sendResponse(w, fmt.Sprintf("replayed %d of %d dead letters: %v", enqueued, len(numbered), enqueueErr), http.StatusServiceUnavailable)
+		return
+	}
+	sendPushResponse(w, ids, "")
+}
+
+func deadLetterIDs(dls []DeadLetter) []uint64 {
+	ids := make([]uint64, 0, len(dls))
+	for _, dl := range dls {
+		ids = append(ids, dl.ID)
+	}
+	return ids
+}
@@ -0,0 +1,160 @@
+package gaurun
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nohana/gaurun/buford/push"
+	"github.com/nohana/gaurun/gcm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushSyncStoresDeadLetter(t *testing.T) {
+	withDeadLetterStore(t)
+
+	calls := 0
+	pusher := func(ctx context.Context, req RequestGaurunNotification) error {
+		calls++
+		return NewDeliveryError(req.Platform, &gcm.Error{StatusCode: http.StatusOK, Reason: gcm.ErrorUnavailable})
+	}
+	req := RequestGaurunNotification{Tokens: []string{"xxx"}, Platform: PlatFormAndroid, Message: "hello", Identifier: "campaign"}
+	settled, _ := pushSync(pusher, req, 2)
+	assert.True(t, settled)
+	assert.Equal(t, 3, calls)
+
+	found, err := DeadLetters.Find(DeadLetterFilter{}, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(found))
+	assert.Equal(t, "android", found[0].Platform)
+	assert.Equal(t, "xxx", found[0].Token)
+	assert.Equal(t, ErrorCategoryRetryable, found[0].Category)
+	assert.Equal(t, "Unavailable", found[0].Reason)
+	assert.Equal(t, 2, found[0].Retry)
+	assert.Equal(t, "hello", found[0].Notification.Message)
+
+	// succeeded pushes are not stored
+	pushSync(func(ctx context.Context, req RequestGaurunNotification) error { return nil }, req, 2)
+	// nor are those which will fail again.
+	pushSync(func(ctx context.Context, req RequestGaurunNotification) error {
+		return NewDeliveryError(req.Platform, &gcm.Error{StatusCode: http.StatusOK, Reason: gcm.ErrorNotRegistered})
+	}, req, 2)
+	pushSync(func(ctx context.Context, req RequestGaurunNotification) error {
+		return NewDeliveryError(req.Platform, &gcm.Error{StatusCode: http.StatusOK, Reason: gcm.ErrorMessageTooBig})
+	}, req, 2)
+	found, err = DeadLetters.Find(DeadLetterFilter{}, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(found))
+}
+
+func TestDeadLetterStoreLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deadletters.db")
+
+	store, err := OpenDeadLetterStore(path, 2, time.Hour)
+	require.Nil(t, err)
+	for _, token := range []string{"a", "b", "c"} {
+		require.Nil(t, store.Add(&DeadLetter{Token: token, FailedAt: time.Now()}))
+	}
+	// the oldest is removed over max entries.
+	found, err := store.Find(DeadLetterFilter{}, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(found))
+	assert.Equal(t, "b", found[0].Token)
+
+	require.Nil(t, store.Delete([]uint64{found[0].ID, 100}))
+	require.Nil(t, store.Add(&DeadLetter{Token: "d", FailedAt: time.Now()}))
+	found, err = store.Find(DeadLetterFilter{}, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 2, len(found))
+	require.Nil(t, store.Close())
+
+	// and those older than max age when opened.
+	store, err = OpenDeadLetterStore(path, 0, time.Nanosecond)
+	require.Nil(t, err)
+	defer store.Close()
+	found, err = store.Find(DeadLetterFilter{}, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(found))
+}
+
+func TestDeadLetterHandlers(t *testing.T) {
+	withDeadLetterStore(t)
+	withPushConf(t)
+	withQueue(t, NewNotificationQueue(10, nil, 0))
+
+	expired := NewDeliveryError(PlatFormIos, &push.Error{Reason: push.ErrExpiredProviderToken, Status: http.StatusForbidden})
+	unavailable := NewDeliveryError(PlatFormAndroid, &gcm.Error{StatusCode: http.StatusOK, Reason: gcm.ErrorUnavailable})
+	storeDeadLetter(RequestGaurunNotification{Tokens: []string{"a"}, Platform: PlatFormIos, Message: "1", Identifier: "x"}, expired)
+	storeDeadLetter(RequestGaurunNotification{Tokens: []string{"b"}, Platform: PlatFormAndroid, Message: "2", Identifier: "x", Retry: 1}, unavailable)
+	storeDeadLetter(RequestGaurunNotification{Tokens: []string{"c"}, Platform: PlatFormAndroid, Message: "3", Identifier: "y", Retry: 1}, unavailable)
+
+	mux := http.NewServeMux()
+	RegisterHandlers(mux)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	list := func(query string) []DeadLetter {
+		res, err := http.Get(s.URL + "/deadletters?" + query)
+		require.Nil(t, err)
+		defer res.Body.Close()
+		var body struct {
+			DeadLetters []DeadLetter `json:"dead_letters"`
+		}
+		require.Nil(t, json.NewDecoder(res.Body).Decode(&body))
+		return body.DeadLetters
+	}
+
+	assert.Equal(t, 3, len(list("")))
+	assert.Equal(t, 2, len(list("platform=android")))
+	assert.Equal(t, 1, len(list("reason=ExpiredProviderToken")))
+	assert.Equal(t, 2, len(list("identifier=x")))
+	assert.Equal(t, 1, len(list("limit=1")))
+	assert.Equal(t, 2, len(list("after=1")))
+
+	// replay
+	res, err := http.Post(s.URL+"/deadletters/replay?platform=android&identifier=x", "", nil)
+	require.Nil(t, err)
+	var respGaurun ResponseGaurun
+	require.Nil(t, json.NewDecoder(res.Body).Decode(&respGaurun))
+	res.Body.Close()
+	assert.Equal(t, 1, len(respGaurun.SeqIDs))
+
+	replayed := QueueNotification.(*NotificationQueue).Pop()
+	assert.Equal(t, []string{"b"}, replayed.Tokens)
+	assert.Equal(t, 0, replayed.Retry)
+	assert.Equal(t, respGaurun.SeqIDs[0], replayed.ID)
+	assert.Equal(t, 2, len(list("")))
+
+	// purge
+	req, _ := http.NewRequest("DELETE", s.URL+"/deadletters?category=auth", nil)
+	res, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	var purged struct {
+		Purged int `json:"purged"`
+	}
+	require.Nil(t, json.NewDecoder(res.Body).Decode(&purged))
+	res.Body.Close()
+	assert.Equal(t, 1, purged.Purged)
+
+	remaining := list("")
+	require.Equal(t, 1, len(remaining))
+	assert.Equal(t, "c", remaining[0].Token)
+
+	// dead letters the queue rejects are kept.
+	QueueNotification.Stop()
+	res, err = http.Post(s.URL+"/deadletters/replay", "", nil)
+	require.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, 1, len(list("")))
+}
@@ -0,0 +1,211 @@
+package gaurun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"firebase.google.com/go/messaging"
+
+	"github.com/nohana/gaurun/buford/push"
+	"github.com/nohana/gaurun/gcm"
+)
+
+// ErrorCategory classifies why a push notification could not be delivered.
+type ErrorCategory string
+
+const (
+	// ErrorCategoryRetryable is a transient failure of the upstream or the network.
+	ErrorCategoryRetryable ErrorCategory = "retryable"
+	// ErrorCategoryPermanent is a failure which will not succeed on retry.
+	ErrorCategoryPermanent ErrorCategory = "permanent"
+	// ErrorCategoryAuth is a failure caused by gaurun's credentials or
+	// configuration, e.g. the topic or the sender ID.
+	ErrorCategoryAuth ErrorCategory = "auth"
+	// ErrorCategoryTokenInvalid means the device token is no longer valid.
+	ErrorCategoryTokenInvalid ErrorCategory = "token-invalid"
+	// ErrorCategoryPayload means the upstream rejected the notification itself.
+	ErrorCategoryPayload ErrorCategory = "payload"
+)
+
+// DeliveryError is a classified error returned by APNs or FCM.
+type DeliveryError struct {
+	Platform   int
+	Category   ErrorCategory
+	Reason     string        // upstream reason code
+	StatusCode int           // upstream HTTP status, 0 when no response was received
+	RetryAfter time.Duration // upstream Retry-After, 0 when not given
+	Timestamp  time.Time     // when APNs last saw the token as invalid
+	Err        error
+}
+
+func (e *DeliveryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether the notification may succeed if sent again.
+func (e *DeliveryError) Retryable() bool {
+	return e.Category == ErrorCategoryRetryable
+}
+
+// asDeliveryError returns err as a *DeliveryError if it is one, or nil.
+func asDeliveryError(err error) *DeliveryError {
+	var de *DeliveryError
+	if errors.As(err, &de) {
+		return de
+	}
+	return nil
+}
+
+// NewDeliveryError classifies an error returned while pushing to platform.
+// It returns nil if err is nil and err itself if it is already classified.
+func NewDeliveryError(platform int, err error) *DeliveryError {
+	if err == nil {
+		return nil
+	}
+	if de := asDeliveryError(err); de != nil {
+		return de
+	}
+
+	de := &DeliveryError{
+		Platform: platform,
+		Category: ErrorCategoryPermanent,
+		Err:      err,
+	}
+
+	var (
+		apnsErr *push.Error
+		gcmErr  *gcm.Error
+	)
+	switch {
+	case errors.As(err, &apnsErr):
+		de.Reason = apnsErr.Reason.Error()
+		de.StatusCode = apnsErr.Status
+		de.RetryAfter = apnsErr.RetryAfter
+		de.Timestamp = apnsErr.Timestamp
+		de.Category = apnsErrorCategory(apnsErr.Reason)
+	case errors.As(err, &gcmErr):
+		de.Reason = gcmErr.Reason
+		de.StatusCode = gcmErr.StatusCode
+		de.RetryAfter = gcmErr.RetryAfter
+		de.Category = gcmErrorCategory(gcmErr)
+	case isTransportError(err):
+		de.Reason = "Transport"
+		de.Category = ErrorCategoryRetryable
+	case platform == PlatFormAndroid:
+		de.Reason, de.Category = fcmV1ErrorCategory(err)
+		de.StatusCode = fcmV1StatusCode(err)
+	}
+
+	return de
+}
+
+func apnsErrorCategory(reason error) ErrorCategory {
+	switch reason {
+	case push.ErrTooManyRequests,
+		push.ErrIdleTimeout,
+		push.ErrShutdown,
+		push.ErrInternalServerError,
+		push.ErrServiceUnavailable:
+		return ErrorCategoryRetryable
+	case push.ErrBadDeviceToken,
+		push.ErrUnregistered:
+		return ErrorCategoryTokenInvalid
+	case push.ErrDeviceTokenNotForTopic,
+		push.ErrBadCertificate,
+		push.ErrBadCertificateEnvironment,
+		push.ErrForbidden,
+		push.ErrMissingProviderToken,
+		push.ErrInvalidProviderToken,
+		push.ErrExpiredProviderToken,
+		push.ErrTooManyProviderTokenUpdates:
+		return ErrorCategoryAuth
+	case push.ErrPayloadEmpty,
+		push.ErrPayloadTooLarge,
+		push.ErrBadMessageID,
+		push.ErrBadExpirationDate,
+		push.ErrBadPriority,
+		push.ErrInvalidPushType:
+		return ErrorCategoryPayload
+	}
+	return ErrorCategoryPermanent
+}
+
+func gcmErrorCategory(err *gcm.Error) ErrorCategory {
+	switch err.Reason {
+	case gcm.ErrorUnavailable,
+		gcm.ErrorInternalServerError,
+		gcm.ErrorDeviceMessageRateExceeded,
+		gcm.ErrorTopicsMessageRateExceeded:
+		return ErrorCategoryRetryable
+	case gcm.ErrorInvalidRegistration,
+		gcm.ErrorNotRegistered:
+		return ErrorCategoryTokenInvalid
+	case gcm.ErrorMismatchSenderID,
+		gcm.ErrorAuthentication,
+		gcm.ErrorInvalidApnsCredential,
+		gcm.ErrorInvalidPackageName:
+		return ErrorCategoryAuth
+	case gcm.ErrorInvalidJSON,
+		gcm.ErrorInvalidParameters,
+		gcm.ErrorMessageTooBig,
+		gcm.ErrorInvalidDataKey,
+		gcm.ErrorInvalidTTL:
+		return ErrorCategoryPayload
+	}
+	return ErrorCategoryPermanent
+}
+
+func fcmV1ErrorCategory(err error) (string, ErrorCategory) {
+	switch {
+	case messaging.IsServerUnavailable(err):
+		return "UNAVAILABLE", ErrorCategoryRetryable
+	case messaging.IsInternal(err):
+		return "INTERNAL", ErrorCategoryRetryable
+	case messaging.IsMessageRateExceeded(err):
+		return "QUOTA_EXCEEDED", ErrorCategoryRetryable
+	case messaging.IsRegistrationTokenNotRegistered(err):
+		return "UNREGISTERED", ErrorCategoryTokenInvalid
+	case messaging.IsMismatchedCredential(err):
+		return "SENDER_ID_MISMATCH", ErrorCategoryAuth
+	case messaging.IsInvalidAPNSCredentials(err):
+		return "THIRD_PARTY_AUTH_ERROR", ErrorCategoryAuth
+	case messaging.IsInvalidArgument(err):
+		return "INVALID_ARGUMENT", ErrorCategoryPayload
+	}
+	return "UNKNOWN", ErrorCategoryPermanent
+}
+
+var fcmV1StatusPattern = regexp.MustCompile(`http error status: (\d+)`)
+
+// fcmV1StatusCode extracts the HTTP status from an error of the Firebase
+// Admin SDK, which only reports it inside the message.
+func fcmV1StatusCode(err error) int {
+	m := fcmV1StatusPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	code, _ := strconv.Atoi(m[1])
+	return code
+}
+
+// isTransportError reports whether err was raised before any response was
+// received from the upstream.
+func isTransportError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var (
+		urlErr *url.Error
+		netErr net.Error
+	)
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
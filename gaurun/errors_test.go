@@ -0,0 +1,68 @@
+package gaurun
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nohana/gaurun/buford/push"
+	"github.com/nohana/gaurun/gcm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDeliveryError(t *testing.T) {
+	assert.Nil(t, NewDeliveryError(PlatFormIos, nil))
+
+	unregisteredAt := time.Unix(1600000000, 0).UTC()
+	cases := []struct {
+		Platform   int
+		Err        error
+		Category   ErrorCategory
+		Reason     string
+		StatusCode int
+	}{
+		{PlatFormIos, &push.Error{Reason: push.ErrUnregistered, Status: http.StatusGone, Timestamp: unregisteredAt}, ErrorCategoryTokenInvalid, "Unregistered", http.StatusGone},
+		{PlatFormIos, &push.Error{Reason: push.ErrBadDeviceToken, Status: http.StatusBadRequest}, ErrorCategoryTokenInvalid, "BadDeviceToken", http.StatusBadRequest},
+		// a token not for the topic or the sender is a misconfiguration, not a dead token.
+		{PlatFormIos, &push.Error{Reason: push.ErrDeviceTokenNotForTopic, Status: http.StatusBadRequest}, ErrorCategoryAuth, "DeviceTokenNotForTopic", http.StatusBadRequest},
+		{PlatFormIos, &push.Error{Reason: push.ErrMissingDeviceToken, Status: http.StatusBadRequest}, ErrorCategoryPermanent, "MissingDeviceToken", http.StatusBadRequest},
+		{PlatFormIos, &push.Error{Reason: push.ErrExpiredProviderToken, Status: http.StatusForbidden}, ErrorCategoryAuth, "ExpiredProviderToken", http.StatusForbidden},
+		{PlatFormIos, &push.Error{Reason: push.ErrPayloadTooLarge, Status: http.StatusRequestEntityTooLarge}, ErrorCategoryPayload, "PayloadTooLarge", http.StatusRequestEntityTooLarge},
+		{PlatFormIos, &push.Error{Reason: push.ErrTooManyRequests, Status: http.StatusTooManyRequests}, ErrorCategoryRetryable, "TooManyRequests", http.StatusTooManyRequests},
+		{PlatFormIos, &push.Error{Reason: push.ErrTopicDisallowed, Status: http.StatusBadRequest}, ErrorCategoryPermanent, "TopicDisallowed", http.StatusBadRequest},
+		{PlatFormAndroid, &gcm.Error{StatusCode: http.StatusUnauthorized, Reason: gcm.ErrorAuthentication}, ErrorCategoryAuth, "Authentication", http.StatusUnauthorized},
+		{PlatFormAndroid, &gcm.Error{StatusCode: http.StatusOK, Reason: gcm.ErrorInvalidRegistration}, ErrorCategoryTokenInvalid, "InvalidRegistration", http.StatusOK},
+		{PlatFormAndroid, &gcm.Error{StatusCode: http.StatusOK, Reason: gcm.ErrorMismatchSenderID}, ErrorCategoryAuth, "MismatchSenderId", http.StatusOK},
+		{PlatFormAndroid, &gcm.Error{StatusCode: http.StatusOK, Reason: gcm.ErrorMissingRegistration}, ErrorCategoryPermanent, "MissingRegistration", http.StatusOK},
+		{PlatFormAndroid, &gcm.Error{StatusCode: http.StatusOK, Reason: gcm.ErrorMessageTooBig}, ErrorCategoryPayload, "MessageTooBig", http.StatusOK},
+		{PlatFormAndroid, fmt.Errorf("wrapped: %w", &gcm.Error{StatusCode: http.StatusOK, Reason: gcm.ErrorUnavailable}), ErrorCategoryRetryable, "Unavailable", http.StatusOK},
+		{PlatFormAndroid, errors.New("something went wrong"), ErrorCategoryPermanent, "UNKNOWN", 0},
+	}
+
+	for _, c := range cases {
+		de := NewDeliveryError(c.Platform, c.Err)
+		assert.Equal(t, c.Platform, de.Platform)
+		assert.Equal(t, c.Category, de.Category, c.Reason)
+		assert.Equal(t, c.Reason, de.Reason)
+		assert.Equal(t, c.StatusCode, de.StatusCode)
+		assert.Equal(t, c.Err.Error(), de.Error())
+		assert.True(t, errors.Is(de, c.Err))
+	}
+
+	de := NewDeliveryError(PlatFormIos, &push.Error{Reason: push.ErrUnregistered, Status: http.StatusGone, Timestamp: unregisteredAt})
+	assert.Equal(t, unregisteredAt, de.Timestamp)
+
+	de = NewDeliveryError(PlatFormAndroid, &gcm.Error{StatusCode: http.StatusServiceUnavailable, Reason: gcm.ErrorUnavailable, RetryAfter: 30 * time.Second})
+	assert.Equal(t, 30*time.Second, de.RetryAfter)
+	assert.True(t, de.Retryable())
+
+	// already classified errors are returned as they are
+	assert.Equal(t, de, NewDeliveryError(PlatFormAndroid, de))
+}
+
+func TestFcmV1StatusCode(t *testing.T) {
+	assert.Equal(t, 404, fcmV1StatusCode(errors.New("http error status: 404; reason: app instance has been unregistered")))
+	assert.Equal(t, 0, fcmV1StatusCode(errors.New("no status")))
+}
@@ -0,0 +1,265 @@
+package gaurun
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EventSinkFile  = "file"
+	EventSinkKafka = "kafka"
+	EventSinkHTTP  = "http"
+
+	EventOverflowDrop  = "drop"
+	EventOverflowBlock = "block"
+)
+
+const (
+	// eventRetryIntervalMax caps the backoff of writing a batch again.
+	eventRetryIntervalMax = 30 * time.Second
+	// eventCloseTimeout bounds how long Close keeps writing the buffered
+	// events to a failing sink.
+	eventCloseTimeout = 10 * time.Second
+)
+
+// DeliveryEvent is a state transition of a notification seen by LogPush.
+type DeliveryEvent struct {
+	Type          string  `json:"type"`
+	Time          string  `json:"time"`
+	ID            string  `json:"id"`
+	RequestID     string  `json:"request_id,omitempty"`
+	Platform      string  `json:"platform"`
+	Token         string  `json:"token"`
+	Identifier    string  `json:"identifier,omitempty"`
+	PriorityClass string  `json:"priority_class,omitempty"`
+	Retry         int     `json:"retry,omitempty"`
+	Ptime         float64 `json:"ptime,omitempty"`
+	Error         string  `json:"error,omitempty"`
+	ErrorCategory string  `json:"error_category,omitempty"`
+	ErrorReason   string  `json:"error_reason,omitempty"`
+	ErrorStatus   int     `json:"error_status,omitempty"`
+}
+
+// EventSink writes batches of events. A batch is written again after an
+// error, so a sink should accept duplicated events.
+type EventSink interface {
+	Write(events []DeliveryEvent) error
+	Close() error
+}
+
+// EventPublisher buffers events and writes them to a sink in batches. A
+// batch is retried until the sink accepts it. When the buffer is full, new
+// events are dropped, or block the caller if block is true.
+type EventPublisher struct {
+	sink          EventSink
+	batchSize     int
+	flushInterval time.Duration
+	block         bool
+
+	events  chan DeliveryEvent
+	closing chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	dropped int64
+}
+
+func NewEventPublisher(sink EventSink, bufferSize, batchSize int, flushInterval time.Duration, block bool) *EventPublisher {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+	p := &EventPublisher{
+		sink:          sink,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		block:         block,
+		events:        make(chan DeliveryEvent, bufferSize),
+		closing:       make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Publish buffers event. It reports false if event is dropped.
+func (p *EventPublisher) Publish(event DeliveryEvent) bool {
+	select {
+	case <-p.closing:
+		atomic.AddInt64(&p.dropped, 1)
+		return false
+	default:
+	}
+	if p.block {
+		select {
+		case p.events <- event:
+			return true
+		case <-p.closing:
+			atomic.AddInt64(&p.dropped, 1)
+			return false
+		}
+	}
+	select {
+	case p.events <- event:
+		return true
+	default:
+		atomic.AddInt64(&p.dropped, 1)
+		return false
+	}
+}
+
+// Dropped returns the number of events dropped so far.
+func (p *EventPublisher) Dropped() int64 {
+	return atomic.LoadInt64(&p.dropped)
+}
+
+func (p *EventPublisher) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]DeliveryEvent, 0, p.batchSize)
+	for {
+		select {
+		case event := <-p.events:
+			batch = append(batch, event)
+			if len(batch) < p.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-p.closing:
+			p.drain(batch)
+			return
+		}
+		if !p.write(batch) {
+			p.drain(batch)
+			return
+		}
+		batch = batch[:0]
+	}
+}
+
+// write writes batch until the sink accepts it. It gives up and returns
+// false if the publisher is closed meanwhile.
+func (p *EventPublisher) write(batch []DeliveryEvent) bool {
+	interval := time.Second
+	for {
+		err := p.sink.Write(batch)
+		if err == nil {
+			return true
+		}
+		LogError.Error(fmt.Sprintf("failed to write %d events: %v", len(batch), err))
+		select {
+		case <-time.After(interval):
+		case <-p.closing:
+			return false
+		}
+		interval *= 2
+		if interval > eventRetryIntervalMax {
+			interval = eventRetryIntervalMax
+		}
+	}
+}
+
+// drain writes batch and the buffered events on close, giving up after
+// eventCloseTimeout.
+func (p *EventPublisher) drain(batch []DeliveryEvent) {
+	for len(p.events) > 0 {
+		batch = append(batch, <-p.events)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	deadline := time.Now().Add(eventCloseTimeout)
+	for {
+		err := p.sink.Write(batch)
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			atomic.AddInt64(&p.dropped, int64(len(batch)))
+			LogError.Error(fmt.Sprintf("gave up writing %d events: %v", len(batch), err))
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Close writes the buffered events and closes the sink.
+func (p *EventPublisher) Close() error {
+	p.once.Do(func() {
+		close(p.closing)
+	})
+	<-p.done
+	return p.sink.Close()
+}
+
+// InitEvents sets up the event sink given by the configuration.
+func InitEvents() error {
+	conf := ConfGaurun.Event
+	var (
+		sink EventSink
+		err  error
+	)
+	switch conf.Sink {
+	case "":
+		return nil
+	case EventSinkFile:
+		sink, err = NewFileEventSink(conf.Path, conf.MaxSize*1024*1024)
+	case EventSinkKafka:
+		sink, err = NewKafkaEventSink(conf.Brokers, conf.Topic)
+	case EventSinkHTTP:
+		sink = NewHTTPEventSink(conf.URL, time.Duration(conf.Timeout)*time.Second)
+	default:
+		return fmt.Errorf("unknown event sink: %s", conf.Sink)
+	}
+	if err != nil {
+		return err
+	}
+
+	var block bool
+	switch conf.Overflow {
+	case EventOverflowDrop:
+	case EventOverflowBlock:
+		block = true
+	default:
+		sink.Close()
+		return fmt.Errorf("unknown event overflow: %s", conf.Overflow)
+	}
+	Events = NewEventPublisher(sink, conf.BufferSize, conf.BatchSize, time.Duration(conf.FlushInterval)*time.Second, block)
+	return nil
+}
+
+// publishEvent publishes a state transition of req to the event sink.
+func publishEvent(id string, status, token string, ptime float64, req RequestGaurunNotification, errPush error) {
+	if Events == nil {
+		return
+	}
+	event := DeliveryEvent{
+		Type:          status,
+		Time:          time.Now().Format(time.RFC3339Nano),
+		ID:            id,
+		RequestID:     req.RequestID,
+		Platform:      platformName(req.Platform),
+		Token:         LogRedactor.Redact(RedactFieldToken, token),
+		Identifier:    req.Identifier,
+		PriorityClass: req.PriorityClass,
+		Retry:         req.Retry,
+		Ptime:         ptime,
+	}
+	if errPush != nil {
+		event.Error = errPush.Error()
+		if de := asDeliveryError(errPush); de != nil {
+			event.ErrorCategory = string(de.Category)
+			event.ErrorReason = de.Reason
+			event.ErrorStatus = de.StatusCode
+		}
+	}
+	Events.Publish(event)
+}
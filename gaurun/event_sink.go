@@ -0,0 +1,171 @@
+package gaurun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// FileEventSink appends events to a file as NDJSON. The file is renamed
+// with a timestamp suffix and a new one is created when it grows over
+// maxSize bytes.
+type FileEventSink struct {
+	path    string
+	maxSize int64
+
+	file *os.File
+	size int64
+}
+
+func NewFileEventSink(path string, maxSize int64) (*FileEventSink, error) {
+	s := &FileEventSink{path: path, maxSize: maxSize}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileEventSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// Write appends events and syncs the file so that written events survive
+// a crash.
+func (s *FileEventSink) Write(events []DeliveryEvent) error {
+	if s.maxSize > 0 && s.size >= s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(buf.Bytes())
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *FileEventSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	rotated := s.path + "." + time.Now().Format("20060102150405.000000")
+	if err := os.Rename(s.path, rotated); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileEventSink) Close() error {
+	return s.file.Close()
+}
+
+// KafkaEventSink produces events to a Kafka topic, keyed by token so that
+// the events of a token keep their order.
+type KafkaEventSink struct {
+	client *kgo.Client
+	topic  string
+}
+
+func NewKafkaEventSink(brokers []string, topic string) (*KafkaEventSink, error) {
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(brokers...),
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaEventSink{client: client, topic: topic}, nil
+}
+
+func (s *KafkaEventSink) Write(events []DeliveryEvent) error {
+	records := make([]*kgo.Record, 0, len(events))
+	for _, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		records = append(records, &kgo.Record{
+			Topic: s.topic,
+			Key:   []byte(event.Token),
+			Value: value,
+		})
+	}
+	return s.client.ProduceSync(context.Background(), records...).FirstErr()
+}
+
+func (s *KafkaEventSink) Close() error {
+	s.client.Close()
+	return nil
+}
+
+// HTTPEventSink posts a batch of events as NDJSON. A response with a
+// status other than 2xx is an error.
+type HTTPEventSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPEventSink(url string, timeout time.Duration) *HTTPEventSink {
+	return &HTTPEventSink{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (s *HTTPEventSink) Write(events []DeliveryEvent) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("event endpoint returned %s", res.Status)
+	}
+	return nil
+}
+
+func (s *HTTPEventSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
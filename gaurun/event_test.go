@@ -0,0 +1,201 @@
+package gaurun
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nohana/gaurun/buford/push"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// memoryEventSink fails the first fails writes.
+type memoryEventSink struct {
+	mu      sync.Mutex
+	fails   int
+	batches [][]DeliveryEvent
+}
+
+func (s *memoryEventSink) Write(events []DeliveryEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fails > 0 {
+		s.fails--
+		return errors.New("unavailable")
+	}
+	s.batches = append(s.batches, append([]DeliveryEvent(nil), events...))
+	return nil
+}
+
+func (s *memoryEventSink) Close() error {
+	return nil
+}
+
+func (s *memoryEventSink) ids() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for _, batch := range s.batches {
+		for _, event := range batch {
+			ids = append(ids, event.ID)
+		}
+	}
+	return ids
+}
+
+func TestEventPublisher(t *testing.T) {
+	sink := &memoryEventSink{fails: 1}
+	p := NewEventPublisher(sink, 10, 2, time.Hour, false)
+
+	for i := 1; i <= 3; i++ {
+		assert.True(t, p.Publish(DeliveryEvent{ID: strconv.Itoa(i)}))
+	}
+	// the first batch is written again after the failure
+	for i := 0; i < 30 && len(sink.ids()) < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"1", "2"}, sink.ids())
+
+	// the rest is written on close
+	assert.Nil(t, p.Close())
+	assert.Equal(t, []string{"1", "2", "3"}, sink.ids())
+	assert.False(t, p.Publish(DeliveryEvent{ID: "4"}))
+	assert.Equal(t, int64(1), p.Dropped())
+}
+
+func TestEventPublisherOverflow(t *testing.T) {
+	// the sink keeps failing, so the buffer fills up.
+	sink := &memoryEventSink{fails: 100}
+	p := NewEventPublisher(sink, 2, 1, time.Hour, false)
+
+	dropped := 0
+	for i := 0; i < 10; i++ {
+		if !p.Publish(DeliveryEvent{ID: strconv.Itoa(i)}) {
+			dropped++
+		}
+	}
+	assert.True(t, dropped >= 7)
+	assert.Equal(t, int64(dropped), p.Dropped())
+}
+
+func TestPublishEvent(t *testing.T) {
+	sink := &memoryEventSink{}
+	Events = NewEventPublisher(sink, 10, 10, time.Hour, false)
+	defer func() {
+		Events = nil
+	}()
+
+	req := RequestGaurunNotification{Platform: PlatFormIos, Identifier: "campaign", Retry: 1}
+	pushErr := &push.Error{Reason: push.ErrTooManyRequests, Status: http.StatusTooManyRequests}
+	LogPush("1", StatusRetriedPush, "xxx", 0, req, NewDeliveryError(PlatFormIos, pushErr))
+	require.Nil(t, Events.Close())
+
+	require.Equal(t, 1, len(sink.batches))
+	event := sink.batches[0][0]
+	assert.Equal(t, StatusRetriedPush, event.Type)
+	assert.Equal(t, "1", event.ID)
+	assert.Equal(t, "ios", event.Platform)
+	assert.Equal(t, "xxx", event.Token)
+	assert.Equal(t, "campaign", event.Identifier)
+	assert.Equal(t, 1, event.Retry)
+	assert.Equal(t, string(ErrorCategoryRetryable), event.ErrorCategory)
+	assert.Equal(t, "TooManyRequests", event.ErrorReason)
+}
+
+func TestFileEventSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.ndjson")
+
+	s, err := NewFileEventSink(path, 10)
+	require.Nil(t, err)
+	require.Nil(t, s.Write([]DeliveryEvent{{ID: "1"}, {ID: "2"}}))
+	// rotated as the file is over 10 bytes
+	require.Nil(t, s.Write([]DeliveryEvent{{ID: "3"}}))
+	require.Nil(t, s.Close())
+
+	files, err := filepath.Glob(path + ".*")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(files))
+	assert.Equal(t, []string{"1", "2"}, readEventIDs(t, files[0]))
+	assert.Equal(t, []string{"3"}, readEventIDs(t, path))
+}
+
+func readEventIDs(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+	var ids []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event DeliveryEvent
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &event))
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func TestHTTPEventSink(t *testing.T) {
+	var (
+		status = http.StatusServiceUnavailable
+		ids    []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+		dec := json.NewDecoder(r.Body)
+		for dec.More() {
+			var event DeliveryEvent
+			require.Nil(t, dec.Decode(&event))
+			ids = append(ids, event.ID)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	s := NewHTTPEventSink(server.URL, time.Second)
+	assert.NotNil(t, s.Write([]DeliveryEvent{{ID: "1"}}))
+	status = http.StatusNoContent
+	assert.Nil(t, s.Write([]DeliveryEvent{{ID: "1"}, {ID: "2"}}))
+	assert.Equal(t, []string{"1", "1", "2"}, ids)
+	assert.Nil(t, s.Close())
+}
+
+func TestKafkaEventSink(t *testing.T) {
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(1, "events"))
+	require.Nil(t, err)
+	defer cluster.Close()
+
+	s, err := NewKafkaEventSink(cluster.ListenAddrs(), "events")
+	require.Nil(t, err)
+	require.Nil(t, s.Write([]DeliveryEvent{{ID: "1", Token: "a"}, {ID: "2", Token: "b"}}))
+	require.Nil(t, s.Close())
+
+	consumer, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...), kgo.ConsumeTopics("events"))
+	require.Nil(t, err)
+	defer consumer.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var records []*kgo.Record
+	for len(records) < 2 && ctx.Err() == nil {
+		records = append(records, consumer.PollFetches(ctx).Records()...)
+	}
+	require.Equal(t, 2, len(records))
+	assert.Equal(t, "a", string(records[0].Key))
+	var event DeliveryEvent
+	require.Nil(t, json.Unmarshal(records[1].Value, &event))
+	assert.Equal(t, "2", event.ID)
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/nohana/gaurun/gcm"
 
 	firebase "firebase.google.com/go"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
 	"go.uber.org/zap"
 )
@@ -12,9 +13,13 @@ var (
 	// Toml configuration for Gaurun
 	ConfGaurun ConfToml
 	// push notification Queue
-	QueueNotification chan RequestGaurunNotification
+	QueueNotification Queue
 	// Stat for Gaurun
 	StatGaurun StatApp
+	// totals of StatGaurun saved across restarts, nil if disabled
+	StatFile *StatStore
+	// delivery funnels per identifier, nil if disabled
+	IdentifierStats *IdentifierStatStore
 	// http client for APNs and GCM/FCM
 	APNSClient  APNsClient
 	GCMClient   *gcm.Client
@@ -23,6 +28,28 @@ var (
 	// access and error logger
 	LogAccess *zap.Logger
 	LogError  *zap.Logger
-	// sequence ID for numbering push
-	SeqID uint64
+	// registry of invalid device tokens, nil if disabled
+	InvalidTokens *TokenStore
+	// seq_ids accepted for idempotency keys, nil if disabled
+	IdempotencyKeys *IdempotencyStore
+	// notification templates
+	Templates *TemplateRegistry
+	// campaigns fanning out to token lists, nil if disabled
+	Campaigns *CampaignManager
+	// notifications failed even after retries, nil if disabled
+	DeadLetters *DeadLetterStore
+	// publisher of delivery events, nil if disabled
+	Events *EventPublisher
+	// fault injection into the clients for APNs and FCM, nil if disabled
+	Chaos *ChaosInjector
+	// emitter of metrics to StatsD, nil if disabled
+	Metrics *MetricsReporter
+	// exporter of traces to the OTLP collector, nil if disabled
+	Tracer *sdktrace.TracerProvider
+	// consumers of message brokers
+	Ingesters []Ingester
+	// redactor of notifications in the logs, nil if disabled
+	LogRedactor *Redactor
+	// generator of IDs numbering push
+	PushIDs = NewPushIDGenerator("")
 )
@@ -0,0 +1,237 @@
+package gaurun
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	HealthStatusOK   = "ok"
+	HealthStatusFail = "fail"
+)
+
+// HealthCheck is the result of a check of readiness.
+type HealthCheck struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// HealthReport is the response-body of /healthz and /readyz.
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+// upstreamHealth follows the results of pushes to APNs or FCM. The circuit
+// opens after consecutive failures of the upstream or the network, and
+// closes on a success or after the cooldown since the last failure. It
+// only makes the instance unready and does not stop pushes.
+type upstreamHealth struct {
+	mu          sync.Mutex
+	failures    int
+	lastFailure time.Time
+	lastFailErr string
+	authErr     string
+	authErrAt   time.Time
+}
+
+var (
+	apnsHealth = &upstreamHealth{}
+	fcmHealth  = &upstreamHealth{}
+
+	// fcmV1TokenSource issues tokens of the service account for FCM v1,
+	// nil unless FCM v1 is initialized.
+	fcmV1TokenSource oauth2.TokenSource
+)
+
+func upstreamHealthOf(platform int) *upstreamHealth {
+	switch platform {
+	case PlatFormIos:
+		return apnsHealth
+	case PlatFormAndroid:
+		return fcmHealth
+	}
+	return nil
+}
+
+// isUpstreamFailure reports whether de is a failure of the upstream or the
+// network rather than of the notification.
+func isUpstreamFailure(de *DeliveryError) bool {
+	return de.Category == ErrorCategoryRetryable && (de.StatusCode == 0 || de.StatusCode >= http.StatusInternalServerError)
+}
+
+// describeFailure describes de for the message of a check.
+func describeFailure(de *DeliveryError) string {
+	if de.Err == nil {
+		return de.Reason
+	}
+	return de.Error()
+}
+
+// record follows the result of a push, where de is nil for a success.
+func (h *upstreamHealth) record(de *DeliveryError) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if de == nil {
+		h.failures = 0
+		h.authErr = ""
+		return
+	}
+	switch {
+	case de.Category == ErrorCategoryAuth:
+		h.authErr = describeFailure(de)
+		h.authErrAt = time.Now()
+	case isUpstreamFailure(de):
+		h.failures++
+		h.lastFailure = time.Now()
+		h.lastFailErr = describeFailure(de)
+	}
+}
+
+func (h *upstreamHealth) circuit(now time.Time, threshold int, cooldown time.Duration) HealthCheck {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if threshold <= 0 || h.failures < threshold || now.Sub(h.lastFailure) >= cooldown {
+		return HealthCheck{Status: HealthStatusOK}
+	}
+	return HealthCheck{
+		Status:  HealthStatusFail,
+		Message: fmt.Sprintf("circuit is open after %d consecutive failures: %s", h.failures, h.lastFailErr),
+	}
+}
+
+// authError returns the last error of authentication not followed by a
+// success.
+func (h *upstreamHealth) authError() (string, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.authErr, h.authErrAt
+}
+
+func (h *upstreamHealth) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures = 0
+	h.lastFailure = time.Time{}
+	h.lastFailErr = ""
+	h.authErr = ""
+	h.authErrAt = time.Time{}
+}
+
+// recordUpstream follows the result of a push for the readiness.
+func recordUpstream(platform int, de *DeliveryError) {
+	if h := upstreamHealthOf(platform); h != nil {
+		h.record(de)
+	}
+}
+
+func checkQueue() HealthCheck {
+	capacity, usage := QueueNotification.Cap(), QueueNotification.Len()
+	msg := fmt.Sprintf("%d of %d notifications are queued", usage, capacity)
+	threshold := ConfGaurun.Health.QueueThreshold
+	if threshold > 0 && capacity > 0 && usage*100 >= capacity*threshold {
+		return HealthCheck{Status: HealthStatusFail, Message: msg}
+	}
+	return HealthCheck{Status: HealthStatusOK, Message: msg}
+}
+
+func checkAPNsCredentials(now time.Time) HealthCheck {
+	if !APNSClient.CertNotAfter.IsZero() && now.After(APNSClient.CertNotAfter) {
+		return HealthCheck{
+			Status:  HealthStatusFail,
+			Message: fmt.Sprintf("certificate expired at %s", APNSClient.CertNotAfter.Format(time.RFC3339)),
+		}
+	}
+	if err, at := apnsHealth.authError(); err != "" {
+		return HealthCheck{Status: HealthStatusFail, Message: fmt.Sprintf("rejected at %s: %s", at.Format(time.RFC3339), err)}
+	}
+	if !APNSClient.CertNotAfter.IsZero() {
+		return HealthCheck{Status: HealthStatusOK, Message: fmt.Sprintf("certificate expires at %s", APNSClient.CertNotAfter.Format(time.RFC3339))}
+	}
+	return HealthCheck{Status: HealthStatusOK}
+}
+
+func checkFCMCredentials() HealthCheck {
+	if ConfGaurun.Android.UseV1 && fcmV1TokenSource != nil {
+		if _, err := fcmV1TokenSource.Token(); err != nil {
+			return HealthCheck{Status: HealthStatusFail, Message: fmt.Sprintf("failed to get access token: %v", err)}
+		}
+	}
+	if err, at := fcmHealth.authError(); err != "" {
+		return HealthCheck{Status: HealthStatusFail, Message: fmt.Sprintf("rejected at %s: %s", at.Format(time.RFC3339), err)}
+	}
+	return HealthCheck{Status: HealthStatusOK}
+}
+
+// checkReadiness runs the checks of readiness.
+func checkReadiness(now time.Time) HealthReport {
+	threshold := ConfGaurun.Health.CircuitFailures
+	cooldown := time.Duration(ConfGaurun.Health.CircuitCooldown) * time.Second
+
+	checks := map[string]HealthCheck{"queue": checkQueue()}
+	if ConfGaurun.Ios.Enabled {
+		checks["apns_credentials"] = checkAPNsCredentials(now)
+		checks["apns_circuit"] = apnsHealth.circuit(now, threshold, cooldown)
+	}
+	if ConfGaurun.Android.Enabled {
+		checks["fcm_credentials"] = checkFCMCredentials()
+		checks["fcm_circuit"] = fcmHealth.circuit(now, threshold, cooldown)
+	}
+
+	report := HealthReport{Status: HealthStatusOK, Checks: checks}
+	for _, check := range checks {
+		if check.Status != HealthStatusOK {
+			report.Status = HealthStatusFail
+		}
+	}
+	return report
+}
+
+func sendHealthReport(w http.ResponseWriter, report HealthReport) {
+	code := http.StatusOK
+	if report.Status != HealthStatusOK {
+		code = http.StatusServiceUnavailable
+	}
+	b, err := json.MarshalIndent(report, "", " ")
+	if err != nil {
+		sendResponse(w, "Response-body could not be created", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Server", serverHeader())
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// LivenessHandler tells that the server is serving.
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		sendResponse(w, "method must be GET or HEAD", http.StatusBadRequest)
+		return
+	}
+	sendHealthReport(w, HealthReport{Status: HealthStatusOK})
+}
+
+// ReadinessHandler tells whether the instance can push notifications, with
+// 503(Service Unavailable) and the failed checks if not.
+func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		sendResponse(w, "method must be GET or HEAD", http.StatusBadRequest)
+		return
+	}
+	report := checkReadiness(time.Now())
+	if report.Status != HealthStatusOK {
+		for name, check := range report.Checks {
+			if check.Status != HealthStatusOK {
+				LogError.Warn(fmt.Sprintf("readiness check %s failed: %s", name, check.Message))
+			}
+		}
+	}
+	sendHealthReport(w, report)
+}
@@ -0,0 +1,113 @@
+package gaurun
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+type failingTokenSource struct{}
+
+func (failingTokenSource) Token() (*oauth2.Token, error) {
+	return nil, errors.New("invalid_grant")
+}
+
+func getReadiness(t *testing.T) (int, HealthReport) {
+	w := httptest.NewRecorder()
+	ReadinessHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	var report HealthReport
+	require.Nil(t, json.NewDecoder(w.Body).Decode(&report))
+	return w.Code, report
+}
+
+func TestLivenessHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	LivenessHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	LivenessHandler(w, httptest.NewRequest("POST", "/healthz", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestReadinessQueue(t *testing.T) {
+	withHealth(t)
+
+	code, report := getReadiness(t)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HealthStatusOK, report.Status)
+	assert.Contains(t, report.Checks, "apns_circuit")
+	assert.Contains(t, report.Checks, "fcm_credentials")
+
+	for i := 0; i < 9; i++ {
+		require.Nil(t, QueueNotification.Push(RequestGaurunNotification{Platform: PlatFormIos}))
+	}
+	code, report = getReadiness(t)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, HealthStatusFail, report.Status)
+	assert.Equal(t, HealthStatusFail, report.Checks["queue"].Status)
+	assert.Equal(t, "9 of 10 notifications are queued", report.Checks["queue"].Message)
+	assert.Equal(t, HealthStatusOK, report.Checks["apns_circuit"].Status)
+
+	// disabled platforms are not checked.
+	ConfGaurun.Ios.Enabled = false
+	ConfGaurun.Health.QueueThreshold = 0
+	code, report = getReadiness(t)
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, report.Checks, "apns_circuit")
+}
+
+func TestReadinessCredentials(t *testing.T) {
+	withHealth(t)
+	now := time.Now()
+
+	APNSClient.CertNotAfter = now.Add(time.Hour)
+	assert.Equal(t, HealthStatusOK, checkReadiness(now).Checks["apns_credentials"].Status)
+	report := checkReadiness(now.Add(2 * time.Hour))
+	assert.Equal(t, HealthStatusFail, report.Status)
+	assert.Contains(t, report.Checks["apns_credentials"].Message, "certificate expired at")
+
+	// an error of authentication lasts until a success.
+	countPushError(&DeliveryError{Platform: PlatFormAndroid, Category: ErrorCategoryAuth, Reason: "AuthenticationError", Err: errors.New("unauthorized")})
+	assert.Equal(t, HealthStatusFail, checkReadiness(now).Checks["fcm_credentials"].Status)
+	countPushSuccess(PlatFormAndroid)
+	assert.Equal(t, HealthStatusOK, checkReadiness(now).Checks["fcm_credentials"].Status)
+
+	ConfGaurun.Android.UseV1 = true
+	fcmV1TokenSource = failingTokenSource{}
+	check := checkReadiness(now).Checks["fcm_credentials"]
+	assert.Equal(t, HealthStatusFail, check.Status)
+	assert.Equal(t, "failed to get access token: invalid_grant", check.Message)
+}
+
+func TestReadinessCircuit(t *testing.T) {
+	withHealth(t)
+	ConfGaurun.Health.CircuitFailures = 3
+	unavailable := &DeliveryError{Platform: PlatFormIos, Category: ErrorCategoryRetryable, StatusCode: http.StatusServiceUnavailable, Err: errors.New("ServiceUnavailable")}
+	tooMany := &DeliveryError{Platform: PlatFormIos, Category: ErrorCategoryRetryable, StatusCode: http.StatusTooManyRequests, Err: errors.New("TooManyRequests")}
+
+	for i := 0; i < 2; i++ {
+		countPushError(unavailable)
+	}
+	// errors of notifications do not open the circuit.
+	countPushError(tooMany)
+	now := time.Now()
+	assert.Equal(t, HealthStatusOK, checkReadiness(now).Checks["apns_circuit"].Status)
+
+	countPushError(unavailable)
+	check := checkReadiness(now).Checks["apns_circuit"]
+	assert.Equal(t, HealthStatusFail, check.Status)
+	assert.Equal(t, "circuit is open after 3 consecutive failures: ServiceUnavailable", check.Message)
+	assert.Equal(t, HealthStatusOK, checkReadiness(now).Checks["fcm_circuit"].Status)
+
+	// the circuit closes after the cooldown or on a success.
+	assert.Equal(t, HealthStatusOK, checkReadiness(now.Add(31 * time.Second)).Checks["apns_circuit"].Status)
+	countPushSuccess(PlatFormIos)
+	assert.Equal(t, HealthStatusOK, checkReadiness(now).Checks["apns_circuit"].Status)
+}
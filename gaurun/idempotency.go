@@ -0,0 +1,242 @@
+package gaurun
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IdempotencyStore remembers the seq_ids assigned for an idempotency key
+// for a fixed TTL so that retried submissions are not enqueued again.
+//
+// The store is local to the process. Instances sharing a queue do not
+// share their keys, so a retry reaching another instance is enqueued
+// again.
+type IdempotencyStore struct {
+	ttl     time.Duration
+	maxKeys int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// pending holds keys whose seq_ids are being assigned. Calls for
+	// other keys do not wait for them.
+	pending map[string]*idempotencyPending
+	// order holds entries from the oldest to the newest. As the TTL is
+	// fixed, it is also the order of expiry.
+	order *list.List
+}
+
+type idempotencyEntry struct {
+	key         string
+	fingerprint string
+	ids         []string
+	// rejected is the notifications numbered for the key which the queue
+	// rejected, to be enqueued by a retry.
+	rejected  []RequestGaurunNotification
+	expiresAt time.Time
+}
+
+type idempotencyPending struct {
+	fingerprint string
+	ids         []string
+	done        chan struct{}
+}
+
+// NewIdempotencyStore returns a store which keeps each key for ttl and
+// at most maxKeys keys. maxKeys less than or equal to zero means no limit.
+func NewIdempotencyStore(ttl time.Duration, maxKeys int) *IdempotencyStore {
+	return &IdempotencyStore{
+		ttl:     ttl,
+		maxKeys: maxKeys,
+		entries: make(map[string]*list.Element),
+		pending: make(map[string]*idempotencyPending),
+		order:   list.New(),
+	}
+}
+
+// Do returns the seq_ids stored for key. If key is not stored or has
+// expired, it calls number to assign new seq_ids and stores them.
+//
+// fingerprint identifies the content submitted with key. replayed reports
+// whether the seq_ids were stored by a previous call, and conflict whether
+// that call was made with a different fingerprint, in which case number
+// is not called and no seq_ids are returned.
+//
+// number is called without the lock of the store. A call for a key whose
+// number is still running waits for it and returns its seq_ids.
+func (s *IdempotencyStore) Do(key, fingerprint string, number func() []string) (ids []string, replayed, conflict bool) {
+	s.mu.Lock()
+	s.expire(time.Now())
+
+	if e, ok := s.entries[key]; ok {
+		s.mu.Unlock()
+		entry := e.Value.(*idempotencyEntry)
+		if entry.fingerprint != fingerprint {
+			return nil, false, true
+		}
+		return entry.ids, true, false
+	}
+	if p, ok := s.pending[key]; ok {
+		s.mu.Unlock()
+		<-p.done
+		if p.fingerprint != fingerprint {
+			return nil, false, true
+		}
+		return p.ids, true, false
+	}
+
+	p := &idempotencyPending{fingerprint: fingerprint, done: make(chan struct{})}
+	s.pending[key] = p
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.pending, key)
+		s.entries[key] = s.order.PushBack(&idempotencyEntry{
+			key:         key,
+			fingerprint: fingerprint,
+			ids:         p.ids,
+			expiresAt:   time.Now().Add(s.ttl),
+		})
+		if s.maxKeys > 0 && s.order.Len() > s.maxKeys {
+			s.remove(s.order.Front())
+		}
+		close(p.done)
+	}()
+	p.ids = number()
+
+	return p.ids, false, false
+}
+
+// Reject records notifications numbered for key which the queue rejected,
+// so that a retry with key takes them by TakeRejected. The seq_ids of key
+// are kept, as notifications enqueued for it must not be enqueued again.
+func (s *IdempotencyStore) Reject(key string, notifications []RequestGaurunNotification) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok {
+		entry := e.Value.(*idempotencyEntry)
+		entry.rejected = append(entry.rejected, notifications...)
+	}
+}
+
+// TakeRejected returns the notifications recorded for key by Reject and
+// removes them, so that only one retry enqueues them.
+func (s *IdempotencyStore) TakeRejected(key string) []RequestGaurunNotification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*idempotencyEntry)
+	rejected := entry.rejected
+	entry.rejected = nil
+	return rejected
+}
+
+// Len returns the number of stored keys including expired ones not yet removed.
+func (s *IdempotencyStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+func (s *IdempotencyStore) expire(now time.Time) {
+	for e := s.order.Front(); e != nil; e = s.order.Front() {
+		if now.Before(e.Value.(*idempotencyEntry).expiresAt) {
+			return
+		}
+		s.remove(e)
+	}
+}
+
+func (s *IdempotencyStore) remove(e *list.Element) {
+	s.order.Remove(e)
+	delete(s.entries, e.Value.(*idempotencyEntry).key)
+}
+
+// InitIdempotencyStore creates IdempotencyKeys if a TTL is configured.
+func InitIdempotencyStore() {
+	if ConfGaurun.Idempotency.TTL <= 0 {
+		IdempotencyKeys = nil
+		return
+	}
+	if backend := ConfGaurun.Queue.Backend; backend != "" && backend != QueueBackendMemory {
+		LogError.Warn(fmt.Sprintf("idempotency keys are not shared between instances of the %s queue", backend))
+	}
+	IdempotencyKeys = NewIdempotencyStore(
+		time.Duration(ConfGaurun.Idempotency.TTL)*time.Second,
+		ConfGaurun.Idempotency.MaxKeys,
+	)
+}
+
+// rejectIdempotencyKeys records rejected, the notifications among those
+// numbered for a request which the queue rejected, for the Idempotency-Key
+// of the request or the identifier keys of its notifications, so that a
+// retry of the request enqueues only them.
+func rejectIdempotencyKeys(idempotencyKey string, notifications, rejected []RequestGaurunNotification) {
+	if IdempotencyKeys == nil {
+		return
+	}
+	if idempotencyKey != "" {
+		IdempotencyKeys.Reject("header:"+idempotencyKey, rejected)
+		return
+	}
+	if !ConfGaurun.Idempotency.UseIdentifier {
+		return
+	}
+	for i := range notifications {
+		notification := &notifications[i]
+		if notification.Identifier == "" {
+			continue
+		}
+		var own []RequestGaurunNotification
+		for _, r := range rejected {
+			if r.Identifier != notification.Identifier || r.Platform != notification.Platform {
+				continue
+			}
+			for _, token := range notification.Tokens {
+				if token == r.Tokens[0] {
+					own = append(own, r)
+					break
+				}
+			}
+		}
+		if len(own) > 0 {
+			IdempotencyKeys.Reject(identifierKey(notification), own)
+		}
+	}
+}
+
+// fingerprintNotifications returns a digest of notifications to detect an
+// idempotency key reused for different content.
+func fingerprintNotifications(notifications []RequestGaurunNotification) string {
+	b, err := json.Marshal(notifications)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// identifierKey returns the idempotency key for a notification given by
+// its identifier. The tokens are part of the key since a campaign sends the
+// same identifier to many tokens in separate requests.
+func identifierKey(notification *RequestGaurunNotification) string {
+	h := sha256.New()
+	h.Write([]byte(notification.Identifier))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.Itoa(notification.Platform)))
+	for _, token := range notification.Tokens {
+		h.Write([]byte{0})
+		h.Write([]byte(token))
+	}
+	return "identifier:" + hex.EncodeToString(h.Sum(nil))
+}
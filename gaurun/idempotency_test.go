@@ -0,0 +1,150 @@
+package gaurun
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyStore(t *testing.T) {
+	store := NewIdempotencyStore(time.Hour, 2)
+
+	calls := 0
+	number := func() []string {
+		calls++
+		return []string{strconv.Itoa(calls)}
+	}
+
+	ids, replayed, conflict := store.Do("a", "x", number)
+	assert.Equal(t, []string{"1"}, ids)
+	assert.False(t, replayed)
+	assert.False(t, conflict)
+
+	ids, replayed, conflict = store.Do("a", "x", number)
+	assert.Equal(t, []string{"1"}, ids)
+	assert.True(t, replayed)
+	assert.False(t, conflict)
+
+	ids, replayed, conflict = store.Do("a", "y", number)
+	assert.Nil(t, ids)
+	assert.False(t, replayed)
+	assert.True(t, conflict)
+	assert.Equal(t, 1, calls)
+
+	// the oldest key is evicted over max keys
+	store.Do("b", "x", number)
+	store.Do("c", "x", number)
+	assert.Equal(t, 2, store.Len())
+	ids, replayed, _ = store.Do("a", "x", number)
+	assert.Equal(t, []string{"4"}, ids)
+	assert.False(t, replayed)
+}
+
+func TestIdempotencyStoreExpiry(t *testing.T) {
+	store := NewIdempotencyStore(10*time.Millisecond, 0)
+	store.Do("a", "", func() []string { return []string{"1"} })
+	time.Sleep(20 * time.Millisecond)
+	ids, replayed, _ := store.Do("a", "", func() []string { return []string{"2"} })
+	assert.Equal(t, []string{"2"}, ids)
+	assert.False(t, replayed)
+	assert.Equal(t, 1, store.Len())
+}
+
+func TestIdempotencyStorePending(t *testing.T) {
+	store := NewIdempotencyStore(time.Hour, 0)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go store.Do("a", "x", func() []string {
+		close(started)
+		<-release
+		return []string{"1"}
+	})
+	<-started
+
+	// another key is not blocked by the number of "a".
+	ids, _, _ := store.Do("b", "x", func() []string { return []string{"2"} })
+	assert.Equal(t, []string{"2"}, ids)
+
+	// the same key waits for it and is replayed.
+	done := make(chan []string)
+	go func() {
+		ids, replayed, _ := store.Do("a", "x", func() []string { return []string{"3"} })
+		assert.True(t, replayed)
+		done <- ids
+	}()
+	select {
+	case <-done:
+		t.Fatal("returned before the pending number")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	assert.Equal(t, []string{"1"}, <-done)
+
+	_, _, conflict := store.Do("a", "y", func() []string { return nil })
+	assert.True(t, conflict)
+}
+
+func TestIdentifierKey(t *testing.T) {
+	n1 := RequestGaurunNotification{Tokens: []string{"a", "b"}, Platform: PlatFormIos, Identifier: "campaign"}
+	n2 := RequestGaurunNotification{Tokens: []string{"c"}, Platform: PlatFormIos, Identifier: "campaign"}
+	n3 := RequestGaurunNotification{Tokens: []string{"a", "b"}, Platform: PlatFormIos, Identifier: "campaign", Message: "other"}
+	assert.NotEqual(t, identifierKey(&n1), identifierKey(&n2))
+	assert.Equal(t, identifierKey(&n1), identifierKey(&n3))
+}
+
+func TestPushNotificationHandlerIdempotency(t *testing.T) {
+	IdempotencyKeys = NewIdempotencyStore(time.Hour, 0)
+	withConf(t)
+	ConfGaurun.Core.NotificationMax = 100
+	ConfGaurun.Ios.Enabled = false
+	ConfGaurun.Android.Enabled = false
+	defer func() {
+		IdempotencyKeys = nil
+	}()
+
+	post := func(key string, reqGaurun RequestGaurun) (*http.Response, ResponseGaurun) {
+		body, err := json.Marshal(reqGaurun)
+		require.Nil(t, err)
+		req := httptest.NewRequest("POST", "/push", bytes.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		PushNotificationHandler(w, req)
+		var respGaurun ResponseGaurun
+		require.Nil(t, json.NewDecoder(w.Body).Decode(&respGaurun))
+		return w.Result(), respGaurun
+	}
+
+	reqGaurun := RequestGaurun{
+		Notifications: []RequestGaurunNotification{
+			{Tokens: []string{"a", "b"}, Platform: PlatFormIos, Message: "hello"},
+		},
+	}
+
+	res, first := post("key", reqGaurun)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, 2, len(first.SeqIDs))
+	assert.Equal(t, "", res.Header.Get("Idempotent-Replayed"))
+
+	res, second := post("key", reqGaurun)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, first.SeqIDs, second.SeqIDs)
+	assert.Equal(t, "true", res.Header.Get("Idempotent-Replayed"))
+
+	res, third := post("", reqGaurun)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.NotEqual(t, first.SeqIDs, third.SeqIDs)
+
+	reqGaurun.Notifications[0].Message = "changed"
+	res, _ = post("key", reqGaurun)
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+}
@@ -0,0 +1,130 @@
+package gaurun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ingestRetryInterval is how long an ingester waits before enqueueing a
+// message again when the queue rejected it.
+const ingestRetryInterval = time.Second
+
+// errMalformedMessage is wrapped by the errors of decodeIngestMessage.
+var errMalformedMessage = errors.New("malformed message")
+
+// ingesterWg waits for Run of the ingesters to return.
+var ingesterWg sync.WaitGroup
+
+// Ingester consumes the same request body as POST /push from a message
+// broker.
+type Ingester interface {
+	// Name returns the name of the broker for logs.
+	Name() string
+	// Run consumes messages until Close is called.
+	Run() error
+	// Close stops Run. Messages not enqueued yet are delivered again.
+	Close() error
+}
+
+// decodeIngestMessage decodes a message in the request body format of
+// POST /push.
+func decodeIngestMessage(data []byte) ([]RequestGaurunNotification, error) {
+	var reqGaurun RequestGaurun
+	if err := json.Unmarshal(data, &reqGaurun); err != nil {
+		return nil, fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+	if len(reqGaurun.Notifications) == 0 {
+		return nil, fmt.Errorf("%w: empty notification", errMalformedMessage)
+	}
+	if int64(len(reqGaurun.Notifications)) > ConfGaurun.Core.NotificationMax {
+		return nil, fmt.Errorf("%w: number of notifications(%d) over limit(%d)", errMalformedMessage, len(reqGaurun.Notifications), ConfGaurun.Core.NotificationMax)
+	}
+	for i := range reqGaurun.Notifications {
+		reqGaurun.Notifications[i].clearInternalFields()
+	}
+	return reqGaurun.Notifications, nil
+}
+
+// ingestMessage numbers the notifications in data and enqueues them like
+// POST /push. While the queue rejects a notification, it retries from that
+// notification until closed returns true. It reports whether the message
+// is settled and may be committed to the broker; a malformed message is
+// dropped and settled so that it is not delivered again.
+func ingestMessage(name string, data []byte, closed func() bool) bool {
+	notifications, err := decodeIngestMessage(data)
+	if err != nil {
+		LogError.Error(fmt.Sprintf("drop message from %s: %v", name, err))
+		return true
+	}
+
+	numbered, ids := numberNotifications(notifications, true)
+	for len(numbered) > 0 {
+		n, err := enqueueNotifications(numbered)
+		if err == nil {
+			break
+		}
+		numbered = numbered[n:]
+		if closed() {
+			return false
+		}
+		time.Sleep(ingestRetryInterval)
+	}
+	LogError.Debug(fmt.Sprintf("ingested notifications from %s: seq_ids=%v", name, ids))
+	return true
+}
+
+// StartIngesters starts the ingesters enabled in the ingest section.
+func StartIngesters() error {
+	conf := ConfGaurun.Ingest
+	if conf.KafkaTopic != "" {
+		ingester, err := NewKafkaIngester(conf.KafkaBrokers, conf.KafkaTopic, conf.KafkaGroup)
+		if err != nil {
+			return err
+		}
+		Ingesters = append(Ingesters, ingester)
+	}
+	if conf.AmqpQueue != "" {
+		ingester, err := NewAmqpIngester(conf.AmqpURL, conf.AmqpQueue)
+		if err != nil {
+			return err
+		}
+		Ingesters = append(Ingesters, ingester)
+	}
+	if conf.NatsSubject != "" {
+		ingester, err := NewNatsIngester(conf.NatsURL, conf.NatsSubject, conf.NatsQueue)
+		if err != nil {
+			return err
+		}
+		Ingesters = append(Ingesters, ingester)
+	}
+
+	for _, ingester := range Ingesters {
+		startIngester(ingester)
+	}
+	return nil
+}
+
+func startIngester(ingester Ingester) {
+	ingesterWg.Add(1)
+	go func() {
+		defer ingesterWg.Done()
+		LogError.Info(fmt.Sprintf("start ingesting from %s", ingester.Name()))
+		if err := ingester.Run(); err != nil {
+			LogError.Error(fmt.Sprintf("failed to ingest from %s: %v", ingester.Name(), err))
+		}
+	}()
+}
+
+// StopIngesters stops all ingesters and waits until they return, so that
+// no notification is enqueued after it.
+func StopIngesters() {
+	for _, ingester := range Ingesters {
+		if err := ingester.Close(); err != nil {
+			LogError.Error(fmt.Sprintf("failed to stop ingesting from %s: %v", ingester.Name(), err))
+		}
+	}
+	ingesterWg.Wait()
+}
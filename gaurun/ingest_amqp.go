@@ -0,0 +1,80 @@
+package gaurun
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpIngestPrefetch is the number of messages delivered to gaurun before
+// they are acknowledged.
+const amqpIngestPrefetch = 100
+
+// AmqpIngester consumes an AMQP queue. A message is acknowledged after its
+// notifications are enqueued, and requeued if gaurun stops before that.
+type AmqpIngester struct {
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	queue   string
+	closed  int32
+}
+
+func NewAmqpIngester(url, queue string) (*AmqpIngester, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := channel.Qos(amqpIngestPrefetch, 0, false); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &AmqpIngester{
+		conn:    conn,
+		channel: channel,
+		queue:   queue,
+	}, nil
+}
+
+func (i *AmqpIngester) Name() string {
+	return "amqp:" + i.queue
+}
+
+func (i *AmqpIngester) Run() error {
+	deliveries, err := i.channel.Consume(i.queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	for d := range deliveries {
+		i.handle(d)
+	}
+	return nil
+}
+
+func (i *AmqpIngester) handle(d amqp.Delivery) {
+	var err error
+	if ingestMessage(i.Name(), d.Body, i.isClosed) {
+		err = d.Ack(false)
+	} else {
+		err = d.Nack(false, true)
+	}
+	if err != nil {
+		LogError.Error(fmt.Sprintf("failed to settle message from %s: %v", i.Name(), err))
+	}
+}
+
+func (i *AmqpIngester) Close() error {
+	if !atomic.CompareAndSwapInt32(&i.closed, 0, 1) {
+		return nil
+	}
+	return i.conn.Close()
+}
+
+func (i *AmqpIngester) isClosed() bool {
+	return atomic.LoadInt32(&i.closed) == 1
+}
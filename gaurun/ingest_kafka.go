@@ -0,0 +1,77 @@
+package gaurun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// KafkaIngester consumes a Kafka topic as a consumer group. The offset of
+// a record is committed after its notifications are enqueued.
+type KafkaIngester struct {
+	client *kgo.Client
+	topic  string
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewKafkaIngester(brokers []string, topic, group string) (*KafkaIngester, error) {
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(brokers...),
+		kgo.ConsumerGroup(group),
+		kgo.ConsumeTopics(topic),
+		kgo.DisableAutoCommit(),
+		kgo.BlockRebalanceOnPoll(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &KafkaIngester{
+		client: client,
+		topic:  topic,
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+func (i *KafkaIngester) Name() string {
+	return "kafka:" + i.topic
+}
+
+func (i *KafkaIngester) Run() error {
+	defer i.client.Close()
+	closed := func() bool { return i.ctx.Err() != nil }
+	for {
+		fetches := i.client.PollFetches(i.ctx)
+		if fetches.IsClientClosed() || closed() {
+			return nil
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			LogError.Error(fmt.Sprintf("failed to fetch from %s[%d]: %v", topic, partition, err))
+		})
+
+		var settled []*kgo.Record
+		iter := fetches.RecordIter()
+		for !iter.Done() {
+			record := iter.Next()
+			if !ingestMessage(i.Name(), record.Value, closed) {
+				break
+			}
+			settled = append(settled, record)
+		}
+		if len(settled) > 0 {
+			if err := i.client.CommitRecords(context.Background(), settled...); err != nil && !errors.Is(err, context.Canceled) {
+				LogError.Error(fmt.Sprintf("failed to commit offsets of %s: %v", i.Name(), err))
+			}
+		}
+		i.client.AllowRebalance()
+	}
+}
+
+func (i *KafkaIngester) Close() error {
+	i.cancel()
+	return nil
+}
@@ -0,0 +1,72 @@
+package gaurun
+
+import (
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NatsIngester subscribes a NATS subject in a queue group so that each
+// message is ingested by one of gaurun instances. Core NATS has no
+// acknowledgement, so messages received but not enqueued yet are lost when
+// gaurun stops.
+type NatsIngester struct {
+	conn    *nats.Conn
+	subject string
+	queue   string
+	msgs    chan *nats.Msg
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewNatsIngester(url, subject, queue string) (*NatsIngester, error) {
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	return &NatsIngester{
+		conn:    conn,
+		subject: subject,
+		queue:   queue,
+		msgs:    make(chan *nats.Msg, nats.DefaultSubPendingMsgsLimit),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (i *NatsIngester) Name() string {
+	return "nats:" + i.subject
+}
+
+func (i *NatsIngester) Run() error {
+	sub, err := i.conn.ChanQueueSubscribe(i.subject, i.queue, i.msgs)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	for {
+		select {
+		case msg := <-i.msgs:
+			ingestMessage(i.Name(), msg.Data, i.isClosed)
+		case <-i.done:
+			return nil
+		}
+	}
+}
+
+func (i *NatsIngester) Close() error {
+	i.closeOnce.Do(func() {
+		close(i.done)
+		i.conn.Close()
+	})
+	return nil
+}
+
+func (i *NatsIngester) isClosed() bool {
+	select {
+	case <-i.done:
+		return true
+	default:
+		return false
+	}
+}
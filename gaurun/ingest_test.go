@@ -0,0 +1,255 @@
+package gaurun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// rejectingQueue rejects pushes of the tokens in rejects as many times as
+// given.
+type rejectingQueue struct {
+	*NotificationQueue
+	rejects map[string]int
+}
+
+func newRejectingQueue() *rejectingQueue {
+	return &rejectingQueue{
+		NotificationQueue: NewNotificationQueue(10, nil, 0),
+		rejects:           map[string]int{},
+	}
+}
+
+func (q *rejectingQueue) Push(notification RequestGaurunNotification) error {
+	token := notification.Tokens[0]
+	if q.rejects[token] > 0 {
+		q.rejects[token]--
+		return ErrQueueFull
+	}
+	return q.NotificationQueue.Push(notification)
+}
+
+func ingestBody(tokens ...string) []byte {
+	var notifications []string
+	for _, token := range tokens {
+		notifications = append(notifications, fmt.Sprintf(`{"token":["ingest-%s"],"platform":1,"message":"hello"}`, token))
+	}
+	body := `{"notifications":[`
+	for i, n := range notifications {
+		if i > 0 {
+			body += ","
+		}
+		body += n
+	}
+	return []byte(body + "]}")
+}
+
+// ingestedTokens drains q and returns the tokens ingested by the test.
+// Notifications enqueued late by other tests are skipped.
+func ingestedTokens(q *NotificationQueue) []string {
+	var tokens []string
+	for q.Len() > 0 {
+		token := q.Pop().Tokens[0]
+		if strings.HasPrefix(token, "ingest-") {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// waitIngested waits until n tokens are ingested and returns them.
+func waitIngested(t *testing.T, q *NotificationQueue, n int) []string {
+	var tokens []string
+	for i := 0; i < 100 && len(tokens) < n; i++ {
+		tokens = append(tokens, ingestedTokens(q)...)
+		time.Sleep(50 * time.Millisecond)
+	}
+	return tokens
+}
+
+// runIngester runs ingester until the test ends.
+func runIngester(t *testing.T, ingester Ingester) {
+	startIngester(ingester)
+	t.Cleanup(func() {
+		ingester.Close()
+		ingesterWg.Wait()
+	})
+}
+
+func TestDecodeIngestMessage(t *testing.T) {
+	withPushConf(t)
+	withQueue(t, NewNotificationQueue(10, nil, 0))
+
+	_, err := decodeIngestMessage([]byte("{"))
+	assert.True(t, errors.Is(err, errMalformedMessage))
+	_, err = decodeIngestMessage([]byte(`{"notifications":[]}`))
+	assert.True(t, errors.Is(err, errMalformedMessage))
+	ConfGaurun.Core.NotificationMax = 1
+	_, err = decodeIngestMessage(ingestBody("a", "b"))
+	assert.True(t, errors.Is(err, errMalformedMessage))
+
+	notifications, err := decodeIngestMessage(ingestBody("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ingest-a"}, notifications[0].Tokens)
+}
+
+func TestIngestMessage(t *testing.T) {
+	queue := newRejectingQueue()
+	withPushConf(t)
+	withQueue(t, queue)
+
+	never := func() bool { return false }
+	assert.True(t, ingestMessage("test", []byte("broken"), never))
+	assert.Nil(t, ingestedTokens(queue.NotificationQueue))
+
+	// "b" is rejected once and enqueued again without "a".
+	queue.rejects["ingest-b"] = 1
+	assert.True(t, ingestMessage("test", ingestBody("a", "b"), never))
+	assert.Equal(t, []string{"ingest-a", "ingest-b"}, ingestedTokens(queue.NotificationQueue))
+
+	// closed while the queue rejects
+	queue.rejects["ingest-c"] = 1
+	always := func() bool { return true }
+	assert.False(t, ingestMessage("test", ingestBody("c"), always))
+	assert.Nil(t, ingestedTokens(queue.NotificationQueue))
+}
+
+func TestKafkaIngester(t *testing.T) {
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(1, "push"))
+	require.Nil(t, err)
+	defer cluster.Close()
+	queue := NewNotificationQueue(10, nil, 0)
+	withPushConf(t)
+	withQueue(t, queue)
+
+	producer, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	require.Nil(t, err)
+	defer producer.Close()
+	produce := func(body []byte) {
+		require.Nil(t, producer.ProduceSync(context.Background(), &kgo.Record{Topic: "push", Value: body}).FirstErr())
+	}
+	produce(ingestBody("a"))
+	produce([]byte("broken"))
+	produce(ingestBody("b"))
+
+	ingester, err := NewKafkaIngester(cluster.ListenAddrs(), "push", "gaurun")
+	require.Nil(t, err)
+	startIngester(ingester)
+	assert.Equal(t, []string{"ingest-a", "ingest-b"}, waitIngested(t, queue, 2))
+	ingester.Close()
+	ingesterWg.Wait()
+
+	// the committed records are not consumed again
+	produce(ingestBody("c"))
+	ingester, err = NewKafkaIngester(cluster.ListenAddrs(), "push", "gaurun")
+	require.Nil(t, err)
+	runIngester(t, ingester)
+	assert.Equal(t, []string{"ingest-c"}, waitIngested(t, queue, 1))
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, ingestedTokens(queue))
+}
+
+func TestNatsIngester(t *testing.T) {
+	s, shutdown := runNatsServer(t)
+	defer shutdown()
+	queue := NewNotificationQueue(10, nil, 0)
+	withPushConf(t)
+	withQueue(t, queue)
+
+	ingester, err := NewNatsIngester(s.ClientURL(), "gaurun.push", "gaurun")
+	require.Nil(t, err)
+	runIngester(t, ingester)
+
+	conn, err := nats.Connect(s.ClientURL())
+	require.Nil(t, err)
+	defer conn.Close()
+	// wait for the subscription
+	for i := 0; i < 100 && s.NumSubscriptions() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Nil(t, conn.Publish("gaurun.push", ingestBody("a", "b")))
+	assert.Equal(t, []string{"ingest-a", "ingest-b"}, waitIngested(t, queue, 2))
+}
+
+// amqpAcknowledger records how deliveries are settled.
+type amqpAcknowledger struct {
+	acked, nacked, requeued int
+}
+
+func (a *amqpAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked++
+	return nil
+}
+
+func (a *amqpAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.nacked++
+	if requeue {
+		a.requeued++
+	}
+	return nil
+}
+
+func (a *amqpAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestAmqpIngesterHandle(t *testing.T) {
+	queue := newRejectingQueue()
+	withPushConf(t)
+	withQueue(t, queue)
+
+	ack := &amqpAcknowledger{}
+	ingester := &AmqpIngester{queue: "push"}
+	ingester.handle(amqp.Delivery{Acknowledger: ack, Body: ingestBody("a")})
+	ingester.handle(amqp.Delivery{Acknowledger: ack, Body: []byte("broken")})
+	assert.Equal(t, 2, ack.acked)
+	assert.Equal(t, []string{"ingest-a"}, ingestedTokens(queue.NotificationQueue))
+
+	// requeued when closed before enqueued
+	ingester.closed = 1
+	queue.rejects["ingest-b"] = 1
+	ingester.handle(amqp.Delivery{Acknowledger: ack, Body: ingestBody("b")})
+	assert.Equal(t, 1, ack.requeued)
+	assert.Nil(t, ingestedTokens(queue.NotificationQueue))
+}
+
+// slowIngester returns from Run a while after Close.
+type slowIngester struct {
+	closed   chan struct{}
+	returned bool
+}
+
+func (i *slowIngester) Name() string { return "slow" }
+
+func (i *slowIngester) Run() error {
+	<-i.closed
+	time.Sleep(50 * time.Millisecond)
+	i.returned = true
+	return nil
+}
+
+func (i *slowIngester) Close() error {
+	close(i.closed)
+	return nil
+}
+
+func TestStopIngestersWaitsForRun(t *testing.T) {
+	ingestersBefore := Ingesters
+	defer func() { Ingesters = ingestersBefore }()
+
+	ingester := &slowIngester{closed: make(chan struct{})}
+	Ingesters = []Ingester{ingester}
+	startIngester(ingester)
+	StopIngesters()
+	assert.True(t, ingester.returned)
+}
@@ -1,10 +1,10 @@
 package gaurun
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"math"
-	"net/http"
-	"sync/atomic"
 	"time"
 
 	"github.com/client9/reopen"
@@ -12,45 +12,104 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
+// LogReq is an access log of a request, written on its completion.
 type LogReq struct {
-	Type          string `json:"type"`
-	Time          string `json:"time"`
-	URI           string `json:"uri"`
-	Method        string `json:"method"`
-	Proto         string `json:"proto"`
-	ContentLength int64  `json:"content_length"`
+	Type          string  `json:"type"`
+	Time          string  `json:"time"`
+	URI           string  `json:"uri"`
+	Method        string  `json:"method"`
+	Proto         string  `json:"proto"`
+	ContentLength int64   `json:"content_length"`
+	Status        int     `json:"status"`
+	Size          int64   `json:"size"`
+	Duration      float64 `json:"duration"`
+	RemoteAddr    string  `json:"remote_addr"`
+	UserAgent     string  `json:"user_agent"`
+	// APIKey is a hash of the API key given by the caller.
+	APIKey    string `json:"api_key,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// Notifications is the number of notifications accepted by POST /push.
+	Notifications int `json:"notifications,omitempty"`
 }
 
+// LogSchemaVersion is the version of the fields of push logs, written as
+// schema. Logs without schema are of version 1, whose id is a number.
+const LogSchemaVersion = 2
+
 type LogPushEntry struct {
+	Schema   int     `json:"schema"`
 	Type     string  `json:"type"`
 	Time     string  `json:"time"`
-	ID       uint64  `json:"id"`
+	ID       string  `json:"id"`
 	Platform string  `json:"platform"`
 	Token    string  `json:"token"`
 	Message  string  `json:"message"`
 	Ptime    float64 `json:"ptime"`
 	Error    string  `json:"error"`
+	// error classification of failed-push
+	ErrorCategory string `json:"error_category,omitempty"`
+	ErrorReason   string `json:"error_reason,omitempty"`
+	ErrorStatus   int    `json:"error_status,omitempty"`
+	// RequestID is the ID given by the caller of the request.
+	RequestID     string       `json:"request_id,omitempty"`
+	Identifier    string       `json:"identifier,omitempty"`
+	PriorityClass string       `json:"priority_class,omitempty"`
+	Retry         int          `json:"retry,omitempty"`
+	Extend        []ExtendJSON `json:"extend,omitempty"`
 	// Android
 	CollapseKey    string `json:"collapse_key,omitempty"`
 	DelayWhileIdle bool   `json:"delay_while_idle,omitempty"`
 	TimeToLive     int    `json:"time_to_live,omitempty"`
+	Priority       string `json:"priority,omitempty"`
+	Body           string `json:"body,omitempty"`
 	// iOS
 	Title            string `json:"title,omitempty"`
 	Subtitle         string `json:"subtitle,omitempty"`
+	PushType         string `json:"push_type,omitempty"`
 	Badge            int    `json:"badge,omitempty"`
 	Category         string `json:"category,omitempty"`
 	Sound            string `json:"sound,omitempty"`
 	ContentAvailable bool   `json:"content_available,omitempty"`
 	MutableContent   bool   `json:"mutable_content,omitempty"`
 	Expiry           int    `json:"expiry,omitempty"`
+	// Notification is the encoded copy of the whole notification in
+	// accepted-push, if enabled. See DecodeNotificationCopy.
+	Notification string `json:"notification,omitempty"`
+}
+
+// ParseLogPushEntry parses a line of push logs of any schema version.
+func ParseLogPushEntry(line []byte) (LogPushEntry, error) {
+	var entry LogPushEntry
+	err := json.Unmarshal(line, &entry)
+	if err == nil {
+		return entry, nil
+	}
+
+	// version 1 has id as a number
+	var v1 struct {
+		LogPushEntry
+		ID json.Number `json:"id"`
+	}
+	if err := json.Unmarshal(line, &v1); err != nil {
+		return entry, err
+	}
+	entry = v1.LogPushEntry
+	if entry.Schema == 0 {
+		entry.Schema = 1
+	}
+	entry.ID = v1.ID.String()
+	return entry, nil
 }
 
 type Reopener interface {
 	Reopen() error
 }
 
+// LogTimeLayout is the layout of time in the logs.
+const LogTimeLayout = "2006/01/02 15:04:05 MST"
+
 func LocalTimeEncoder(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
-	enc.AppendString(t.Format("2006/01/02 15:04:05 MST"))
+	enc.AppendString(t.Format(LogTimeLayout))
 }
 
 func InitLog(outString, levelString string) (*zap.Logger, Reopener, error) {
@@ -99,30 +158,32 @@ func LogSetupFatal(err error) {
 	log.Fatal(err)
 }
 
-func LogAcceptedRequest(r *http.Request) {
-	LogAccess.Info("",
-		zap.String("type", "accepted-request"),
-		zap.String("uri", r.URL.String()),
-		zap.String("method", r.Method),
-		zap.String("proto", r.Proto),
-		zap.Int64("content_length", r.ContentLength),
-	)
-}
-
-func LogPush(id uint64, status, token string, ptime float64, req RequestGaurunNotification, errPush error) {
-	var plat string
-	switch req.Platform {
-	case PlatFormIos:
-		plat = "ios"
-	case PlatFormAndroid:
-		plat = "android"
-	}
+func LogPush(id string, status, token string, ptime float64, req RequestGaurunNotification, errPush error) {
+	plat := platformName(req.Platform)
 
 	ptime = math.Floor(ptime*1000) / 1000 // %.3f conversion
 
+	publishEvent(id, status, token, ptime, req, errPush)
+	countIdentifier(status, req, errPush)
+
+	// the copy of the notification is made of the original.
+	original := req
+	token = LogRedactor.Redact(RedactFieldToken, token)
+	req = LogRedactor.RedactNotification(req)
+
 	errMsg := ""
+	errCategory, errReason, errStatus := zap.Skip(), zap.Skip(), zap.Skip()
 	if errPush != nil {
 		errMsg = errPush.Error()
+		if de := asDeliveryError(errPush); de != nil {
+			errCategory = zap.String("error_category", string(de.Category))
+			if de.Reason != "" {
+				errReason = zap.String("error_reason", de.Reason)
+			}
+			if de.StatusCode != 0 {
+				errStatus = zap.Int("error_status", de.StatusCode)
+			}
+		}
 	}
 
 	var logger func(string, ...zapcore.Field)
@@ -134,7 +195,13 @@ func LogPush(id uint64, status, token string, ptime float64, req RequestGaurunNo
 	case StatusFailedPush:
 		fallthrough
 	case StatusDisabledPush:
+		fallthrough
+	case StatusSuppressedPush:
+		fallthrough
+	case StatusExpiredPush:
 		logger = LogError.Error
+	case StatusRetriedPush:
+		logger = LogError.Warn
 	}
 
 	// omitempty request parameters handling.
@@ -186,14 +253,55 @@ func LogPush(id uint64, status, token string, ptime float64, req RequestGaurunNo
 	if req.Identifier != "" {
 		identifier = zap.String("identifier", req.Identifier)
 	}
+	priority := zap.Skip()
+	if req.Priority != "" {
+		priority = zap.String("priority", req.Priority)
+	}
+	body := zap.Skip()
+	if req.Body != "" {
+		body = zap.String("body", req.Body)
+	}
+	pushType := zap.Skip()
+	if req.PushType != "" {
+		pushType = zap.String("push_type", req.PushType)
+	}
+	priorityClass := zap.Skip()
+	if req.PriorityClass != "" {
+		priorityClass = zap.String("priority_class", req.PriorityClass)
+	}
+	retry := zap.Skip()
+	if req.Retry != 0 {
+		retry = zap.Int("retry", req.Retry)
+	}
+	extend := zap.Skip()
+	if len(req.Extend) > 0 {
+		extend = zap.Reflect("extend", req.Extend)
+	}
+	notification := zap.Skip()
+	if status == StatusAcceptedPush && ConfGaurun.Log.NotificationCopy {
+		copied, err := encodeNotificationCopy(original, notificationCopyRedact, notificationCopyKey)
+		if err != nil {
+			LogError.Error(fmt.Sprintf("failed to encode notification: seq_id=%s: %v", id, err))
+		} else {
+			notification = zap.String("notification", copied)
+		}
+	}
+	requestID := zap.Skip()
+	if req.RequestID != "" {
+		requestID = zap.String("request_id", req.RequestID)
+	}
 
 	logger(req.Message,
-		zap.Uint64("id", id),
+		zap.Int("schema", LogSchemaVersion),
+		zap.String("id", id),
 		zap.String("platform", plat),
 		zap.String("token", token),
 		zap.String("type", status),
 		zap.Float64("ptime", ptime),
 		zap.String("error", errMsg),
+		errCategory,
+		errReason,
+		errStatus,
 		collapseKey,
 		delayWhileIdle,
 		timeToLive,
@@ -206,9 +314,78 @@ func LogPush(id uint64, status, token string, ptime float64, req RequestGaurunNo
 		mutableContent,
 		expiry,
 		identifier,
+		requestID,
+		priority,
+		body,
+		pushType,
+		priorityClass,
+		retry,
+		extend,
+		notification,
 	)
 }
 
-func numberingPush() uint64 {
-	return atomic.AddUint64(&SeqID, 1)
+// notification rebuilds the notification logged by an accepted-push entry.
+// The copy of the notification is preferred if it can be decoded with key,
+// and fields redacted from it are taken from the entry.
+func (e *LogPushEntry) notification(key []byte) RequestGaurunNotification {
+	n := RequestGaurunNotification{
+		Tokens:           []string{e.Token},
+		Message:          e.Message,
+		CollapseKey:      e.CollapseKey,
+		DelayWhileIdle:   e.DelayWhileIdle,
+		TimeToLive:       e.TimeToLive,
+		Title:            e.Title,
+		Subtitle:         e.Subtitle,
+		Badge:            e.Badge,
+		Category:         e.Category,
+		Sound:            e.Sound,
+		ContentAvailable: e.ContentAvailable,
+		MutableContent:   e.MutableContent,
+		Expiry:           e.Expiry,
+		Identifier:       e.Identifier,
+		PriorityClass:    e.PriorityClass,
+		Extend:           e.Extend,
+		Priority:         e.Priority,
+		Body:             e.Body,
+		PushType:         e.PushType,
+		ID:               e.ID,
+		RequestID:        e.RequestID,
+	}
+	switch e.Platform {
+	case "ios":
+		n.Platform = PlatFormIos
+	case "android":
+		n.Platform = PlatFormAndroid
+	}
+	if t, err := time.ParseInLocation(LogTimeLayout, e.Time, time.Local); err == nil {
+		n.AcceptedAt = t.UnixNano() / int64(time.Millisecond)
+	}
+	if e.Notification != "" {
+		// fields in the copy override the entry.
+		if data, err := decodeNotificationCopyJSON(e.Notification, key); err == nil {
+			json.Unmarshal(data, &n)
+		}
+	}
+	return n
+}
+
+// hasCopy reports whether the entry has a copy of the notification which
+// can be decoded with key.
+func (e *LogPushEntry) hasCopy(key []byte) bool {
+	if e.Notification == "" {
+		return false
+	}
+	_, err := decodeNotificationCopyJSON(e.Notification, key)
+	return err == nil
+}
+
+func platformName(platform int) string {
+	switch platform {
+	case PlatFormIos:
+		return "ios"
+	case PlatFormAndroid:
+		return "android"
+	}
+	return ""
 }
@@ -0,0 +1,169 @@
+package gaurun
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// formats of the copy of a notification in the log, given by its first byte.
+	notificationCopyPlain     = 0
+	notificationCopyEncrypted = 1
+)
+
+var (
+	// notificationCopyKey encrypts the copies of notifications if not nil.
+	notificationCopyKey []byte
+	// notificationCopyRedact is the fields removed from the copies.
+	notificationCopyRedact []string
+)
+
+// InitNotificationCopy loads the key and the redacted fields of the copies
+// of notifications written to accepted-push logs.
+func InitNotificationCopy() error {
+	conf := ConfGaurun.Log
+	notificationCopyKey = nil
+	notificationCopyRedact = conf.NotificationRedact
+	if conf.NotificationKeyFile == "" {
+		// a plain copy would expose tokens and messages to anyone
+		// reading the log.
+		if conf.NotificationCopy {
+			return errors.New("notification_copy requires notification_key_file")
+		}
+		return nil
+	}
+	key, err := LoadNotificationKey(conf.NotificationKeyFile)
+	if err != nil {
+		return err
+	}
+	notificationCopyKey = key
+	return nil
+}
+
+// LoadNotificationKey reads a key of AES-256 encoded in base64 from path.
+func LoadNotificationKey(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("notification key must be in base64: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("notification key must be 32 bytes: %d", len(key))
+	}
+	return key, nil
+}
+
+// encodeNotificationCopy encodes n compactly as deflated JSON in base64,
+// leaving out the fields in redact and encrypted with key if not nil.
+func encodeNotificationCopy(n RequestGaurunNotification, redact []string, key []byte) (string, error) {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return "", err
+	}
+	if len(redact) > 0 {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return "", err
+		}
+		for _, name := range redact {
+			delete(fields, name)
+		}
+		if data, err = json.Marshal(fields); err != nil {
+			return "", err
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(notificationCopyPlain)
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return "", err
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	encoded := buf.Bytes()
+
+	if key != nil {
+		gcm, err := newNotificationCipher(key)
+		if err != nil {
+			return "", err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		sealed := append([]byte{notificationCopyEncrypted}, nonce...)
+		encoded = gcm.Seal(sealed, nonce, encoded[1:], nil)
+	}
+	return base64.RawStdEncoding.EncodeToString(encoded), nil
+}
+
+// DecodeNotificationCopy decodes a copy of a notification written to an
+// accepted-push log. key is required if the copy is encrypted. Redacted
+// fields are left empty.
+func DecodeNotificationCopy(s string, key []byte) (RequestGaurunNotification, error) {
+	var n RequestGaurunNotification
+	data, err := decodeNotificationCopyJSON(s, key)
+	if err != nil {
+		return n, err
+	}
+	err = json.Unmarshal(data, &n)
+	return n, err
+}
+
+func decodeNotificationCopyJSON(s string, key []byte) ([]byte, error) {
+	encoded, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) == 0 {
+		return nil, errors.New("empty notification copy")
+	}
+
+	deflated := encoded[1:]
+	switch encoded[0] {
+	case notificationCopyPlain:
+	case notificationCopyEncrypted:
+		if key == nil {
+			return nil, errors.New("notification copy is encrypted")
+		}
+		gcm, err := newNotificationCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(deflated) < gcm.NonceSize() {
+			return nil, errors.New("notification copy is too short")
+		}
+		nonce := deflated[:gcm.NonceSize()]
+		if deflated, err = gcm.Open(nil, nonce, deflated[gcm.NonceSize():], nil); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown format of notification copy: %d", encoded[0])
+	}
+
+	return io.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+}
+
+func newNotificationCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
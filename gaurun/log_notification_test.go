@@ -0,0 +1,142 @@
+package gaurun
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotificationCopy(t *testing.T) {
+	n := RequestGaurunNotification{
+		ID:       "01",
+		Tokens:   []string{"a"},
+		Platform: PlatFormIos,
+		Message:  "secret",
+		PushType: ApnsPushTypeBackground,
+		Extend:   []ExtendJSON{{Key: "k", Value: "v"}},
+	}
+
+	copied, err := encodeNotificationCopy(n, nil, nil)
+	require.Nil(t, err)
+	decoded, err := DecodeNotificationCopy(copied, nil)
+	require.Nil(t, err)
+	assert.Equal(t, n, decoded)
+
+	copied, err = encodeNotificationCopy(n, []string{"message"}, nil)
+	require.Nil(t, err)
+	decoded, err = DecodeNotificationCopy(copied, nil)
+	require.Nil(t, err)
+	assert.Equal(t, "", decoded.Message)
+	assert.Equal(t, n.Extend, decoded.Extend)
+
+	key := bytes.Repeat([]byte{1}, 32)
+	copied, err = encodeNotificationCopy(n, nil, key)
+	require.Nil(t, err)
+	decoded, err = DecodeNotificationCopy(copied, key)
+	require.Nil(t, err)
+	assert.Equal(t, n, decoded)
+	_, err = DecodeNotificationCopy(copied, nil)
+	assert.NotNil(t, err)
+	_, err = DecodeNotificationCopy(copied, bytes.Repeat([]byte{2}, 32))
+	assert.NotNil(t, err)
+}
+
+func TestLoadNotificationKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "key")
+	key := bytes.Repeat([]byte{1}, 32)
+	require.Nil(t, ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600))
+	loaded, err := LoadNotificationKey(path)
+	require.Nil(t, err)
+	assert.Equal(t, key, loaded)
+
+	require.Nil(t, ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key[:16])), 0600))
+	_, err = LoadNotificationKey(path)
+	assert.NotNil(t, err)
+}
+
+func TestParseLogPushEntry(t *testing.T) {
+	entry, err := ParseLogPushEntry([]byte(`{"type":"accepted-push","id":12,"token":"a"}`))
+	require.Nil(t, err)
+	assert.Equal(t, 1, entry.Schema)
+	assert.Equal(t, "12", entry.ID)
+
+	entry, err = ParseLogPushEntry([]byte(`{"schema":2,"type":"accepted-push","id":"01F4J7ZQ8R2C9XK6T00000001B","token":"a"}`))
+	require.Nil(t, err)
+	assert.Equal(t, 2, entry.Schema)
+	assert.Equal(t, "01F4J7ZQ8R2C9XK6T00000001B", entry.ID)
+
+	_, err = ParseLogPushEntry([]byte(`broken`))
+	assert.NotNil(t, err)
+}
+
+func TestLogPushNotificationCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	logAccessBefore := LogAccess
+	withConf(t)
+	defer func() {
+		LogAccess = logAccessBefore
+		notificationCopyKey = nil
+		notificationCopyRedact = nil
+	}()
+	path := filepath.Join(dir, "access.log")
+	LogAccess, _, err = InitLog(path, "info")
+	require.Nil(t, err)
+	ConfGaurun.Log.NotificationCopy = true
+	ConfGaurun.Log.NotificationRedact = []string{"vars"}
+	// the copy is not written in plain.
+	assert.NotNil(t, InitNotificationCopy())
+
+	key := bytes.Repeat([]byte{1}, 32)
+	ConfGaurun.Log.NotificationKeyFile = filepath.Join(dir, "notification.key")
+	require.Nil(t, ioutil.WriteFile(ConfGaurun.Log.NotificationKeyFile, []byte(base64.StdEncoding.EncodeToString(key)), 0600))
+	require.Nil(t, InitNotificationCopy())
+
+	n := RequestGaurunNotification{
+		ID:            "01",
+		Tokens:        []string{"a"},
+		Platform:      PlatFormAndroid,
+		Message:       "hello",
+		Body:          "body",
+		Priority:      "high",
+		PriorityClass: PriorityClassLow,
+		Vars:          map[string]string{"name": "gopher"},
+		AcceptedAt:    1000,
+	}
+	LogPush(n.ID, StatusAcceptedPush, "a", 0, n, nil)
+	LogPush(n.ID, StatusSucceededPush, "a", 0, n, nil)
+	LogAccess.Sync()
+
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	lines := bytes.Split(bytes.TrimSpace(b), []byte("\n"))
+	require.Len(t, lines, 2)
+
+	accepted, err := ParseLogPushEntry(lines[0])
+	require.Nil(t, err)
+	assert.Equal(t, LogSchemaVersion, accepted.Schema)
+	assert.Equal(t, "body", accepted.Body)
+	assert.Equal(t, "high", accepted.Priority)
+	assert.NotEqual(t, "", accepted.Notification)
+	assert.Equal(t, n.Message, accepted.notification(nil).Message)
+	recovered := accepted.notification(key)
+	expected := n
+	expected.Vars = nil
+	assert.Equal(t, expected, recovered)
+
+	succeeded, err := ParseLogPushEntry(lines[1])
+	require.Nil(t, err)
+	assert.Equal(t, "", succeeded.Notification)
+}
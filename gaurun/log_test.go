@@ -23,7 +23,7 @@ func BenchmarkLogPushIOSOmitempty(b *testing.B) {
 	}
 	errPush := fmt.Errorf("error")
 	for i := 0; i < b.N; i++ {
-		LogPush(uint64(100), StatusAcceptedPush, "xxx", 0.123, req, errPush)
+		LogPush("100", StatusAcceptedPush, "xxx", 0.123, req, errPush)
 	}
 }
 
@@ -37,6 +37,6 @@ func BenchmarkLogPushIOSFull(b *testing.B) {
 	}
 	errPush := fmt.Errorf("error")
 	for i := 0; i < b.N; i++ {
-		LogPush(uint64(100), StatusAcceptedPush, "xxx", 0.123, req, errPush)
+		LogPush("100", StatusAcceptedPush, "xxx", 0.123, req, errPush)
 	}
 }
@@ -0,0 +1,293 @@
+package gaurun
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MetricsSinkStatsD    = "statsd"
+	MetricsSinkDogStatsD = "dogstatsd"
+)
+
+// statsdPacketMax keeps a packet of metrics in a single Ethernet frame.
+const statsdPacketMax = 1432
+
+// MetricsEmitter sends metrics to a metrics agent. Tags are given as
+// "key:value". Metrics may be buffered until Flush.
+type MetricsEmitter interface {
+	Count(name string, value int64, tags ...string)
+	Gauge(name string, value float64, tags ...string)
+	Timing(name string, d time.Duration, tags ...string)
+	Flush() error
+	Close() error
+}
+
+// StatsDEmitter sends metrics to StatsD or DogStatsD over UDP. DogStatsD is
+// given tags as they are, while tag values are appended to the metric name
+// for StatsD, which has no tags.
+type StatsDEmitter struct {
+	conn      net.Conn
+	prefix    string
+	dogstatsd bool
+	// tags are the tags added to every metric, joined for DogStatsD or as
+	// the suffix of the names for StatsD.
+	tags string
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// NewStatsDEmitter returns an emitter sending metrics named with prefix to
+// addr. tags are added to every metric, before the tags of the metric.
+func NewStatsDEmitter(addr, prefix string, dogstatsd bool, tags []string) (*StatsDEmitter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	e := &StatsDEmitter{
+		conn:      conn,
+		prefix:    prefix,
+		dogstatsd: dogstatsd,
+	}
+	if dogstatsd {
+		e.tags = strings.Join(tags, ",")
+	} else {
+		var b strings.Builder
+		writeStatsDTags(&b, tags)
+		e.tags = b.String()
+	}
+	return e, nil
+}
+
+func (e *StatsDEmitter) Count(name string, value int64, tags ...string) {
+	e.write(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+func (e *StatsDEmitter) Gauge(name string, value float64, tags ...string) {
+	e.write(name, strconv.FormatFloat(value, 'f', -1, 64), "g", tags)
+}
+
+func (e *StatsDEmitter) Timing(name string, d time.Duration, tags ...string) {
+	e.write(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64), "ms", tags)
+}
+
+var (
+	// statsdName replaces the characters reserved by StatsD in names.
+	statsdName = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+	// dogstatsdTag replaces the characters reserved by DogStatsD in tags.
+	dogstatsdTag = strings.NewReplacer("|", "_", ",", "_", "\n", "_")
+)
+
+func (e *StatsDEmitter) line(name, value, kind string, tags []string) string {
+	var b strings.Builder
+	b.WriteString(e.prefix)
+	b.WriteString(statsdName.Replace(name))
+	if !e.dogstatsd {
+		b.WriteString(e.tags)
+		writeStatsDTags(&b, tags)
+	}
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(kind)
+	if e.dogstatsd && (e.tags != "" || len(tags) > 0) {
+		b.WriteString("|#")
+		b.WriteString(e.tags)
+		for i, tag := range tags {
+			if i > 0 || e.tags != "" {
+				b.WriteByte(',')
+			}
+			b.WriteString(dogstatsdTag.Replace(tag))
+		}
+	}
+	return b.String()
+}
+
+// writeStatsDTags appends the values of tags to a StatsD metric name.
+func writeStatsDTags(b *strings.Builder, tags []string) {
+	for _, tag := range tags {
+		if i := strings.IndexByte(tag, ':'); i >= 0 {
+			tag = tag[i+1:]
+		}
+		b.WriteByte('.')
+		b.WriteString(statsdName.Replace(strings.Replace(tag, ".", "_", -1)))
+	}
+}
+
+// write buffers a metric, sending the buffered ones first if the packet
+// would be too large.
+func (e *StatsDEmitter) write(name, value, kind string, tags []string) {
+	line := e.line(name, value, kind, tags)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.buf.Len() > 0 && e.buf.Len()+1+len(line) > statsdPacketMax {
+		e.flush()
+	}
+	if e.buf.Len() > 0 {
+		e.buf.WriteByte('\n')
+	}
+	e.buf.WriteString(line)
+}
+
+func (e *StatsDEmitter) flush() error {
+	if e.buf.Len() == 0 {
+		return nil
+	}
+	_, err := e.conn.Write(e.buf.Bytes())
+	e.buf.Reset()
+	return err
+}
+
+// Flush sends the buffered metrics. Metrics failed to be sent are dropped
+// as UDP does.
+func (e *StatsDEmitter) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.flush()
+}
+
+func (e *StatsDEmitter) Close() error {
+	err := e.Flush()
+	if cerr := e.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// MetricsReporter emits the metrics of pushes to an emitter and flushes it
+// with the gauges of the queue and pushers at flushInterval.
+type MetricsReporter struct {
+	emitter       MetricsEmitter
+	flushInterval time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewMetricsReporter(emitter MetricsEmitter, flushInterval time.Duration) *MetricsReporter {
+	r := &MetricsReporter{
+		emitter:       emitter,
+		flushInterval: flushInterval,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+func (r *MetricsReporter) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.report()
+		case <-r.stop:
+			r.report()
+			return
+		}
+	}
+}
+
+// report emits the gauges and flushes the emitter.
+func (r *MetricsReporter) report() {
+	if QueueNotification != nil {
+		r.emitter.Gauge("queue.max", float64(QueueNotification.Cap()))
+		r.emitter.Gauge("queue.usage", float64(QueueNotification.Len()))
+		for lane, n := range QueueNotification.LaneLen() {
+			r.emitter.Gauge("queue.lane", float64(n), "lane:"+lane)
+		}
+	}
+	r.emitter.Gauge("pusher.max", float64(atomic.LoadInt64(&ConfGaurun.Core.PusherMax)*ConfGaurun.Core.WorkerNum))
+	r.emitter.Gauge("pusher.count", float64(atomic.LoadInt64(&PusherCountAll)))
+	if Events != nil {
+		r.emitter.Gauge("events.dropped", float64(Events.Dropped()))
+	}
+	if err := r.emitter.Flush(); err != nil {
+		LogError.Warn(fmt.Sprintf("failed to send metrics: %v", err))
+	}
+}
+
+// Close reports the metrics left and closes the emitter.
+func (r *MetricsReporter) Close() error {
+	close(r.stop)
+	<-r.done
+	return r.emitter.Close()
+}
+
+// InitMetrics sets up the metrics emitter given by the configuration.
+func InitMetrics() error {
+	conf := ConfGaurun.Metrics
+	var dogstatsd bool
+	switch conf.Sink {
+	case "":
+		return nil
+	case MetricsSinkStatsD:
+	case MetricsSinkDogStatsD:
+		dogstatsd = true
+	default:
+		return fmt.Errorf("unknown metrics sink: %s", conf.Sink)
+	}
+	if conf.FlushInterval <= 0 {
+		return fmt.Errorf("metrics flush_interval must be positive")
+	}
+
+	var tags []string
+	if conf.App != "" {
+		tags = append(tags, "app:"+conf.App)
+	}
+	tags = append(tags, conf.Tags...)
+	emitter, err := NewStatsDEmitter(conf.Address, conf.Prefix, dogstatsd, tags)
+	if err != nil {
+		return err
+	}
+	Metrics = NewMetricsReporter(emitter, time.Duration(conf.FlushInterval)*time.Second)
+	return nil
+}
+
+func metricsPlatformTag(platform int) string {
+	return "platform:" + platformName(platform)
+}
+
+// emitPushCount counts a push of platform in name.
+func emitPushCount(name string, platform int) {
+	if Metrics == nil {
+		return
+	}
+	Metrics.emitter.Count(name, 1, metricsPlatformTag(platform))
+}
+
+// emitPushError counts a failed push with its category and reason.
+func emitPushError(de *DeliveryError) {
+	if Metrics == nil {
+		return
+	}
+	tags := []string{metricsPlatformTag(de.Platform), "category:" + string(de.Category)}
+	if de.Reason != "" {
+		tags = append(tags, "reason:"+de.Reason)
+	}
+	Metrics.emitter.Count("push.error", 1, tags...)
+}
+
+// emitPushTime records how long a push to APNs or FCM took.
+func emitPushTime(platform int, d time.Duration, err error) {
+	if Metrics == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	Metrics.emitter.Timing("push.time", d, metricsPlatformTag(platform), "result:"+result)
+}
@@ -0,0 +1,97 @@
+package gaurun
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listenStatsD(t *testing.T) (net.PacketConn, func() []string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	receive := func() []string {
+		buf := make([]byte, 65536)
+		require.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		require.Nil(t, err)
+		return strings.Split(string(buf[:n]), "\n")
+	}
+	return conn, receive
+}
+
+func TestStatsDEmitter(t *testing.T) {
+	conn, receive := listenStatsD(t)
+	defer conn.Close()
+
+	e, err := NewStatsDEmitter(conn.LocalAddr().String(), "gaurun", false, []string{"app:example", "env:prod.jp"})
+	require.Nil(t, err)
+	defer e.Close()
+	e.Count("push.error", 1, "platform:ios", "category:retryable", "reason:TooManyRequests")
+	e.Gauge("queue.usage", 12)
+	e.Timing("push.time", 1500*time.Microsecond, "platform:android", "result:success")
+	require.Nil(t, e.Flush())
+	assert.Equal(t, []string{
+		"gaurun.push.error.example.prod_jp.ios.retryable.TooManyRequests:1|c",
+		"gaurun.queue.usage.example.prod_jp:12|g",
+		"gaurun.push.time.example.prod_jp.android.success:1.5|ms",
+	}, receive())
+}
+
+func TestDogStatsDEmitter(t *testing.T) {
+	conn, receive := listenStatsD(t)
+	defer conn.Close()
+
+	e, err := NewStatsDEmitter(conn.LocalAddr().String(), "gaurun.", true, []string{"app:example"})
+	require.Nil(t, err)
+	defer e.Close()
+	e.Count("push.error", 1, "platform:ios", "reason:a|b")
+	e.Gauge("pusher.count", 3)
+	require.Nil(t, e.Flush())
+	assert.Equal(t, []string{
+		"gaurun.push.error:1|c|#app:example,platform:ios,reason:a_b",
+		"gaurun.pusher.count:3|g|#app:example",
+	}, receive())
+
+	// metrics over a packet are sent in another one.
+	for i := 0; i < 100; i++ {
+		e.Count("push.success", 1, "platform:android")
+	}
+	require.Nil(t, e.Flush())
+	received, packets := 0, 0
+	for received < 100 {
+		lines := receive()
+		assert.True(t, len(strings.Join(lines, "\n")) <= statsdPacketMax)
+		received += len(lines)
+		packets++
+	}
+	assert.Equal(t, 100, received)
+	assert.True(t, packets > 1)
+}
+
+func TestMetricsReporter(t *testing.T) {
+	conn, receive := listenStatsD(t)
+	defer conn.Close()
+
+	e, err := NewStatsDEmitter(conn.LocalAddr().String(), "gaurun", true, nil)
+	require.Nil(t, err)
+
+	defer func() { Metrics = nil }()
+	withQueue(t, NewNotificationQueue(10, nil, 0))
+	Metrics = NewMetricsReporter(e, time.Hour)
+
+	countPushSuccess(PlatFormIos)
+	countPushError(&DeliveryError{Platform: PlatFormAndroid, Category: ErrorCategoryTokenInvalid, Reason: "UNREGISTERED"})
+	emitPushTime(PlatFormIos, 2*time.Millisecond, nil)
+	require.Nil(t, Metrics.Close())
+
+	lines := receive()
+	assert.Contains(t, lines, "gaurun.push.success:1|c|#platform:ios")
+	assert.Contains(t, lines, "gaurun.push.error:1|c|#platform:android,category:token-invalid,reason:UNREGISTERED")
+	assert.Contains(t, lines, "gaurun.push.time:2|ms|#platform:ios,result:success")
+	assert.Contains(t, lines, "gaurun.queue.max:10|g")
+	assert.Contains(t, lines, "gaurun.queue.usage:0|g")
+}
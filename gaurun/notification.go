@@ -7,9 +7,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
-	"strconv"
-	"sync/atomic"
 	"time"
 
 	"firebase.google.com/go/messaging"
@@ -47,10 +46,93 @@ type RequestGaurunNotification struct {
 	ContentAvailable bool         `json:"content_available,omitempty"`
 	MutableContent   bool         `json:"mutable_content,omitempty"`
 	Expiry           int          `json:"expiry,omitempty"`
+	PriorityClass    string       `json:"priority_class,omitempty"`
 	Retry            int          `json:"retry,omitempty"`
 	Extend           []ExtendJSON `json:"extend,omitempty"`
+	// Template
+	Template string            `json:"template,omitempty"`
+	Locale   string            `json:"locale,omitempty"`
+	Vars     map[string]string `json:"vars,omitempty"`
 	// meta
-	ID uint64 `json:"seq_id,omitempty"`
+	ID         string `json:"seq_id,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+	AcceptedAt int64  `json:"accepted_at,omitempty"` // unix time in milliseconds
+	// W3C trace context of the request (traceparent and tracestate)
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+}
+
+// clearInternalFields zeroes the fields which gaurun sets itself, so
+// that the callers of POST /push and the brokers cannot set them, e.g.
+// backdate accepted_at to expire a notification at once.
+func (n *RequestGaurunNotification) clearInternalFields() {
+	n.ID = ""
+	n.Retry = 0
+	n.AcceptedAt = 0
+	n.TraceContext = nil
+}
+
+// acceptedTime returns when the notification was accepted, or now if it
+// has not been enqueued.
+func (n *RequestGaurunNotification) acceptedTime() time.Time {
+	if n.AcceptedAt == 0 {
+		return time.Now()
+	}
+	return time.Unix(0, n.AcceptedAt*int64(time.Millisecond))
+}
+
+// Deadline returns the time after which the notification is not worth
+// pushing, computed from expiry for iOS and time_to_live for Android since
+// the notification was accepted. The second return value is false if the
+// notification has no lifetime.
+func (n *RequestGaurunNotification) Deadline() (time.Time, bool) {
+	var lifetime int
+	switch n.Platform {
+	case PlatFormIos:
+		lifetime = n.Expiry
+	case PlatFormAndroid:
+		lifetime = n.TimeToLive
+	}
+	if lifetime <= 0 {
+		return time.Time{}, false
+	}
+	return n.acceptedTime().Add(time.Duration(lifetime) * time.Second), true
+}
+
+// isExpired reports whether the deadline of the notification has passed at now.
+func (n *RequestGaurunNotification) isExpired(now time.Time) bool {
+	deadline, ok := n.Deadline()
+	return ok && !now.Before(deadline)
+}
+
+// remainingTTL returns the lifetime left for the notification in seconds,
+// rounded up. It returns 0 if the notification has no lifetime.
+func (n *RequestGaurunNotification) remainingTTL() int {
+	deadline, ok := n.Deadline()
+	if !ok {
+		return 0
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		// expired while pushing. 1 second is the shortest to keep the lifetime.
+		return 1
+	}
+	return int(math.Ceil(remaining.Seconds()))
+}
+
+// WithRemainingLifetime returns n with expiry or time_to_live shortened
+// to the lifetime left since it was accepted, so that it keeps its
+// deadline when resubmitted to POST /push, which ignores accepted_at.
+func (n RequestGaurunNotification) WithRemainingLifetime() RequestGaurunNotification {
+	if remaining := n.remainingTTL(); remaining > 0 {
+		switch n.Platform {
+		case PlatFormIos:
+			n.Expiry = remaining
+		case PlatFormAndroid:
+			n.TimeToLive = remaining
+		}
+	}
+	n.AcceptedAt = 0
+	return n
 }
 
 type ExtendJSON struct {
@@ -59,7 +141,9 @@ type ExtendJSON struct {
 }
 
 type ResponseGaurun struct {
-	Message string `json:"message"`
+	Message   string   `json:"message"`
+	SeqIDs    []string `json:"seq_ids,omitempty"`
+	RequestID string   `json:"request_id,omitempty"`
 }
 
 type CertificatePem struct {
@@ -67,13 +151,66 @@ type CertificatePem struct {
 	Key  []byte
 }
 
-func enqueueNotifications(notifications []RequestGaurunNotification) {
+// numberNotifications validates notifications and splits them into one
+// notification per token, each numbered with its own ID. It returns the
+// notifications to enqueue and the IDs of all notifications.
+//
+// If dedupIdentifiers is true and the idempotency store is enabled for
+// identifiers, a notification whose identifier and tokens were already
+// accepted within the TTL is not returned for enqueueing again, but the IDs
+// assigned at that time are.
+func numberNotifications(notifications []RequestGaurunNotification, dedupIdentifiers bool) ([]RequestGaurunNotification, []string) {
+	var (
+		numbered []RequestGaurunNotification
+		ids      []string
+	)
 	for _, notification := range notifications {
 		err := validateNotification(&notification)
 		if err != nil {
 			LogError.Error(err.Error())
 			continue
 		}
+		if err := renderNotification(&notification); err != nil {
+			LogError.Error(err.Error())
+			continue
+		}
+		split := func() []string {
+			var splitIDs []string
+			for _, token := range notification.Tokens {
+				notification2 := notification
+				notification2.Tokens = []string{token}
+				notification2.ID = numberingPush()
+				numbered = append(numbered, notification2)
+				splitIDs = append(splitIDs, notification2.ID)
+			}
+			return splitIDs
+		}
+		if dedupIdentifiers && IdempotencyKeys != nil && ConfGaurun.Idempotency.UseIdentifier && notification.Identifier != "" {
+			key := identifierKey(&notification)
+			splitIDs, replayed, _ := IdempotencyKeys.Do(key, "", split)
+			if replayed {
+				LogError.Info(fmt.Sprintf("skip duplicated notification: identifier=%s", notification.Identifier))
+				// those the queue rejected before are enqueued by this retry.
+				numbered = append(numbered, IdempotencyKeys.TakeRejected(key)...)
+			}
+			ids = append(ids, splitIDs...)
+		} else {
+			ids = append(ids, split()...)
+		}
+	}
+	return numbered, ids
+}
+
+// enqueueNotifications enqueues notifications numbered by numberNotifications.
+// If the queue rejects a notification, it stops there and returns the number
+// of notifications handled before it. Notifications rejected as the queue is
+// stopped for shutdown are saved to the recovery file instead, if any.
+func enqueueNotifications(notifications []RequestGaurunNotification) (int, error) {
+	acceptedAt := time.Now().UnixNano() / int64(time.Millisecond)
+	for i, notification := range notifications {
+		if notification.AcceptedAt == 0 {
+			notification.AcceptedAt = acceptedAt
+		}
 		var enabledPush bool
 		switch notification.Platform {
 		case PlatFormIos:
@@ -81,22 +218,44 @@ func enqueueNotifications(notifications []RequestGaurunNotification) {
 		case PlatFormAndroid:
 			enabledPush = ConfGaurun.Android.Enabled
 		}
-		// Enqueue notification per token
-		for _, token := range notification.Tokens {
-			notification2 := notification
-			notification2.Tokens = []string{token}
-			notification2.ID = numberingPush()
-			if enabledPush {
-				LogPush(notification2.ID, StatusAcceptedPush, token, 0, notification2, nil)
-				QueueNotification <- notification2
-			} else {
-				LogPush(notification2.ID, StatusDisabledPush, token, 0, notification2, nil)
+		token := notification.Tokens[0]
+		if enabledPush && isSuppressedToken(notification.Platform, token) {
+			countPushSuppressed(notification.Platform)
+			LogPush(notification.ID, StatusSuppressedPush, token, 0, notification, nil)
+		} else if enabledPush {
+			span := startEnqueueSpan(notification)
+			err := QueueNotification.Push(notification)
+			endSpan(span, err)
+			if err == ErrQueueClosed && ConfGaurun.Core.RecoveryFile != "" {
+				rest := append([]RequestGaurunNotification{notification}, notifications[i+1:]...)
+				for j := range rest {
+					if rest[j].AcceptedAt == 0 {
+						rest[j].AcceptedAt = acceptedAt
+					}
+				}
+				if err = SaveRecoveryFile(ConfGaurun.Core.RecoveryFile, rest); err == nil {
+					LogError.Info(fmt.Sprintf("saved %d notifications to %s", len(rest), ConfGaurun.Core.RecoveryFile))
+					for _, saved := range rest {
+						LogPush(saved.ID, StatusAcceptedPush, saved.Tokens[0], 0, saved, nil)
+					}
+					return len(notifications), nil
+				}
 			}
+			if err != nil {
+				LogError.Error(fmt.Sprintf("failed to enqueue notification: seq_id=%s request_id=%s: %v", notification.ID, notification.RequestID, err))
+				return i, err
+			}
+			// only notifications enqueued are accepted, so that one rejected
+			// and retried by the caller is not accepted twice.
+			LogPush(notification.ID, StatusAcceptedPush, token, 0, notification, nil)
+		} else {
+			LogPush(notification.ID, StatusDisabledPush, token, 0, notification, nil)
 		}
 	}
+	return len(notifications), nil
 }
 
-func pushNotificationIos(req RequestGaurunNotification) error {
+func pushNotificationIos(ctx context.Context, req RequestGaurunNotification) error {
 	LogError.Debug("START push notification for iOS")
 
 	service := NewApnsServiceHttp2(APNSClient)
@@ -111,19 +270,26 @@ func pushNotificationIos(req RequestGaurunNotification) error {
 	}
 	payload := NewApnsPayloadHttp2(&req)
 
+	_, span := startUpstreamSpan(ctx, "apns push")
 	stime := time.Now()
 	err := ApnsPushHttp2(token, service, headers, payload)
 
 	etime := time.Now()
 	ptime := etime.Sub(stime).Seconds()
+	recordPushTime(req.Platform, etime.Sub(stime), err)
 
 	if err != nil {
-		atomic.AddInt64(&StatGaurun.Ios.PushError, 1)
-		LogPush(req.ID, StatusFailedPush, token, ptime, req, err)
-		return err
+		de := NewDeliveryError(PlatFormIos, err)
+		endUpstreamSpan(span, de)
+		countPushError(de)
+		recordInvalidToken(token, de)
+		LogPush(req.ID, StatusFailedPush, token, ptime, req, de)
+		return de
 	}
 
-	atomic.AddInt64(&StatGaurun.Ios.PushSuccess, 1)
+	endUpstreamSpan(span, nil)
+	countPushSuccess(PlatFormIos)
+	clearInvalidToken(PlatFormIos, token)
 	LogPush(req.ID, StatusSucceededPush, token, ptime, req, nil)
 
 	LogError.Debug("END push notification for iOS")
@@ -131,7 +297,7 @@ func pushNotificationIos(req RequestGaurunNotification) error {
 	return nil
 }
 
-func pushNotificationAndroid(req RequestGaurunNotification) error {
+func pushNotificationAndroid(ctx context.Context, req RequestGaurunNotification) error {
 	LogError.Debug("START push notification for Android")
 
 	data := map[string]interface{}{"message": req.Message}
@@ -146,28 +312,38 @@ func pushNotificationAndroid(req RequestGaurunNotification) error {
 	msg := gcm.NewMessage(data, token)
 	msg.CollapseKey = req.CollapseKey
 	msg.DelayWhileIdle = req.DelayWhileIdle
-	msg.TimeToLive = req.TimeToLive
+	msg.TimeToLive = req.remainingTTL()
 	msg.Priority = req.Priority
 
+	_, span := startUpstreamSpan(ctx, "fcm send")
 	stime := time.Now()
-	_, err := GCMClient.Send(msg)
+	resp, err := GCMClient.Send(msg)
 	etime := time.Now()
 	ptime := etime.Sub(stime).Seconds()
+	if err == nil {
+		err = resp.ResultError(0)
+	}
+	recordPushTime(req.Platform, etime.Sub(stime), err)
 	if err != nil {
-		atomic.AddInt64(&StatGaurun.Android.PushError, 1)
-		LogPush(req.ID, StatusFailedPush, token, ptime, req, err)
-		return err
+		de := NewDeliveryError(PlatFormAndroid, err)
+		endUpstreamSpan(span, de)
+		countPushError(de)
+		recordInvalidToken(token, de)
+		LogPush(req.ID, StatusFailedPush, token, ptime, req, de)
+		return de
 	}
 
+	endUpstreamSpan(span, nil)
 	LogPush(req.ID, StatusSucceededPush, token, ptime, req, nil)
 
-	atomic.AddInt64(&StatGaurun.Android.PushSuccess, int64(len(req.Tokens)))
+	countPushSuccess(PlatFormAndroid)
+	clearInvalidToken(PlatFormAndroid, token)
 	LogError.Debug("END push notification for Android")
 
 	return nil
 }
 
-func pushNotificationFCMV1(req RequestGaurunNotification) error {
+func pushNotificationFCMV1(ctx context.Context, req RequestGaurunNotification) error {
 	LogError.Debug("START push notification for FCMv1")
 
 	data := make(map[string]string)
@@ -177,11 +353,12 @@ func pushNotificationFCMV1(req RequestGaurunNotification) error {
 		}
 	}
 
-	sendContext := context.Background()
-	client, err := FirebaseApp.Messaging(sendContext)
+	client, err := FirebaseApp.Messaging(ctx)
 	if err != nil {
-		LogPush(req.ID, StatusFailedPush, "", time.Now().Sub(time.Now()).Seconds(), req, err)
-		return err
+		de := &DeliveryError{Platform: PlatFormAndroid, Category: ErrorCategoryAuth, Err: err}
+		countPushError(de)
+		LogPush(req.ID, StatusFailedPush, "", time.Now().Sub(time.Now()).Seconds(), req, de)
+		return de
 	}
 
 	token := req.Tokens[0]
@@ -209,25 +386,31 @@ func pushNotificationFCMV1(req RequestGaurunNotification) error {
 	if len(req.CollapseKey) > 0 {
 		msg.Android.CollapseKey = req.CollapseKey
 	}
-	durationStr := strconv.Itoa(req.TimeToLive)
-	ttl, err := time.ParseDuration(durationStr + "s")
-	if err != nil {
+	if remaining := req.remainingTTL(); remaining > 0 {
+		ttl := time.Duration(remaining) * time.Second
 		msg.Android.TTL = &ttl
 	}
 
+	sendContext, span := startUpstreamSpan(ctx, "fcm v1 send")
 	stime := time.Now()
 	_, err = client.Send(sendContext, msg)
 	etime := time.Now()
 	ptime := etime.Sub(stime).Seconds()
+	recordPushTime(req.Platform, etime.Sub(stime), err)
 	if err != nil {
-		atomic.AddInt64(&StatGaurun.Android.PushError, 1)
-		LogPush(req.ID, StatusFailedPush, token, ptime, req, err)
-		return err
+		de := NewDeliveryError(PlatFormAndroid, err)
+		endUpstreamSpan(span, de)
+		countPushError(de)
+		recordInvalidToken(token, de)
+		LogPush(req.ID, StatusFailedPush, token, ptime, req, de)
+		return de
 	}
 
+	endUpstreamSpan(span, nil)
 	LogPush(req.ID, StatusSucceededPush, token, ptime, req, nil)
 
-	atomic.AddInt64(&StatGaurun.Android.PushSuccess, int64(len(req.Tokens)))
+	countPushSuccess(PlatFormAndroid)
+	clearInvalidToken(PlatFormAndroid, token)
 	LogError.Debug("END push notification for FCMv1")
 
 	return nil
@@ -245,10 +428,29 @@ func validateNotification(notification *RequestGaurunNotification) error {
 		return errors.New("invalid platform")
 	}
 
-	if !ConfGaurun.Core.AllowsEmptyMessage && len(notification.Message) == 0 {
+	if !ConfGaurun.Core.AllowsEmptyMessage && len(notification.Message) == 0 && notification.Template == "" {
 		return errors.New("empty message")
 	}
 
+	if notification.Template != "" {
+		if Templates == nil {
+			return fmt.Errorf("template %s is not found", notification.Template)
+		}
+		if _, ok := Templates.Get(notification.Template); !ok {
+			return fmt.Errorf("template %s is not found", notification.Template)
+		}
+	}
+
+	if notification.PriorityClass != "" {
+		if notification.PriorityClass != PriorityClassHigh && notification.PriorityClass != PriorityClassNormal && notification.PriorityClass != PriorityClassLow {
+			return fmt.Errorf("priority_class must be %s, %s or %s", PriorityClassHigh, PriorityClassNormal, PriorityClassLow)
+		}
+	}
+
+	if !validRequestID(notification.RequestID) {
+		return fmt.Errorf("request_id must be at most %d printable characters", RequestIDMax)
+	}
+
 	if notification.PushType != "" {
 		if notification.PushType != ApnsPushTypeAlert && notification.PushType != ApnsPushTypeBackground {
 			return fmt.Errorf("push_type must be %s or %s", ApnsPushTypeAlert, ApnsPushTypeBackground)
@@ -258,10 +460,31 @@ func validateNotification(notification *RequestGaurunNotification) error {
 	return nil
 }
 
-func sendResponse(w http.ResponseWriter, msg string, code int) {
-	respGaurun := ResponseGaurun{
-		Message: msg,
+// validRequestID reports whether id is empty or short enough to log,
+// without spaces and control characters.
+func validRequestID(id string) bool {
+	if len(id) > RequestIDMax {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
 	}
+	return true
+}
+
+func sendResponse(w http.ResponseWriter, msg string, code int) {
+	writeResponse(w, ResponseGaurun{Message: msg}, code)
+}
+
+// sendPushResponse responds to POST /push with the IDs of the notifications
+// and the request ID given by the caller.
+func sendPushResponse(w http.ResponseWriter, ids []string, requestID string) {
+	writeResponse(w, ResponseGaurun{Message: "ok", SeqIDs: ids, RequestID: requestID}, http.StatusOK)
+}
+
+func writeResponse(w http.ResponseWriter, respGaurun ResponseGaurun, code int) {
 	buf := &bytes.Buffer{}
 
 	if err := json.NewEncoder(buf).Encode(respGaurun); err != nil {
@@ -277,8 +500,22 @@ func sendResponse(w http.ResponseWriter, msg string, code int) {
 	_, _ = w.Write(buf.Bytes())
 }
 
+// sendJSON writes v as the indented JSON response-body with status 200.
+func sendJSON(w http.ResponseWriter, v interface{}) {
+	respBody, err := json.MarshalIndent(v, "", " ")
+	if err != nil {
+		msg := "Response-body could not be created"
+		LogError.Error(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Server", serverHeader())
+	w.Write(respBody)
+}
+
 func PushNotificationHandler(w http.ResponseWriter, r *http.Request) {
-	LogAcceptedRequest(r)
 	LogError.Debug("push-request is Accepted")
 
 	LogError.Debug("method check")
@@ -287,6 +524,18 @@ func PushNotificationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx, span := startRequestSpan(r, "POST /push")
+	defer span.End()
+
+	requestID := r.Header.Get(RequestIDHeader)
+	if !validRequestID(requestID) {
+		sendResponse(w, fmt.Sprintf("%s must be at most %d printable characters", RequestIDHeader, RequestIDMax), http.StatusBadRequest)
+		return
+	}
+	if requestID != "" {
+		w.Header().Set(RequestIDHeader, requestID)
+	}
+
 	LogError.Debug("content-length check")
 	if r.ContentLength == 0 {
 		sendResponse(w, "request body is empty", http.StatusBadRequest)
@@ -305,7 +554,7 @@ func PushNotificationHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if m := LogError.Check(zap.DebugLevel, "parse request body"); m != nil {
-			m.Write(zap.String("body", string(reqBody)))
+			m.Write(zap.String("body", LogRedactor.redactRequestBody(reqBody)))
 		}
 		err = json.Unmarshal(reqBody, &reqGaurun)
 	} else {
@@ -330,9 +579,88 @@ func PushNotificationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	LogError.Debug("enqueue notification")
-	go enqueueNotifications(reqGaurun.Notifications)
+	LogError.Debug("number notification")
+	var (
+		numbered []RequestGaurunNotification
+		ids      []string
+	)
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	var fingerprint string
+	if idempotencyKey != "" && IdempotencyKeys != nil {
+		// the request ID differs between retries of the same request.
+		fingerprint = fingerprintNotifications(reqGaurun.Notifications)
+	}
+	for i := range reqGaurun.Notifications {
+		reqGaurun.Notifications[i].clearInternalFields()
+	}
+	if requestID != "" {
+		for i := range reqGaurun.Notifications {
+			if reqGaurun.Notifications[i].RequestID == "" {
+				reqGaurun.Notifications[i].RequestID = requestID
+			}
+		}
+	}
+	for i := range reqGaurun.Notifications {
+		injectTraceContext(ctx, &reqGaurun.Notifications[i])
+	}
+	if idempotencyKey != "" && IdempotencyKeys != nil {
+		var replayed, conflict bool
+		ids, replayed, conflict = IdempotencyKeys.Do("header:"+idempotencyKey, fingerprint, func() []string {
+			var numberedIDs []string
+			numbered, numberedIDs = numberNotifications(reqGaurun.Notifications, false)
+			return numberedIDs
+		})
+		if conflict {
+			msg := fmt.Sprintf("Idempotency-Key %s is reused for a different request", idempotencyKey)
+			LogError.Error(msg)
+			sendResponse(w, msg, http.StatusUnprocessableEntity)
+			return
+		}
+		if replayed {
+			LogError.Info(fmt.Sprintf("skip duplicated request: Idempotency-Key=%s", idempotencyKey))
+			w.Header().Set("Idempotent-Replayed", "true")
+			// those the queue rejected before are enqueued by this retry.
+			numbered = IdempotencyKeys.TakeRejected("header:" + idempotencyKey)
+		}
+	} else {
+		numbered, ids = numberNotifications(reqGaurun.Notifications, true)
+	}
+
+	if len(numbered) > 0 {
+		LogError.Debug("enqueue notification")
+		if _, ok := QueueNotification.(*NotificationQueue); ok {
+			// the memory queue blocks while full, which the caller does not wait for.
+			EnqueueWg.Add(1)
+			go func() {
+				defer EnqueueWg.Done()
+				enqueueNotifications(numbered)
+			}()
+		} else if n, err := enqueueNotifications(numbered); err != nil {
+			// the shared queues reject notifications while full, which the
+			// caller is told about to retry the rest.
+			rejected := numbered[n:]
+			rejectIdempotencyKeys(idempotencyKey, reqGaurun.Notifications, rejected)
+			rejectedIDs := make(map[string]bool, len(rejected))
+			for _, notification := range rejected {
+				rejectedIDs[notification.ID] = true
+			}
+			enqueuedIDs := make([]string, 0, len(ids))
+			for _, id := range ids {
+				if !rejectedIDs[id] {
+					enqueuedIDs = append(enqueuedIDs, id)
+				}
+			}
+			setAccessNotifications(r.Context(), len(enqueuedIDs))
+			writeResponse(w, ResponseGaurun{
+				Message:   fmt.Sprintf("enqueued %d of %d notifications: %v", len(enqueuedIDs), len(ids), err),
+				SeqIDs:    enqueuedIDs,
+				RequestID: requestID,
+			}, http.StatusServiceUnavailable)
+			return
+		}
+	}
 
 	LogError.Debug("response to client")
-	sendResponse(w, "ok", http.StatusOK)
+	setAccessNotifications(r.Context(), len(ids))
+	sendPushResponse(w, ids, requestID)
 }
@@ -1,13 +1,20 @@
 package gaurun
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestValidateNotification(t *testing.T) {
@@ -129,3 +136,144 @@ func TestSendResponse(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, string(body), "{\"message\":\"valid message\"}\n")
 }
+
+func TestNotificationDeadline(t *testing.T) {
+	acceptedAt := time.Now().Add(-20 * time.Second)
+	acceptedAtMs := acceptedAt.UnixNano() / int64(time.Millisecond)
+
+	ios := RequestGaurunNotification{Platform: PlatFormIos, Expiry: 60, AcceptedAt: acceptedAtMs}
+	deadline, ok := ios.Deadline()
+	assert.True(t, ok)
+	assert.Equal(t, acceptedAtMs+60000, deadline.UnixNano()/int64(time.Millisecond))
+	assert.False(t, ios.isExpired(time.Now()))
+	assert.True(t, ios.isExpired(time.Now().Add(time.Minute)))
+	remaining := ios.remainingTTL()
+	assert.True(t, remaining > 35 && remaining <= 40, remaining)
+
+	android := RequestGaurunNotification{Platform: PlatFormAndroid, TimeToLive: 10, AcceptedAt: acceptedAtMs}
+	assert.True(t, android.isExpired(time.Now()))
+	assert.Equal(t, 1, android.remainingTTL())
+
+	// no lifetime
+	noLifetime := RequestGaurunNotification{Platform: PlatFormIos, AcceptedAt: acceptedAtMs}
+	_, ok = noLifetime.Deadline()
+	assert.False(t, ok)
+	assert.False(t, noLifetime.isExpired(time.Now().Add(time.Hour)))
+	assert.Equal(t, 0, noLifetime.remainingTTL())
+
+	// not accepted yet
+	notAccepted := RequestGaurunNotification{Platform: PlatFormAndroid, TimeToLive: 10}
+	assert.Equal(t, 10, notAccepted.remainingTTL())
+
+	// resubmitted with the lifetime left
+	resubmitted := ios.WithRemainingLifetime()
+	assert.Equal(t, int64(0), resubmitted.AcceptedAt)
+	assert.True(t, resubmitted.Expiry > 35 && resubmitted.Expiry <= 40, resubmitted.Expiry)
+	assert.Equal(t, 0, noLifetime.WithRemainingLifetime().Expiry)
+}
+
+func TestPushNotificationHandlerInternalFields(t *testing.T) {
+	withConf(t)
+	ConfGaurun.Ios.Enabled = true
+	withQueue(t, NewNotificationQueue(10, nil, 0))
+
+	// the fields gaurun sets itself are not taken from the caller.
+	body := `{"notifications":[{"token":["a"],"platform":1,"message":"hello","expiry":60,"seq_id":"forged","retry":5,"accepted_at":1,"trace_context":{"traceparent":"forged"}}]}`
+	w := httptest.NewRecorder()
+	PushNotificationHandler(w, httptest.NewRequest("POST", "/push", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+	EnqueueWg.Wait()
+
+	msg, err := QueueNotification.Receive()
+	require.Nil(t, err)
+	n := msg.Notification
+	assert.NotEqual(t, "forged", n.ID)
+	assert.Equal(t, 0, n.Retry)
+	assert.Nil(t, n.TraceContext)
+	assert.False(t, n.isExpired(time.Now()))
+	assert.True(t, time.Since(n.acceptedTime()) < time.Minute)
+}
+
+func TestPushNotificationHandlerRequestID(t *testing.T) {
+	IdempotencyKeys = NewIdempotencyStore(time.Hour, 0)
+	withConf(t)
+	ConfGaurun.Core.NotificationMax = 100
+	ConfGaurun.Ios.Enabled = false
+	ConfGaurun.Android.Enabled = false
+	defer func() {
+		IdempotencyKeys = nil
+	}()
+
+	body := `{"notifications":[{"token":["a","b"],"platform":1,"message":"hello"}]}`
+	post := func(requestID string) (*http.Response, ResponseGaurun) {
+		req := httptest.NewRequest("POST", "/push", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", "key")
+		req.Header.Set(RequestIDHeader, requestID)
+		w := httptest.NewRecorder()
+		PushNotificationHandler(w, req)
+		var respGaurun ResponseGaurun
+		require.Nil(t, json.NewDecoder(w.Body).Decode(&respGaurun))
+		return w.Result(), respGaurun
+	}
+
+	res, first := post("req-1")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "req-1", res.Header.Get(RequestIDHeader))
+	assert.Equal(t, "req-1", first.RequestID)
+	assert.Equal(t, 2, len(first.SeqIDs))
+
+	// a retry with another request ID is not a different request.
+	res, second := post("req-2")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "req-2", second.RequestID)
+	assert.Equal(t, first.SeqIDs, second.SeqIDs)
+
+	res, _ = post("has space")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res, _ = post(strings.Repeat("x", RequestIDMax+1))
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestEnqueueNotificationsAccepted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	withConf(t)
+	logAccessBefore := LogAccess
+	defer func() {
+		LogAccess = logAccessBefore
+	}()
+	path := filepath.Join(dir, "access.log")
+	LogAccess, _, err = InitLog(path, "info")
+	require.Nil(t, err)
+	ConfGaurun.Ios.Enabled = true
+	queue := newRejectingQueue()
+	queue.rejects["b"] = 1
+	withQueue(t, queue)
+
+	notifications := []RequestGaurunNotification{
+		{ID: "1", Tokens: []string{"a"}, Platform: PlatFormIos, Message: "hello"},
+		{ID: "2", Tokens: []string{"b"}, Platform: PlatFormIos, Message: "hello"},
+	}
+	n, err := enqueueNotifications(notifications)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, ErrQueueFull, err)
+	// the retry of the rejected one is accepted once.
+	n, err = enqueueNotifications(notifications[n:])
+	assert.Equal(t, 1, n)
+	assert.Nil(t, err)
+	LogAccess.Sync()
+
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	var accepted []string
+	for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+		entry, err := ParseLogPushEntry(line)
+		require.Nil(t, err)
+		if entry.Type == StatusAcceptedPush {
+			accepted = append(accepted, entry.ID)
+		}
+	}
+	assert.Equal(t, []string{"1", "2"}, accepted)
+}
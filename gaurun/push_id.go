@@ -0,0 +1,125 @@
+package gaurun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+	"time"
+)
+
+// pushIDAlphabet is Crockford's base32 used by ULID.
+const pushIDAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+const pushIDSeqMask = 1<<48 - 1
+
+// PushIDGenerator numbers notifications with IDs in the format of ULID,
+// 26 characters sortable by the time they are generated. Its 128 bits are
+// a timestamp in milliseconds (48 bits), a hash of the instance (32 bits)
+// and a sequence starting at random (48 bits), so that IDs are unique
+// across instances and restarts.
+type PushIDGenerator struct {
+	instance uint32
+
+	mu     sync.Mutex
+	lastMs uint64
+	seq    uint64
+}
+
+// NewPushIDGenerator returns a generator for the instance. An empty
+// instance is given a random hash.
+func NewPushIDGenerator(instance string) *PushIDGenerator {
+	var b [10]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	g := &PushIDGenerator{
+		instance: binary.BigEndian.Uint32(b[:4]),
+		seq:      binary.BigEndian.Uint64(b[2:]) & pushIDSeqMask,
+	}
+	if instance != "" {
+		h := fnv.New32a()
+		h.Write([]byte(instance))
+		g.instance = h.Sum32()
+	}
+	return g
+}
+
+// New returns a new ID. IDs returned by a generator are strictly
+// increasing even if the clock goes back.
+func (g *PushIDGenerator) New() string {
+	g.mu.Lock()
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	if ms < g.lastMs {
+		ms = g.lastMs
+	}
+	g.seq = (g.seq + 1) & pushIDSeqMask
+	if g.seq == 0 {
+		// the sequence wrapped within the millisecond.
+		ms++
+	}
+	g.lastMs = ms
+	seq := g.seq
+	g.mu.Unlock()
+
+	hi := ms<<16 | uint64(g.instance>>16)
+	lo := uint64(g.instance&0xffff)<<48 | seq
+
+	var id [26]byte
+	for i := len(id) - 1; i >= 0; i-- {
+		id[i] = pushIDAlphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(id[:])
+}
+
+// PushIDTime returns the time when id was generated.
+func PushIDTime(id string) (time.Time, error) {
+	if len(id) != 26 {
+		return time.Time{}, fmt.Errorf("invalid push ID: %s", id)
+	}
+	var ms uint64
+	for i := 0; i < 10; i++ {
+		n := -1
+		for j := 0; j < len(pushIDAlphabet); j++ {
+			if id[i] == pushIDAlphabet[j] {
+				n = j
+				break
+			}
+		}
+		if n < 0 {
+			return time.Time{}, fmt.Errorf("invalid push ID: %s", id)
+		}
+		ms = ms<<5 | uint64(n)
+	}
+	return time.Unix(0, int64(ms)*int64(time.Millisecond)), nil
+}
+
+// instanceName returns the name identifying the running gaurun instance.
+func instanceName() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid()), nil
+}
+
+// InitPushIDs sets up PushIDs for the instance given by the configuration.
+func InitPushIDs() error {
+	instance := ConfGaurun.Core.InstanceID
+	if instance == "" {
+		var err error
+		if instance, err = instanceName(); err != nil {
+			return err
+		}
+	}
+	PushIDs = NewPushIDGenerator(instance)
+	return nil
+}
+
+func numberingPush() string {
+	return PushIDs.New()
+}
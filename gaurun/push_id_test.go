@@ -0,0 +1,53 @@
+package gaurun
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushIDGenerator(t *testing.T) {
+	g := NewPushIDGenerator("host-1")
+	ids := make([]string, 1000)
+	seen := make(map[string]bool)
+	for i := range ids {
+		ids[i] = g.New()
+		assert.Len(t, ids[i], 26)
+		seen[ids[i]] = true
+	}
+	assert.Len(t, seen, len(ids))
+	assert.True(t, sort.StringsAreSorted(ids))
+
+	// IDs of another instance differ even in the same millisecond.
+	other := NewPushIDGenerator("host-2")
+	other.seq = g.seq - 1
+	other.lastMs = g.lastMs
+	assert.NotEqual(t, g.New(), other.New())
+}
+
+func TestPushIDGeneratorClockBack(t *testing.T) {
+	g := NewPushIDGenerator("")
+	g.lastMs = uint64(time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond))
+	id1 := g.New()
+	id2 := g.New()
+	assert.True(t, id1 < id2)
+}
+
+func TestPushIDTime(t *testing.T) {
+	before := time.Now().Truncate(time.Millisecond)
+	id := NewPushIDGenerator("").New()
+	after := time.Now()
+
+	tm, err := PushIDTime(id)
+	require.Nil(t, err)
+	assert.False(t, tm.Before(before))
+	assert.False(t, tm.After(after))
+
+	_, err = PushIDTime("1")
+	assert.NotNil(t, err)
+	_, err = PushIDTime("UUUUUUUUUUUUUUUUUUUUUUUUUU")
+	assert.NotNil(t, err)
+}
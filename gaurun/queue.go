@@ -0,0 +1,414 @@
+package gaurun
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	PriorityClassHigh   = "high"
+	PriorityClassNormal = "normal"
+	PriorityClassLow    = "low"
+)
+
+const (
+	QueueBackendMemory = "memory"
+	QueueBackendRedis  = "redis"
+	QueueBackendNats   = "nats"
+)
+
+// PriorityClasses are the lanes of NotificationQueue from the highest.
+var PriorityClasses = []string{PriorityClassHigh, PriorityClassNormal, PriorityClassLow}
+
+var (
+	// ErrQueueClosed is returned after the queue is closed.
+	ErrQueueClosed = errors.New("queue is closed")
+	// ErrQueueFull is returned by backends which do not block while full.
+	ErrQueueFull = errors.New("queue is full")
+)
+
+// QueueProducer is the side of Queue used by the handlers.
+type QueueProducer interface {
+	// Push adds notification to the queue.
+	Push(notification RequestGaurunNotification) error
+}
+
+// QueueConsumer is the side of Queue used by the push workers.
+type QueueConsumer interface {
+	// Receive blocks until a notification is available. The notification
+	// must be acknowledged with QueueMessage.Ack once it is settled. It
+	// returns ErrQueueClosed after the queue is closed.
+	Receive() (*QueueMessage, error)
+}
+
+// Queue carries notifications from the handlers to the push workers.
+// NotificationQueue keeps them in memory, and the others share a backlog
+// between gaurun instances.
+type Queue interface {
+	QueueProducer
+	QueueConsumer
+	// Len returns the number of queued notifications.
+	Len() int
+	// Cap returns the maximum number of queued notifications.
+	Cap() int
+	// LaneLen returns the number of queued notifications per priority
+	// class, or nil if the backend has no lanes.
+	LaneLen() map[string]int
+	// Stop rejects new notifications. NotificationQueue is still received
+	// until it is empty, while the shared backends stop receiving at once
+	// and leave the rest to other instances.
+	Stop()
+	// Close stops the queue and releases the backend.
+	Close() error
+}
+
+// QueueMessage is a notification received from Queue.
+type QueueMessage struct {
+	Notification RequestGaurunNotification
+
+	ack func() error
+	// stopKeepAlive stops extending the claim on the notification, which
+	// the shared backends keep while it is being pushed.
+	stopKeepAlive func()
+}
+
+// Ack removes the notification from the queue. A notification which is
+// not acknowledged is delivered again by the shared backends.
+func (m *QueueMessage) Ack() error {
+	if m.stopKeepAlive != nil {
+		m.stopKeepAlive()
+	}
+	if m.ack == nil {
+		return nil
+	}
+	return m.ack()
+}
+
+// Release gives up the notification without acknowledging it. It reports
+// whether the queue delivers it again, which the shared backends do after
+// ack_wait.
+func (m *QueueMessage) Release() bool {
+	if m.stopKeepAlive != nil {
+		m.stopKeepAlive()
+	}
+	return m.ack != nil
+}
+
+// keepAlive calls touch every interval until the returned function is
+// called or stop is closed, so that a notification being pushed longer
+// than ack_wait is not delivered again to another instance.
+func keepAlive(interval time.Duration, stop <-chan struct{}, touch func() error) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := touch(); err != nil {
+					LogError.Warn(fmt.Sprintf("failed to extend the claim on notification: %v", err))
+				}
+			case <-done:
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// queueAgingEvery is how often a notification which has waited longer than
+// the aging threshold is served regardless of its lane: once every
+// queueAgingEvery pops at most, so that aged notifications do not starve
+// but the lanes are still served by their weights under a long backlog.
+const queueAgingEvery = 4
+
+// NotificationQueue is a bounded queue of notifications with a lane per
+// priority class. Lanes are served by smooth weighted round-robin, and
+// every queueAgingEvery pops, the notification which has waited the
+// longest beyond the aging threshold is served regardless of its lane so
+// that low lanes do not starve.
+type NotificationQueue struct {
+	capacity int
+	aging    time.Duration
+
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	lanes    []*queueLane
+	size     int
+	closed   bool
+	// sinceAged is the number of pops since an aged notification was served.
+	sinceAged int
+}
+
+type queueLane struct {
+	weight  int
+	current int
+	items   *list.List
+}
+
+type queueItem struct {
+	notification RequestGaurunNotification
+	enqueuedAt   time.Time
+}
+
+// NewNotificationQueue returns a queue holding at most capacity
+// notifications. weights are given per priority class, and a class without
+// a positive weight is weighted 1. aging less than or equal to zero
+// disables aging.
+func NewNotificationQueue(capacity int, weights map[string]int, aging time.Duration) *NotificationQueue {
+	q := &NotificationQueue{
+		capacity: capacity,
+		aging:    aging,
+	}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	for _, class := range PriorityClasses {
+		weight := weights[class]
+		if weight <= 0 {
+			weight = 1
+		}
+		q.lanes = append(q.lanes, &queueLane{weight: weight, items: list.New()})
+	}
+	return q
+}
+
+// laneIndex returns the lane of a priority class. Empty or unknown classes
+// are put on the normal lane.
+func laneIndex(class string) int {
+	for i, c := range PriorityClasses {
+		if c == class {
+			return i
+		}
+	}
+	return 1
+}
+
+// Push adds notification to the lane of its priority class. It blocks
+// while the queue is full.
+func (q *NotificationQueue) Push(notification RequestGaurunNotification) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.size >= q.capacity && !q.closed {
+		q.notFull.Wait()
+	}
+	if q.closed {
+		return ErrQueueClosed
+	}
+	q.lanes[laneIndex(notification.PriorityClass)].items.PushBack(&queueItem{
+		notification: notification,
+		enqueuedAt:   time.Now(),
+	})
+	q.size++
+	q.notEmpty.Signal()
+	return nil
+}
+
+// Pop removes the next notification to push. It blocks while the queue is
+// empty, and returns the zero value once the queue is closed and empty.
+func (q *NotificationQueue) Pop() RequestGaurunNotification {
+	notification, _ := q.pop()
+	return notification
+}
+
+// Receive is Pop for QueueConsumer. Notifications in memory need no
+// acknowledgement.
+func (q *NotificationQueue) Receive() (*QueueMessage, error) {
+	notification, ok := q.pop()
+	if !ok {
+		return nil, ErrQueueClosed
+	}
+	return &QueueMessage{Notification: notification}, nil
+}
+
+func (q *NotificationQueue) pop() (RequestGaurunNotification, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.size == 0 {
+		if q.closed {
+			return RequestGaurunNotification{}, false
+		}
+		q.notEmpty.Wait()
+	}
+
+	var lane *queueLane
+	if q.sinceAged >= queueAgingEvery-1 {
+		lane = q.agedLane(time.Now())
+	}
+	if lane == nil {
+		lane = q.weightedLane()
+		q.sinceAged++
+	} else {
+		q.sinceAged = 0
+	}
+	item := lane.items.Remove(lane.items.Front()).(*queueItem)
+	q.size--
+	q.notFull.Signal()
+	return item.notification, true
+}
+
+// agedLane returns the lane whose head has waited the longest beyond the
+// aging threshold, or nil if there is no such lane.
+func (q *NotificationQueue) agedLane(now time.Time) *queueLane {
+	if q.aging <= 0 {
+		return nil
+	}
+	var (
+		oldest   *queueLane
+		oldestAt time.Time
+	)
+	for _, lane := range q.lanes {
+		front := lane.items.Front()
+		if front == nil {
+			continue
+		}
+		enqueuedAt := front.Value.(*queueItem).enqueuedAt
+		if now.Sub(enqueuedAt) < q.aging {
+			continue
+		}
+		if oldest == nil || enqueuedAt.Before(oldestAt) {
+			oldest, oldestAt = lane, enqueuedAt
+		}
+	}
+	return oldest
+}
+
+// weightedLane picks a non-empty lane by smooth weighted round-robin.
+func (q *NotificationQueue) weightedLane() *queueLane {
+	var (
+		best  *queueLane
+		total int
+	)
+	for _, lane := range q.lanes {
+		if lane.items.Len() == 0 {
+			continue
+		}
+		lane.current += lane.weight
+		total += lane.weight
+		if best == nil || lane.current > best.current {
+			best = lane
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// Len returns the number of queued notifications.
+func (q *NotificationQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// Cap returns the maximum number of queued notifications.
+func (q *NotificationQueue) Cap() int {
+	return q.capacity
+}
+
+// LaneLen returns the number of queued notifications per priority class.
+func (q *NotificationQueue) LaneLen() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	lens := make(map[string]int, len(q.lanes))
+	for i, lane := range q.lanes {
+		lens[PriorityClasses[i]] = lane.items.Len()
+	}
+	return lens
+}
+
+// Stop rejects new notifications. Queued notifications are still received
+// until the queue is empty.
+func (q *NotificationQueue) Stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+func (q *NotificationQueue) Close() error {
+	q.Stop()
+	return nil
+}
+
+// Drain removes all queued notifications and returns them.
+func (q *NotificationQueue) Drain() []RequestGaurunNotification {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var notifications []RequestGaurunNotification
+	for _, lane := range q.lanes {
+		for e := lane.items.Front(); e != nil; e = e.Next() {
+			notifications = append(notifications, e.Value.(*queueItem).notification)
+		}
+		lane.items.Init()
+	}
+	q.size = 0
+	q.notFull.Broadcast()
+	return notifications
+}
+
+// InitQueue sets up QueueNotification on the backend given by the
+// configuration. queueNum is the capacity of the queue.
+func InitQueue(queueNum int64) error {
+	conf := ConfGaurun.Queue
+	ackWait := time.Duration(conf.AckWait) * time.Second
+	consumer := conf.Consumer
+	if consumer == "" {
+		var err error
+		if consumer, err = instanceName(); err != nil {
+			return err
+		}
+	}
+
+	var (
+		queue Queue
+		err   error
+	)
+	switch conf.Backend {
+	case "", QueueBackendMemory:
+		weights := map[string]int{
+			PriorityClassHigh:   ConfGaurun.Priority.HighWeight,
+			PriorityClassNormal: ConfGaurun.Priority.NormalWeight,
+			PriorityClassLow:    ConfGaurun.Priority.LowWeight,
+		}
+		aging := time.Duration(ConfGaurun.Priority.Aging) * time.Second
+		queue = NewNotificationQueue(int(queueNum), weights, aging)
+	case QueueBackendRedis:
+		if ackWait <= 0 {
+			return fmt.Errorf("ack_wait must be positive for the redis queue")
+		}
+		warnIgnoredPriority(conf.Backend)
+		queue, err = NewRedisQueue(conf.URL, conf.Stream, conf.Group, consumer, int(queueNum), ackWait)
+	case QueueBackendNats:
+		if ackWait <= 0 {
+			return fmt.Errorf("ack_wait must be positive for the nats queue")
+		}
+		warnIgnoredPriority(conf.Backend)
+		queue, err = NewNatsQueue(conf.URL, conf.Stream, conf.Group, int(queueNum), ackWait)
+	default:
+		return fmt.Errorf("unknown queue backend: %s", conf.Backend)
+	}
+	if err != nil {
+		return err
+	}
+	QueueNotification = queue
+	return nil
+}
+
+// warnIgnoredPriority warns that the priority section changed from the
+// defaults has no effect, as the shared backends have a single lane and
+// push notifications in the order they are enqueued regardless of
+// priority_class.
+func warnIgnoredPriority(backend string) {
+	if ConfGaurun.Priority != BuildDefaultConf().Priority {
+		LogError.Warn(fmt.Sprintf("priority section is ignored by the %s queue, which has no lanes", backend))
+	}
+}
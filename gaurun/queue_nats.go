@@ -0,0 +1,189 @@
+package gaurun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// natsQueueFetchWait bounds how long Receive waits in one fetch so that
+// it notices the queue is closed.
+const natsQueueFetchWait = time.Second
+
+// natsErrCodeStreamStoreFailed is returned by JetStream when a message is
+// discarded as the stream is full.
+const natsErrCodeStreamStoreFailed jetstream.ErrorCode = 10077
+
+// NatsQueue is a Queue on a NATS JetStream stream with work-queue
+// retention. All gaurun instances pull from one durable consumer, and a
+// notification is removed from the stream when it is acknowledged.
+// Notifications not acknowledged within ackWait, for example by a dead
+// instance, are delivered again to others. The instance pushing a
+// notification marks it in progress every ackWait/3 so that retries longer
+// than ackWait are not delivered again.
+type NatsQueue struct {
+	conn     *nats.Conn
+	stream   jetstream.Stream
+	consumer jetstream.Consumer
+	js       jetstream.JetStream
+	subject  string
+	capacity int
+	ackWait  time.Duration
+
+	closed    int32
+	closeOnce sync.Once
+	// done stops the keep-alives of the received notifications.
+	done chan struct{}
+}
+
+// NewNatsQueue connects to the NATS server given by url and creates the
+// stream and the durable consumer if they do not exist. The stream is
+// named stream and takes the subject of the same name.
+func NewNatsQueue(url, stream, durable string, capacity int, ackWait time.Duration) (*NatsQueue, error) {
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ctx := context.Background()
+	maxMsgs := int64(-1)
+	if capacity > 0 {
+		maxMsgs = int64(capacity)
+	}
+	s, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      stream,
+		Subjects:  []string{stream},
+		Retention: jetstream.WorkQueuePolicy,
+		MaxMsgs:   maxMsgs,
+		Discard:   jetstream.DiscardNew,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c, err := s.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:       durable,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       ackWait,
+		MaxAckPending: -1,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &NatsQueue{
+		conn:     conn,
+		stream:   s,
+		consumer: c,
+		js:       js,
+		subject:  stream,
+		capacity: capacity,
+		ackWait:  ackWait,
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Push publishes notification to the stream. It returns ErrQueueFull
+// instead of blocking when the stream holds capacity notifications.
+func (q *NatsQueue) Push(notification RequestGaurunNotification) error {
+	if q.isClosed() {
+		return ErrQueueClosed
+	}
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	_, err = q.js.Publish(context.Background(), q.subject, data)
+	var apiErr *jetstream.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode == natsErrCodeStreamStoreFailed {
+		return ErrQueueFull
+	}
+	return err
+}
+
+func (q *NatsQueue) Receive() (*QueueMessage, error) {
+	for {
+		if q.isClosed() {
+			return nil, ErrQueueClosed
+		}
+		batch, err := q.consumer.Fetch(1, jetstream.FetchMaxWait(natsQueueFetchWait))
+		if err != nil {
+			return nil, q.receiveError(err)
+		}
+		for msg := range batch.Messages() {
+			var notification RequestGaurunNotification
+			if err := json.Unmarshal(msg.Data(), &notification); err != nil {
+				LogError.Error(fmt.Sprintf("drop broken message in nats stream: %v", err))
+				if err := msg.Term(); err != nil {
+					LogError.Error(fmt.Sprintf("failed to drop message in nats stream: %v", err))
+				}
+				continue
+			}
+			return &QueueMessage{
+				Notification:  notification,
+				ack:           msg.Ack,
+				stopKeepAlive: keepAlive(q.ackWait/3, q.done, msg.InProgress),
+			}, nil
+		}
+		if err := batch.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) {
+			return nil, q.receiveError(err)
+		}
+	}
+}
+
+func (q *NatsQueue) receiveError(err error) error {
+	if q.isClosed() || errors.Is(err, nats.ErrConnectionClosed) {
+		return ErrQueueClosed
+	}
+	return err
+}
+
+func (q *NatsQueue) Len() int {
+	info, err := q.stream.Info(context.Background())
+	if err != nil {
+		LogError.Warn(fmt.Sprintf("failed to get info of nats stream: %v", err))
+		return 0
+	}
+	return int(info.State.Msgs)
+}
+
+func (q *NatsQueue) Cap() int {
+	return q.capacity
+}
+
+// LaneLen returns nil as the stream is not divided by priority class.
+func (q *NatsQueue) LaneLen() map[string]int {
+	return nil
+}
+
+// Stop makes Receive return ErrQueueClosed. Notifications received
+// already can still be acknowledged until Close.
+func (q *NatsQueue) Stop() {
+	atomic.StoreInt32(&q.closed, 1)
+}
+
+func (q *NatsQueue) Close() error {
+	q.Stop()
+	q.closeOnce.Do(func() {
+		close(q.done)
+		q.conn.Close()
+	})
+	return nil
+}
+
+func (q *NatsQueue) isClosed() bool {
+	return atomic.LoadInt32(&q.closed) == 1
+}
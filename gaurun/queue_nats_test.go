@@ -0,0 +1,83 @@
+package gaurun
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runNatsServer(t *testing.T) (*server.Server, func()) {
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  dir,
+	})
+	require.Nil(t, err)
+	go s.Start()
+	require.True(t, s.ReadyForConnections(5*time.Second))
+	return s, func() {
+		s.Shutdown()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNatsQueue(t *testing.T) {
+	s, shutdown := runNatsServer(t)
+	defer shutdown()
+
+	q1, err := NewNatsQueue(s.ClientURL(), "gaurun", "gaurun", 2, 500*time.Millisecond)
+	require.Nil(t, err)
+	defer q1.Close()
+	// the stream and the consumer already exist
+	q2, err := NewNatsQueue(s.ClientURL(), "gaurun", "gaurun", 2, 500*time.Millisecond)
+	require.Nil(t, err)
+	defer q2.Close()
+
+	assert.Nil(t, q1.Push(RequestGaurunNotification{ID: "1", Tokens: []string{"a"}}))
+	assert.Nil(t, q1.Push(RequestGaurunNotification{ID: "2", Tokens: []string{"b"}}))
+	assert.Equal(t, ErrQueueFull, q1.Push(RequestGaurunNotification{ID: "3"}))
+	assert.Equal(t, 2, q2.Len())
+	assert.Nil(t, q2.LaneLen())
+
+	msg, err := q1.Receive()
+	require.Nil(t, err)
+	assert.Equal(t, "1", msg.Notification.ID)
+	assert.Equal(t, []string{"a"}, msg.Notification.Tokens)
+	assert.Nil(t, msg.Ack())
+
+	// q1 receives 2 and keeps it while pushing longer than ackWait, then
+	// dies without ack and q2 receives it again.
+	msg, err = q1.Receive()
+	require.Nil(t, err)
+	assert.Equal(t, "2", msg.Notification.ID)
+	redelivered := make(chan *QueueMessage)
+	go func() {
+		m, err := q2.Receive()
+		assert.Nil(t, err)
+		redelivered <- m
+	}()
+	select {
+	case <-redelivered:
+		t.Fatal("delivered again while being pushed")
+	case <-time.After(time.Second):
+	}
+	assert.Nil(t, q1.Close())
+	select {
+	case msg = <-redelivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not delivered again after q1 died")
+	}
+	assert.Equal(t, "2", msg.Notification.ID)
+	assert.Nil(t, msg.Ack())
+
+	_, err = q1.Receive()
+	assert.Equal(t, ErrQueueClosed, err)
+}
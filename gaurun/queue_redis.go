@@ -0,0 +1,237 @@
+package gaurun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisQueueBlock bounds how long Receive waits in one XREADGROUP so that
+// pending notifications of dead consumers are claimed in time.
+const redisQueueBlock = time.Second
+
+const redisQueueField = "notification"
+
+// RedisQueue is a Queue on a Redis stream. All gaurun instances read the
+// stream as one consumer group, and a notification is deleted from the
+// stream when it is acknowledged. Notifications left pending longer than
+// claimIdle, for example by a dead instance, are claimed by others. The
+// instance pushing a notification claims it again every claimIdle/3 so
+// that retries longer than claimIdle are not claimed by others.
+type RedisQueue struct {
+	client    *redis.Client
+	stream    string
+	group     string
+	consumer  string
+	capacity  int
+	claimIdle time.Duration
+
+	mu        sync.Mutex
+	nextClaim time.Time
+	closed    int32
+	closeOnce sync.Once
+	// done stops the keep-alives of the received notifications.
+	done chan struct{}
+}
+
+// NewRedisQueue connects to the Redis given by url and creates the stream
+// and the consumer group if they do not exist.
+func NewRedisQueue(url, stream, group, consumer string, capacity int, claimIdle time.Duration) (*RedisQueue, error) {
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	q := &RedisQueue{
+		client:    redis.NewClient(opt),
+		stream:    stream,
+		group:     group,
+		consumer:  consumer,
+		capacity:  capacity,
+		claimIdle: claimIdle,
+		done:      make(chan struct{}),
+	}
+	err = q.client.XGroupCreateMkStream(context.Background(), stream, group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		q.client.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Push adds notification to the stream. It returns ErrQueueFull instead of
+// blocking when the stream holds capacity notifications.
+func (q *RedisQueue) Push(notification RequestGaurunNotification) error {
+	if q.isClosed() {
+		return ErrQueueClosed
+	}
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if q.capacity > 0 {
+		n, err := q.client.XLen(ctx, q.stream).Result()
+		if err != nil {
+			return err
+		}
+		if n >= int64(q.capacity) {
+			return ErrQueueFull
+		}
+	}
+	return q.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: q.stream,
+		Values: map[string]interface{}{redisQueueField: data},
+	}).Err()
+}
+
+func (q *RedisQueue) Receive() (*QueueMessage, error) {
+	ctx := context.Background()
+	for {
+		if q.isClosed() {
+			return nil, ErrQueueClosed
+		}
+
+		if q.claimDue() {
+			msgs, _, err := q.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   q.stream,
+				Group:    q.group,
+				Consumer: q.consumer,
+				MinIdle:  q.claimIdle,
+				Start:    "0-0",
+				Count:    1,
+			}).Result()
+			if err != nil {
+				return nil, q.receiveError(err)
+			}
+			if len(msgs) > 0 {
+				if m, ok := q.message(msgs[0]); ok {
+					return m, nil
+				}
+				continue
+			}
+		}
+
+		streams, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    q.group,
+			Consumer: q.consumer,
+			Streams:  []string{q.stream, ">"},
+			Count:    1,
+			Block:    redisQueueBlock,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, q.receiveError(err)
+		}
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				if m, ok := q.message(msg); ok {
+					return m, nil
+				}
+			}
+		}
+	}
+}
+
+// claimDue reports whether it is time to look for pending notifications
+// of dead consumers. Only one Receive in claimIdle/2 looks for them.
+func (q *RedisQueue) claimDue() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	if now.Before(q.nextClaim) {
+		return false
+	}
+	q.nextClaim = now.Add(q.claimIdle / 2)
+	return true
+}
+
+// message decodes msg. A message which is not a notification is dropped
+// so that it is not delivered forever.
+func (q *RedisQueue) message(msg redis.XMessage) (*QueueMessage, bool) {
+	ack := func() error {
+		ctx := context.Background()
+		_, err := q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.XAck(ctx, q.stream, q.group, msg.ID)
+			pipe.XDel(ctx, q.stream, msg.ID)
+			return nil
+		})
+		return err
+	}
+
+	var notification RequestGaurunNotification
+	data, _ := msg.Values[redisQueueField].(string)
+	if err := json.Unmarshal([]byte(data), &notification); err != nil {
+		LogError.Error(fmt.Sprintf("drop broken message %s in redis stream: %v", msg.ID, err))
+		if err := ack(); err != nil {
+			LogError.Error(fmt.Sprintf("failed to drop message %s in redis stream: %v", msg.ID, err))
+		}
+		return nil, false
+	}
+	touch := func() error {
+		return q.client.XClaimJustID(context.Background(), &redis.XClaimArgs{
+			Stream:   q.stream,
+			Group:    q.group,
+			Consumer: q.consumer,
+			Messages: []string{msg.ID},
+		}).Err()
+	}
+	return &QueueMessage{
+		Notification:  notification,
+		ack:           ack,
+		stopKeepAlive: keepAlive(q.claimIdle/3, q.done, touch),
+	}, true
+}
+
+func (q *RedisQueue) receiveError(err error) error {
+	if q.isClosed() || errors.Is(err, redis.ErrClosed) {
+		return ErrQueueClosed
+	}
+	return err
+}
+
+func (q *RedisQueue) Len() int {
+	n, err := q.client.XLen(context.Background(), q.stream).Result()
+	if err != nil {
+		LogError.Warn(fmt.Sprintf("failed to get length of redis stream: %v", err))
+		return 0
+	}
+	return int(n)
+}
+
+func (q *RedisQueue) Cap() int {
+	return q.capacity
+}
+
+// LaneLen returns nil as the stream is not divided by priority class.
+func (q *RedisQueue) LaneLen() map[string]int {
+	return nil
+}
+
+// Stop makes Receive return ErrQueueClosed. Notifications received
+// already can still be acknowledged until Close.
+func (q *RedisQueue) Stop() {
+	atomic.StoreInt32(&q.closed, 1)
+}
+
+func (q *RedisQueue) Close() error {
+	q.Stop()
+	var err error
+	q.closeOnce.Do(func() {
+		close(q.done)
+		err = q.client.Close()
+	})
+	return err
+}
+
+func (q *RedisQueue) isClosed() bool {
+	return atomic.LoadInt32(&q.closed) == 1
+}
@@ -0,0 +1,129 @@
+package gaurun
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisQueue(t *testing.T) {
+	s := miniredis.RunT(t)
+	url := "redis://" + s.Addr()
+
+	q1, err := NewRedisQueue(url, "gaurun", "gaurun", "node1", 2, 200*time.Millisecond)
+	require.Nil(t, err)
+	defer q1.Close()
+	// the group already exists
+	q2, err := NewRedisQueue(url, "gaurun", "gaurun", "node2", 2, 200*time.Millisecond)
+	require.Nil(t, err)
+	defer q2.Close()
+
+	assert.Nil(t, q1.Push(RequestGaurunNotification{ID: "1", Tokens: []string{"a"}}))
+	assert.Nil(t, q1.Push(RequestGaurunNotification{ID: "2", Tokens: []string{"b"}}))
+	assert.Equal(t, ErrQueueFull, q1.Push(RequestGaurunNotification{ID: "3"}))
+	assert.Equal(t, 2, q2.Len())
+	assert.Nil(t, q2.LaneLen())
+
+	msg, err := q1.Receive()
+	require.Nil(t, err)
+	assert.Equal(t, "1", msg.Notification.ID)
+	assert.Equal(t, []string{"a"}, msg.Notification.Tokens)
+	assert.Nil(t, msg.Ack())
+	assert.Equal(t, 1, q1.Len())
+
+	// node1 receives 2 and keeps it while pushing longer than claimIdle,
+	// then releases it without ack and node2 claims it.
+	msg, err = q1.Receive()
+	require.Nil(t, err)
+	assert.Equal(t, "2", msg.Notification.ID)
+	claimed := make(chan *QueueMessage)
+	go func() {
+		m, err := q2.Receive()
+		assert.Nil(t, err)
+		claimed <- m
+	}()
+	select {
+	case <-claimed:
+		t.Fatal("claimed while being pushed")
+	case <-time.After(600 * time.Millisecond):
+	}
+	assert.True(t, msg.Release())
+	select {
+	case msg = <-claimed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not claimed after released")
+	}
+	assert.Equal(t, "2", msg.Notification.ID)
+	assert.Nil(t, msg.Ack())
+	assert.Equal(t, 0, q2.Len())
+
+	assert.Nil(t, q1.Close())
+	_, err = q1.Receive()
+	assert.Equal(t, ErrQueueClosed, err)
+	assert.Equal(t, ErrQueueClosed, q1.Push(RequestGaurunNotification{}))
+}
+
+func TestPushNotificationHandlerQueueFull(t *testing.T) {
+	s := miniredis.RunT(t)
+	q, err := NewRedisQueue("redis://"+s.Addr(), "gaurun", "gaurun", "node1", 1, time.Minute)
+	require.Nil(t, err)
+	defer q.Close()
+
+	withConf(t)
+	defer func() {
+		IdempotencyKeys = nil
+	}()
+	ConfGaurun.Ios.Enabled = true
+	withQueue(t, q)
+	IdempotencyKeys = NewIdempotencyStore(time.Hour, 0)
+
+	post := func(idempotencyKey string) (int, ResponseGaurun) {
+		req := httptest.NewRequest("POST", "/push", strings.NewReader(`{"notifications":[{"token":["a","b"],"platform":1,"message":"hello","identifier":"x"}]}`))
+		if idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+		w := httptest.NewRecorder()
+		PushNotificationHandler(w, req)
+		var respGaurun ResponseGaurun
+		require.Nil(t, json.NewDecoder(w.Body).Decode(&respGaurun))
+		return w.Code, respGaurun
+	}
+	receive := func() string {
+		msg, err := q.Receive()
+		require.Nil(t, err)
+		require.Nil(t, msg.Ack())
+		return msg.Notification.Tokens[0]
+	}
+
+	for _, idempotencyKey := range []string{"key", ""} {
+		ConfGaurun.Idempotency.UseIdentifier = idempotencyKey == ""
+
+		// the caller is told the notifications the full stream rejected.
+		code, respGaurun := post(idempotencyKey)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		require.Equal(t, 1, len(respGaurun.SeqIDs))
+		first := respGaurun.SeqIDs[0]
+		assert.Equal(t, "a", receive())
+
+		// and the retry enqueues only those rejected, with their seq_ids.
+		code, respGaurun = post(idempotencyKey)
+		assert.Equal(t, http.StatusOK, code)
+		require.Equal(t, 2, len(respGaurun.SeqIDs))
+		assert.Equal(t, first, respGaurun.SeqIDs[0])
+		assert.Equal(t, 1, q.Len())
+		assert.Equal(t, "b", receive())
+
+		// which are enqueued only once.
+		code, respGaurun = post(idempotencyKey)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 2, len(respGaurun.SeqIDs))
+		assert.Equal(t, 0, q.Len())
+	}
+}
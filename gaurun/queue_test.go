@@ -0,0 +1,124 @@
+package gaurun
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotificationQueueWeighted(t *testing.T) {
+	weights := map[string]int{PriorityClassHigh: 3, PriorityClassNormal: 2, PriorityClassLow: 1}
+	q := NewNotificationQueue(100, weights, 0)
+
+	for i := 0; i < 6; i++ {
+		for _, class := range PriorityClasses {
+			q.Push(RequestGaurunNotification{PriorityClass: class})
+		}
+	}
+	assert.Equal(t, 18, q.Len())
+	assert.Equal(t, map[string]int{PriorityClassHigh: 6, PriorityClassNormal: 6, PriorityClassLow: 6}, q.LaneLen())
+
+	counts := map[string]int{}
+	for i := 0; i < 6; i++ {
+		counts[q.Pop().PriorityClass]++
+	}
+	assert.Equal(t, map[string]int{PriorityClassHigh: 3, PriorityClassNormal: 2, PriorityClassLow: 1}, counts)
+}
+
+func TestNotificationQueueDefaultLane(t *testing.T) {
+	q := NewNotificationQueue(10, nil, 0)
+	q.Push(RequestGaurunNotification{Message: "no class"})
+	assert.Equal(t, 1, q.LaneLen()[PriorityClassNormal])
+	assert.Equal(t, "no class", q.Pop().Message)
+}
+
+func TestNotificationQueueAging(t *testing.T) {
+	weights := map[string]int{PriorityClassHigh: 100, PriorityClassNormal: 1, PriorityClassLow: 1}
+	q := NewNotificationQueue(100, weights, 20*time.Millisecond)
+
+	q.Push(RequestGaurunNotification{PriorityClass: PriorityClassLow, Message: "old"})
+	time.Sleep(30 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		q.Push(RequestGaurunNotification{PriorityClass: PriorityClassHigh})
+	}
+
+	// the low notification has waited beyond aging, so it is served within
+	// queueAgingEvery pops in spite of its weight.
+	for i := 0; i < queueAgingEvery-1; i++ {
+		assert.Equal(t, PriorityClassHigh, q.Pop().PriorityClass)
+	}
+	assert.Equal(t, "old", q.Pop().Message)
+}
+
+func TestNotificationQueueAgingBacklog(t *testing.T) {
+	weights := map[string]int{PriorityClassHigh: 100, PriorityClassNormal: 1, PriorityClassLow: 1}
+	q := NewNotificationQueue(100, weights, time.Millisecond)
+
+	for i := 0; i < 40; i++ {
+		q.Push(RequestGaurunNotification{PriorityClass: PriorityClassLow})
+	}
+	for i := 0; i < 40; i++ {
+		q.Push(RequestGaurunNotification{PriorityClass: PriorityClassHigh})
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// under a backlog older than aging, the high lane still gets most pops.
+	counts := map[string]int{}
+	for i := 0; i < 20; i++ {
+		counts[q.Pop().PriorityClass]++
+	}
+	assert.Equal(t, 15, counts[PriorityClassHigh])
+	assert.Equal(t, 5, counts[PriorityClassLow])
+}
+
+func TestNotificationQueueBlocking(t *testing.T) {
+	q := NewNotificationQueue(1, nil, 0)
+	q.Push(RequestGaurunNotification{Message: "first"})
+
+	pushed := make(chan struct{})
+	go func() {
+		q.Push(RequestGaurunNotification{Message: "second"})
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("push must block while the queue is full")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	assert.Equal(t, "first", q.Pop().Message)
+	<-pushed
+	assert.Equal(t, "second", q.Pop().Message)
+	assert.Equal(t, 1, q.Cap())
+}
+
+func TestNotificationQueueClose(t *testing.T) {
+	q := NewNotificationQueue(10, nil, 0)
+	assert.Nil(t, q.Push(RequestGaurunNotification{Message: "queued"}))
+	assert.Nil(t, q.Close())
+
+	assert.Equal(t, ErrQueueClosed, q.Push(RequestGaurunNotification{Message: "rejected"}))
+
+	// queued notifications are still received after closed
+	msg, err := q.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, "queued", msg.Notification.Message)
+	assert.Nil(t, msg.Ack())
+
+	_, err = q.Receive()
+	assert.Equal(t, ErrQueueClosed, err)
+}
+
+func TestNotificationQueueDrain(t *testing.T) {
+	q := NewNotificationQueue(10, nil, 0)
+	q.Push(RequestGaurunNotification{PriorityClass: PriorityClassLow, Message: "low"})
+	q.Push(RequestGaurunNotification{PriorityClass: PriorityClassHigh, Message: "high"})
+
+	drained := q.Drain()
+	assert.Equal(t, 2, len(drained))
+	assert.Equal(t, "high", drained[0].Message)
+	assert.Equal(t, "low", drained[1].Message)
+	assert.Equal(t, 0, q.Len())
+}
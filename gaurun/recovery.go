@@ -0,0 +1,86 @@
+package gaurun
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// SaveRecoveryFile appends notifications to the recovery file as NDJSON.
+func SaveRecoveryFile(path string, notifications []RequestGaurunNotification) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, notification := range notifications {
+		if err := enc.Encode(notification); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadRecoveryFile reads notifications saved by SaveRecoveryFile. It
+// returns nil if the file does not exist.
+func LoadRecoveryFile(path string) ([]RequestGaurunNotification, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var notifications []RequestGaurunNotification
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var notification RequestGaurunNotification
+		if err := json.Unmarshal(scanner.Bytes(), &notification); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, notification)
+	}
+	return notifications, scanner.Err()
+}
+
+// RecoverNotifications enqueues the notifications left in the recovery
+// file by the last shutdown and removes the file. Notifications the queue
+// rejects are kept in the file.
+func RecoverNotifications() error {
+	path := ConfGaurun.Core.RecoveryFile
+	if path == "" {
+		return nil
+	}
+	notifications, err := LoadRecoveryFile(path)
+	if err != nil || len(notifications) == 0 {
+		return err
+	}
+
+	LogError.Info(fmt.Sprintf("recover %d notifications from %s", len(notifications), path))
+	n, enqueueErr := enqueueNotifications(notifications)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if enqueueErr != nil {
+		if err := SaveRecoveryFile(path, notifications[n:]); err != nil {
+			return err
+		}
+		return enqueueErr
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package gaurun
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoveryFile(t *testing.T) {
+	path := withRecoveryFile(t)
+
+	notifications, err := LoadRecoveryFile(path)
+	assert.Nil(t, err)
+	assert.Nil(t, notifications)
+
+	n1 := RequestGaurunNotification{ID: "1", Tokens: []string{"a"}, Platform: PlatFormIos, Message: "hello", Retry: 1, AcceptedAt: 1000}
+	n2 := RequestGaurunNotification{ID: "2", Tokens: []string{"b"}, Platform: PlatFormAndroid, Message: "hello"}
+	require.Nil(t, SaveRecoveryFile(path, []RequestGaurunNotification{n1}))
+	// appended
+	require.Nil(t, SaveRecoveryFile(path, []RequestGaurunNotification{n2}))
+
+	notifications, err = LoadRecoveryFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []RequestGaurunNotification{n1, n2}, notifications)
+}
+
+func TestRecoverNotifications(t *testing.T) {
+	path := withRecoveryFile(t)
+	queue := NewNotificationQueue(10, nil, 0)
+	withQueue(t, queue)
+
+	n := RequestGaurunNotification{ID: "1", Tokens: []string{"a"}, Platform: PlatFormIos, Message: "hello", AcceptedAt: 1000}
+	require.Nil(t, SaveRecoveryFile(path, []RequestGaurunNotification{n}))
+	require.Nil(t, RecoverNotifications())
+
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	require.Equal(t, 1, queue.Len())
+	// accepted_at is kept so that the lifetime is not extended.
+	assert.Equal(t, n, queue.Pop())
+}
+
+func TestShutdownPushWorkersSavesLeftovers(t *testing.T) {
+	path := withRecoveryFile(t)
+	// no worker is running, so all notifications are left.
+	queue := NewNotificationQueue(10, nil, 0)
+	withQueue(t, queue)
+	n := RequestGaurunNotification{ID: "1", Tokens: []string{"a"}, Platform: PlatFormIos, Message: "hello"}
+	require.Nil(t, queue.Push(n))
+
+	require.Nil(t, ShutdownPushWorkers(context.Background()))
+	assert.Equal(t, 0, queue.Len())
+	notifications, err := LoadRecoveryFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []RequestGaurunNotification{n}, notifications)
+
+	// notifications enqueued after the queue is stopped are saved as well.
+	count, err := enqueueNotifications([]RequestGaurunNotification{{ID: "2", Tokens: []string{"b"}, Platform: PlatFormIos, Message: "hello"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	notifications, err = LoadRecoveryFile(path)
+	assert.Nil(t, err)
+	require.Equal(t, 2, len(notifications))
+	assert.Equal(t, "2", notifications[1].ID)
+}
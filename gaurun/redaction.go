@@ -0,0 +1,228 @@
+package gaurun
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	RedactDrop     = "drop"
+	RedactTruncate = "truncate"
+	RedactHash     = "hash"
+)
+
+// fields of notifications which can be redacted in the logs.
+const (
+	RedactFieldToken    = "token"
+	RedactFieldMessage  = "message"
+	RedactFieldTitle    = "title"
+	RedactFieldSubtitle = "subtitle"
+	RedactFieldBody     = "body"
+	RedactFieldExtend   = "extend"
+	RedactFieldVars     = "vars"
+)
+
+// redactHashPrefix tells hashed values from raw ones, e.g. APNs tokens,
+// which are hex as well.
+const redactHashPrefix = "hmac:"
+
+var redactFields = []string{
+	RedactFieldToken,
+	RedactFieldMessage,
+	RedactFieldTitle,
+	RedactFieldSubtitle,
+	RedactFieldBody,
+	RedactFieldExtend,
+	RedactFieldVars,
+}
+
+// Redactor redacts fields of notifications before they are written to the
+// logs and the event sink. Hashes are HMAC-SHA256 with a secret key, so
+// that they are stable across restarts and instances sharing the key and
+// a value can be found in the logs by its hash.
+type Redactor struct {
+	policies map[string]string
+	key      []byte
+	truncate int
+}
+
+func NewRedactor(policies map[string]string, key []byte, truncate int) (*Redactor, error) {
+	for field, policy := range policies {
+		known := false
+		for _, f := range redactFields {
+			if f == field {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown field to redact: %s", field)
+		}
+		switch policy {
+		case RedactDrop:
+		case RedactTruncate:
+			if truncate <= 0 {
+				return nil, fmt.Errorf("truncate_length must be positive to truncate %s", field)
+			}
+		case RedactHash:
+			if len(key) == 0 {
+				return nil, fmt.Errorf("key_file is required to hash %s", field)
+			}
+		default:
+			return nil, fmt.Errorf("unknown redaction policy for %s: %s", field, policy)
+		}
+	}
+	return &Redactor{policies: policies, key: key, truncate: truncate}, nil
+}
+
+// Redact redacts value of field by its policy. A nil Redactor leaves
+// values as they are.
+func (r *Redactor) Redact(field, value string) string {
+	if r == nil || value == "" {
+		return value
+	}
+	switch r.policies[field] {
+	case RedactDrop:
+		return ""
+	case RedactTruncate:
+		if utf8.RuneCountInString(value) <= r.truncate {
+			return value
+		}
+		return string([]rune(value)[:r.truncate]) + "..."
+	case RedactHash:
+		return r.Hash(value)
+	}
+	return value
+}
+
+// Hash returns the hash of value written to the logs.
+func (r *Redactor) Hash(value string) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(value))
+	return redactHashPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// RedactNotification returns a copy of n with its fields redacted.
+func (r *Redactor) RedactNotification(n RequestGaurunNotification) RequestGaurunNotification {
+	if r == nil {
+		return n
+	}
+	tokens := make([]string, 0, len(n.Tokens))
+	for _, token := range n.Tokens {
+		tokens = append(tokens, r.Redact(RedactFieldToken, token))
+	}
+	n.Tokens = tokens
+	n.Message = r.Redact(RedactFieldMessage, n.Message)
+	n.Title = r.Redact(RedactFieldTitle, n.Title)
+	n.Subtitle = r.Redact(RedactFieldSubtitle, n.Subtitle)
+	n.Body = r.Redact(RedactFieldBody, n.Body)
+	n.Extend = r.redactExtend(n.Extend)
+	n.Vars = r.redactVars(n.Vars)
+	return n
+}
+
+// redactVars redacts the values of vars by the policy of vars, or by that
+// of message if not given since they are rendered into the message.
+func (r *Redactor) redactVars(vars map[string]string) map[string]string {
+	field := RedactFieldVars
+	if r.policies[field] == "" {
+		field = RedactFieldMessage
+	}
+	if r.policies[field] == "" || len(vars) == 0 {
+		return vars
+	}
+	if r.policies[field] == RedactDrop {
+		return nil
+	}
+	redacted := make(map[string]string, len(vars))
+	for k, v := range vars {
+		redacted[k] = r.Redact(field, v)
+	}
+	return redacted
+}
+
+func (r *Redactor) redactExtend(extend []ExtendJSON) []ExtendJSON {
+	if r == nil || r.policies[RedactFieldExtend] == "" || len(extend) == 0 {
+		return extend
+	}
+	if r.policies[RedactFieldExtend] == RedactDrop {
+		return nil
+	}
+	redacted := make([]ExtendJSON, 0, len(extend))
+	for _, e := range extend {
+		e.Value = r.Redact(RedactFieldExtend, e.Value)
+		redacted = append(redacted, e)
+	}
+	return redacted
+}
+
+// redactRequestBody returns the request-body of POST /push to write to the
+// debug log.
+func (r *Redactor) redactRequestBody(body []byte) string {
+	if r == nil {
+		return string(body)
+	}
+	var req RequestGaurun
+	if err := json.Unmarshal(body, &req); err != nil {
+		return fmt.Sprintf("(malformed request-body of %d bytes)", len(body))
+	}
+	for i := range req.Notifications {
+		req.Notifications[i] = r.RedactNotification(req.Notifications[i])
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Sprintf("(request-body of %d bytes)", len(body))
+	}
+	return string(b)
+}
+
+// InitRedaction creates LogRedactor unless no field is redacted. It fails
+// if the copies of notifications in the logs, which are not redacted, are
+// not encrypted.
+func InitRedaction() error {
+	conf := ConfGaurun.Redaction
+	LogRedactor = nil
+	if len(conf.Fields) == 0 {
+		return nil
+	}
+	if ConfGaurun.Log.NotificationCopy && ConfGaurun.Log.NotificationKeyFile == "" {
+		return errors.New("notification_key_file is required to redact fields with notification_copy")
+	}
+	var key []byte
+	if conf.KeyFile != "" {
+		var err error
+		if key, err = LoadRedactionKey(conf.KeyFile); err != nil {
+			return err
+		}
+	}
+	redactor, err := NewRedactor(conf.Fields, key, conf.TruncateLength)
+	if err != nil {
+		return err
+	}
+	LogRedactor = redactor
+	return nil
+}
+
+// LoadRedactionKey reads a key of HMAC encoded in base64 from path.
+func LoadRedactionKey(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("redaction key must be in base64: %v", err)
+	}
+	if len(key) < 16 {
+		return nil, fmt.Errorf("redaction key must be at least 16 bytes: %d", len(key))
+	}
+	return key, nil
+}
@@ -0,0 +1,178 @@
+package gaurun
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var redactionKey = []byte("0123456789abcdef")
+
+func TestRedactor(t *testing.T) {
+	r, err := NewRedactor(map[string]string{
+		RedactFieldToken:   RedactHash,
+		RedactFieldMessage: RedactTruncate,
+		RedactFieldBody:    RedactDrop,
+		RedactFieldExtend:  RedactHash,
+	}, redactionKey, 5)
+	require.Nil(t, err)
+
+	// hashes are stable and differ by keys.
+	hashed := r.Redact(RedactFieldToken, "token-a")
+	assert.True(t, strings.HasPrefix(hashed, "hmac:"), hashed)
+	assert.Len(t, hashed, len("hmac:")+64)
+	assert.Equal(t, hashed, r.Redact(RedactFieldToken, "token-a"))
+	assert.NotEqual(t, hashed, r.Redact(RedactFieldToken, "token-b"))
+	other, err := NewRedactor(map[string]string{RedactFieldToken: RedactHash}, []byte("fedcba9876543210"), 0)
+	require.Nil(t, err)
+	assert.NotEqual(t, hashed, other.Redact(RedactFieldToken, "token-a"))
+
+	assert.Equal(t, "こんにちは...", r.Redact(RedactFieldMessage, "こんにちは、世界"))
+	assert.Equal(t, "hello", r.Redact(RedactFieldMessage, "hello"))
+	assert.Equal(t, "", r.Redact(RedactFieldBody, "body"))
+	assert.Equal(t, "title", r.Redact(RedactFieldTitle, "title"))
+
+	n := r.RedactNotification(RequestGaurunNotification{
+		Tokens:  []string{"token-a"},
+		Message: "hello, world",
+		Title:   "title",
+		Body:    "body",
+		Extend:  []ExtendJSON{{Key: "url", Value: "https://example.com/users/1"}},
+		Vars:    map[string]string{"name": "gopher, the mascot"},
+	})
+	assert.Equal(t, []string{hashed}, n.Tokens)
+	assert.Equal(t, "hello...", n.Message)
+	assert.Equal(t, "title", n.Title)
+	assert.Equal(t, "", n.Body)
+	assert.Equal(t, "url", n.Extend[0].Key)
+	assert.Equal(t, r.Hash("https://example.com/users/1"), n.Extend[0].Value)
+	// vars are redacted as message unless given.
+	assert.Equal(t, map[string]string{"name": "gophe..."}, n.Vars)
+
+	body := r.redactRequestBody([]byte(`{"notifications":[{"token":["token-a"],"platform":1,"message":"hello, world","vars":{"name":"gopher, the mascot"}}]}`))
+	assert.NotContains(t, body, "gopher, the mascot")
+
+	body = r.redactRequestBody([]byte(`{"notifications":[{"token":["token-a"],"platform":1,"message":"hello, world"}]}`))
+	assert.NotContains(t, body, `"token-a"`)
+	assert.Contains(t, body, hashed)
+	assert.Contains(t, body, `"hello..."`)
+	assert.Equal(t, "(malformed request-body of 6 bytes)", r.redactRequestBody([]byte("{token")))
+
+	var nilRedactor *Redactor
+	assert.Equal(t, "token-a", nilRedactor.Redact(RedactFieldToken, "token-a"))
+
+	_, err = NewRedactor(map[string]string{"badge": RedactDrop}, nil, 0)
+	assert.NotNil(t, err)
+	_, err = NewRedactor(map[string]string{RedactFieldToken: "mask"}, nil, 0)
+	assert.NotNil(t, err)
+	_, err = NewRedactor(map[string]string{RedactFieldToken: RedactHash}, nil, 0)
+	assert.NotNil(t, err)
+	_, err = NewRedactor(map[string]string{RedactFieldMessage: RedactTruncate}, nil, 0)
+	assert.NotNil(t, err)
+}
+
+func TestInitRedaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	withConf(t)
+	defer func() {
+		LogRedactor = nil
+	}()
+
+	require.Nil(t, InitRedaction())
+	assert.Nil(t, LogRedactor)
+
+	path := filepath.Join(dir, "redaction.key")
+	require.Nil(t, ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(redactionKey)+"\n"), 0600))
+	ConfGaurun.Redaction.Fields = map[string]string{RedactFieldToken: RedactHash}
+	ConfGaurun.Redaction.KeyFile = path
+	require.Nil(t, InitRedaction())
+	require.NotNil(t, LogRedactor)
+	expected, err := NewRedactor(ConfGaurun.Redaction.Fields, redactionKey, 0)
+	require.Nil(t, err)
+	assert.Equal(t, expected.Hash("token-a"), LogRedactor.Redact(RedactFieldToken, "token-a"))
+
+	// the copies in the logs are not redacted and must be encrypted.
+	ConfGaurun.Log.NotificationCopy = true
+	assert.NotNil(t, InitRedaction())
+	ConfGaurun.Log.NotificationKeyFile = filepath.Join(dir, "notification.key")
+	require.Nil(t, InitRedaction())
+
+	require.Nil(t, ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString([]byte("short"))), 0600))
+	assert.NotNil(t, InitRedaction())
+}
+
+func TestLogPushRedaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	logAccessBefore := LogAccess
+	withConf(t)
+	defer func() {
+		LogAccess = logAccessBefore
+		LogRedactor = nil
+		notificationCopyKey = nil
+		Events = nil
+	}()
+	path := filepath.Join(dir, "access.log")
+	LogAccess, _, err = InitLog(path, "info")
+	require.Nil(t, err)
+	LogRedactor, err = NewRedactor(map[string]string{
+		RedactFieldToken:   RedactHash,
+		RedactFieldMessage: RedactDrop,
+		RedactFieldBody:    RedactTruncate,
+	}, redactionKey, 4)
+	require.Nil(t, err)
+	sink := &memoryEventSink{}
+	Events = NewEventPublisher(sink, 10, 10, time.Hour, false)
+
+	n := RequestGaurunNotification{
+		ID:         "01",
+		Tokens:     []string{"secret-token"},
+		Platform:   PlatFormAndroid,
+		Message:    "hello",
+		Body:       "private body",
+		AcceptedAt: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	// without a copy, the notification cannot be replayed.
+	LogPush("00", StatusAcceptedPush, "secret-token", 0, n, nil)
+	ConfGaurun.Log.NotificationCopy = true
+	notificationCopyKey = bytes.Repeat([]byte{1}, 32)
+	LogPush(n.ID, StatusAcceptedPush, "secret-token", 0, n, nil)
+	LogAccess.Sync()
+	require.Nil(t, Events.Close())
+
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	assert.NotContains(t, string(b), "secret-token")
+	assert.NotContains(t, string(b), "hello")
+	lines := bytes.Split(bytes.TrimSpace(b), []byte("\n"))
+	require.Len(t, lines, 2)
+	entry, err := ParseLogPushEntry(lines[1])
+	require.Nil(t, err)
+	assert.Equal(t, LogRedactor.Hash("secret-token"), entry.Token)
+	assert.Equal(t, "", entry.Message)
+	assert.Equal(t, "priv...", entry.Body)
+	assert.Equal(t, LogRedactor.Hash("secret-token"), sink.batches[0][0].Token)
+
+	// the copy keeps the original for replay.
+	lost := NewLostPushes(notificationCopyKey)
+	lost.RequireCopy()
+	_, err = lost.ScanLog(bytes.NewReader(b))
+	require.Nil(t, err)
+	assert.Equal(t, 1, lost.Uncopied())
+	replayed := lost.Notifications(ReplayFilter{})
+	require.Len(t, replayed, 1)
+	assert.Equal(t, []string{"secret-token"}, replayed[0].Tokens)
+	assert.Equal(t, "hello", replayed[0].Message)
+}
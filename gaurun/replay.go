@@ -0,0 +1,152 @@
+package gaurun
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"sort"
+	"time"
+)
+
+// ReplayFilter selects notifications to replay. Empty fields match any.
+type ReplayFilter struct {
+	// Since and Until select notifications accepted in [Since, Until).
+	Since      time.Time
+	Until      time.Time
+	Platform   string
+	Identifier string
+}
+
+func (f *ReplayFilter) match(n *RequestGaurunNotification) bool {
+	accepted := n.acceptedTime()
+	if !f.Since.IsZero() && accepted.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !accepted.Before(f.Until) {
+		return false
+	}
+	if f.Platform != "" && platformName(n.Platform) != f.Platform {
+		return false
+	}
+	if f.Identifier != "" && n.Identifier != f.Identifier {
+		return false
+	}
+	return true
+}
+
+// LostPushes collects the notifications which were accepted but never
+// settled, from access logs and recovery files of gaurun.
+type LostPushes struct {
+	key     []byte
+	accepts map[string]RequestGaurunNotification
+	settled map[string]bool
+
+	requireCopy bool
+	uncopied    int
+}
+
+// NewLostPushes returns LostPushes decoding encrypted copies of
+// notifications in the logs with key.
+func NewLostPushes(key []byte) *LostPushes {
+	return &LostPushes{
+		key:     key,
+		accepts: make(map[string]RequestGaurunNotification),
+		settled: make(map[string]bool),
+	}
+}
+
+// RequireCopy makes notifications accepted without a copy left out, since
+// the fields of the logs may be redacted. It must be called before ScanLog.
+func (l *LostPushes) RequireCopy() {
+	l.requireCopy = true
+}
+
+// Uncopied returns the number of notifications left out by RequireCopy.
+func (l *LostPushes) Uncopied() int {
+	return l.uncopied
+}
+
+// ScanLog reads an access log of gaurun, which may be gzipped. Pushes may
+// be accepted and settled in different logs, so rotated logs can be read
+// in any order. It returns the number of lines which are not JSON.
+func (l *LostPushes) ScanLog(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+
+	malformed := 0
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry, err := ParseLogPushEntry(scanner.Bytes())
+		if err != nil {
+			malformed++
+			continue
+		}
+		if entry.ID == "" {
+			continue
+		}
+		switch entry.Type {
+		case StatusAcceptedPush:
+			if l.requireCopy && !entry.hasCopy(l.key) {
+				l.uncopied++
+				continue
+			}
+			l.accepts[entry.ID] = entry.notification(l.key)
+		case StatusSucceededPush, StatusExpiredPush:
+			l.settled[entry.ID] = true
+		case StatusFailedPush:
+			// a notification rejected for itself fails again on replay.
+			switch ErrorCategory(entry.ErrorCategory) {
+			case ErrorCategoryPermanent, ErrorCategoryTokenInvalid, ErrorCategoryPayload:
+				l.settled[entry.ID] = true
+			}
+		}
+	}
+	return malformed, scanner.Err()
+}
+
+// AddRecovered adds notifications loaded from a recovery file, which are
+// all lost.
+func (l *LostPushes) AddRecovered(notifications []RequestGaurunNotification) {
+	for _, n := range notifications {
+		l.accepts[n.ID] = n
+	}
+}
+
+// Notifications returns the lost notifications matching filter in order of
+// ID. Notifications whose lifetime has passed are left out, and a
+// notification having the same identifier, platform and token as a former
+// one is left out as a duplicate.
+func (l *LostPushes) Notifications(filter ReplayFilter) []RequestGaurunNotification {
+	var lost []RequestGaurunNotification
+	for id, n := range l.accepts {
+		if l.settled[id] || !filter.match(&n) || n.isExpired(time.Now()) {
+			continue
+		}
+		lost = append(lost, n)
+	}
+	sort.Slice(lost, func(i, j int) bool {
+		return lost[i].ID < lost[j].ID
+	})
+
+	seen := make(map[string]bool)
+	deduped := lost[:0]
+	for _, n := range lost {
+		if n.Identifier != "" {
+			key := identifierKey(&n)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		deduped = append(deduped, n)
+	}
+	return deduped
+}
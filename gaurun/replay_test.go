@@ -0,0 +1,69 @@
+package gaurun
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLostPushes(t *testing.T) {
+	now := time.Now().Format(LogTimeLayout)
+	old := time.Now().Add(-2 * time.Hour).Format(LogTimeLayout)
+	line := func(typ, id, platform, token, time string, extra string) string {
+		return `{"type":"` + typ + `","time":"` + time + `","id":"` + id + `","platform":"` + platform + `","token":"` + token + `","message":"hello"` + extra + "}\n"
+	}
+
+	log1 := line(StatusAcceptedPush, "01", "ios", "a", now, "") +
+		line(StatusAcceptedPush, "02", "android", "b", now, `,"identifier":"x"`) +
+		line(StatusAcceptedPush, "03", "android", "b", now, `,"identifier":"x"`) +
+		line(StatusAcceptedPush, "04", "ios", "c", now, "") +
+		line(StatusAcceptedPush, "05", "ios", "d", now, "") +
+		line(StatusAcceptedPush, "06", "ios", "e", old, `,"expiry":60`) +
+		line(StatusAcceptedPush, "07", "ios", "f", old, "") +
+		`{"type":"accepted-request","uri":"/push"}` + "\n" +
+		"broken\n"
+	// the rotated log is gzipped
+	var log2 bytes.Buffer
+	zw := gzip.NewWriter(&log2)
+	zw.Write([]byte(line(StatusSucceededPush, "04", "ios", "c", now, "") +
+		line(StatusFailedPush, "05", "ios", "d", now, `,"error_category":"token-invalid"`) +
+		line(StatusFailedPush, "01", "ios", "a", now, `,"error_category":"retryable"`)))
+	zw.Close()
+
+	lost := NewLostPushes(nil)
+	malformed, err := lost.ScanLog(&log2)
+	require.Nil(t, err)
+	assert.Equal(t, 0, malformed)
+	malformed, err = lost.ScanLog(strings.NewReader(log1))
+	require.Nil(t, err)
+	assert.Equal(t, 1, malformed)
+	lost.AddRecovered([]RequestGaurunNotification{
+		{ID: "08", Tokens: []string{"g"}, Platform: PlatFormAndroid, Message: "hello", PushType: ApnsPushTypeAlert},
+	})
+
+	ids := func(notifications []RequestGaurunNotification) []string {
+		var ids []string
+		for _, n := range notifications {
+			ids = append(ids, n.ID)
+		}
+		return ids
+	}
+
+	// 03 is a duplicate of 02, 04 and 05 are settled, and 06 has expired.
+	notifications := lost.Notifications(ReplayFilter{})
+	assert.Equal(t, []string{"01", "02", "07", "08"}, ids(notifications))
+	assert.Equal(t, PlatFormIos, notifications[0].Platform)
+	assert.Equal(t, []string{"a"}, notifications[0].Tokens)
+	assert.Equal(t, "hello", notifications[0].Message)
+	assert.Equal(t, ApnsPushTypeAlert, notifications[3].PushType)
+
+	assert.Equal(t, []string{"02", "08"}, ids(lost.Notifications(ReplayFilter{Platform: "android"})))
+	assert.Equal(t, []string{"02"}, ids(lost.Notifications(ReplayFilter{Identifier: "x"})))
+	assert.Equal(t, []string{"07"}, ids(lost.Notifications(ReplayFilter{Until: time.Now().Add(-time.Hour)})))
+	assert.Equal(t, []string{"01", "02", "08"}, ids(lost.Notifications(ReplayFilter{Since: time.Now().Add(-time.Hour)})))
+}
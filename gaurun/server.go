@@ -15,7 +15,20 @@ import (
 func RegisterHandlers(mux *http.ServeMux) {
 	mux.HandleFunc("/push", PushNotificationHandler)
 	mux.HandleFunc("/stat/app", StatsHandler)
+	mux.HandleFunc("/stat/reset", StatResetHandler)
+	mux.HandleFunc("/stat/identifier/", IdentifierStatHandler)
 	mux.HandleFunc("/config/pushers", ConfigPushersHandler)
+	mux.HandleFunc("/tokens", TokensHandler)
+	mux.HandleFunc("/tokens/", TokenHandler)
+	mux.HandleFunc("/templates", TemplatesHandler)
+	mux.HandleFunc("/templates/", TemplateHandler)
+	mux.HandleFunc("/campaigns", CampaignsHandler)
+	mux.HandleFunc("/campaigns/", CampaignHandler)
+	mux.HandleFunc("/deadletters", DeadLettersHandler)
+	mux.HandleFunc("/deadletters/replay", DeadLettersReplayHandler)
+	mux.HandleFunc("/chaos", ChaosHandler)
+	mux.HandleFunc("/healthz", LivenessHandler)
+	mux.HandleFunc("/readyz", ReadinessHandler)
 
 	statsGo.PrettyPrintEnabled()
 	mux.HandleFunc("/stat/go", statsGo.Handler)
@@ -17,6 +17,14 @@ func TestRegisterHandlers(t *testing.T) {
 		"/push",
 		"/stat/app",
 		"/config/pushers",
+		"/tokens",
+		"/tokens/",
+		"/templates",
+		"/templates/",
+		"/campaigns",
+		"/campaigns/",
+		"/deadletters",
+		"/deadletters/replay",
 		"/stat/go",
 	}
 
@@ -1,59 +1,251 @@
 package gaurun
 
 import (
-	"encoding/json"
+	"fmt"
 	"net/http"
 	"sync/atomic"
+	"time"
 )
 
 type StatApp struct {
-	QueueMax    int         `json:"queue_max"`
-	QueueUsage  int         `json:"queue_usage"`
-	PusherMax   int64       `json:"pusher_max"`
-	PusherCount int64       `json:"pusher_count"`
-	Ios         StatIos     `json:"ios"`
-	Android     StatAndroid `json:"android"`
+	QueueMax      int            `json:"queue_max"`
+	QueueUsage    int            `json:"queue_usage"`
+	QueueLanes    map[string]int `json:"queue_lanes"`
+	PusherMax     int64          `json:"pusher_max"`
+	PusherCount   int64          `json:"pusher_count"`
+	EventsDropped int64          `json:"events_dropped"`
+	Ios           StatIos        `json:"ios"`
+	Android       StatAndroid    `json:"android"`
 }
 
 type StatAndroid struct {
-	PushSuccess int64 `json:"push_success"`
-	PushError   int64 `json:"push_error"`
+	PushSuccess    int64                 `json:"push_success"`
+	PushError      int64                 `json:"push_error"`
+	PushRetry      int64                 `json:"push_retry"`
+	PushSuppressed int64                 `json:"push_suppressed"`
+	PushExpired    int64                 `json:"push_expired"`
+	Errors         StatErrors            `json:"errors"`
+	Reasons        map[string]int64      `json:"reasons"`
+	Windows        map[string]StatWindow `json:"windows,omitempty"`
 }
 
 type StatIos struct {
-	PushSuccess int64 `json:"push_success"`
-	PushError   int64 `json:"push_error"`
+	PushSuccess    int64                 `json:"push_success"`
+	PushError      int64                 `json:"push_error"`
+	PushRetry      int64                 `json:"push_retry"`
+	PushSuppressed int64                 `json:"push_suppressed"`
+	PushExpired    int64                 `json:"push_expired"`
+	Errors         StatErrors            `json:"errors"`
+	Reasons        map[string]int64      `json:"reasons"`
+	Windows        map[string]StatWindow `json:"windows,omitempty"`
+}
+
+// StatErrors breaks push errors down by ErrorCategory.
+type StatErrors struct {
+	Retryable    int64 `json:"retryable"`
+	Permanent    int64 `json:"permanent"`
+	Auth         int64 `json:"auth"`
+	TokenInvalid int64 `json:"token_invalid"`
+	Payload      int64 `json:"payload"`
+}
+
+func (s *StatErrors) counter(category ErrorCategory) *int64 {
+	switch category {
+	case ErrorCategoryRetryable:
+		return &s.Retryable
+	case ErrorCategoryAuth:
+		return &s.Auth
+	case ErrorCategoryTokenInvalid:
+		return &s.TokenInvalid
+	case ErrorCategoryPayload:
+		return &s.Payload
+	}
+	return &s.Permanent
+}
+
+func (s *StatErrors) store(v StatErrors) {
+	atomic.StoreInt64(&s.Retryable, v.Retryable)
+	atomic.StoreInt64(&s.Permanent, v.Permanent)
+	atomic.StoreInt64(&s.Auth, v.Auth)
+	atomic.StoreInt64(&s.TokenInvalid, v.TokenInvalid)
+	atomic.StoreInt64(&s.Payload, v.Payload)
+}
+
+func (s *StatErrors) load() StatErrors {
+	return StatErrors{
+		Retryable:    atomic.LoadInt64(&s.Retryable),
+		Permanent:    atomic.LoadInt64(&s.Permanent),
+		Auth:         atomic.LoadInt64(&s.Auth),
+		TokenInvalid: atomic.LoadInt64(&s.TokenInvalid),
+		Payload:      atomic.LoadInt64(&s.Payload),
+	}
+}
+
+// countPushError counts a failed push for its platform and category.
+func countPushError(de *DeliveryError) {
+	switch de.Platform {
+	case PlatFormIos:
+		atomic.AddInt64(&StatGaurun.Ios.PushError, 1)
+		atomic.AddInt64(StatGaurun.Ios.Errors.counter(de.Category), 1)
+	case PlatFormAndroid:
+		atomic.AddInt64(&StatGaurun.Android.PushError, 1)
+		atomic.AddInt64(StatGaurun.Android.Errors.counter(de.Category), 1)
+	}
+	if d := statDetailOf(de.Platform); d != nil {
+		d.addError(time.Now(), de.Reason)
+	}
+	emitPushError(de)
+	recordUpstream(de.Platform, de)
+}
+
+// countPushSuccess counts a succeeded push.
+func countPushSuccess(platform int) {
+	switch platform {
+	case PlatFormIos:
+		atomic.AddInt64(&StatGaurun.Ios.PushSuccess, 1)
+	case PlatFormAndroid:
+		atomic.AddInt64(&StatGaurun.Android.PushSuccess, 1)
+	}
+	if d := statDetailOf(platform); d != nil {
+		d.addSuccess(time.Now())
+	}
+	emitPushCount("push.success", platform)
+	recordUpstream(platform, nil)
+}
+
+// countPushSuppressed counts a push skipped for an invalid token.
+func countPushSuppressed(platform int) {
+	switch platform {
+	case PlatFormIos:
+		atomic.AddInt64(&StatGaurun.Ios.PushSuppressed, 1)
+	case PlatFormAndroid:
+		atomic.AddInt64(&StatGaurun.Android.PushSuppressed, 1)
+	}
+	emitPushCount("push.suppressed", platform)
+}
+
+// countPushExpired counts a push discarded as expired in the queue.
+func countPushExpired(platform int) {
+	switch platform {
+	case PlatFormIos:
+		atomic.AddInt64(&StatGaurun.Ios.PushExpired, 1)
+	case PlatFormAndroid:
+		atomic.AddInt64(&StatGaurun.Android.PushExpired, 1)
+	}
+	emitPushCount("push.expired", platform)
+}
+
+// countPushRetry counts a push retried after a retryable error.
+func countPushRetry(platform int) {
+	switch platform {
+	case PlatFormIos:
+		atomic.AddInt64(&StatGaurun.Ios.PushRetry, 1)
+	case PlatFormAndroid:
+		atomic.AddInt64(&StatGaurun.Android.PushRetry, 1)
+	}
+	if d := statDetailOf(platform); d != nil {
+		d.addRetry(time.Now())
+	}
+	emitPushCount("push.retry", platform)
+}
+
+// recordPushTime records how long a request to APNs or FCM took.
+func recordPushTime(platform int, d time.Duration, err error) {
+	if detail := statDetailOf(platform); detail != nil {
+		detail.addLatency(time.Now(), d)
+	}
+	emitPushTime(platform, d, err)
 }
 
 func InitStat() {
 	StatGaurun.QueueUsage = 0
 	StatGaurun.PusherCount = 0
-	StatGaurun.Ios.PushSuccess = 0
-	StatGaurun.Ios.PushError = 0
-	StatGaurun.Android.PushSuccess = 0
-	StatGaurun.Android.PushError = 0
+	resetStat()
+}
+
+// resetStat clears the totals of pushes, the counts by reason, the rolling
+// windows and the stats per identifier.
+func resetStat() {
+	storeStat(StatIos{}, StatAndroid{})
+	statIosDetail.reset()
+	statAndroidDetail.reset()
+	if IdentifierStats != nil {
+		IdentifierStats.Reset()
+	}
+}
+
+// loadStat returns the totals of pushes and the counts by reason.
+func loadStat() (StatIos, StatAndroid) {
+	var (
+		ios     StatIos
+		android StatAndroid
+	)
+	ios.PushSuccess = atomic.LoadInt64(&StatGaurun.Ios.PushSuccess)
+	ios.PushError = atomic.LoadInt64(&StatGaurun.Ios.PushError)
+	ios.PushRetry = atomic.LoadInt64(&StatGaurun.Ios.PushRetry)
+	ios.PushSuppressed = atomic.LoadInt64(&StatGaurun.Ios.PushSuppressed)
+	ios.PushExpired = atomic.LoadInt64(&StatGaurun.Ios.PushExpired)
+	ios.Errors = StatGaurun.Ios.Errors.load()
+	ios.Reasons = statIosDetail.loadReasons()
+	android.PushSuccess = atomic.LoadInt64(&StatGaurun.Android.PushSuccess)
+	android.PushError = atomic.LoadInt64(&StatGaurun.Android.PushError)
+	android.PushRetry = atomic.LoadInt64(&StatGaurun.Android.PushRetry)
+	android.PushSuppressed = atomic.LoadInt64(&StatGaurun.Android.PushSuppressed)
+	android.PushExpired = atomic.LoadInt64(&StatGaurun.Android.PushExpired)
+	android.Errors = StatGaurun.Android.Errors.load()
+	android.Reasons = statAndroidDetail.loadReasons()
+	return ios, android
+}
+
+// storeStat replaces the totals of pushes and the counts by reason.
+func storeStat(ios StatIos, android StatAndroid) {
+	atomic.StoreInt64(&StatGaurun.Ios.PushSuccess, ios.PushSuccess)
+	atomic.StoreInt64(&StatGaurun.Ios.PushError, ios.PushError)
+	atomic.StoreInt64(&StatGaurun.Ios.PushRetry, ios.PushRetry)
+	atomic.StoreInt64(&StatGaurun.Ios.PushSuppressed, ios.PushSuppressed)
+	atomic.StoreInt64(&StatGaurun.Ios.PushExpired, ios.PushExpired)
+	StatGaurun.Ios.Errors.store(ios.Errors)
+	statIosDetail.storeReasons(ios.Reasons)
+	atomic.StoreInt64(&StatGaurun.Android.PushSuccess, android.PushSuccess)
+	atomic.StoreInt64(&StatGaurun.Android.PushError, android.PushError)
+	atomic.StoreInt64(&StatGaurun.Android.PushRetry, android.PushRetry)
+	atomic.StoreInt64(&StatGaurun.Android.PushSuppressed, android.PushSuppressed)
+	atomic.StoreInt64(&StatGaurun.Android.PushExpired, android.PushExpired)
+	StatGaurun.Android.Errors.store(android.Errors)
+	statAndroidDetail.storeReasons(android.Reasons)
 }
 
 func StatsHandler(w http.ResponseWriter, r *http.Request) {
 	var result StatApp
-	result.QueueMax = cap(QueueNotification)
-	result.QueueUsage = len(QueueNotification)
+	result.QueueMax = QueueNotification.Cap()
+	result.QueueUsage = QueueNotification.Len()
+	result.QueueLanes = QueueNotification.LaneLen()
 	result.PusherMax = ConfGaurun.Core.PusherMax * ConfGaurun.Core.WorkerNum
 	result.PusherCount = atomic.LoadInt64(&PusherCountAll)
-	result.Ios.PushSuccess = atomic.LoadInt64(&StatGaurun.Ios.PushSuccess)
-	result.Ios.PushError = atomic.LoadInt64(&StatGaurun.Ios.PushError)
-	result.Android.PushSuccess = atomic.LoadInt64(&StatGaurun.Android.PushSuccess)
-	result.Android.PushError = atomic.LoadInt64(&StatGaurun.Android.PushError)
-
-	respBody, err := json.MarshalIndent(result, "", " ")
-	if err != nil {
-		msg := "Response-body could not be created"
-		LogError.Error(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
-		return
+	if Events != nil {
+		result.EventsDropped = Events.Dropped()
 	}
+	result.Ios, result.Android = loadStat()
+	now := time.Now()
+	result.Ios.Windows = statIosDetail.windows(now)
+	result.Android.Windows = statAndroidDetail.windows(now)
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Header().Set("Server", serverHeader())
-	w.Write(respBody)
+	sendJSON(w, result)
+}
+
+// StatResetHandler clears the stats of pushes, saving the cleared totals
+// if the stat file is given.
+func StatResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendResponse(w, "method must be POST", http.StatusBadRequest)
+		return
+	}
+	resetStat()
+	if StatFile != nil {
+		if err := StatFile.Save(); err != nil {
+			LogError.Error(fmt.Sprintf("failed to save stat: %v", err))
+		}
+	}
+	LogError.Info("reset stat")
+	sendResponse(w, "ok", http.StatusOK)
 }
@@ -0,0 +1,181 @@
+package gaurun
+
+import (
+	"container/list"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdentifierStat is the delivery funnel of the notifications given an
+// identifier, counted per token.
+type IdentifierStat struct {
+	Identifier string `json:"identifier"`
+	Accepted   int64  `json:"accepted"`
+	Succeeded  int64  `json:"succeeded"`
+	// Failed is the pushes failed even after retries.
+	Failed     int64 `json:"failed"`
+	Expired    int64 `json:"expired"`
+	Retried    int64 `json:"retried"`
+	Suppressed int64 `json:"suppressed"`
+	Disabled   int64 `json:"disabled"`
+	// Pending is the accepted pushes not settled yet.
+	Pending int64 `json:"pending"`
+	// Reasons breaks Failed down by reason code of APNs or FCM.
+	Reasons     map[string]int64 `json:"reasons"`
+	FirstSeenAt time.Time        `json:"first_seen_at"`
+	LastSeenAt  time.Time        `json:"last_seen_at"`
+}
+
+// IdentifierStatStore aggregates the states of pushes per identifier. It
+// keeps at most maxIdentifiers identifiers, dropping the one least
+// recently seen.
+type IdentifierStatStore struct {
+	maxIdentifiers int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order holds entries from the least recently seen.
+	order *list.List
+}
+
+func NewIdentifierStatStore(maxIdentifiers int) *IdentifierStatStore {
+	return &IdentifierStatStore{
+		maxIdentifiers: maxIdentifiers,
+		entries:        make(map[string]*list.Element),
+		order:          list.New(),
+	}
+}
+
+// Count counts a state of a push logged by LogPush.
+func (s *IdentifierStatStore) Count(identifier, status string, errPush error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	var stat *IdentifierStat
+	if e, ok := s.entries[identifier]; ok {
+		s.order.MoveToBack(e)
+		stat = e.Value.(*IdentifierStat)
+	} else {
+		stat = &IdentifierStat{Identifier: identifier, Reasons: map[string]int64{}, FirstSeenAt: now}
+		s.entries[identifier] = s.order.PushBack(stat)
+		if s.maxIdentifiers > 0 && s.order.Len() > s.maxIdentifiers {
+			front := s.order.Front()
+			s.order.Remove(front)
+			delete(s.entries, front.Value.(*IdentifierStat).Identifier)
+		}
+	}
+	stat.LastSeenAt = now
+
+	var reason string
+	if de := asDeliveryError(errPush); de != nil {
+		reason = de.Reason
+	}
+	switch status {
+	case StatusAcceptedPush:
+		stat.Accepted++
+	case StatusSucceededPush:
+		stat.Succeeded++
+	case StatusFailedPush:
+		stat.Failed++
+		if reason != "" {
+			stat.Reasons[reason]++
+		}
+	case StatusRetriedPush:
+		// the failure logged just before is not final.
+		stat.Retried++
+		stat.Failed--
+		if reason != "" {
+			if stat.Reasons[reason]--; stat.Reasons[reason] <= 0 {
+				delete(stat.Reasons, reason)
+			}
+		}
+	case StatusExpiredPush:
+		stat.Expired++
+	case StatusSuppressedPush:
+		stat.Suppressed++
+	case StatusDisabledPush:
+		stat.Disabled++
+	}
+}
+
+// Get returns the stat of identifier.
+func (s *IdentifierStatStore) Get(identifier string) (IdentifierStat, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[identifier]
+	if !ok {
+		return IdentifierStat{}, false
+	}
+	stat := *e.Value.(*IdentifierStat)
+	stat.Reasons = make(map[string]int64, len(stat.Reasons))
+	for reason, n := range e.Value.(*IdentifierStat).Reasons {
+		stat.Reasons[reason] = n
+	}
+	stat.Pending = stat.Accepted - stat.Succeeded - stat.Failed - stat.Expired
+	if stat.Pending < 0 {
+		// accepted by another instance sharing the queue
+		stat.Pending = 0
+	}
+	return stat, true
+}
+
+// Len returns the number of identifiers kept.
+func (s *IdentifierStatStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+// Reset forgets all identifiers.
+func (s *IdentifierStatStore) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = make(map[string]*list.Element)
+	s.order.Init()
+}
+
+// InitIdentifierStats creates IdentifierStats unless disabled.
+func InitIdentifierStats() {
+	if ConfGaurun.Stat.IdentifierMax <= 0 {
+		IdentifierStats = nil
+		return
+	}
+	IdentifierStats = NewIdentifierStatStore(ConfGaurun.Stat.IdentifierMax)
+}
+
+// countIdentifier counts a state of a push for its identifier, if any.
+func countIdentifier(status string, req RequestGaurunNotification, errPush error) {
+	if IdentifierStats == nil || req.Identifier == "" {
+		return
+	}
+	IdentifierStats.Count(req.Identifier, status, errPush)
+}
+
+// IdentifierStatHandler returns the delivery funnel of an identifier.
+func IdentifierStatHandler(w http.ResponseWriter, r *http.Request) {
+	if IdentifierStats == nil {
+		sendResponse(w, "identifier stat is disabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		sendResponse(w, "method must be GET", http.StatusBadRequest)
+		return
+	}
+
+	identifier, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/stat/identifier/"))
+	if err != nil || identifier == "" {
+		sendResponse(w, "malformed identifier", http.StatusBadRequest)
+		return
+	}
+	stat, found := IdentifierStats.Get(identifier)
+	if !found {
+		sendResponse(w, "identifier not found", http.StatusNotFound)
+		return
+	}
+	sendJSON(w, stat)
+}
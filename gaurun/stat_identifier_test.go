@@ -0,0 +1,85 @@
+package gaurun
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nohana/gaurun/gcm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentifierStatStore(t *testing.T) {
+	s := NewIdentifierStatStore(2)
+	unavailable := NewDeliveryError(PlatFormAndroid, &gcm.Error{StatusCode: http.StatusOK, Reason: gcm.ErrorUnavailable})
+	notRegistered := NewDeliveryError(PlatFormAndroid, &gcm.Error{StatusCode: http.StatusOK, Reason: gcm.ErrorNotRegistered})
+
+	for i := 0; i < 5; i++ {
+		s.Count("campaign", StatusAcceptedPush, nil)
+	}
+	s.Count("campaign", StatusSucceededPush, nil)
+	// failed once and then succeeded on retry
+	s.Count("campaign", StatusFailedPush, unavailable)
+	s.Count("campaign", StatusRetriedPush, unavailable)
+	s.Count("campaign", StatusSucceededPush, nil)
+	s.Count("campaign", StatusFailedPush, notRegistered)
+	s.Count("campaign", StatusExpiredPush, nil)
+	s.Count("campaign", StatusSuppressedPush, nil)
+
+	stat, found := s.Get("campaign")
+	require.True(t, found)
+	assert.Equal(t, int64(5), stat.Accepted)
+	assert.Equal(t, int64(2), stat.Succeeded)
+	assert.Equal(t, int64(1), stat.Failed)
+	assert.Equal(t, int64(1), stat.Retried)
+	assert.Equal(t, int64(1), stat.Expired)
+	assert.Equal(t, int64(1), stat.Suppressed)
+	assert.Equal(t, int64(1), stat.Pending)
+	assert.Equal(t, map[string]int64{gcm.ErrorNotRegistered: 1}, stat.Reasons)
+
+	// the identifier least recently seen is dropped.
+	s.Count("a", StatusAcceptedPush, nil)
+	s.Count("campaign", StatusSucceededPush, nil)
+	s.Count("b", StatusAcceptedPush, nil)
+	assert.Equal(t, 2, s.Len())
+	_, found = s.Get("a")
+	assert.False(t, found)
+	_, found = s.Get("campaign")
+	assert.True(t, found)
+
+	s.Reset()
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestIdentifierStatHandler(t *testing.T) {
+	defer func() {
+		IdentifierStats = nil
+	}()
+
+	IdentifierStats = nil
+	w := httptest.NewRecorder()
+	IdentifierStatHandler(w, httptest.NewRequest("GET", "/stat/identifier/campaign", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	IdentifierStats = NewIdentifierStatStore(10)
+	LogPush("01", StatusAcceptedPush, "xxx", 0, RequestGaurunNotification{Platform: PlatFormIos, Identifier: "spring/sale"}, nil)
+	LogPush("02", StatusAcceptedPush, "yyy", 0, RequestGaurunNotification{Platform: PlatFormIos}, nil)
+
+	w = httptest.NewRecorder()
+	IdentifierStatHandler(w, httptest.NewRequest("GET", "/stat/identifier/spring%2Fsale", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var stat IdentifierStat
+	require.Nil(t, json.NewDecoder(w.Body).Decode(&stat))
+	assert.Equal(t, "spring/sale", stat.Identifier)
+	assert.Equal(t, int64(1), stat.Accepted)
+	assert.Equal(t, int64(1), stat.Pending)
+
+	w = httptest.NewRecorder()
+	IdentifierStatHandler(w, httptest.NewRequest("GET", "/stat/identifier/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	IdentifierStatHandler(w, httptest.NewRequest("DELETE", "/stat/identifier/spring%2Fsale", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,115 @@
+package gaurun
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// statTotals is the content of the stat file.
+type statTotals struct {
+	Ios     StatIos     `json:"ios"`
+	Android StatAndroid `json:"android"`
+	SavedAt time.Time   `json:"saved_at"`
+}
+
+// StatStore saves the totals of pushes and the counts by reason to a file
+// at saveInterval, so that they survive restarts. The rolling windows are
+// not saved.
+type StatStore struct {
+	path         string
+	saveInterval time.Duration
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenStatStore restores the totals saved in path, if any, and starts
+// saving them.
+func OpenStatStore(path string, saveInterval time.Duration) (*StatStore, error) {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		var totals statTotals
+		if err := json.Unmarshal(b, &totals); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		storeStat(totals.Ios, totals.Android)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	s := &StatStore{
+		path:         path,
+		saveInterval: saveInterval,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *StatStore) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				LogError.Error(fmt.Sprintf("failed to save stat: %v", err))
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Save writes the current totals to the file. The totals are taken under
+// the lock of the write, so that a save racing another never overwrites
+// newer totals with older ones.
+func (s *StatStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var totals statTotals
+	totals.Ios, totals.Android = loadStat()
+	totals.SavedAt = time.Now().UTC()
+	b, err := json.Marshal(totals)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Close stops saving at the interval and saves the totals at last.
+func (s *StatStore) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.Save()
+}
+
+// InitStatStore restores and saves the totals if the stat file is given.
+// It must be called after InitStat.
+func InitStatStore() error {
+	conf := ConfGaurun.Stat
+	if conf.Path == "" {
+		return nil
+	}
+	if conf.SaveInterval <= 0 {
+		return fmt.Errorf("stat save_interval must be positive")
+	}
+	store, err := OpenStatStore(conf.Path, time.Duration(conf.SaveInterval)*time.Second)
+	if err != nil {
+		return err
+	}
+	StatFile = store
+	return nil
+}
@@ -0,0 +1,125 @@
+package gaurun
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatWindows(t *testing.T) {
+	d := newStatDetail()
+	now := time.Now()
+
+	// an hour and a half ago, out of all windows
+	d.addSuccess(now.Add(-90 * time.Minute))
+	// 30 minutes ago, only in 1h
+	d.addError(now.Add(-30*time.Minute), "Unregistered")
+	// 2 minutes ago, in 5m and 1h
+	d.addRetry(now.Add(-2 * time.Minute))
+	d.addError(now.Add(-2*time.Minute), "TooManyRequests")
+	// now, in all windows
+	for i := 0; i < 3; i++ {
+		d.addSuccess(now)
+		d.addLatency(now, 10*time.Millisecond)
+	}
+	d.addLatency(now, 2*time.Second)
+
+	windows := d.windows(now)
+	assert.Equal(t, int64(3), windows["1m"].Success)
+	assert.Equal(t, int64(0), windows["1m"].Error)
+	assert.Equal(t, 1.0, windows["1m"].SuccessRatio)
+	assert.Equal(t, 3.0/60, windows["1m"].SuccessRate)
+	assert.Equal(t, int64(1), windows["5m"].Error)
+	assert.Equal(t, int64(1), windows["5m"].Retry)
+	assert.Equal(t, 0.75, windows["5m"].SuccessRatio)
+	assert.Equal(t, int64(3), windows["1h"].Success)
+	assert.Equal(t, int64(2), windows["1h"].Error)
+
+	// percentiles are the upper bounds of the bins.
+	latency := windows["1m"].Latency
+	assert.True(t, latency.P50 >= 0.010 && latency.P50 < 0.012, latency.P50)
+	assert.True(t, latency.P99 >= 2 && latency.P99 < 2.4, latency.P99)
+	assert.Equal(t, StatLatency{}, d.window(now.Add(2*time.Hour), time.Hour).Latency)
+
+	assert.Equal(t, map[string]int64{"Unregistered": 1, "TooManyRequests": 1}, d.loadReasons())
+	d.reset()
+	assert.Equal(t, map[string]int64{}, d.loadReasons())
+	assert.Equal(t, int64(0), d.window(now, time.Hour).Success)
+}
+
+func TestStatStoreAndReset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer InitStat()
+
+	InitStat()
+	countPushSuccess(PlatFormIos)
+	countPushError(&DeliveryError{Platform: PlatFormAndroid, Category: ErrorCategoryTokenInvalid, Reason: "UNREGISTERED"})
+
+	path := filepath.Join(dir, "stat.json")
+	store, err := OpenStatStore(path, time.Hour)
+	require.Nil(t, err)
+	require.Nil(t, store.Close())
+
+	// totals are restored after a restart, but windows are not.
+	InitStat()
+	store, err = OpenStatStore(path, time.Hour)
+	require.Nil(t, err)
+	defer store.Close()
+	ios, android := loadStat()
+	assert.Equal(t, int64(1), ios.PushSuccess)
+	assert.Equal(t, int64(1), android.PushError)
+	assert.Equal(t, int64(1), android.Errors.TokenInvalid)
+	assert.Equal(t, map[string]int64{"UNREGISTERED": 1}, android.Reasons)
+	assert.Equal(t, int64(0), statIosDetail.window(time.Now(), time.Minute).Success)
+
+	StatFile = store
+	defer func() {
+		StatFile = nil
+	}()
+	w := httptest.NewRecorder()
+	StatResetHandler(w, httptest.NewRequest("GET", "/stat/reset", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = httptest.NewRecorder()
+	StatResetHandler(w, httptest.NewRequest("POST", "/stat/reset", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	ios, android = loadStat()
+	assert.Equal(t, int64(0), ios.PushSuccess)
+	assert.Equal(t, int64(0), android.Errors.TokenInvalid)
+	assert.Equal(t, map[string]int64{}, android.Reasons)
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	var totals statTotals
+	require.Nil(t, json.Unmarshal(b, &totals))
+	assert.Equal(t, int64(0), totals.Ios.PushSuccess)
+}
+
+func TestStatsHandler(t *testing.T) {
+	defer InitStat()
+	withQueue(t, NewNotificationQueue(10, nil, 0))
+	InitStat()
+	countPushSuccess(PlatFormIos)
+	recordPushTime(PlatFormIos, 5*time.Millisecond, nil)
+	countPushError(&DeliveryError{Platform: PlatFormIos, Category: ErrorCategoryRetryable, Reason: "TooManyRequests"})
+
+	w := httptest.NewRecorder()
+	StatsHandler(w, httptest.NewRequest("GET", "/stat/app", nil))
+	var result StatApp
+	require.Nil(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(t, int64(1), result.Ios.PushSuccess)
+	assert.Equal(t, map[string]int64{"TooManyRequests": 1}, result.Ios.Reasons)
+	require.Contains(t, result.Ios.Windows, "1m")
+	assert.Equal(t, 0.5, result.Ios.Windows["1m"].SuccessRatio)
+	assert.True(t, result.Ios.Windows["5m"].Latency.P95 > 0)
+	assert.Equal(t, StatWindow{}, result.Android.Windows["1h"])
+}
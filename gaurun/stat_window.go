@@ -0,0 +1,235 @@
+package gaurun
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// statBucketSpan is the resolution of the rolling windows.
+	statBucketSpan = 10 * time.Second
+	// statBucketNum buckets hold the longest window.
+	statBucketNum = int(time.Hour / statBucketSpan)
+	// statLatencyBins bins of latency. Bin i holds latencies up to
+	// 2^(i/4) milliseconds, and the last one holds the rest.
+	statLatencyBins = 80
+)
+
+// statWindows are the rolling windows shown in /stat/app.
+var statWindows = []struct {
+	name string
+	span time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+}
+
+// StatWindow is the pushes within a rolling window. Rates are per second.
+type StatWindow struct {
+	Success      int64       `json:"success"`
+	Error        int64       `json:"error"`
+	Retry        int64       `json:"retry"`
+	SuccessRate  float64     `json:"success_rate"`
+	ErrorRate    float64     `json:"error_rate"`
+	RetryRate    float64     `json:"retry_rate"`
+	SuccessRatio float64     `json:"success_ratio"`
+	Latency      StatLatency `json:"latency"`
+}
+
+// StatLatency is the percentiles of the time taken by requests to APNs or
+// FCM in seconds, as ptime in the logs.
+type StatLatency struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+type statBucket struct {
+	index   int64 // start of the bucket in statBucketSpan since the epoch
+	success int64
+	errors  int64
+	retry   int64
+	latency [statLatencyBins]int64
+}
+
+// statDetail holds the pushes of a platform by error reason and in the
+// buckets of the rolling windows.
+type statDetail struct {
+	mu      sync.Mutex
+	reasons map[string]int64
+	buckets [statBucketNum]statBucket
+}
+
+var (
+	statIosDetail     = newStatDetail()
+	statAndroidDetail = newStatDetail()
+)
+
+func newStatDetail() *statDetail {
+	return &statDetail{reasons: map[string]int64{}}
+}
+
+func statDetailOf(platform int) *statDetail {
+	switch platform {
+	case PlatFormIos:
+		return statIosDetail
+	case PlatFormAndroid:
+		return statAndroidDetail
+	}
+	return nil
+}
+
+func statBucketIndex(now time.Time) int64 {
+	return now.UnixNano() / int64(statBucketSpan)
+}
+
+// bucketLocked returns the bucket of now, clearing the one left from an
+// hour before.
+func (d *statDetail) bucketLocked(now time.Time) *statBucket {
+	index := statBucketIndex(now)
+	b := &d.buckets[index%int64(statBucketNum)]
+	if b.index != index {
+		*b = statBucket{index: index}
+	}
+	return b
+}
+
+func (d *statDetail) addSuccess(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.bucketLocked(now).success++
+}
+
+func (d *statDetail) addError(now time.Time, reason string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.bucketLocked(now).errors++
+	if reason != "" {
+		d.reasons[reason]++
+	}
+}
+
+func (d *statDetail) addRetry(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.bucketLocked(now).retry++
+}
+
+func latencyBin(latency time.Duration) int {
+	ms := float64(latency) / float64(time.Millisecond)
+	if ms <= 1 {
+		return 0
+	}
+	bin := int(math.Ceil(4 * math.Log2(ms)))
+	if bin >= statLatencyBins {
+		return statLatencyBins - 1
+	}
+	return bin
+}
+
+// latencyBinMax returns the upper bound of bin i in seconds.
+func latencyBinMax(i int) float64 {
+	return math.Pow(2, float64(i)/4) / 1000
+}
+
+func (d *statDetail) addLatency(now time.Time, latency time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.bucketLocked(now).latency[latencyBin(latency)]++
+}
+
+// window sums up the buckets within span before now.
+func (d *statDetail) window(now time.Time, span time.Duration) StatWindow {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var (
+		w       StatWindow
+		latency [statLatencyBins]int64
+	)
+	current := statBucketIndex(now)
+	oldest := current - int64(span/statBucketSpan)
+	for i := range d.buckets {
+		b := &d.buckets[i]
+		if b.index <= oldest || b.index > current {
+			continue
+		}
+		w.Success += b.success
+		w.Error += b.errors
+		w.Retry += b.retry
+		for j, n := range b.latency {
+			latency[j] += n
+		}
+	}
+
+	seconds := span.Seconds()
+	w.SuccessRate = float64(w.Success) / seconds
+	w.ErrorRate = float64(w.Error) / seconds
+	w.RetryRate = float64(w.Retry) / seconds
+	if w.Success+w.Error > 0 {
+		w.SuccessRatio = float64(w.Success) / float64(w.Success+w.Error)
+	}
+	w.Latency = StatLatency{
+		P50: latencyPercentile(latency, 50),
+		P95: latencyPercentile(latency, 95),
+		P99: latencyPercentile(latency, 99),
+	}
+	return w
+}
+
+// latencyPercentile returns the upper bound of the bin the p-th percentile
+// falls in, or 0 if there are no latencies.
+func latencyPercentile(latency [statLatencyBins]int64, p float64) float64 {
+	var total int64
+	for _, n := range latency {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(float64(total) * p / 100))
+	var seen int64
+	for i, n := range latency {
+		seen += n
+		if seen >= rank {
+			return latencyBinMax(i)
+		}
+	}
+	return latencyBinMax(statLatencyBins - 1)
+}
+
+func (d *statDetail) windows(now time.Time) map[string]StatWindow {
+	windows := make(map[string]StatWindow, len(statWindows))
+	for _, sw := range statWindows {
+		windows[sw.name] = d.window(now, sw.span)
+	}
+	return windows
+}
+
+func (d *statDetail) loadReasons() map[string]int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	reasons := make(map[string]int64, len(d.reasons))
+	for reason, n := range d.reasons {
+		reasons[reason] = n
+	}
+	return reasons
+}
+
+func (d *statDetail) storeReasons(reasons map[string]int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reasons = map[string]int64{}
+	for reason, n := range reasons {
+		d.reasons[reason] = n
+	}
+}
+
+func (d *statDetail) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reasons = map[string]int64{}
+	d.buckets = [statBucketNum]statBucket{}
+}
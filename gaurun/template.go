@@ -0,0 +1,388 @@
+package gaurun
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// NotificationTemplate is the copy of a notification in several locales.
+// Each text is a text/template rendered with the vars of a notification.
+type NotificationTemplate struct {
+	Name          string                     `json:"name"`
+	DefaultLocale string                     `json:"default_locale"`
+	Locales       map[string]TemplateContent `json:"locales"`
+
+	compiled map[string]*compiledContent
+}
+
+// TemplateContent is the copy of a notification in a locale.
+type TemplateContent struct {
+	Title    string       `json:"title,omitempty"`
+	Subtitle string       `json:"subtitle,omitempty"`
+	Message  string       `json:"message,omitempty"`
+	Body     string       `json:"body,omitempty"`
+	Extend   []ExtendJSON `json:"extend,omitempty"`
+}
+
+type compiledContent struct {
+	title    *template.Template
+	subtitle *template.Template
+	message  *template.Template
+	body     *template.Template
+	extend   []*template.Template
+}
+
+// TemplateRegistry holds the notification templates by name. If dir is not
+// empty, each template is also stored as dir/{name}.json.
+type TemplateRegistry struct {
+	dir string
+
+	mu        sync.RWMutex
+	templates map[string]*NotificationTemplate
+}
+
+var templateNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// NewTemplateRegistry returns a registry loaded with the templates in dir.
+func NewTemplateRegistry(dir string) (*TemplateRegistry, error) {
+	r := &TemplateRegistry{
+		dir:       dir,
+		templates: make(map[string]*NotificationTemplate),
+	}
+	if dir == "" {
+		return r, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		t, err := ParseNotificationTemplate(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if t.Name == "" {
+			t.Name = strings.TrimSuffix(filepath.Base(path), ".json")
+		}
+		r.templates[t.Name] = t
+	}
+	return r, nil
+}
+
+// ParseNotificationTemplate parses and compiles a template given in JSON.
+func ParseNotificationTemplate(b []byte) (*NotificationTemplate, error) {
+	var t NotificationTemplate
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+	if err := t.compile(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (t *NotificationTemplate) compile() error {
+	if t.Name != "" && !templateNamePattern.MatchString(t.Name) {
+		return fmt.Errorf("invalid template name: %s", t.Name)
+	}
+	if len(t.Locales) == 0 {
+		return fmt.Errorf("template has no locale")
+	}
+	if t.DefaultLocale == "" {
+		return fmt.Errorf("default_locale is empty")
+	}
+	if _, ok := t.Locales[t.DefaultLocale]; !ok {
+		return fmt.Errorf("default_locale %s is not defined", t.DefaultLocale)
+	}
+
+	t.compiled = make(map[string]*compiledContent, len(t.Locales))
+	for locale, content := range t.Locales {
+		c := &compiledContent{}
+		var err error
+		parse := func(field, text string) *template.Template {
+			if err != nil {
+				return nil
+			}
+			if text == "" {
+				return nil
+			}
+			var tmpl *template.Template
+			tmpl, err = template.New(locale + "." + field).Option("missingkey=error").Parse(text)
+			return tmpl
+		}
+		c.title = parse("title", content.Title)
+		c.subtitle = parse("subtitle", content.Subtitle)
+		c.message = parse("message", content.Message)
+		c.body = parse("body", content.Body)
+		for _, extend := range content.Extend {
+			c.extend = append(c.extend, parse("extend."+extend.Key, extend.Value))
+		}
+		if err != nil {
+			return err
+		}
+		t.compiled[locale] = c
+	}
+	return nil
+}
+
+// resolveLocale returns the locale used for the requested one: the locale
+// itself if defined, then its parent locales (e.g. pt for pt-BR), and the
+// default locale at last.
+func (t *NotificationTemplate) resolveLocale(locale string) string {
+	locale = strings.Replace(locale, "_", "-", -1)
+	for locale != "" {
+		if _, ok := t.compiled[locale]; ok {
+			return locale
+		}
+		i := strings.LastIndex(locale, "-")
+		if i < 0 {
+			break
+		}
+		locale = locale[:i]
+	}
+	return t.DefaultLocale
+}
+
+// Render overwrites the title, subtitle, message, body and extend of req
+// with the copy for req.Locale rendered with req.Vars. Empty texts in the
+// template leave the fields of req as they are.
+func (t *NotificationTemplate) Render(req *RequestGaurunNotification) error {
+	locale := t.resolveLocale(req.Locale)
+	c := t.compiled[locale]
+	content := t.Locales[locale]
+
+	vars := req.Vars
+	if vars == nil {
+		vars = map[string]string{}
+	}
+	render := func(tmpl *template.Template, dst *string) error {
+		if tmpl == nil {
+			return nil
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, vars); err != nil {
+			return fmt.Errorf("failed to render template %s: %v", t.Name, err)
+		}
+		*dst = buf.String()
+		return nil
+	}
+
+	if err := render(c.title, &req.Title); err != nil {
+		return err
+	}
+	if err := render(c.subtitle, &req.Subtitle); err != nil {
+		return err
+	}
+	if err := render(c.message, &req.Message); err != nil {
+		return err
+	}
+	if err := render(c.body, &req.Body); err != nil {
+		return err
+	}
+
+	if len(c.extend) > 0 {
+		extends := make([]ExtendJSON, 0, len(req.Extend)+len(c.extend))
+		rendered := make(map[string]bool, len(c.extend))
+		for i, tmpl := range c.extend {
+			extend := ExtendJSON{Key: content.Extend[i].Key}
+			if err := render(tmpl, &extend.Value); err != nil {
+				return err
+			}
+			extends = append(extends, extend)
+			rendered[extend.Key] = true
+		}
+		// keys given in the request and not in the template are kept
+		for _, extend := range req.Extend {
+			if !rendered[extend.Key] {
+				extends = append(extends, extend)
+			}
+		}
+		req.Extend = extends
+	}
+
+	return nil
+}
+
+// Get returns the template named name.
+func (r *TemplateRegistry) Get(name string) (*NotificationTemplate, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.templates[name]
+	return t, ok
+}
+
+// Names returns the names of all templates in order.
+func (r *TemplateRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.templates))
+	for name := range r.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Put adds or replaces t, and stores it in the directory if any.
+func (r *TemplateRegistry) Put(t *NotificationTemplate) error {
+	if !templateNamePattern.MatchString(t.Name) {
+		return fmt.Errorf("invalid template name: %s", t.Name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dir != "" {
+		b, err := json.MarshalIndent(t, "", "  ")
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(r.dir, t.Name+".json")
+		tmp := path + ".tmp"
+		if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+	}
+	r.templates[t.Name] = t
+	return nil
+}
+
+// Delete removes the template named name. It reports whether the template existed.
+func (r *TemplateRegistry) Delete(name string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.templates[name]; !ok {
+		return false, nil
+	}
+	if r.dir != "" {
+		err := os.Remove(filepath.Join(r.dir, name+".json"))
+		if err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+	}
+	delete(r.templates, name)
+	return true, nil
+}
+
+// InitTemplates loads Templates from the configured directory.
+func InitTemplates() error {
+	var err error
+	Templates, err = NewTemplateRegistry(ConfGaurun.Template.Dir)
+	return err
+}
+
+// renderNotification renders the template referenced by notification, if
+// any. The empty message, which validateNotification leaves to templates,
+// is checked on the rendered notification.
+func renderNotification(notification *RequestGaurunNotification) error {
+	if notification.Template == "" {
+		return nil
+	}
+	if Templates == nil {
+		return fmt.Errorf("template %s is not found", notification.Template)
+	}
+	t, ok := Templates.Get(notification.Template)
+	if !ok {
+		return fmt.Errorf("template %s is not found", notification.Template)
+	}
+	if err := t.Render(notification); err != nil {
+		return err
+	}
+	if !ConfGaurun.Core.AllowsEmptyMessage && len(notification.Message) == 0 {
+		return fmt.Errorf("empty message rendered by template %s", notification.Template)
+	}
+	return nil
+}
+
+// TemplatesHandler lists the names of the templates.
+func TemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	if Templates == nil {
+		sendResponse(w, "template registry is disabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		sendResponse(w, "method must be GET", http.StatusBadRequest)
+		return
+	}
+	sendJSON(w, struct {
+		Templates []string `json:"templates"`
+	}{Templates.Names()})
+}
+
+// TemplateHandler shows (GET), creates or replaces (PUT) and removes
+// (DELETE) a single template given as /templates/{name}.
+func TemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if Templates == nil {
+		sendResponse(w, "template registry is disabled", http.StatusNotFound)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/templates/")
+	if !templateNamePattern.MatchString(name) {
+		sendResponse(w, "malformed template name", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		t, ok := Templates.Get(name)
+		if !ok {
+			sendResponse(w, "template not found", http.StatusNotFound)
+			return
+		}
+		sendJSON(w, t)
+	case "PUT":
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			sendResponse(w, "failed to read request-body", http.StatusInternalServerError)
+			return
+		}
+		t, err := ParseNotificationTemplate(b)
+		if err != nil {
+			LogError.Error(err.Error())
+			sendResponse(w, fmt.Sprintf("malformed template: %v", err), http.StatusBadRequest)
+			return
+		}
+		if t.Name != "" && t.Name != name {
+			sendResponse(w, "template name does not match the path", http.StatusBadRequest)
+			return
+		}
+		t.Name = name
+		if err := Templates.Put(t); err != nil {
+			LogError.Error(err.Error())
+			sendResponse(w, "failed to save template", http.StatusInternalServerError)
+			return
+		}
+		sendResponse(w, "ok", http.StatusOK)
+	case "DELETE":
+		found, err := Templates.Delete(name)
+		if err != nil {
+			LogError.Error(err.Error())
+			sendResponse(w, "failed to delete template", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			sendResponse(w, "template not found", http.StatusNotFound)
+			return
+		}
+		sendResponse(w, "ok", http.StatusOK)
+	default:
+		sendResponse(w, "method must be GET, PUT or DELETE", http.StatusBadRequest)
+	}
+}
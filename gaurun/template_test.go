@@ -0,0 +1,159 @@
+package gaurun
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTemplate = `{
+  "name": "welcome",
+  "default_locale": "en",
+  "locales": {
+    "en": {"title": "Welcome", "message": "Hello, {{.name}}!", "extend": [{"key": "url", "val": "https://example.com/{{.id}}"}]},
+    "pt": {"title": "Bem-vindo", "message": "Olá, {{.name}}!"},
+    "pt-BR": {"message": "Oi, {{.name}}!"}
+  }
+}`
+
+func TestNotificationTemplateRender(t *testing.T) {
+	tmpl, err := ParseNotificationTemplate([]byte(testTemplate))
+	require.Nil(t, err)
+
+	cases := []struct {
+		Locale  string
+		Title   string
+		Message string
+	}{
+		{"en", "Welcome", "Hello, gopher!"},
+		{"pt", "Bem-vindo", "Olá, gopher!"},
+		{"pt-BR", "original", "Oi, gopher!"},
+		{"pt_PT", "Bem-vindo", "Olá, gopher!"},
+		{"ja", "Welcome", "Hello, gopher!"},
+		{"", "Welcome", "Hello, gopher!"},
+	}
+	for _, c := range cases {
+		req := RequestGaurunNotification{
+			Title:  "original",
+			Locale: c.Locale,
+			Vars:   map[string]string{"name": "gopher", "id": "1"},
+		}
+		assert.Nil(t, tmpl.Render(&req))
+		assert.Equal(t, c.Title, req.Title, c.Locale)
+		assert.Equal(t, c.Message, req.Message, c.Locale)
+	}
+
+	req := RequestGaurunNotification{
+		Vars:   map[string]string{"name": "gopher", "id": "1"},
+		Extend: []ExtendJSON{{Key: "url", Value: "overwritten"}, {Key: "kept", Value: "kept"}},
+	}
+	assert.Nil(t, tmpl.Render(&req))
+	assert.Equal(t, []ExtendJSON{{Key: "url", Value: "https://example.com/1"}, {Key: "kept", Value: "kept"}}, req.Extend)
+
+	// missing vars
+	req = RequestGaurunNotification{}
+	assert.NotNil(t, tmpl.Render(&req))
+}
+
+func TestParseNotificationTemplateInvalid(t *testing.T) {
+	cases := []string{
+		`{"name": "a", "default_locale": "en"}`,
+		`{"name": "a", "default_locale": "ja", "locales": {"en": {"message": "hello"}}}`,
+		`{"name": "a", "default_locale": "en", "locales": {"en": {"message": "{{.name"}}}`,
+		`{"name": "../a", "default_locale": "en", "locales": {"en": {"message": "hello"}}}`,
+	}
+	for _, c := range cases {
+		_, err := ParseNotificationTemplate([]byte(c))
+		assert.NotNil(t, err, c)
+	}
+}
+
+func TestTemplateRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "welcome.json"), []byte(testTemplate), 0644))
+
+	Templates, err = NewTemplateRegistry(dir)
+	require.Nil(t, err)
+	defer func() {
+		Templates = nil
+	}()
+	assert.Equal(t, []string{"welcome"}, Templates.Names())
+
+	notification := RequestGaurunNotification{
+		Tokens:   []string{"xxx"},
+		Platform: PlatFormIos,
+		Template: "welcome",
+		Vars:     map[string]string{"name": "gopher", "id": "1"},
+	}
+	assert.Nil(t, validateNotification(&notification))
+	assert.Nil(t, renderNotification(&notification))
+	assert.Equal(t, "Hello, gopher!", notification.Message)
+
+	notification.Template = "unknown"
+	assert.NotNil(t, validateNotification(&notification))
+
+	mux := http.NewServeMux()
+	RegisterHandlers(mux)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	do := func(method, path, body string) int {
+		req, _ := http.NewRequest(method, s.URL+path, bytes.NewBufferString(body))
+		res, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, do("PUT", "/templates/goodbye", `{"default_locale": "en", "locales": {"en": {"message": "Bye"}}}`))
+	assert.Equal(t, http.StatusBadRequest, do("PUT", "/templates/broken", `{"default_locale": "en"}`))
+	assert.Equal(t, []string{"goodbye", "welcome"}, Templates.Names())
+	_, err = os.Stat(filepath.Join(dir, "goodbye.json"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, do("GET", "/templates/goodbye", ""))
+	assert.Equal(t, http.StatusOK, do("DELETE", "/templates/goodbye", ""))
+	assert.Equal(t, http.StatusNotFound, do("GET", "/templates/goodbye", ""))
+	_, err = os.Stat(filepath.Join(dir, "goodbye.json"))
+	assert.True(t, os.IsNotExist(err))
+
+	// templates are loaded again from the directory
+	registry, err := NewTemplateRegistry(dir)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"welcome"}, registry.Names())
+}
+
+func TestRenderNotificationEmptyMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "title.json"), []byte(`{"name": "title", "default_locale": "en", "locales": {"en": {"title": "Welcome"}}}`), 0644))
+
+	Templates, err = NewTemplateRegistry(dir)
+	require.Nil(t, err)
+	defer func() {
+		Templates = nil
+	}()
+
+	// the template renders no message, which is checked after rendering.
+	notification := RequestGaurunNotification{
+		Tokens:   []string{"xxx"},
+		Platform: PlatFormIos,
+		Template: "title",
+	}
+	assert.Nil(t, validateNotification(&notification))
+	assert.NotNil(t, renderNotification(&notification))
+
+	notification.Message = "given"
+	assert.Nil(t, renderNotification(&notification))
+	assert.Equal(t, "given", notification.Message)
+}
@@ -0,0 +1,331 @@
+package gaurun
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/nohana/gaurun/buford/push"
+	"github.com/nohana/gaurun/gcm"
+)
+
+var tokenStateBucket = []byte("tokens")
+
+// tokenStatePlatforms are the platforms the token store namespaces tokens
+// by, in the order single tokens are looked up without a platform.
+var tokenStatePlatforms = []string{"ios", "android"}
+
+// invalidTokenReasons are the reasons for which APNs and FCM reject a
+// device token itself. Other errors, e.g. of the topic or the sender ID,
+// do not tell that the token is invalid.
+var invalidTokenReasons = map[string]bool{
+	push.ErrBadDeviceToken.Error(): true,
+	push.ErrUnregistered.Error():   true,
+	gcm.ErrorInvalidRegistration:   true,
+	gcm.ErrorNotRegistered:         true,
+	"UNREGISTERED":                 true, // FCM v1
+}
+
+// TokenState records a device token which APNs or FCM rejected permanently.
+type TokenState struct {
+	Token      string    `json:"token"`
+	Platform   string    `json:"platform"`
+	Reason     string    `json:"reason"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Timestamp  time.Time `json:"timestamp,omitempty"` // when APNs last saw the token as invalid
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// TokenStore is an on-disk registry of invalid device tokens, keyed by
+// their platforms and tokens. Tokens recorded longer than ttl ago are
+// treated as not recorded, and are deleted when the store is opened.
+type TokenStore struct {
+	db  *bolt.DB
+	ttl time.Duration
+}
+
+func tokenStateKey(platform, token string) []byte {
+	return []byte(platform + ":" + token)
+}
+
+// OpenTokenStore opens the token store at path, creating it if necessary.
+// Tokens expire after ttl, or never if ttl is not positive.
+func OpenTokenStore(path string, ttl time.Duration) (*TokenStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &TokenStore{db: db, ttl: ttl}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(tokenStateBucket)
+		if err != nil {
+			return err
+		}
+		return s.purge(b)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *TokenStore) Close() error {
+	return s.db.Close()
+}
+
+// expired reports whether state was recorded longer than ttl ago.
+func (s *TokenStore) expired(state TokenState) bool {
+	return s.ttl > 0 && time.Since(state.RecordedAt) >= s.ttl
+}
+
+// purge deletes the expired tokens in b.
+func (s *TokenStore) purge(b *bolt.Bucket) error {
+	if s.ttl <= 0 {
+		return nil
+	}
+	var expired [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		var state TokenState
+		if err := json.Unmarshal(v, &state); err != nil {
+			return err
+		}
+		if s.expired(state) {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put records state, replacing any previous state for the same platform
+// and token.
+func (s *TokenStore) Put(state TokenState) error {
+	v, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokenStateBucket).Put(tokenStateKey(state.Platform, state.Token), v)
+	})
+}
+
+// Get returns the state of token of platform. The second return value
+// reports whether the token is recorded and not expired.
+func (s *TokenStore) Get(platform, token string) (TokenState, bool, error) {
+	var (
+		state TokenState
+		found bool
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(tokenStateBucket).Get(tokenStateKey(platform, token))
+		if v == nil {
+			return nil
+		}
+		if err := json.Unmarshal(v, &state); err != nil {
+			return err
+		}
+		found = !s.expired(state)
+		return nil
+	})
+	return state, found, err
+}
+
+// contains reports whether token of platform is recorded, even if it has
+// expired.
+func (s *TokenStore) contains(platform, token string) (bool, error) {
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(tokenStateBucket).Get(tokenStateKey(platform, token)) != nil
+		return nil
+	})
+	return found, err
+}
+
+// Delete removes token of platform from the store. The second return
+// value reports whether the token was recorded.
+func (s *TokenStore) Delete(platform, token string) (bool, error) {
+	var found bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokenStateBucket)
+		found = b.Get(tokenStateKey(platform, token)) != nil
+		if !found {
+			return nil
+		}
+		return b.Delete(tokenStateKey(platform, token))
+	})
+	return found, err
+}
+
+// ForEach calls fn for each recorded token not expired in key order. It
+// stops and returns the error if fn returns one.
+func (s *TokenStore) ForEach(fn func(state TokenState) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokenStateBucket).ForEach(func(k, v []byte) error {
+			var state TokenState
+			if err := json.Unmarshal(v, &state); err != nil {
+				return err
+			}
+			if s.expired(state) {
+				return nil
+			}
+			return fn(state)
+		})
+	})
+}
+
+// InitTokenStore opens InvalidTokens if a path is configured.
+func InitTokenStore() error {
+	if ConfGaurun.TokenStore.Path == "" {
+		return nil
+	}
+	var err error
+	InvalidTokens, err = OpenTokenStore(ConfGaurun.TokenStore.Path, time.Duration(ConfGaurun.TokenStore.TTL)*time.Second)
+	return err
+}
+
+// isSuppressedToken reports whether pushes to token of platform should be
+// skipped. A token recorded longer than ttl ago is pushed again, and is
+// recorded again or cleared by the result.
+func isSuppressedToken(platform int, token string) bool {
+	if InvalidTokens == nil {
+		return false
+	}
+	_, found, err := InvalidTokens.Get(platformName(platform), token)
+	if err != nil {
+		LogError.Error("failed to look up token state: " + err.Error())
+		return false
+	}
+	return found
+}
+
+// recordInvalidToken stores token if de says it is no longer valid.
+func recordInvalidToken(token string, de *DeliveryError) {
+	if InvalidTokens == nil || de == nil || de.Category != ErrorCategoryTokenInvalid || !invalidTokenReasons[de.Reason] {
+		return
+	}
+	state := TokenState{
+		Token:      token,
+		Platform:   platformName(de.Platform),
+		Reason:     de.Reason,
+		StatusCode: de.StatusCode,
+		Timestamp:  de.Timestamp,
+		RecordedAt: time.Now().UTC(),
+	}
+	if err := InvalidTokens.Put(state); err != nil {
+		LogError.Error("failed to record invalid token: " + err.Error())
+	}
+}
+
+// clearInvalidToken removes token of platform, which has been pushed
+// successfully, if it is recorded.
+func clearInvalidToken(platform int, token string) {
+	if InvalidTokens == nil {
+		return
+	}
+	name := platformName(platform)
+	if found, err := InvalidTokens.contains(name, token); err != nil || !found {
+		return
+	}
+	if _, err := InvalidTokens.Delete(name, token); err != nil {
+		LogError.Error("failed to clear invalid token: " + err.Error())
+	}
+}
+
+// TokensHandler exports every recorded token as newline-delimited JSON.
+// The optional parameter platform (ios or android) filters the output.
+func TokensHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		sendResponse(w, "method must be GET", http.StatusBadRequest)
+		return
+	}
+	if InvalidTokens == nil {
+		sendResponse(w, "token store is disabled", http.StatusNotFound)
+		return
+	}
+
+	platform := r.URL.Query().Get("platform")
+
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	w.Header().Set("Server", serverHeader())
+
+	encoder := json.NewEncoder(w)
+	err := InvalidTokens.ForEach(func(state TokenState) error {
+		if platform != "" && state.Platform != platform {
+			return nil
+		}
+		return encoder.Encode(state)
+	})
+	if err != nil {
+		// the status has already been sent, so only logging is possible.
+		LogError.Error("failed to export tokens: " + err.Error())
+	}
+}
+
+// TokenHandler shows (GET) or removes (DELETE) the state of a single token
+// given as /tokens/{token}. The optional parameter platform (ios or
+// android) selects the platform of the token, which is otherwise looked up
+// in (GET) or removed from (DELETE) every platform.
+func TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if InvalidTokens == nil {
+		sendResponse(w, "token store is disabled", http.StatusNotFound)
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, "/tokens/")
+	if token == "" || strings.Contains(token, "/") {
+		sendResponse(w, "malformed token", http.StatusBadRequest)
+		return
+	}
+
+	platforms := tokenStatePlatforms
+	if platform := r.URL.Query().Get("platform"); platform != "" {
+		platforms = []string{platform}
+	}
+
+	switch r.Method {
+	case "GET":
+		for _, platform := range platforms {
+			state, found, err := InvalidTokens.Get(platform, token)
+			if err != nil {
+				LogError.Error(err.Error())
+				sendResponse(w, "failed to get token", http.StatusInternalServerError)
+				return
+			}
+			if found {
+				sendJSON(w, state)
+				return
+			}
+		}
+		sendResponse(w, "token not found", http.StatusNotFound)
+	case "DELETE":
+		deleted := false
+		for _, platform := range platforms {
+			found, err := InvalidTokens.Delete(platform, token)
+			if err != nil {
+				LogError.Error(err.Error())
+				sendResponse(w, "failed to delete token", http.StatusInternalServerError)
+				return
+			}
+			deleted = deleted || found
+		}
+		if !deleted {
+			sendResponse(w, "token not found", http.StatusNotFound)
+			return
+		}
+		sendResponse(w, "ok", http.StatusOK)
+	default:
+		sendResponse(w, "method must be GET or DELETE", http.StatusBadRequest)
+	}
+}
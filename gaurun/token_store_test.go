@@ -0,0 +1,187 @@
+package gaurun
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nohana/gaurun/buford/push"
+	"github.com/nohana/gaurun/gcm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenStore(t *testing.T) {
+	withTokenStore(t)
+	withConf(t)
+
+	_, found, err := InvalidTokens.Get("ios", "xxx")
+	assert.Nil(t, err)
+	assert.False(t, found)
+	assert.False(t, isSuppressedToken(PlatFormIos, "xxx"))
+
+	unregisteredAt := time.Unix(1600000000, 0).UTC()
+	recordInvalidToken("xxx", NewDeliveryError(PlatFormIos, &push.Error{
+		Reason:    push.ErrUnregistered,
+		Status:    http.StatusGone,
+		Timestamp: unregisteredAt,
+	}))
+	// errors other than token-invalid are not recorded
+	recordInvalidToken("yyy", NewDeliveryError(PlatFormIos, &push.Error{
+		Reason: push.ErrServiceUnavailable,
+		Status: http.StatusServiceUnavailable,
+	}))
+	// nor are mismatches of the topic, which every token would get.
+	recordInvalidToken("zzz", NewDeliveryError(PlatFormIos, &push.Error{
+		Reason: push.ErrDeviceTokenNotForTopic,
+		Status: http.StatusBadRequest,
+	}))
+	recordInvalidToken("zzz", NewDeliveryError(PlatFormAndroid, &gcm.Error{
+		StatusCode: http.StatusOK,
+		Reason:     gcm.ErrorMismatchSenderID,
+	}))
+
+	state, found, err := InvalidTokens.Get("ios", "xxx")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "ios", state.Platform)
+	assert.Equal(t, "Unregistered", state.Reason)
+	assert.Equal(t, http.StatusGone, state.StatusCode)
+	assert.Equal(t, unregisteredAt, state.Timestamp)
+	assert.True(t, isSuppressedToken(PlatFormIos, "xxx"))
+	assert.False(t, isSuppressedToken(PlatFormAndroid, "xxx"))
+	assert.False(t, isSuppressedToken(PlatFormIos, "yyy"))
+	assert.False(t, isSuppressedToken(PlatFormIos, "zzz"))
+	assert.False(t, isSuppressedToken(PlatFormAndroid, "zzz"))
+
+	// a token recorded longer than ttl ago is pushed again,
+	state.RecordedAt = time.Now().Add(-time.Hour)
+	require.Nil(t, InvalidTokens.Put(state))
+	assert.False(t, isSuppressedToken(PlatFormIos, "xxx"))
+
+	// and is deleted by a success.
+	clearInvalidToken(PlatFormIos, "xxx")
+	found, err = InvalidTokens.contains("ios", "xxx")
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	recordInvalidToken("xxx", NewDeliveryError(PlatFormIos, &push.Error{
+		Reason: push.ErrBadDeviceToken,
+		Status: http.StatusBadRequest,
+	}))
+	found, err = InvalidTokens.Delete("ios", "xxx")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.False(t, isSuppressedToken(PlatFormIos, "xxx"))
+
+	found, err = InvalidTokens.Delete("ios", "xxx")
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
+
+func TestTokenStoreExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.db")
+
+	store, err := OpenTokenStore(path, 0)
+	require.Nil(t, err)
+	require.Nil(t, store.Put(TokenState{Token: "old", Platform: "ios", RecordedAt: time.Now().Add(-2 * time.Hour)}))
+	require.Nil(t, store.Put(TokenState{Token: "new", Platform: "ios", RecordedAt: time.Now()}))
+	require.Nil(t, store.Close())
+
+	store, err = OpenTokenStore(path, time.Hour)
+	require.Nil(t, err)
+	defer store.Close()
+	// expired tokens are deleted on open.
+	found, err := store.contains("ios", "old")
+	require.Nil(t, err)
+	assert.False(t, found)
+	_, found, err = store.Get("ios", "new")
+	require.Nil(t, err)
+	assert.True(t, found)
+
+	// and those expiring while open are neither looked up nor exported.
+	require.Nil(t, store.Put(TokenState{Token: "old", Platform: "ios", RecordedAt: time.Now().Add(-2 * time.Hour)}))
+	_, found, err = store.Get("ios", "old")
+	require.Nil(t, err)
+	assert.False(t, found)
+	var tokens []string
+	require.Nil(t, store.ForEach(func(state TokenState) error {
+		tokens = append(tokens, state.Token)
+		return nil
+	}))
+	assert.Equal(t, []string{"new"}, tokens)
+}
+
+func TestTokenHandlers(t *testing.T) {
+	withTokenStore(t)
+
+	require.Nil(t, InvalidTokens.Put(TokenState{Token: "xxx", Platform: "ios", Reason: "Unregistered", RecordedAt: time.Now()}))
+	require.Nil(t, InvalidTokens.Put(TokenState{Token: "yyy", Platform: "android", Reason: "NotRegistered", RecordedAt: time.Now()}))
+	require.Nil(t, InvalidTokens.Put(TokenState{Token: "xxx", Platform: "android", Reason: "NotRegistered", RecordedAt: time.Now()}))
+
+	mux := http.NewServeMux()
+	RegisterHandlers(mux)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	// export
+	res, err := http.Get(s.URL + "/tokens?platform=android")
+	require.Nil(t, err)
+	var states []TokenState
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		var state TokenState
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &state))
+		states = append(states, state)
+	}
+	res.Body.Close()
+	assert.Equal(t, 2, len(states))
+	assert.Equal(t, "xxx", states[0].Token)
+	assert.Equal(t, "yyy", states[1].Token)
+
+	// single token
+	res, err = http.Get(s.URL + "/tokens/xxx")
+	require.Nil(t, err)
+	var state TokenState
+	require.Nil(t, json.NewDecoder(res.Body).Decode(&state))
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "Unregistered", state.Reason)
+
+	res, err = http.Get(s.URL + "/tokens/xxx?platform=android")
+	require.Nil(t, err)
+	require.Nil(t, json.NewDecoder(res.Body).Decode(&state))
+	res.Body.Close()
+	assert.Equal(t, "NotRegistered", state.Reason)
+
+	req, _ := http.NewRequest("DELETE", s.URL+"/tokens/xxx?platform=ios", nil)
+	res, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, err = http.Get(s.URL + "/tokens/xxx?platform=ios")
+	require.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	req, _ = http.NewRequest("DELETE", s.URL+"/tokens/xxx", nil)
+	res, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, err = http.Get(s.URL + "/tokens/xxx")
+	require.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
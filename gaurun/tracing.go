@@ -0,0 +1,159 @@
+package gaurun
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/nohana/gaurun"
+
+// traceContext propagates W3C trace context from callers to notifications.
+// Notifications carry the trace context even if tracing is disabled.
+var traceContext = propagation.TraceContext{}
+
+// InitTracing exports spans to the OTLP collector if configured.
+func InitTracing() error {
+	conf := ConfGaurun.Tracing
+	if conf.Endpoint == "" {
+		return nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(conf.Endpoint))
+	if err != nil {
+		return err
+	}
+	attrs := []attribute.KeyValue{attribute.String("service.name", conf.ServiceName)}
+	if ConfGaurun.Core.InstanceID != "" {
+		attrs = append(attrs, attribute.String("service.instance.id", ConfGaurun.Core.InstanceID))
+	}
+	Tracer = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+	)
+	otel.SetTracerProvider(Tracer)
+	return nil
+}
+
+// ShutdownTracing exports the spans left, if tracing is enabled.
+func ShutdownTracing(ctx context.Context) error {
+	if Tracer == nil {
+		return nil
+	}
+	return Tracer.Shutdown(ctx)
+}
+
+func tracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
+
+// startRequestSpan starts the span of a request, following the trace
+// context given by the caller.
+func startRequestSpan(r *http.Request, name string) (context.Context, trace.Span) {
+	ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.Path),
+		))
+}
+
+// injectTraceContext makes notification carry the trace context of ctx.
+func injectTraceContext(ctx context.Context, notification *RequestGaurunNotification) {
+	carrier := propagation.MapCarrier{}
+	traceContext.Inject(ctx, carrier)
+	if len(carrier) > 0 {
+		notification.TraceContext = carrier
+	}
+}
+
+// notificationContext returns the context of the trace req is carrying.
+func notificationContext(req RequestGaurunNotification) context.Context {
+	return traceContext.Extract(context.Background(), propagation.MapCarrier(req.TraceContext))
+}
+
+func notificationAttributes(req RequestGaurunNotification) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("gaurun.seq_id", req.ID),
+		attribute.String("gaurun.platform", platformName(req.Platform)),
+	}
+	if req.RequestID != "" {
+		attrs = append(attrs, attribute.String("gaurun.request_id", req.RequestID))
+	}
+	return attrs
+}
+
+// startEnqueueSpan starts the span of enqueueing req.
+func startEnqueueSpan(req RequestGaurunNotification) trace.Span {
+	_, span := tracer().Start(notificationContext(req), "enqueue",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(notificationAttributes(req)...))
+	return span
+}
+
+// traceQueueWait records the span from when req was accepted until now,
+// when a worker received it from the queue.
+func traceQueueWait(req RequestGaurunNotification) {
+	_, span := tracer().Start(notificationContext(req), "queue wait",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithTimestamp(req.acceptedTime()),
+		trace.WithAttributes(notificationAttributes(req)...),
+		trace.WithAttributes(attribute.String("gaurun.queue", ConfGaurun.Queue.Backend)))
+	span.End()
+}
+
+// startAttemptSpan starts the span of a try to push req.
+func startAttemptSpan(ctx context.Context, req RequestGaurunNotification) (context.Context, trace.Span) {
+	return tracer().Start(ctx, "push attempt",
+		trace.WithAttributes(notificationAttributes(req)...),
+		trace.WithAttributes(attribute.Int("gaurun.retry", req.Retry)))
+}
+
+// startUpstreamSpan starts the span of a request to APNs or FCM.
+func startUpstreamSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+}
+
+// endSpan ends span with the result of a push. The status and reason given
+// by APNs or FCM are recorded if err is a *DeliveryError.
+func endSpan(span trace.Span, err error) {
+	if err == nil {
+		span.SetStatus(codes.Ok, "")
+		span.End()
+		return
+	}
+	if de := asDeliveryError(err); de != nil {
+		if de.StatusCode != 0 {
+			span.SetAttributes(attribute.Int("http.status_code", de.StatusCode))
+		}
+		if de.Reason != "" {
+			span.SetAttributes(attribute.String("gaurun.reason", de.Reason))
+		}
+		span.SetAttributes(attribute.String("gaurun.error_category", string(de.Category)))
+		if de.RetryAfter > 0 {
+			span.SetAttributes(attribute.Int64("gaurun.retry_after_ms", int64(de.RetryAfter/time.Millisecond)))
+		}
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	span.End()
+}
+
+// endUpstreamSpan ends span of a request to APNs or FCM succeeded with
+// status 200, or failed with err.
+func endUpstreamSpan(span trace.Span, err error) {
+	if err == nil {
+		span.SetAttributes(attribute.Int("http.status_code", http.StatusOK))
+	}
+	endSpan(span, err)
+}
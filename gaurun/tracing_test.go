@@ -0,0 +1,157 @@
+package gaurun
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nohana/gaurun/gcm"
+	"github.com/nohana/gaurun/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// setupTracing records spans instead of exporting them.
+func setupTracing() (*tracetest.SpanRecorder, func()) {
+	recorder := tracetest.NewSpanRecorder()
+	providerBefore := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	return recorder, func() {
+		otel.SetTracerProvider(providerBefore)
+	}
+}
+
+func findSpans(spans []sdktrace.ReadOnlySpan, name string) []sdktrace.ReadOnlySpan {
+	var found []sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		if span.Name() == name {
+			found = append(found, span)
+		}
+	}
+	return found
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTraceContextThroughQueue(t *testing.T) {
+	recorder, teardown := setupTracing()
+	defer teardown()
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	r := httptest.NewRequest("POST", "/push", nil)
+	r.Header.Set("traceparent", traceparent)
+	ctx, span := startRequestSpan(r, "POST /push")
+	notification := RequestGaurunNotification{ID: "01", Tokens: []string{"xxx"}, Platform: PlatFormAndroid}
+	injectTraceContext(ctx, &notification)
+	span.End()
+	assert.Contains(t, notification.TraceContext["traceparent"], "4bf92f3577b34da6a3ce929d0e0e4736")
+
+	// the trace context survives queues storing notifications as JSON.
+	b, err := json.Marshal(notification)
+	require.Nil(t, err)
+	var queued RequestGaurunNotification
+	require.Nil(t, json.Unmarshal(b, &queued))
+	queued.AcceptedAt = time.Now().Add(-time.Second).UnixNano() / int64(time.Millisecond)
+	traceQueueWait(queued)
+
+	calls := 0
+	pusher := func(ctx context.Context, req RequestGaurunNotification) error {
+		calls++
+		_, span := startUpstreamSpan(ctx, "fcm send")
+		if calls == 1 {
+			err := NewDeliveryError(req.Platform, &gcm.Error{StatusCode: http.StatusServiceUnavailable, Reason: gcm.ErrorUnavailable})
+			endUpstreamSpan(span, err)
+			return err
+		}
+		endUpstreamSpan(span, nil)
+		return nil
+	}
+	_, err = pushWithRetry(pusher, queued, 1)
+	require.Nil(t, err)
+
+	spans := recorder.Ended()
+	request := findSpans(spans, "POST /push")
+	require.Len(t, request, 1)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", request[0].SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", request[0].Parent().SpanID().String())
+
+	wait := findSpans(spans, "queue wait")
+	require.Len(t, wait, 1)
+	assert.Equal(t, request[0].SpanContext().SpanID(), wait[0].Parent().SpanID())
+	assert.True(t, wait[0].EndTime().Sub(wait[0].StartTime()) >= time.Second)
+
+	attempts := findSpans(spans, "push attempt")
+	require.Len(t, attempts, 2)
+	for i, attempt := range attempts {
+		assert.Equal(t, request[0].SpanContext().SpanID(), attempt.Parent().SpanID())
+		assert.Equal(t, int64(i), spanAttribute(attempt, "gaurun.retry").AsInt64())
+	}
+	assert.Equal(t, string(ErrorCategoryRetryable), spanAttribute(attempts[0], "gaurun.error_category").AsString())
+
+	upstream := findSpans(spans, "fcm send")
+	require.Len(t, upstream, 2)
+	assert.Equal(t, attempts[0].SpanContext().SpanID(), upstream[0].Parent().SpanID())
+	assert.Equal(t, trace.SpanKindClient, upstream[0].SpanKind())
+	assert.Equal(t, int64(http.StatusServiceUnavailable), spanAttribute(upstream[0], "http.status_code").AsInt64())
+	assert.Equal(t, "Unavailable", spanAttribute(upstream[0], "gaurun.reason").AsString())
+	assert.Equal(t, int64(http.StatusOK), spanAttribute(upstream[1], "http.status_code").AsInt64())
+}
+
+func TestTraceUpstream(t *testing.T) {
+	recorder, teardown := setupTracing()
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	withConf(t)
+
+	server := mock.NewServer()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	initMockClients(t, dir, ts.URL, server)
+
+	token := strings.Repeat("ab", 32)
+	server.SetResponses(token, mock.Response{Reason: "Unregistered"})
+	require.NotNil(t, PushNotification(RequestGaurunNotification{
+		ID: "01", Tokens: []string{token}, Platform: PlatFormIos, Message: "hello",
+	}))
+
+	ConfGaurun.Android.UseV1 = true
+	require.Nil(t, PushNotification(RequestGaurunNotification{
+		ID: "02", Tokens: []string{"android"}, Platform: PlatFormAndroid, Body: "hello",
+	}))
+
+	spans := recorder.Ended()
+	apns := findSpans(spans, "apns push")
+	require.Len(t, apns, 1)
+	assert.Equal(t, int64(http.StatusGone), spanAttribute(apns[0], "http.status_code").AsInt64())
+	assert.Equal(t, "Unregistered", spanAttribute(apns[0], "gaurun.reason").AsString())
+	assert.Equal(t, string(ErrorCategoryTokenInvalid), spanAttribute(apns[0], "gaurun.error_category").AsString())
+
+	fcm := findSpans(spans, "fcm v1 send")
+	require.Len(t, fcm, 1)
+	assert.Equal(t, int64(http.StatusOK), spanAttribute(fcm[0], "http.status_code").AsInt64())
+	attempts := findSpans(spans, "push attempt")
+	require.Len(t, attempts, 2)
+	assert.Equal(t, attempts[1].SpanContext().SpanID(), fcm[0].Parent().SpanID())
+}
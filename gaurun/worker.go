@@ -1,12 +1,11 @@
 package gaurun
 
 import (
+	"context"
 	"fmt"
-	"strings"
 	"sync"
 	"sync/atomic"
-
-	"github.com/nohana/gaurun/buford/push"
+	"time"
 )
 
 var (
@@ -18,90 +17,261 @@ var (
 	//
 	// This is used to block main process to shutdown while pusher is still working.
 	PusherWg sync.WaitGroup
+
+	// WorkerWg is global wait group for push workers, which return when
+	// QueueNotification is stopped and received up.
+	WorkerWg sync.WaitGroup
+
+	// EnqueueWg is global wait group for the handlers enqueueing
+	// notifications to the memory queue after responding.
+	EnqueueWg sync.WaitGroup
+
+	// pushersCtx is done when the shutdown gives up waiting for the
+	// pushers, which then stop waiting to retry.
+	pushersCtx, stopPushers = context.WithCancel(context.Background())
 )
 
 func init() {
 	PusherCountAll = 0
 }
 
-func StartPushWorkers(workerNum, queueNum int64) {
-	QueueNotification = make(chan RequestGaurunNotification, queueNum)
+// StartPushWorkers starts workers receiving from QueueNotification, which
+// must be set up by InitQueue.
+func StartPushWorkers(workerNum int64) {
+	pushersCtx, stopPushers = context.WithCancel(context.Background())
 	for i := int64(0); i < workerNum; i++ {
+		WorkerWg.Add(1)
 		go pushNotificationWorker()
 	}
 }
 
-func isExternalServerError(err error, platform int) bool {
-	switch platform {
-	case PlatFormIos:
-		if err == push.ErrIdleTimeout || err == push.ErrShutdown || err == push.ErrInternalServerError || err == push.ErrServiceUnavailable {
-			return true
+// ShutdownPushWorkers stops QueueNotification and waits until the workers
+// push the queued notifications or ctx is done. Notifications left in the
+// memory queue then are saved to the recovery file, if any, and lost
+// otherwise. Notifications being pushed are waited for in both cases.
+func ShutdownPushWorkers(ctx context.Context) error {
+	QueueNotification.Stop()
+	// the handlers waiting for room in the queue return at once when it is
+	// stopped, saving the rest to the recovery file.
+	EnqueueWg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		WorkerWg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+Wait:
+	for {
+		select {
+		case <-done:
+			break Wait
+		case <-ctx.Done():
+			stopPushers()
+			break Wait
+		case <-ticker.C:
+			LogError.Info(fmt.Sprintf("wait until queue is empty. Current queue len: %d", QueueNotification.Len()))
 		}
-	case PlatFormAndroid:
-		if err.Error() == "Unavailable" || err.Error() == "InternalServerError" || strings.Contains(err.Error(), "Timeout") {
-			return true
+	}
+
+	var err error
+	if q, ok := QueueNotification.(*NotificationQueue); ok {
+		if leftovers := q.Drain(); len(leftovers) > 0 {
+			path := ConfGaurun.Core.RecoveryFile
+			if path == "" {
+				err = fmt.Errorf("%d notifications are lost as recovery_file is not given", len(leftovers))
+			} else if err = SaveRecoveryFile(path, leftovers); err == nil {
+				LogError.Info(fmt.Sprintf("saved %d notifications to %s", len(leftovers), path))
+			}
 		}
+	}
+
+	// workers return after the notification in hand once the queue is empty.
+	<-done
+	PusherWg.Wait()
+	return err
+}
+
+// retryAfterMax caps how long a pusher waits before retrying when the
+// upstream asks for a longer delay with Retry-After.
+const retryAfterMax = 10 * time.Second
+
+func isRetryableError(err error, platform int) bool {
+	switch platform {
+	case PlatFormIos, PlatFormAndroid:
+		return NewDeliveryError(platform, err).Retryable()
 	default:
 		// not through
 	}
 	return false
 }
 
-func pushSync(pusher func(req RequestGaurunNotification) error, req RequestGaurunNotification, retryMax int) {
+// waitRetryAfter blocks for the delay the upstream requested, if any. It
+// returns false if the pushers are stopped for shutdown in the meantime.
+func waitRetryAfter(err error) bool {
+	ctx := pushersCtx
+	de := asDeliveryError(err)
+	if de == nil || de.RetryAfter <= 0 {
+		return ctx.Err() == nil
+	}
+	wait := de.RetryAfter
+	if wait > retryAfterMax {
+		wait = retryAfterMax
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func pushSync(pusher func(ctx context.Context, req RequestGaurunNotification) error, req RequestGaurunNotification, retryMax int) (bool, error) {
 	PusherWg.Add(1)
 	defer PusherWg.Done()
+	return pushWithRetry(pusher, req, retryMax)
+}
+
+// pushWithRetry pushes req until it succeeds, fails with an error not to
+// retry, or is retried retryMax times. Retries are given up when the
+// pushers are stopped for shutdown. Each try is traced as a span of
+// the trace req is carrying.
+//
+// It reports whether the push is settled: it succeeded, or its last failure
+// is recorded. A push whose retries are cut short by shutdown, or whose
+// dead letter could not be stored, is not settled and should be pushed
+// again.
+func pushWithRetry(pusher func(ctx context.Context, req RequestGaurunNotification) error, req RequestGaurunNotification, retryMax int) (bool, error) {
+	ctx := notificationContext(req)
 Retry:
-	err := pusher(req)
-	if err != nil && req.Retry < retryMax && isExternalServerError(err, req.Platform) {
+	attemptCtx, span := startAttemptSpan(ctx, req)
+	err := pusher(attemptCtx, req)
+	endSpan(span, err)
+	if err == nil {
+		return true, nil
+	}
+	if req.Retry < retryMax && isRetryableError(err, req.Platform) {
+		if !waitRetryAfter(err) {
+			return false, err
+		}
 		req.Retry++
+		countPushRetry(req.Platform)
+		LogPush(req.ID, StatusRetriedPush, req.Tokens[0], 0, req, err)
 		goto Retry
 	}
+	return storeDeadLetter(req, err) == nil, err
 }
 
-func pushAsync(pusher func(req RequestGaurunNotification) error, req RequestGaurunNotification, retryMax int, pusherCount *int64) {
+func pushAsync(pusher func(ctx context.Context, req RequestGaurunNotification) error, msg *QueueMessage, retryMax int, pusherCount *int64) {
 	defer PusherWg.Done()
-Retry:
-	err := pusher(req)
-	if err != nil && req.Retry < retryMax && isExternalServerError(err, req.Platform) {
-		req.Retry++
-		goto Retry
-	}
+	settled, _ := pushWithRetry(pusher, msg.Notification, retryMax)
+	settleNotification(msg, settled)
 
 	atomic.AddInt64(pusherCount, -1)
 	atomic.AddInt64(&PusherCountAll, -1)
 }
 
+// ackNotification acknowledges msg, which is then never delivered again.
+func ackNotification(msg *QueueMessage) {
+	if err := msg.Ack(); err != nil {
+		LogError.Error(fmt.Sprintf("failed to ack notification: seq_id=%s request_id=%s: %v", msg.Notification.ID, msg.Notification.RequestID, err))
+	}
+}
+
+// settleNotification acknowledges msg if its push is settled. Otherwise msg
+// is left to the shared queues to deliver again, or saved to the recovery
+// file, if any, as the memory queue never does.
+func settleNotification(msg *QueueMessage, settled bool) {
+	if settled {
+		ackNotification(msg)
+		return
+	}
+	if msg.Release() {
+		return
+	}
+	notification := msg.Notification
+	path := ConfGaurun.Core.RecoveryFile
+	if path == "" {
+		LogError.Error(fmt.Sprintf("notification is lost as recovery_file is not given: seq_id=%s request_id=%s", notification.ID, notification.RequestID))
+		return
+	}
+	if err := SaveRecoveryFile(path, []RequestGaurunNotification{notification}); err != nil {
+		LogError.Error(fmt.Sprintf("failed to save notification to %s: seq_id=%s request_id=%s: %v", path, notification.ID, notification.RequestID, err))
+	}
+}
+
+// selectPusher returns the pusher for platform and its retry count, or a
+// nil pusher for an invalid platform.
+func selectPusher(platform int) (func(ctx context.Context, req RequestGaurunNotification) error, int) {
+	switch platform {
+	case PlatFormIos:
+		return pushNotificationIos, ConfGaurun.Ios.RetryMax
+	case PlatFormAndroid:
+		if ConfGaurun.Android.UseV1 {
+			return pushNotificationFCMV1, ConfGaurun.Android.RetryMax
+		}
+		return pushNotificationAndroid, ConfGaurun.Android.RetryMax
+	}
+	return nil, 0
+}
+
+// PushNotification pushes req synchronously with retries as a worker does,
+// and returns the error of the last try.
+func PushNotification(req RequestGaurunNotification) error {
+	pusher, retryMax := selectPusher(req.Platform)
+	if pusher == nil {
+		return fmt.Errorf("invalid platform: %d", req.Platform)
+	}
+	_, err := pushSync(pusher, req, retryMax)
+	return err
+}
+
 func pushNotificationWorker() {
 	var (
 		retryMax    int
-		pusher      func(req RequestGaurunNotification) error
+		pusher      func(ctx context.Context, req RequestGaurunNotification) error
 		pusherCount int64
 	)
 
 	// pusherCount is the independent value between workers
 	pusherCount = 0
 
+	defer WorkerWg.Done()
+
 	for {
-		notification := <-QueueNotification
-
-		switch notification.Platform {
-		case PlatFormIos:
-			pusher = pushNotificationIos
-			retryMax = ConfGaurun.Ios.RetryMax
-		case PlatFormAndroid:
-			if ConfGaurun.Android.UseV1 {
-				pusher = pushNotificationFCMV1
-			} else {
-				pusher = pushNotificationAndroid
-			}
-			retryMax = ConfGaurun.Android.RetryMax
-		default:
+		msg, err := QueueNotification.Receive()
+		if err == ErrQueueClosed {
+			return
+		}
+		if err != nil {
+			LogError.Error(fmt.Sprintf("failed to receive notification: %v", err))
+			time.Sleep(time.Second)
+			continue
+		}
+		notification := msg.Notification
+		traceQueueWait(notification)
+
+		if notification.isExpired(time.Now()) {
+			countPushExpired(notification.Platform)
+			LogPush(notification.ID, StatusExpiredPush, notification.Tokens[0], 0, notification, nil)
+			ackNotification(msg)
+			continue
+		}
+
+		pusher, retryMax = selectPusher(notification.Platform)
+		if pusher == nil {
 			LogError.Warn(fmt.Sprintf("invalid platform: %d", notification.Platform))
+			ackNotification(msg)
 			continue
 		}
 
 		if atomic.LoadInt64(&ConfGaurun.Core.PusherMax) <= 0 {
-			pushSync(pusher, notification, retryMax)
+			settled, _ := pushSync(pusher, notification, retryMax)
+			settleNotification(msg, settled)
 			continue
 		}
 
@@ -112,10 +282,11 @@ func pushNotificationWorker() {
 			atomic.AddInt64(&pusherCount, 1)
 			atomic.AddInt64(&PusherCountAll, 1)
 			PusherWg.Add(1)
-			go pushAsync(pusher, notification, retryMax, &pusherCount)
+			go pushAsync(pusher, msg, retryMax, &pusherCount)
 			continue
 		} else {
-			pushSync(pusher, notification, retryMax)
+			settled, _ := pushSync(pusher, notification, retryMax)
+			settleNotification(msg, settled)
 			continue
 		}
 	}
@@ -1,35 +1,98 @@
 package gaurun
 
 import (
+	"context"
 	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/nohana/gaurun/buford/push"
+	"github.com/nohana/gaurun/gcm"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestIsExternalServerError(t *testing.T) {
+func TestIsRetryableError(t *testing.T) {
 	cases := []struct {
 		Err      error
 		Platform int
 		Expected bool
 	}{
-		{push.ErrIdleTimeout, PlatFormIos, true},
-		{push.ErrShutdown, PlatFormIos, true},
-		{push.ErrInternalServerError, PlatFormIos, true},
-		{push.ErrServiceUnavailable, PlatFormIos, true},
+		{&push.Error{Reason: push.ErrIdleTimeout, Status: http.StatusServiceUnavailable}, PlatFormIos, true},
+		{&push.Error{Reason: push.ErrShutdown, Status: http.StatusServiceUnavailable}, PlatFormIos, true},
+		{&push.Error{Reason: push.ErrInternalServerError, Status: http.StatusInternalServerError}, PlatFormIos, true},
+		{&push.Error{Reason: push.ErrServiceUnavailable, Status: http.StatusServiceUnavailable}, PlatFormIos, true},
+		{&push.Error{Reason: push.ErrUnregistered, Status: http.StatusGone}, PlatFormIos, false},
+		{&url.Error{Op: "Post", URL: "https://api.push.apple.com", Err: errors.New("connection reset")}, PlatFormIos, true},
 		{errors.New("no error"), PlatFormIos, false},
 
-		{errors.New("Unavailable"), PlatFormAndroid, true},
-		{errors.New("InternalServerError"), PlatFormAndroid, true},
-		{errors.New("Timeout"), PlatFormAndroid, true},
+		{&gcm.Error{StatusCode: http.StatusOK, Reason: gcm.ErrorUnavailable}, PlatFormAndroid, true},
+		{&gcm.Error{StatusCode: http.StatusOK, Reason: gcm.ErrorInternalServerError}, PlatFormAndroid, true},
+		{&gcm.Error{StatusCode: http.StatusServiceUnavailable, Reason: gcm.ErrorUnavailable}, PlatFormAndroid, true},
+		{&gcm.Error{StatusCode: http.StatusOK, Reason: gcm.ErrorNotRegistered}, PlatFormAndroid, false},
+		{&url.Error{Op: "Post", URL: gcm.FCMSendEndpoint, Err: errors.New("Timeout")}, PlatFormAndroid, true},
 		{errors.New("no error"), PlatFormAndroid, false},
 
 		{errors.New("no error"), 100 /* neither iOS nor Android */, false},
 	}
 
 	for _, c := range cases {
-		actual := isExternalServerError(c.Err, c.Platform)
-		assert.Equal(t, actual, c.Expected)
+		actual := isRetryableError(c.Err, c.Platform)
+		assert.Equal(t, c.Expected, actual, c.Err.Error())
 	}
 }
+
+func TestWaitRetryAfter(t *testing.T) {
+	defer func() {
+		pushersCtx, stopPushers = context.WithCancel(context.Background())
+	}()
+	err := NewDeliveryError(PlatFormIos, &push.Error{Reason: push.ErrTooManyRequests, Status: http.StatusTooManyRequests, RetryAfter: time.Hour})
+
+	assert.True(t, waitRetryAfter(errors.New("no Retry-After")))
+
+	// the wait for Retry-After is cut short by shutdown.
+	time.AfterFunc(10*time.Millisecond, stopPushers)
+	start := time.Now()
+	assert.False(t, waitRetryAfter(err))
+	assert.True(t, time.Since(start) < retryAfterMax)
+	assert.False(t, waitRetryAfter(errors.New("no Retry-After")))
+}
+
+func TestSettleNotification(t *testing.T) {
+	defer func() {
+		pushersCtx, stopPushers = context.WithCancel(context.Background())
+	}()
+	dir, err := ioutil.TempDir("", "gaurun")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	withConf(t)
+	ConfGaurun.Core.RecoveryFile = filepath.Join(dir, "recovery.json")
+
+	unavailable := func(ctx context.Context, req RequestGaurunNotification) error {
+		return NewDeliveryError(req.Platform, &gcm.Error{StatusCode: http.StatusOK, Reason: gcm.ErrorUnavailable})
+	}
+	req := RequestGaurunNotification{ID: "1", Tokens: []string{"xxx"}, Platform: PlatFormAndroid, Message: "hello"}
+
+	// a push failing for the last time is settled.
+	settled, err := pushWithRetry(unavailable, req, 0)
+	assert.NotNil(t, err)
+	assert.True(t, settled)
+
+	// but not one whose retries are cut short by shutdown, which the
+	// memory queue saves to the recovery file.
+	stopPushers()
+	settled, err = pushWithRetry(unavailable, req, 1)
+	assert.NotNil(t, err)
+	assert.False(t, settled)
+	settleNotification(&QueueMessage{Notification: req}, settled)
+
+	saved, err := LoadRecoveryFile(ConfGaurun.Core.RecoveryFile)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(saved))
+	assert.Equal(t, "1", saved[0].ID)
+}
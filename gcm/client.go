@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+
+	"github.com/nohana/gaurun/internal/retryafter"
 )
 
 const (
@@ -66,7 +68,10 @@ func NewClient(urlString, apiKey string) (*Client, error) {
 
 // Send sends a message to the FCM server without retrying in case of
 // service unavailability. A non-nil error is returned if a non-recoverable
-// error occurs (i.e. if the response status is not "200 OK").
+// error occurs (i.e. if the response status is not "200 OK"). Such an error
+// is an *Error when the FCM server responded. Errors for individual
+// registration IDs are reported in the results of the Response; see
+// Response.ResultError.
 func (c *Client) Send(msg *Message) (*Response, error) {
 	if err := msg.validate(); err != nil {
 		return nil, err
@@ -95,8 +100,14 @@ func (c *Client) send(msg *Message) (*Response, error) {
 	}
 	defer resp.Body.Close()
 
+	retryAfter := retryafter.Parse(resp.Header.Get("Retry-After"))
+
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("invalid status code %d: %s", resp.StatusCode, resp.Status)
+		return nil, &Error{
+			StatusCode: resp.StatusCode,
+			Reason:     statusReason(resp.StatusCode),
+			RetryAfter: retryAfter,
+		}
 	}
 
 	var response Response
@@ -104,6 +115,7 @@ func (c *Client) send(msg *Message) (*Response, error) {
 	if err := decoder.Decode(&response); err != nil {
 		return nil, err
 	}
+	response.retryAfter = retryAfter
 
 	return &response, err
 }
@@ -110,3 +110,48 @@ func TestSend(t *testing.T) {
 		server.Close()
 	}
 }
+
+func TestSendError(t *testing.T) {
+	server := startTestServer(t, &testResponse{StatusCode: http.StatusUnauthorized})
+	defer server.Close()
+
+	sender, err := NewClient(server.URL, "testAPIKey")
+	if err != nil {
+		t.Fatalf("Failed to setup sender client: %s", err)
+	}
+
+	_, err = sender.Send(NewMessage(map[string]interface{}{"key": "value"}, "1"))
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expect to be *Error: %v", err)
+	}
+	if e.StatusCode != http.StatusUnauthorized || e.Reason != ErrorAuthentication {
+		t.Fatalf("unexpected error: %#v", e)
+	}
+}
+
+func TestResultError(t *testing.T) {
+	resp := &Response{
+		Results: []Result{
+			{MessageID: "id"},
+			{Error: ErrorNotRegistered},
+		},
+	}
+
+	if err := resp.ResultError(0); err != nil {
+		t.Fatalf("expect no error for result 0: %v", err)
+	}
+
+	err := resp.ResultError(1)
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expect to be *Error: %v", err)
+	}
+	if e.Reason != ErrorNotRegistered || e.Error() != ErrorNotRegistered {
+		t.Fatalf("unexpected error: %#v", e)
+	}
+
+	if err := resp.ResultError(2); err != nil {
+		t.Fatalf("expect no error for out of range result: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package gcm
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Error codes returned by the FCM server, either in the result of a
+// processed message or implied by the HTTP status of the response.
+// See more on https://firebase.google.com/docs/cloud-messaging/http-server-ref#error-codes
+const (
+	ErrorMissingRegistration       = "MissingRegistration"
+	ErrorInvalidRegistration       = "InvalidRegistration"
+	ErrorNotRegistered             = "NotRegistered"
+	ErrorInvalidPackageName        = "InvalidPackageName"
+	ErrorMismatchSenderID          = "MismatchSenderId"
+	ErrorInvalidParameters         = "InvalidParameters"
+	ErrorMessageTooBig             = "MessageTooBig"
+	ErrorInvalidDataKey            = "InvalidDataKey"
+	ErrorInvalidTTL                = "InvalidTtl"
+	ErrorUnavailable               = "Unavailable"
+	ErrorInternalServerError       = "InternalServerError"
+	ErrorDeviceMessageRateExceeded = "DeviceMessageRateExceeded"
+	ErrorTopicsMessageRateExceeded = "TopicsMessageRateExceeded"
+	ErrorInvalidApnsCredential     = "InvalidApnsCredential"
+	ErrorAuthentication            = "Authentication"
+	ErrorInvalidJSON               = "InvalidJSON"
+)
+
+// Error is returned when the FCM server rejects a message, either with a
+// non-200 HTTP status or with an error code in its result.
+type Error struct {
+	StatusCode int
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode != http.StatusOK {
+		return fmt.Sprintf("invalid status code %d: %s", e.StatusCode, e.Reason)
+	}
+	return e.Reason
+}
+
+// statusReason returns the error code FCM implies with the HTTP status code.
+func statusReason(statusCode int) string {
+	switch {
+	case statusCode == http.StatusBadRequest:
+		return ErrorInvalidJSON
+	case statusCode == http.StatusUnauthorized:
+		return ErrorAuthentication
+	case statusCode >= http.StatusInternalServerError:
+		return ErrorUnavailable
+	default:
+		return http.StatusText(statusCode)
+	}
+}
@@ -1,5 +1,10 @@
 package gcm
 
+import (
+	"net/http"
+	"time"
+)
+
 // Response represents the FCM server's response to the application
 // server's sent message. See the documentation for FCM Architectural
 // Overview for more information:
@@ -8,6 +13,8 @@ type Response struct {
 	MulticastID  int64    `json:"multicast_id"`
 	CanonicalIDs int      `json:"canonical_ids"`
 	Results      []Result `json:"results"`
+
+	retryAfter time.Duration
 }
 
 // Result represents the status of a processed message.
@@ -16,3 +23,16 @@ type Result struct {
 	RegistrationID string `json:"registration_id"`
 	Error          string `json:"error"`
 }
+
+// ResultError returns an *Error for the i-th result if FCM failed to
+// process the message for that registration ID, and nil otherwise.
+func (r *Response) ResultError(i int) error {
+	if r == nil || i < 0 || i >= len(r.Results) || r.Results[i].Error == "" {
+		return nil
+	}
+	return &Error{
+		StatusCode: http.StatusOK,
+		Reason:     r.Results[i].Error,
+		RetryAfter: r.retryAfter,
+	}
+}
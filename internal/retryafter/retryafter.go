@@ -0,0 +1,26 @@
+// Package retryafter parses the Retry-After header of APNs and FCM, shared
+// by the clients in buford and gcm.
+package retryafter
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Parse reads a Retry-After header value given either in seconds or as an
+// HTTP date. It returns zero when the value is absent or malformed.
+func Parse(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,28 @@
+package retryafter
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":                              0,
+		"120":                           120 * time.Second,
+		"0":                             0,
+		"-1":                            0,
+		"soon":                          0,
+		"Mon, 02 Jan 2006 15:04:05 GMT": 0,
+	}
+	for value, expected := range cases {
+		if d := Parse(value); d != expected {
+			t.Errorf("Parse(%q) = %v, expected %v", value, d, expected)
+		}
+	}
+
+	d := Parse(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if d <= 50*time.Second || d > time.Minute {
+		t.Errorf("Parse of a date a minute later = %v", d)
+	}
+}
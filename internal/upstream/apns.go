@@ -0,0 +1,64 @@
+package upstream
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// APNsReasons maps every reason APNs responds with to its HTTP status.
+var APNsReasons = map[string]int{
+	"BadCollapseId":               http.StatusBadRequest,
+	"BadDeviceToken":              http.StatusBadRequest,
+	"BadExpirationDate":           http.StatusBadRequest,
+	"BadMessageId":                http.StatusBadRequest,
+	"BadPriority":                 http.StatusBadRequest,
+	"BadTopic":                    http.StatusBadRequest,
+	"DeviceTokenNotForTopic":      http.StatusBadRequest,
+	"DuplicateHeaders":            http.StatusBadRequest,
+	"IdleTimeout":                 http.StatusBadRequest,
+	"InvalidPushType":             http.StatusBadRequest,
+	"MissingDeviceToken":          http.StatusBadRequest,
+	"MissingTopic":                http.StatusBadRequest,
+	"PayloadEmpty":                http.StatusBadRequest,
+	"TopicDisallowed":             http.StatusBadRequest,
+	"BadCertificate":              http.StatusForbidden,
+	"BadCertificateEnvironment":   http.StatusForbidden,
+	"ExpiredProviderToken":        http.StatusForbidden,
+	"Forbidden":                   http.StatusForbidden,
+	"InvalidProviderToken":        http.StatusForbidden,
+	"MissingProviderToken":        http.StatusForbidden,
+	"BadPath":                     http.StatusNotFound,
+	"MethodNotAllowed":            http.StatusMethodNotAllowed,
+	"Unregistered":                http.StatusGone,
+	"PayloadTooLarge":             http.StatusRequestEntityTooLarge,
+	"TooManyProviderTokenUpdates": http.StatusTooManyRequests,
+	"TooManyRequests":             http.StatusTooManyRequests,
+	"InternalServerError":         http.StatusInternalServerError,
+	"ServiceUnavailable":          http.StatusServiceUnavailable,
+	"Shutdown":                    http.StatusServiceUnavailable,
+}
+
+type apnsError struct {
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+}
+
+// WriteAPNsError writes e as APNs rejects a push.
+func WriteAPNsError(w http.ResponseWriter, e Error) {
+	status := e.Status
+	if status == 0 {
+		status = APNsReasons[e.Reason]
+	}
+	if status == 0 {
+		status = http.StatusBadRequest
+	}
+	body := apnsError{Reason: e.Reason}
+	if status == http.StatusGone {
+		body.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	WriteRetryAfter(w, e.RetryAfter)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
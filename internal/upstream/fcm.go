@@ -0,0 +1,98 @@
+package upstream
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// FCMV1Errors maps every FCM v1 error code to its HTTP status.
+var FCMV1Errors = map[string]int{
+	"UNSPECIFIED_ERROR":      http.StatusInternalServerError,
+	"INVALID_ARGUMENT":       http.StatusBadRequest,
+	"UNREGISTERED":           http.StatusNotFound,
+	"SENDER_ID_MISMATCH":     http.StatusForbidden,
+	"QUOTA_EXCEEDED":         http.StatusTooManyRequests,
+	"UNAVAILABLE":            http.StatusServiceUnavailable,
+	"INTERNAL":               http.StatusInternalServerError,
+	"THIRD_PARTY_AUTH_ERROR": http.StatusUnauthorized,
+}
+
+// fcmV1Statuses maps HTTP statuses to the canonical codes of Google APIs.
+var fcmV1Statuses = map[int]string{
+	http.StatusBadRequest:          "INVALID_ARGUMENT",
+	http.StatusUnauthorized:        "UNAUTHENTICATED",
+	http.StatusForbidden:           "PERMISSION_DENIED",
+	http.StatusNotFound:            "NOT_FOUND",
+	http.StatusTooManyRequests:     "RESOURCE_EXHAUSTED",
+	http.StatusInternalServerError: "INTERNAL",
+	http.StatusServiceUnavailable:  "UNAVAILABLE",
+}
+
+// FCMResult is the result for a token in a response of legacy FCM.
+type FCMResult struct {
+	MessageID string `json:"message_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// FCMResponse is a response of legacy FCM.
+type FCMResponse struct {
+	MulticastID  int64       `json:"multicast_id"`
+	Success      int         `json:"success"`
+	Failure      int         `json:"failure"`
+	CanonicalIDs int         `json:"canonical_ids"`
+	Results      []FCMResult `json:"results"`
+}
+
+// WriteFCMError writes e as legacy FCM rejects the whole request with its
+// status, or only the result for a token with its reason.
+func WriteFCMError(w http.ResponseWriter, e Error) {
+	WriteRetryAfter(w, e.RetryAfter)
+	if e.Status != 0 && e.Status != http.StatusOK {
+		http.Error(w, http.StatusText(e.Status), e.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(FCMResponse{
+		Failure: 1,
+		Results: []FCMResult{{Error: e.Reason}},
+	})
+}
+
+type fcmV1ErrorDetail struct {
+	Type      string `json:"@type"`
+	ErrorCode string `json:"errorCode,omitempty"`
+}
+
+type fcmV1Error struct {
+	Error struct {
+		Code    int                `json:"code"`
+		Message string             `json:"message"`
+		Status  string             `json:"status"`
+		Details []fcmV1ErrorDetail `json:"details,omitempty"`
+	} `json:"error"`
+}
+
+// WriteFCMV1Error writes e as FCM v1 rejects a push.
+func WriteFCMV1Error(w http.ResponseWriter, e Error) {
+	status := e.Status
+	if status == 0 {
+		status = FCMV1Errors[e.Reason]
+	}
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	var body fcmV1Error
+	body.Error.Code = status
+	body.Error.Message = e.Reason
+	body.Error.Status = fcmV1Statuses[status]
+	if _, ok := FCMV1Errors[e.Reason]; ok {
+		body.Error.Details = []fcmV1ErrorDetail{{
+			Type:      "type.googleapis.com/google.firebase.fcm.v1.FcmError",
+			ErrorCode: e.Reason,
+		}}
+	}
+	WriteRetryAfter(w, e.RetryAfter)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,57 @@
+// Package upstream describes the errors APNs, legacy FCM and FCM v1 respond
+// with, and writes them as Apple and Google do. It is shared by the mock
+// server and the fault injection of gaurun.
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+)
+
+// API names.
+const (
+	APIAPNs  = "apns"
+	APIFCM   = "fcm"
+	APIFCMV1 = "fcmv1"
+)
+
+// Error is an error response of an API.
+type Error struct {
+	// Reason is an APNs reason (e.g. "Unregistered"), a legacy FCM error
+	// (e.g. "NotRegistered") or an FCM v1 error code (e.g. "UNREGISTERED").
+	Reason string
+	// Status is the HTTP status. If zero, the status Apple or Google
+	// responds with for Reason is used.
+	Status int
+	// RetryAfter is sent as the Retry-After header if positive.
+	RetryAfter time.Duration
+}
+
+// WriteRetryAfter sets the Retry-After header in seconds, rounded up to
+// one, if retryAfter is positive.
+func WriteRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		secs := int(retryAfter / time.Second)
+		if secs < 1 {
+			secs = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+}
+
+// NewResponse returns the response of api rejecting a push with e without
+// a server, e.g. to inject faults into clients.
+func NewResponse(api string, e Error) *http.Response {
+	rec := httptest.NewRecorder()
+	switch api {
+	case APIAPNs:
+		WriteAPNsError(rec, e)
+	case APIFCM:
+		WriteFCMError(rec, e)
+	default:
+		WriteFCMV1Error(rec, e)
+	}
+	return rec.Result()
+}
@@ -0,0 +1,37 @@
+package upstream
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewResponse(t *testing.T) {
+	res := NewResponse(APIAPNs, Error{Reason: "Unregistered"})
+	if res.StatusCode != http.StatusGone {
+		t.Errorf("status of Unregistered = %d, expected %d", res.StatusCode, http.StatusGone)
+	}
+	var apns apnsError
+	if err := json.NewDecoder(res.Body).Decode(&apns); err != nil || apns.Reason != "Unregistered" || apns.Timestamp == 0 {
+		t.Errorf("body of Unregistered = %+v, %v", apns, err)
+	}
+
+	res = NewResponse(APIFCM, Error{Reason: "NotRegistered", RetryAfter: time.Millisecond})
+	if res.StatusCode != http.StatusOK || res.Header.Get("Retry-After") != "1" {
+		t.Errorf("status of NotRegistered = %d, Retry-After = %q", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+	var fcm FCMResponse
+	if err := json.NewDecoder(res.Body).Decode(&fcm); err != nil || fcm.Failure != 1 || fcm.Results[0].Error != "NotRegistered" {
+		t.Errorf("body of NotRegistered = %+v, %v", fcm, err)
+	}
+
+	res = NewResponse(APIFCMV1, Error{Reason: "UNREGISTERED"})
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("status of UNREGISTERED = %d, expected %d", res.StatusCode, http.StatusNotFound)
+	}
+	var fcmV1 fcmV1Error
+	if err := json.NewDecoder(res.Body).Decode(&fcmV1); err != nil || fcmV1.Error.Status != "NOT_FOUND" || fcmV1.Error.Details[0].ErrorCode != "UNREGISTERED" {
+		t.Errorf("body of UNREGISTERED = %+v, %v", fcmV1, err)
+	}
+}
@@ -0,0 +1,213 @@
+package mock
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/nohana/gaurun/internal/upstream"
+)
+
+const (
+	// apnsPayloadMax is the maximum size of a payload accepted by APNs.
+	apnsPayloadMax = 4096
+	// apnsVoIPPayloadMax is the maximum size of a VoIP payload.
+	apnsVoIPPayloadMax = 5120
+	// providerTokenLifetime is how long APNs accepts a provider token.
+	providerTokenLifetime = time.Hour
+)
+
+// APNsReasons maps every reason APNs responds with to its HTTP status.
+var APNsReasons = upstream.APNsReasons
+
+var apnsPushTypes = map[string]bool{
+	"alert":        true,
+	"background":   true,
+	"location":     true,
+	"voip":         true,
+	"complication": true,
+	"fileprovider": true,
+	"mdm":          true,
+	"liveactivity": true,
+}
+
+func writeAPNsError(w http.ResponseWriter, resp Response) {
+	upstream.WriteAPNsError(w, resp.upstreamError())
+}
+
+func (s *Server) serveAPNs(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/3/device"), "/")
+	body, _ := io.ReadAll(r.Body)
+
+	// an invalid request is rejected as APNs does before it is scripted.
+	if reason := s.checkAPNs(r, token, body); reason != "" {
+		writeAPNsError(w, Response{Reason: reason})
+		return
+	}
+
+	resp, seq := s.receive(APIAPNs, token, r, body)
+	id := r.Header.Get("apns-id")
+	if id == "" {
+		id = newAPNsID(seq)
+	}
+	w.Header().Set("apns-id", id)
+	if resp.Reason != "" {
+		writeAPNsError(w, resp)
+		return
+	}
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+}
+
+// checkAPNs validates a request as APNs does and returns the reason it is
+// rejected for.
+func (s *Server) checkAPNs(r *http.Request, token string, body []byte) string {
+	if r.Method != http.MethodPost {
+		return "MethodNotAllowed"
+	}
+	if token == "" {
+		return "MissingDeviceToken"
+	}
+	if strings.Contains(token, "/") {
+		return "BadPath"
+	}
+	if _, err := hex.DecodeString(token); err != nil || len(token) < 64 {
+		return "BadDeviceToken"
+	}
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "apns-") && len(values) > 1 {
+			return "DuplicateHeaders"
+		}
+	}
+
+	pushType := r.Header.Get("apns-push-type")
+	if pushType != "" && !apnsPushTypes[pushType] {
+		return "InvalidPushType"
+	}
+	if priority := r.Header.Get("apns-priority"); priority != "" && priority != "1" && priority != "5" && priority != "10" {
+		return "BadPriority"
+	}
+	if expiration := r.Header.Get("apns-expiration"); expiration != "" {
+		if _, err := strconv.ParseInt(expiration, 10, 64); err != nil {
+			return "BadExpirationDate"
+		}
+	}
+	if id := r.Header.Get("apns-id"); id != "" && !validAPNsID(id) {
+		return "BadMessageId"
+	}
+	if len(r.Header.Get("apns-collapse-id")) > 64 {
+		return "BadCollapseId"
+	}
+
+	if len(body) == 0 {
+		return "PayloadEmpty"
+	}
+	max := apnsPayloadMax
+	if pushType == "voip" {
+		max = apnsVoIPPayloadMax
+	}
+	if len(body) > max {
+		return "PayloadTooLarge"
+	}
+
+	topic := r.Header.Get("apns-topic")
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		if reason := s.checkProviderToken(authorization); reason != "" {
+			return reason
+		}
+		if topic == "" {
+			return "MissingTopic"
+		}
+	} else if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		if s.APNsKeys != nil {
+			return "MissingProviderToken"
+		}
+	}
+	if topic != "" && len(s.APNsTopics) > 0 && !contains(s.APNsTopics, topic) {
+		return "TopicDisallowed"
+	}
+	return ""
+}
+
+// checkProviderToken validates the JWT of a token-based connection.
+func (s *Server) checkProviderToken(authorization string) string {
+	bearer := strings.TrimPrefix(authorization, "bearer ")
+	if bearer == authorization {
+		return "InvalidProviderToken"
+	}
+
+	claims := jwt.MapClaims{}
+	keyFunc := func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodES256 {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		key, ok := s.APNsKeys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id: %s", kid)
+		}
+		return key, nil
+	}
+
+	var err error
+	if s.APNsKeys == nil {
+		_, _, err = new(jwt.Parser).ParseUnverified(bearer, claims)
+	} else {
+		_, err = jwt.ParseWithClaims(bearer, claims, keyFunc)
+	}
+	if err != nil {
+		return "InvalidProviderToken"
+	}
+	if iss, _ := claims["iss"].(string); iss == "" {
+		return "InvalidProviderToken"
+	}
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		return "InvalidProviderToken"
+	}
+	if time.Since(time.Unix(int64(iat), 0)) > providerTokenLifetime {
+		return "ExpiredProviderToken"
+	}
+	return ""
+}
+
+// validAPNsID reports whether id is a UUID in 8-4-4-4-12 form.
+func validAPNsID(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i, c := range id {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func newAPNsID(n int64) string {
+	return fmt.Sprintf("00000000-0000-4000-8000-%012x", n)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
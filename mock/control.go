@@ -0,0 +1,90 @@
+package mock
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The control API lets tests in other processes script and inspect a
+// server run by gaurun_mock:
+//
+//	GET    /mock/requests           received pushes
+//	DELETE /mock/requests           Reset
+//	PUT    /mock/responses/{token}  SetResponses with a JSON array of responses
+//	DELETE /mock/responses/{token}  SetResponses with no response
+
+// ResponseJSON is a Response in the control API.
+type ResponseJSON struct {
+	Reason     string `json:"reason,omitempty"`
+	Status     int    `json:"status,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"` // second
+	Latency    int    `json:"latency,omitempty"`     // millisecond
+}
+
+func (r ResponseJSON) Response() Response {
+	return Response{
+		Reason:     r.Reason,
+		Status:     r.Status,
+		RetryAfter: time.Duration(r.RetryAfter) * time.Second,
+		Latency:    time.Duration(r.Latency) * time.Millisecond,
+	}
+}
+
+// RequestJSON is a Request in the control API.
+type RequestJSON struct {
+	API    string          `json:"api"`
+	Token  string          `json:"token"`
+	Header http.Header     `json:"header"`
+	Body   json.RawMessage `json:"body"`
+	Time   time.Time       `json:"time"`
+}
+
+func (s *Server) serveControl(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/mock/requests" && r.Method == http.MethodGet:
+		requests := []RequestJSON{}
+		for _, req := range s.Requests() {
+			body := json.RawMessage(req.Body)
+			if !json.Valid(body) {
+				body, _ = json.Marshal(string(req.Body))
+			}
+			requests = append(requests, RequestJSON{
+				API:    req.API,
+				Token:  req.Token,
+				Header: req.Header,
+				Body:   body,
+				Time:   req.Time,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(requests)
+	case r.URL.Path == "/mock/requests" && r.Method == http.MethodDelete:
+		s.Reset()
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(r.URL.Path, "/mock/responses/"):
+		token := strings.TrimPrefix(r.URL.Path, "/mock/responses/")
+		switch r.Method {
+		case http.MethodPut:
+			var scripted []ResponseJSON
+			if err := json.NewDecoder(r.Body).Decode(&scripted); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			responses := make([]Response, 0, len(scripted))
+			for _, resp := range scripted {
+				responses = append(responses, resp.Response())
+			}
+			s.SetResponses(token, responses...)
+		case http.MethodDelete:
+			s.SetResponses(token)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,138 @@
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/nohana/gaurun/internal/upstream"
+)
+
+// AccessToken is the OAuth2 access token issued by POST /token.
+const AccessToken = "mock-access-token"
+
+// FCMV1Errors maps every FCM v1 error code to its HTTP status.
+var FCMV1Errors = upstream.FCMV1Errors
+
+type fcmMessage struct {
+	To              string   `json:"to"`
+	RegistrationIDs []string `json:"registration_ids"`
+}
+
+// serveFCM serves the legacy HTTP API. A scripted response with a status
+// other than 200 fails the whole request, and a reason fails the result
+// for its token.
+func (s *Server) serveFCM(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "key=")
+	if key == "" || key == r.Header.Get("Authorization") || (s.FCMAPIKey != "" && key != s.FCMAPIKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var msg fcmMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		http.Error(w, "JSON_PARSING_ERROR", http.StatusBadRequest)
+		return
+	}
+	tokens := msg.RegistrationIDs
+	if msg.To != "" {
+		tokens = append(tokens, msg.To)
+	}
+
+	res := upstream.FCMResponse{Results: []upstream.FCMResult{}}
+	if len(tokens) == 0 {
+		res.Failure = 1
+		res.Results = append(res.Results, upstream.FCMResult{Error: "MissingRegistration"})
+	}
+	for _, token := range tokens {
+		resp, seq := s.receive(APIFCM, token, r, body)
+		res.MulticastID = seq
+		if resp.Status != 0 && resp.Status != http.StatusOK {
+			writeFCMError(w, resp)
+			return
+		}
+		if resp.Reason != "" {
+			upstream.WriteRetryAfter(w, resp.RetryAfter)
+			res.Failure++
+			res.Results = append(res.Results, upstream.FCMResult{Error: resp.Reason})
+			continue
+		}
+		res.Success++
+		res.Results = append(res.Results, upstream.FCMResult{MessageID: fmt.Sprintf("0:%d", seq)})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+func writeFCMError(w http.ResponseWriter, resp Response) {
+	upstream.WriteFCMError(w, resp.upstreamError())
+}
+
+type fcmV1Request struct {
+	Message struct {
+		Token string `json:"token"`
+		Topic string `json:"topic"`
+	} `json:"message"`
+}
+
+func writeFCMV1Error(w http.ResponseWriter, resp Response) {
+	upstream.WriteFCMV1Error(w, resp.upstreamError())
+}
+
+func (s *Server) serveFCMV1(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeFCMV1Error(w, Response{Status: http.StatusMethodNotAllowed, Reason: "method not allowed"})
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		writeFCMV1Error(w, Response{Status: http.StatusUnauthorized, Reason: "request is missing an OAuth 2 access token"})
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var req fcmV1Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeFCMV1Error(w, Response{Status: http.StatusBadRequest, Reason: "invalid JSON payload"})
+		return
+	}
+	token := req.Message.Token
+	if token == "" {
+		token = req.Message.Topic
+	}
+	if token == "" {
+		writeFCMV1Error(w, Response{Reason: "INVALID_ARGUMENT"})
+		return
+	}
+
+	resp, seq := s.receive(APIFCMV1, token, r, body)
+	if resp.Reason != "" || (resp.Status != 0 && resp.Status != http.StatusOK) {
+		writeFCMV1Error(w, resp)
+		return
+	}
+	project := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/"), "/messages:send")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(map[string]string{
+		"name": fmt.Sprintf("%s/messages/%d", project, seq),
+	})
+}
+
+// serveToken issues AccessToken to any service account, so that the
+// token_uri of a service account for testing can point to the server.
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": AccessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	})
+}
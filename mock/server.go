@@ -0,0 +1,199 @@
+// Package mock emulates APNs, legacy FCM and FCM v1 for testing gaurun
+// without reaching Apple or Google.
+//
+// A Server serves the three APIs on one handler:
+//
+//	POST /3/device/{token}                     APNs
+//	POST /fcm/send                             legacy FCM
+//	POST /v1/projects/{project}/messages:send  FCM v1
+//	POST /token                                OAuth2 token for FCM v1 service accounts
+//	/mock/...                                  control API for other processes
+//
+// Every push succeeds unless a response is scripted for its token with
+// SetResponses, and every request is recorded for assertions.
+package mock
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nohana/gaurun/internal/upstream"
+	"golang.org/x/time/rate"
+)
+
+// API names of Request.
+const (
+	APIAPNs  = upstream.APIAPNs
+	APIFCM   = upstream.APIFCM
+	APIFCMV1 = upstream.APIFCMV1
+)
+
+// Response is a scripted response for a token.
+type Response struct {
+	// Reason is an APNs reason (e.g. "Unregistered"), a legacy FCM error
+	// (e.g. "NotRegistered") or an FCM v1 error code (e.g. "UNREGISTERED").
+	// Empty means success.
+	Reason string
+	// Status is the HTTP status. If zero, the status Apple or Google
+	// responds with for Reason is used.
+	Status int
+	// RetryAfter is sent as the Retry-After header if positive.
+	RetryAfter time.Duration
+	// Latency delays the response in addition to Server.Latency.
+	Latency time.Duration
+}
+
+func (r Response) upstreamError() upstream.Error {
+	return upstream.Error{Reason: r.Reason, Status: r.Status, RetryAfter: r.RetryAfter}
+}
+
+// Request is a push received by the server.
+type Request struct {
+	API    string
+	Token  string
+	Header http.Header
+	Body   []byte
+	Time   time.Time
+}
+
+// Server is a mock of APNs and FCM. Its exported fields must be set before
+// it serves.
+type Server struct {
+	// Latency delays every response.
+	Latency time.Duration
+	// RateLimit is the number of pushes accepted per second. Pushes over it
+	// are rejected as TooManyRequests, DeviceMessageRateExceeded or
+	// QUOTA_EXCEEDED. Zero means no limit.
+	RateLimit int
+	// APNsKeys verifies APNs provider tokens by key ID. If nil, requests
+	// without provider tokens are accepted and signatures are not verified.
+	APNsKeys map[string]*ecdsa.PublicKey
+	// APNsTopics is the topics accepted by APNs. Empty means any.
+	APNsTopics []string
+	// FCMAPIKey is the API key required by legacy FCM. Empty means any.
+	FCMAPIKey string
+
+	mu       sync.Mutex
+	scripts  map[string][]Response
+	requests []Request
+	limiter  *rate.Limiter
+	once     sync.Once
+	seq      int64
+}
+
+func NewServer() *Server {
+	return &Server{
+		scripts: make(map[string][]Response),
+	}
+}
+
+// SetResponses scripts the responses for token. Each push to token takes
+// the next response and the last one is repeated.
+func (s *Server) SetResponses(token string, responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(responses) == 0 {
+		delete(s.scripts, token)
+		return
+	}
+	s.scripts[token] = responses
+}
+
+// Requests returns the pushes received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Reset forgets the scripted responses and the received pushes.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts = make(map[string][]Response)
+	s.requests = nil
+}
+
+// receive records a push and returns the response scripted for token and
+// the sequence number of the push.
+func (s *Server) receive(api, token string, r *http.Request, body []byte) (Response, int64) {
+	s.once.Do(func() {
+		if s.RateLimit > 0 {
+			s.limiter = rate.NewLimiter(rate.Limit(s.RateLimit), s.RateLimit)
+		}
+	})
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{
+		API:    api,
+		Token:  token,
+		Header: r.Header.Clone(),
+		Body:   body,
+		Time:   time.Now(),
+	})
+	var resp Response
+	if script := s.scripts[token]; len(script) > 0 {
+		resp = script[0]
+		if len(script) > 1 {
+			s.scripts[token] = script[1:]
+		}
+	}
+	s.seq++
+	seq := s.seq
+	s.mu.Unlock()
+
+	if s.limiter != nil && !s.limiter.Allow() && resp.Reason == "" {
+		resp = Response{Reason: rateLimitReason(api), RetryAfter: time.Second}
+	}
+	time.Sleep(s.Latency + resp.Latency)
+	return resp, seq
+}
+
+func rateLimitReason(api string) string {
+	switch api {
+	case APIAPNs:
+		return "TooManyRequests"
+	case APIFCM:
+		return "DeviceMessageRateExceeded"
+	}
+	return "QUOTA_EXCEEDED"
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/3/device"):
+		s.serveAPNs(w, r)
+	case r.URL.Path == "/fcm/send":
+		s.serveFCM(w, r)
+	case strings.HasPrefix(r.URL.Path, "/v1/projects/") && strings.HasSuffix(r.URL.Path, "/messages:send"):
+		s.serveFCMV1(w, r)
+	case r.URL.Path == "/token":
+		s.serveToken(w, r)
+	case strings.HasPrefix(r.URL.Path, "/mock/"):
+		s.serveControl(w, r)
+	default:
+		writeAPNsError(w, Response{Reason: "BadPath"})
+	}
+}
+
+// NewResponse returns the response of api rejecting a push as resp without
+// a server, e.g. to inject faults into clients.
+func NewResponse(api string, resp Response) *http.Response {
+	return upstream.NewResponse(api, resp.upstreamError())
+}
+
+// Start serves s on a local port over TLS with HTTP/2 as APNs does. Client
+// certificates are requested but not verified. The client of the returned
+// server trusts it.
+func (s *Server) Start() *httptest.Server {
+	ts := httptest.NewUnstartedServer(s)
+	ts.EnableHTTP2 = true
+	ts.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ts.StartTLS()
+	return ts
+}
@@ -0,0 +1,267 @@
+package mock
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/nohana/gaurun/buford/push"
+	"github.com/nohana/gaurun/buford/token"
+	"github.com/nohana/gaurun/gcm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	deviceToken  = strings.Repeat("ab", 32)
+	deviceToken2 = strings.Repeat("cd", 32)
+)
+
+func newAuthToken(t *testing.T, s *Server) *token.Token {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	s.APNsKeys = map[string]*ecdsa.PublicKey{"KEY": &key.PublicKey}
+	return &token.Token{AuthKey: key, KeyID: "KEY", TeamID: "TEAM"}
+}
+
+func TestAPNs(t *testing.T) {
+	s := NewServer()
+	s.APNsTopics = []string{"com.example.app"}
+	authToken := newAuthToken(t, s)
+	ts := s.Start()
+	defer ts.Close()
+
+	service := &push.Service{Client: ts.Client(), Host: ts.URL}
+	headers := &push.Headers{Topic: "com.example.app", PushType: push.PushTypeAlert, AuthToken: authToken}
+	payload := []byte(`{"aps":{"alert":"hello"}}`)
+
+	id, err := service.Push(deviceToken, headers, payload)
+	require.Nil(t, err)
+	assert.NotEqual(t, "", id)
+
+	requests := s.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, APIAPNs, requests[0].API)
+	assert.Equal(t, deviceToken, requests[0].Token)
+	assert.Equal(t, payload, requests[0].Body)
+	assert.Equal(t, "com.example.app", requests[0].Header.Get("apns-topic"))
+
+	// the scripted responses are taken in order and the last is repeated.
+	s.SetResponses(deviceToken,
+		Response{Reason: "TooManyRequests", RetryAfter: 2 * time.Second},
+		Response{Reason: "Unregistered"},
+	)
+	_, err = service.Push(deviceToken, headers, payload)
+	require.IsType(t, &push.Error{}, err)
+	assert.Equal(t, push.ErrTooManyRequests, err.(*push.Error).Reason)
+	assert.Equal(t, http.StatusTooManyRequests, err.(*push.Error).Status)
+	assert.Equal(t, 2*time.Second, err.(*push.Error).RetryAfter)
+	for i := 0; i < 2; i++ {
+		_, err = service.Push(deviceToken, headers, payload)
+		require.IsType(t, &push.Error{}, err)
+		assert.Equal(t, push.ErrUnregistered, err.(*push.Error).Reason)
+		assert.Equal(t, http.StatusGone, err.(*push.Error).Status)
+	}
+
+	// every reason is responded with its status.
+	for reason, status := range APNsReasons {
+		s.SetResponses(deviceToken2, Response{Reason: reason})
+		_, err = service.Push(deviceToken2, headers, payload)
+		require.IsType(t, &push.Error{}, err, reason)
+		assert.Equal(t, status, err.(*push.Error).Status, reason)
+		// buford spells BadMessageId as BadMessageID.
+		assert.True(t, strings.EqualFold(reason, err.(*push.Error).Reason.Error()), reason)
+	}
+
+	s.Reset()
+	assert.Len(t, s.Requests(), 0)
+	_, err = service.Push(deviceToken, headers, payload)
+	assert.Nil(t, err)
+}
+
+func TestAPNsRejects(t *testing.T) {
+	s := NewServer()
+	s.APNsTopics = []string{"com.example.app"}
+	authToken := newAuthToken(t, s)
+	ts := s.Start()
+	defer ts.Close()
+
+	service := &push.Service{Client: ts.Client(), Host: ts.URL}
+	payload := []byte(`{"aps":{"alert":"hello"}}`)
+
+	expiredToken := func() *token.Token {
+		jwtToken := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+			"iss": "TEAM",
+			"iat": time.Now().Add(-2 * time.Hour).Unix(),
+		})
+		jwtToken.Header["kid"] = "KEY"
+		bearer, err := jwtToken.SignedString(authToken.AuthKey)
+		require.Nil(t, err)
+		// IssuedAt keeps the client from renewing the token.
+		return &token.Token{AuthKey: authToken.AuthKey, KeyID: "KEY", TeamID: "TEAM", IssuedAt: time.Now().Unix(), Bearer: bearer}
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	cases := []struct {
+		reason  string
+		token   string
+		headers *push.Headers
+		payload []byte
+	}{
+		{"BadDeviceToken", "xyz", &push.Headers{Topic: "com.example.app", AuthToken: authToken}, payload},
+		{"PayloadEmpty", deviceToken, &push.Headers{Topic: "com.example.app", AuthToken: authToken}, nil},
+		{"BadMessageId", deviceToken, &push.Headers{ID: "bad", Topic: "com.example.app", AuthToken: authToken}, payload},
+		{"InvalidPushType", deviceToken, &push.Headers{Topic: "com.example.app", PushType: "bad", AuthToken: authToken}, payload},
+		{"MissingProviderToken", deviceToken, &push.Headers{Topic: "com.example.app"}, payload},
+		{"InvalidProviderToken", deviceToken, &push.Headers{Topic: "com.example.app", AuthToken: &token.Token{AuthKey: otherKey, KeyID: "KEY", TeamID: "TEAM"}}, payload},
+		{"ExpiredProviderToken", deviceToken, &push.Headers{Topic: "com.example.app", AuthToken: expiredToken()}, payload},
+		{"MissingTopic", deviceToken, &push.Headers{AuthToken: authToken}, payload},
+		{"TopicDisallowed", deviceToken, &push.Headers{Topic: "com.example.other", AuthToken: authToken}, payload},
+	}
+	for _, c := range cases {
+		_, err := service.Push(c.token, c.headers, c.payload)
+		require.IsType(t, &push.Error{}, err, c.reason)
+		assert.True(t, strings.EqualFold(c.reason, err.(*push.Error).Reason.Error()), c.reason)
+	}
+	// rejected requests are not recorded.
+	assert.Len(t, s.Requests(), 0)
+}
+
+func TestFCM(t *testing.T) {
+	s := NewServer()
+	s.FCMAPIKey = "key"
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	client, err := gcm.NewClient(ts.URL+"/fcm/send", "key")
+	require.Nil(t, err)
+	s.SetResponses("b", Response{Reason: gcm.ErrorNotRegistered})
+
+	res, err := client.Send(gcm.NewMessage(map[string]interface{}{"message": "hello"}, "a", "b"))
+	require.Nil(t, err)
+	require.Len(t, res.Results, 2)
+	assert.Equal(t, "", res.Results[0].Error)
+	assert.NotEqual(t, "", res.Results[0].MessageID)
+	assert.Equal(t, gcm.ErrorNotRegistered, res.Results[1].Error)
+
+	requests := s.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, APIFCM, requests[0].API)
+	assert.Equal(t, "a", requests[0].Token)
+	assert.Contains(t, string(requests[0].Body), `"hello"`)
+
+	s.SetResponses("a", Response{Status: http.StatusServiceUnavailable, RetryAfter: 3 * time.Second})
+	_, err = client.Send(gcm.NewMessage(map[string]interface{}{"message": "hello"}, "a"))
+	require.IsType(t, &gcm.Error{}, err)
+	assert.Equal(t, http.StatusServiceUnavailable, err.(*gcm.Error).StatusCode)
+	assert.Equal(t, 3*time.Second, err.(*gcm.Error).RetryAfter)
+
+	client, err = gcm.NewClient(ts.URL+"/fcm/send", "wrong")
+	require.Nil(t, err)
+	_, err = client.Send(gcm.NewMessage(map[string]interface{}{"message": "hello"}, "a"))
+	require.IsType(t, &gcm.Error{}, err)
+	assert.Equal(t, gcm.ErrorAuthentication, err.(*gcm.Error).Reason)
+}
+
+func TestFCMV1(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	send := func(authorization, body string) (int, map[string]interface{}) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/projects/p/messages:send", strings.NewReader(body))
+		require.Nil(t, err)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer res.Body.Close()
+		var v map[string]interface{}
+		require.Nil(t, json.NewDecoder(res.Body).Decode(&v))
+		return res.StatusCode, v
+	}
+
+	res, err := http.Post(ts.URL+"/token", "application/x-www-form-urlencoded", nil)
+	require.Nil(t, err)
+	var issued map[string]interface{}
+	require.Nil(t, json.NewDecoder(res.Body).Decode(&issued))
+	res.Body.Close()
+	assert.Equal(t, AccessToken, issued["access_token"])
+
+	status, v := send("Bearer "+AccessToken, `{"message":{"token":"a"}}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, strings.HasPrefix(v["name"].(string), "projects/p/messages/"))
+
+	s.SetResponses("a", Response{Reason: "UNREGISTERED"})
+	status, v = send("Bearer "+AccessToken, `{"message":{"token":"a"}}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	details := v["error"].(map[string]interface{})["details"].([]interface{})
+	assert.Equal(t, "UNREGISTERED", details[0].(map[string]interface{})["errorCode"])
+
+	status, _ = send("", `{"message":{"token":"a"}}`)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Len(t, s.Requests(), 2)
+}
+
+func TestRateLimitAndLatency(t *testing.T) {
+	s := NewServer()
+	s.RateLimit = 2
+	s.Latency = 20 * time.Millisecond
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	client, err := gcm.NewClient(ts.URL+"/fcm/send", "key")
+	require.Nil(t, err)
+	start := time.Now()
+	res, err := client.Send(gcm.NewMessage(map[string]interface{}{"message": "hello"}, "a", "b", "c"))
+	require.Nil(t, err)
+	assert.True(t, time.Since(start) >= 60*time.Millisecond)
+	require.Len(t, res.Results, 3)
+	assert.Equal(t, "", res.Results[1].Error)
+	assert.Equal(t, gcm.ErrorDeviceMessageRateExceeded, res.Results[2].Error)
+}
+
+func TestControl(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/mock/responses/a", bytes.NewBufferString(`[{"reason":"NotRegistered"}]`))
+	require.Nil(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	client, err := gcm.NewClient(ts.URL+"/fcm/send", "key")
+	require.Nil(t, err)
+	sent, err := client.Send(gcm.NewMessage(map[string]interface{}{"message": "hello"}, "a"))
+	require.Nil(t, err)
+	assert.Equal(t, gcm.ErrorNotRegistered, sent.Results[0].Error)
+
+	res, err = http.Get(ts.URL + "/mock/requests")
+	require.Nil(t, err)
+	var requests []RequestJSON
+	require.Nil(t, json.NewDecoder(res.Body).Decode(&requests))
+	res.Body.Close()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "a", requests[0].Token)
+	assert.Contains(t, string(requests[0].Body), `"registration_ids"`)
+
+	req, err = http.NewRequest(http.MethodDelete, ts.URL+"/mock/requests", nil)
+	require.Nil(t, err)
+	res, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	res.Body.Close()
+	assert.Len(t, s.Requests(), 0)
+}